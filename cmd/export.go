@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/pagpeter/trackme/pkg/server"
+	"github.com/pagpeter/trackme/pkg/store"
+)
+
+// runExport writes the request logs of the configured store to a file or
+// stdout, with the filters of /api/export. The store is opened read-only,
+// so a running server can be exported from:
+//
+//	trackme export -format csv -type ja4 -value t13d1516h2_8daaf6152771_e5627efa2ab1 -o ja4.csv
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	params := url.Values{}
+	for _, name := range []string{"format", "type", "value", "ua", "since", "until"} {
+		fs.Func(name, "same as the "+name+" parameter of /api/export", func(v string) error {
+			params.Set(name, v)
+			return nil
+		})
+	}
+	out := fs.String("o", "-", "file to write to, - for stdout")
+	fs.Parse(args)
+
+	format, q, err := server.ParseExport(params)
+	if err != nil {
+		return err
+	}
+	st, err := store.OpenReader(srv.GetConfig())
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		return fmt.Errorf("no store is configured")
+	}
+	defer st.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	n, err := store.Export(st, bw, format, q)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d request logs\n", n)
+	return nil
+}
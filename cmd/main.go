@@ -5,21 +5,20 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/pagpeter/quic-go"
 	"github.com/pagpeter/quic-go/http3"
 	"github.com/pagpeter/trackme/pkg/server"
+	"github.com/pagpeter/trackme/pkg/store"
 	"github.com/pagpeter/trackme/pkg/tcp"
 	"github.com/pagpeter/trackme/pkg/utils"
 	utls "github.com/wwhtrbbtt/utls"
-
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var cert tls.Certificate
@@ -61,57 +60,70 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	if len(srv.GetConfig().MongoURL) == 0 { // Don't attempt to setup mongo if its not populated in the config
-		return
-	}
-
-	clientOptions := options.Client().ApplyURI(srv.GetConfig().MongoURL)
-	client, err := mongo.Connect(srv.GetMongoContext(), clientOptions)
-	if err != nil {
+	if err := server.CheckPrivacyConfig(srv.GetConfig()); err != nil {
 		log.Fatal(err)
 	}
+}
 
-	err = client.Ping(srv.GetMongoContext(), nil)
+// openStore opens the configured store for the server, which also starts
+// the request logger and the retention
+func openStore() {
+	st, err := store.Open(srv.GetConfig())
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println(srv.GetConfig().DB, srv.GetConfig().Collection)
-	collection := client.Database(srv.GetConfig().DB).Collection(srv.GetConfig().Collection)
-	srv.SetMongoConnection(client, collection)
+	if st != nil {
+		srv.SetStore(st)
+	}
 }
 
-func redirect(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, srv.GetConfig().HTTPRedirect, http.StatusMovedPermanently)
+// closeOnSignal stores the queued request logs before exiting
+func closeOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Println("Shutting down, storing queued request logs")
+	if err := srv.Close(); err != nil {
+		log.Println("Error closing the store:", err)
+	}
+	os.Exit(0)
 }
 
-func StartRedirectServer(host, port string) {
-	// Starts an HTTP server on port 80 that redirects to the HTTPS server on port 443
+func StartPlainServer(host, port string) {
+	// Starts the plain HTTP server on port 80. API requests (HTTP/1, h2c and
+	// HTTP/2 with prior knowledge) are answered, everything else is redirected
+	// to the HTTPS server on port 443
 
 	local = (host == "" || host == "0.0.0.0" || host == "localhost") && port != "443"
 	srv.SetLocal(local)
 
-	log.Println("Starting Redirect Server:", srv.GetConfig().HTTPRedirect)
+	log.Println("Starting Plain HTTP Server, redirecting to", srv.GetConfig().HTTPRedirect)
 	log.Println("Listening on", host+":"+port)
 
-	http.HandleFunc("/", redirect)
-	err := http.ListenAndServe(host+":"+port, nil)
+	listener, err := net.Listen("tcp", host+":"+port)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Fatal("Error starting plain listener: ", err)
 	}
-}
+	defer listener.Close()
 
-// Timeout function
-func timeoutHandleTLSConnection(conn net.Conn) bool {
-	result := make(chan bool)
-	go func() {
-		result <- srv.HandleTLSConnection(conn)
-	}()
-	select {
-	case <-time.After(15 * time.Second):
-		return false
-	case tmp := <-result:
-		return tmp
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("Error accepting connection", err)
+			continue
+		}
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logCrash(r)
+					conn.Close()
+				}
+			}()
+
+			if !srv.HandlePlainConnection(conn) {
+				conn.Close()
+			}
+		}()
 	}
 }
 
@@ -131,6 +143,9 @@ func StartHTTP3Server(host, port string) {
 		TLSConfig: h3TLSConfig,
 		QUICConfig: &quic.Config{
 			Allow0RTT: true,
+			// Idle connections keep sending PINGs, which keeps the RTT
+			// estimate used by /api/rtt fresh
+			KeepAlivePeriod: 5 * time.Second,
 		},
 	}
 
@@ -149,7 +164,16 @@ func main() {
 		}
 	}()
 
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	openStore()
 	log.Println("Starting server...")
+	go closeOnSignal()
 	log.Println("Listening on " + srv.GetConfig().Host + ":" + srv.GetConfig().TLSPort)
 
 	// Load the TLS certificates
@@ -186,7 +210,7 @@ func main() {
 	}
 
 	defer listener.Close()
-	go StartRedirectServer(srv.GetConfig().Host, srv.GetConfig().HTTPPort)
+	go StartPlainServer(srv.GetConfig().Host, srv.GetConfig().HTTPPort)
 	go StartHTTP3Server(srv.GetConfig().Host, srv.GetConfig().TLSPort)
 	if srv.GetConfig().Device != "" {
 		go tcp.SniffTCP(srv.GetConfig().Device, tlsPort, srv)
@@ -225,7 +249,7 @@ func main() {
 						}
 					}()
 
-					success := timeoutHandleTLSConnection(conn)
+					success := srv.HandleTLSConnection(conn)
 					if !success {
 						server.Log("Request aborted - " + ip)
 						conn.Close()
@@ -0,0 +1,93 @@
+package http
+
+import (
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// H2Diff is the difference between two Akamai fingerprints, from a to b
+type H2Diff struct {
+	// Settings maps the SETTINGS that differ to their values, empty when
+	// a side does not send it
+	Settings          map[string]types.ValueDiff `json:"settings,omitempty"`
+	SettingsReordered bool                       `json:"settings_reordered,omitempty"`
+	WindowUpdate      *types.ValueDiff           `json:"window_update,omitempty"`
+	Priority          types.ListDiff             `json:"priority"`
+	PseudoHeaders     types.ListDiff             `json:"pseudo_headers"`
+}
+
+// Changed reports whether the fingerprints differ
+func (d H2Diff) Changed() bool {
+	return len(d.Settings) > 0 || d.SettingsReordered || d.WindowUpdate != nil || d.Priority.Changed() || d.PseudoHeaders.Changed()
+}
+
+// DiffAkamai compares two Akamai fingerprints. It reports false if either
+// is not an Akamai fingerprint.
+func DiffAkamai(a, b string) (H2Diff, bool) {
+	ea, okA := AkamaiElements(a)
+	eb, okB := AkamaiElements(b)
+	if !okA || !okB {
+		return H2Diff{}, false
+	}
+
+	d := H2Diff{
+		Settings:      map[string]types.ValueDiff{},
+		Priority:      types.DiffList(ea["priority"], eb["priority"]),
+		PseudoHeaders: types.DiffList(ea["pseudo_headers"], eb["pseudo_headers"]),
+	}
+	idsA, valuesA := splitSettings(ea["settings"])
+	idsB, valuesB := splitSettings(eb["settings"])
+	for _, id := range append(idsA, idsB...) {
+		if valuesA[id] != valuesB[id] {
+			d.Settings[settingName(id)] = types.ValueDiff{A: valuesA[id], B: valuesB[id]}
+		}
+	}
+	d.SettingsReordered = types.DiffList(idsA, idsB).Reordered
+	if wa, wb := strings.Join(ea["window_update"], ""), strings.Join(eb["window_update"], ""); wa != wb {
+		d.WindowUpdate = &types.ValueDiff{A: wa, B: wb}
+	}
+	return d, true
+}
+
+// DiffHeaderOrder compares the order of the header names of two requests.
+// Headers are "name: value" lines, pseudo-headers and values are ignored.
+func DiffHeaderOrder(a, b []string) types.ListDiff {
+	return types.DiffList(headerNames(a), headerNames(b))
+}
+
+func headerNames(headers []string) []string {
+	names := []string{}
+	for _, h := range headers {
+		if strings.HasPrefix(h, ":") {
+			continue
+		}
+		if name, _, ok := strings.Cut(h, ":"); ok {
+			names = append(names, strings.ToLower(strings.TrimSpace(name)))
+		}
+	}
+	return names
+}
+
+// splitSettings splits "id:value" settings into the IDs in order and
+// their values
+func splitSettings(settings []string) ([]string, map[string]string) {
+	ids := []string{}
+	values := map[string]string{}
+	for _, s := range settings {
+		id, value, _ := strings.Cut(s, ":")
+		ids = append(ids, id)
+		values[id] = value
+	}
+	return ids, values
+}
+
+// settingName returns the name of a SETTINGS ID, unknown IDs are kept
+func settingName(id string) string {
+	for name, settingID := range settingIDs {
+		if settingID == id {
+			return name
+		}
+	}
+	return id
+}
@@ -0,0 +1,56 @@
+package http
+
+import (
+	"testing"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestDiffAkamai(t *testing.T) {
+	chrome := "1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p"
+	firefox := "1:65536;4:131072;2:0;8:1|12517377|0|m,p,a,s"
+
+	d, ok := DiffAkamai(chrome, firefox)
+	if !ok || !d.Changed() {
+		t.Fatalf("Expected the fingerprints to differ: %+v", d)
+	}
+	settings := map[string]types.ValueDiff{
+		"INITIAL_WINDOW_SIZE":  {A: "6291456", B: "131072"},
+		"MAX_HEADER_LIST_SIZE": {A: "262144", B: ""},
+		"8":                    {A: "", B: "1"},
+	}
+	if len(d.Settings) != len(settings) {
+		t.Fatalf("Unexpected settings %+v", d.Settings)
+	}
+	for name, v := range settings {
+		if d.Settings[name] != v {
+			t.Fatalf("Unexpected setting %s: %+v", name, d.Settings[name])
+		}
+	}
+	if !d.SettingsReordered || d.WindowUpdate == nil || *d.WindowUpdate != (types.ValueDiff{A: "15663105", B: "12517377"}) {
+		t.Fatalf("Unexpected settings order or window update %+v", d)
+	}
+	if d.Priority.Changed() || !d.PseudoHeaders.Reordered || len(d.PseudoHeaders.Added) != 0 {
+		t.Fatalf("Unexpected priority or pseudo-headers %+v %+v", d.Priority, d.PseudoHeaders)
+	}
+
+	if d, ok := DiffAkamai(chrome, chrome); !ok || d.Changed() {
+		t.Fatalf("Expected equal fingerprints to match: %+v", d)
+	}
+	if _, ok := DiffAkamai(chrome, "771,4865,0,29,0"); ok {
+		t.Fatal("Expected a JA3 to be rejected")
+	}
+}
+
+func TestDiffHeaderOrder(t *testing.T) {
+	a := []string{":method: GET", "Accept: */*", "User-Agent: a", "Cookie: x"}
+	b := []string{":method: GET", ":path: /", "user-agent: b", "accept: text/html", "x-extra: 1"}
+
+	d := DiffHeaderOrder(a, b)
+	if !d.Reordered || len(d.Added) != 1 || d.Added[0] != "x-extra" || len(d.Removed) != 1 || d.Removed[0] != "cookie" {
+		t.Fatalf("Unexpected header diff %+v", d)
+	}
+	if d := DiffHeaderOrder(a, []string{"accept: text/html", "user-agent: b", "cookie: y"}); d.Changed() {
+		t.Fatalf("Expected values and casing to be ignored: %+v", d)
+	}
+}
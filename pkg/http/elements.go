@@ -0,0 +1,30 @@
+package http
+
+import "strings"
+
+// AkamaiElements splits an Akamai fingerprint into its lists: settings,
+// window_update, priority and pseudo_headers. It reports false if it is
+// not an Akamai fingerprint.
+func AkamaiElements(fp string) (map[string][]string, bool) {
+	parts := strings.Split(fp, "|")
+	if len(parts) != 4 {
+		return nil, false
+	}
+	return map[string][]string{
+		"settings":       splitElements(parts[0], ";"),
+		"window_update":  splitElements(parts[1], ""),
+		"priority":       splitElements(parts[2], ","),
+		"pseudo_headers": splitElements(parts[3], ","),
+	}, true
+}
+
+// splitElements splits a list, an empty sep keeps s as a single element
+func splitElements(s, sep string) []string {
+	if s == "" {
+		return []string{}
+	}
+	if sep == "" {
+		return []string{s}
+	}
+	return strings.Split(s, sep)
+}
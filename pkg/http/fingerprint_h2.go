@@ -7,6 +7,17 @@ import (
 	"github.com/pagpeter/trackme/pkg/types"
 )
 
+// settingIDs maps the SETTINGS names to the IDs in the fingerprint
+var settingIDs = map[string]string{
+	"HEADER_TABLE_SIZE":      "1",
+	"ENABLE_PUSH":            "2",
+	"MAX_CONCURRENT_STREAMS": "3",
+	"INITIAL_WINDOW_SIZE":    "4",
+	"MAX_FRAME_SIZE":         "5",
+	"MAX_HEADER_LIST_SIZE":   "6",
+	"NO_RFC7540_PRIORITIES":  "9",
+}
+
 // Based on https://www.blackhat.com/docs/eu-17/materials/eu-17-Shuster-Passive-Fingerprinting-Of-HTTP2-Clients-wp.pdf
 // Fingerprint format:
 // S[;]|WU|P[,]#|PS[,]
@@ -16,15 +27,6 @@ import (
 // PS: Pseudo-header order (eg: "m,p,a,s")
 func getSettingsFingerprint(frames []types.ParsedFrame) string {
 	var sf string // SettingsFingerprint
-	mapping := map[string]string{
-		"HEADER_TABLE_SIZE":      "1",
-		"ENABLE_PUSH":            "2",
-		"MAX_CONCURRENT_STREAMS": "3",
-		"INITIAL_WINDOW_SIZE":    "4",
-		"MAX_FRAME_SIZE":         "5",
-		"MAX_HEADER_LIST_SIZE":   "6",
-		"NO_RFC7540_PRIORITIES":  "9",
-	}
 
 	for _, frame := range frames {
 		if frame.Type == "SETTINGS" {
@@ -33,7 +35,7 @@ func getSettingsFingerprint(frames []types.ParsedFrame) string {
 				if len(parts) != 2 {
 					return "error"
 				}
-				sf += mapping[parts[0]] + ":" + parts[1] + ";"
+				sf += settingIDs[parts[0]] + ":" + parts[1] + ";"
 			}
 			break
 		}
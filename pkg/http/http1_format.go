@@ -0,0 +1,219 @@
+package http
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// HTTP/1 formatting fingerprint
+// Format: [line endings]|[request target]|[header casing]|[colon spacing]|[duplicates]|[folds]|[anomalies]
+// Example: crlf|origin|c|1|d0|f0|-
+//
+// JA4H only looks at header names and values, this fingerprint covers how the
+// request head was written. HTTP libraries differ exactly in these details.
+
+// Header name casing styles
+const (
+	casingCanonical = "c" // Content-Type
+	casingLower     = "l" // content-type
+	casingUpper     = "u" // CONTENT-TYPE
+	casingMixed     = "m" // content-Type
+)
+
+// Whitespace between the colon and the header value
+const (
+	spacingNone   = "0"
+	spacingSingle = "1"
+	spacingMulti  = "2"
+	spacingTab    = "t"
+)
+
+// AnalyzeHTTP1Format inspects the raw request head (request line, headers and
+// the terminating empty line) for formatting details and anomalies
+func AnalyzeHTTP1Format(head []byte) types.Http1Format {
+	f := types.Http1Format{
+		HeaderCasing:     []string{},
+		ColonSpacing:     []string{},
+		DuplicateHeaders: []string{},
+		FoldedHeaders:    []string{},
+		Anomalies:        []string{},
+	}
+
+	raw := string(head)
+	crlf := strings.Count(raw, "\r\n")
+	lf := strings.Count(raw, "\n") - crlf
+	switch {
+	case lf == 0:
+		f.LineEndings = "crlf"
+	case crlf == 0:
+		f.LineEndings = "lf"
+	default:
+		f.LineEndings = "mixed"
+	}
+
+	lines := strings.Split(raw, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+
+	requestLine := lines[0]
+	parts := strings.Fields(requestLine)
+	if len(parts) != 3 || strings.Join(parts, " ") != requestLine {
+		f.Anomalies = append(f.Anomalies, "request_line_spacing")
+	}
+	if len(parts) > 0 && parts[0] != strings.ToUpper(parts[0]) {
+		f.Anomalies = append(f.Anomalies, "lowercase_method")
+	}
+	if len(parts) > 1 {
+		f.RequestTarget = requestTargetForm(parts[0], parts[1])
+	}
+
+	seen := map[string]int{}
+	lastName := ""
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+
+		// obs-fold: a line starting with whitespace continues the previous
+		// header (RFC 9112, section 5.2)
+		if line[0] == ' ' || line[0] == '\t' {
+			if lastName != "" {
+				f.FoldedHeaders = append(f.FoldedHeaders, lastName)
+			} else {
+				f.Anomalies = appendOnce(f.Anomalies, "invalid_header_line")
+			}
+			continue
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			f.Anomalies = appendOnce(f.Anomalies, "invalid_header_line")
+			lastName = ""
+			continue
+		}
+		if strings.TrimRight(name, " \t") != name {
+			f.Anomalies = appendOnce(f.Anomalies, "space_before_colon")
+			name = strings.TrimRight(name, " \t")
+		}
+		if len(value) > 0 && strings.TrimRight(value, " \t") != value {
+			f.Anomalies = appendOnce(f.Anomalies, "trailing_whitespace")
+		}
+
+		f.HeaderCasing = append(f.HeaderCasing, headerCasing(name))
+		f.ColonSpacing = append(f.ColonSpacing, colonSpacing(value))
+
+		lower := strings.ToLower(name)
+		seen[lower]++
+		if seen[lower] == 2 {
+			f.DuplicateHeaders = append(f.DuplicateHeaders, lower)
+		}
+		lastName = lower
+	}
+
+	if len(parts) == 3 && parts[2] == "HTTP/1.0" {
+		f.Anomalies = append(f.Anomalies, "http10")
+	}
+
+	anomalies := "-"
+	if len(f.Anomalies) > 0 {
+		sorted := append([]string{}, f.Anomalies...)
+		sort.Strings(sorted)
+		anomalies = strings.Join(sorted, ",")
+	}
+	f.Fingerprint = fmt.Sprintf("%s|%s|%s|%s|d%d|f%d|%s",
+		f.LineEndings,
+		f.RequestTarget,
+		distinct(f.HeaderCasing),
+		distinct(f.ColonSpacing),
+		len(f.DuplicateHeaders),
+		len(f.FoldedHeaders),
+		anomalies,
+	)
+	f.FingerprintHash = utils.SHA256trunc(f.Fingerprint)
+	return f
+}
+
+// requestTargetForm returns the form of the request target (RFC 9112, section 3.2)
+func requestTargetForm(method, target string) string {
+	switch {
+	case strings.HasPrefix(target, "/"):
+		return "origin"
+	case target == "*":
+		return "asterisk"
+	case strings.Contains(target, "://"):
+		return "absolute"
+	case strings.EqualFold(method, "CONNECT"):
+		return "authority"
+	default:
+		return "invalid"
+	}
+}
+
+func headerCasing(name string) string {
+	switch {
+	case name == strings.ToLower(name):
+		return casingLower
+	case name == strings.ToUpper(name) && len(name) > 1:
+		return casingUpper
+	case name == canonicalHeaderName(name):
+		return casingCanonical
+	default:
+		return casingMixed
+	}
+}
+
+// canonicalHeaderName upper cases the first letter of every dash separated
+// part and lower cases the rest, like Go's net/http does
+func canonicalHeaderName(name string) string {
+	parts := strings.Split(name, "-")
+	for i, part := range parts {
+		if len(part) > 0 {
+			parts[i] = strings.ToUpper(part[:1]) + strings.ToLower(part[1:])
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+func colonSpacing(value string) string {
+	switch {
+	case value == "" || (value[0] != ' ' && value[0] != '\t'):
+		return spacingNone
+	case value[0] == '\t':
+		return spacingTab
+	case len(value) > 1 && (value[1] == ' ' || value[1] == '\t'):
+		return spacingMulti
+	default:
+		return spacingSingle
+	}
+}
+
+// distinct returns the sorted distinct values joined without separator
+func distinct(values []string) string {
+	set := map[string]bool{}
+	for _, v := range values {
+		set[v] = true
+	}
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		return "-"
+	}
+	return strings.Join(keys, "")
+}
+
+func appendOnce(list []string, v string) []string {
+	for _, existing := range list {
+		if existing == v {
+			return list
+		}
+	}
+	return append(list, v)
+}
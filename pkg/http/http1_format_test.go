@@ -0,0 +1,59 @@
+package http
+
+import "testing"
+
+func TestAnalyzeHTTP1Format(t *testing.T) {
+	tests := []struct {
+		name        string
+		head        string
+		fingerprint string
+		duplicates  []string
+		folded      []string
+	}{
+		{
+			name:        "curl",
+			head:        "GET / HTTP/1.1\r\nHost: example.com\r\nUser-Agent: curl/8.5.0\r\nAccept: */*\r\n\r\n",
+			fingerprint: "crlf|origin|c|1|d0|f0|-",
+		},
+		{
+			name:        "hand written",
+			head:        "get http://example.com/ HTTP/1.0\nhost:example.com\nACCEPT:  */*\nhost: other \n folded\n\n",
+			fingerprint: "lf|absolute|lu|012|d1|f1|http10,lowercase_method,trailing_whitespace",
+			duplicates:  []string{"host"},
+			folded:      []string{"host"},
+		},
+		{
+			name:        "mixed line endings",
+			head:        "GET / HTTP/1.1\r\nHost : example.com\nX-custom:\tvalue\r\n\r\n",
+			fingerprint: "mixed|origin|cm|1t|d0|f0|space_before_colon",
+		},
+		{
+			name:        "broken request line",
+			head:        "OPTIONS  * HTTP/1.1\r\nno colon\r\n\r\n",
+			fingerprint: "crlf|asterisk|-|-|d0|f0|invalid_header_line,request_line_spacing",
+		},
+	}
+
+	for _, tt := range tests {
+		f := AnalyzeHTTP1Format([]byte(tt.head))
+		if f.Fingerprint != tt.fingerprint {
+			t.Fatalf("%s: expected %q, got %q", tt.name, tt.fingerprint, f.Fingerprint)
+		}
+		if len(f.FingerprintHash) != 12 {
+			t.Fatalf("%s: unexpected hash %q", tt.name, f.FingerprintHash)
+		}
+		if len(f.DuplicateHeaders) != len(tt.duplicates) || len(f.FoldedHeaders) != len(tt.folded) {
+			t.Fatalf("%s: unexpected duplicate or folded headers %+v", tt.name, f)
+		}
+		for i := range tt.duplicates {
+			if f.DuplicateHeaders[i] != tt.duplicates[i] {
+				t.Fatalf("%s: unexpected duplicate headers %v", tt.name, f.DuplicateHeaders)
+			}
+		}
+		for i := range tt.folded {
+			if f.FoldedHeaders[i] != tt.folded[i] {
+				t.Fatalf("%s: unexpected folded headers %v", tt.name, f.FoldedHeaders)
+			}
+		}
+	}
+}
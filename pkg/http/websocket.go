@@ -0,0 +1,145 @@
+package http
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// WebSocket handshake fingerprint
+// Format: [transport]|[header order]|[version]|[extension offers]|[protocols]
+// Example: http/1.1|host,upgrade,connection,sec-websocket-key,sec-websocket-version,sec-websocket-extensions|13|permessage-deflate;client_max_window_bits|-
+//
+// Browsers and WebSocket libraries differ in the order of the handshake
+// headers and in the permessage-deflate parameters they offer.
+
+// SplitHeader splits a "name: value" header, HTTP/2 pseudo-headers keep
+// their leading colon
+func SplitHeader(h string) (string, string) {
+	offset := 0
+	if strings.HasPrefix(h, ":") {
+		offset = 1
+	}
+	i := strings.Index(h[offset:], ":")
+	if i < 0 {
+		return strings.ToLower(strings.TrimSpace(h)), ""
+	}
+	return strings.ToLower(strings.TrimSpace(h[:offset+i])), strings.TrimSpace(h[offset+i+1:])
+}
+
+// AnalyzeWebSocketHandshake fingerprints the headers of a WebSocket upgrade
+// request, given as "name: value" in the order they were sent
+func AnalyzeWebSocketHandshake(transport string, headers []string) types.WebSocketDetails {
+	d := types.WebSocketDetails{
+		Transport:   transport,
+		HeaderOrder: []string{},
+	}
+
+	var extensions, protocols []string
+	for _, h := range headers {
+		name, value := SplitHeader(h)
+		d.HeaderOrder = append(d.HeaderOrder, name)
+		switch name {
+		case "sec-websocket-version":
+			d.Version = value
+		case "sec-websocket-key":
+			key, err := base64.StdEncoding.DecodeString(value)
+			d.KeyValid = err == nil && len(key) == 16
+		case "origin":
+			d.Origin = value
+		case "sec-websocket-extensions":
+			extensions = append(extensions, value)
+		case "sec-websocket-protocol":
+			for _, p := range strings.Split(value, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					protocols = append(protocols, p)
+				}
+			}
+		}
+	}
+	d.Protocols = protocols
+	d.Extensions = strings.Join(extensions, ", ")
+	d.ExtensionOffers = parseExtensions(d.Extensions)
+	for _, e := range d.ExtensionOffers {
+		if e.Name == "permessage-deflate" {
+			d.PermessageDeflate = parseDeflateOffer(e)
+			break
+		}
+	}
+
+	offers := []string{}
+	for _, e := range d.ExtensionOffers {
+		offers = append(offers, strings.Join(append([]string{e.Name}, e.Params...), ";"))
+	}
+	d.Fingerprint = fmt.Sprintf("%s|%s|%s|%s|%s",
+		transport,
+		strings.Join(d.HeaderOrder, ","),
+		orDash(d.Version),
+		orDash(strings.Join(offers, ",")),
+		orDash(strings.Join(protocols, ",")),
+	)
+	d.FingerprintHash = utils.SHA256trunc(d.Fingerprint)
+	return d
+}
+
+// parseExtensions parses a Sec-WebSocket-Extensions value (RFC 6455,
+// section 9.1). Parameter values lose their quotes.
+func parseExtensions(header string) []types.WebSocketExtension {
+	var offers []types.WebSocketExtension
+	for _, offer := range strings.Split(header, ",") {
+		parts := strings.Split(offer, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" {
+			continue
+		}
+		e := types.WebSocketExtension{Name: name}
+		for _, p := range parts[1:] {
+			k, v, hasValue := strings.Cut(strings.TrimSpace(p), "=")
+			k = strings.ToLower(strings.TrimSpace(k))
+			if k == "" {
+				continue
+			}
+			if hasValue {
+				k += "=" + strings.Trim(strings.TrimSpace(v), `"`)
+			}
+			e.Params = append(e.Params, k)
+		}
+		offers = append(offers, e)
+	}
+	return offers
+}
+
+func parseDeflateOffer(e types.WebSocketExtension) *types.PermessageDeflateOffer {
+	offer := &types.PermessageDeflateOffer{}
+	for _, p := range e.Params {
+		k, v, hasValue := strings.Cut(p, "=")
+		bits := 15
+		if hasValue {
+			if n, err := strconv.Atoi(v); err == nil {
+				bits = n
+			}
+		}
+		switch k {
+		case "server_no_context_takeover":
+			offer.ServerNoContextTakeover = true
+		case "client_no_context_takeover":
+			offer.ClientNoContextTakeover = true
+		case "server_max_window_bits":
+			offer.ServerMaxWindowBits = bits
+		case "client_max_window_bits":
+			offer.ClientMaxWindowBits = bits
+		}
+	}
+	return offer
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+var errDecodedBodyTooLarge = errors.New("decoded request body too large")
+
+// decodedBody is a request body in the shape httpbin reports it
+type decodedBody struct {
+	Data  string
+	JSON  interface{}
+	Form  map[string]interface{}
+	Files map[string]interface{}
+}
+
+// decodeRequestBody decompresses the request body according to its
+// Content-Encoding and parses it according to its Content-Type. It works the
+// same for HTTP/1, HTTP/2 and HTTP/3 requests. Bodies that decompress to
+// more than maxSize bytes are left compressed.
+func decodeRequestBody(res types.Response, maxSize int64) decodedBody {
+	decoded := decodedBody{
+		Form:  map[string]interface{}{},
+		Files: map[string]interface{}{},
+	}
+
+	body := res.Body
+	if len(body) == 0 {
+		return decoded
+	}
+
+	headers := extractHeaders(res)
+	if encoding := headerValue(headers, "Content-Encoding"); encoding != "" {
+		if plain, err := decompressBody(body, encoding, maxSize); err == nil {
+			body = plain
+		}
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(headerValue(headers, "Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			decoded.Form = flattenValues(values)
+			return decoded
+		}
+	case "multipart/form-data":
+		if err := decodeMultipart(body, params["boundary"], &decoded); err == nil {
+			return decoded
+		}
+		decoded.Form = map[string]interface{}{}
+		decoded.Files = map[string]interface{}{}
+	}
+
+	decoded.Data = bodyString(body, "application/octet-stream")
+	var jsonData interface{}
+	if json.Unmarshal(body, &jsonData) == nil {
+		decoded.JSON = jsonData
+	}
+	return decoded
+}
+
+// decompressBody undoes every listed Content-Encoding, last applied first.
+// Every step may decompress to at most maxSize bytes.
+func decompressBody(body []byte, encoding string, maxSize int64) ([]byte, error) {
+	encodings := strings.Split(encoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var r io.Reader
+		var err error
+		switch strings.ToLower(strings.TrimSpace(encodings[i])) {
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			// deflate is zlib wrapped, but some clients send raw deflate
+			r, err = zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				r, err = flate.NewReader(bytes.NewReader(body)), nil
+			}
+		case "br":
+			r = brotli.NewReader(bytes.NewReader(body))
+		case "zstd":
+			var d *zstd.Decoder
+			d, err = zstd.NewReader(bytes.NewReader(body))
+			if err == nil {
+				defer d.Close()
+				r = d
+			}
+		case "identity", "":
+			continue
+		default:
+			return nil, fmt.Errorf("unsupported content-encoding %q", encodings[i])
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		plain, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(plain)) > maxSize {
+			return nil, errDecodedBodyTooLarge
+		}
+		body = plain
+	}
+	return body, nil
+}
+
+// decodeMultipart fills the form fields and files of a multipart body
+func decodeMultipart(body []byte, boundary string, decoded *decodedBody) error {
+	if boundary == "" {
+		return errors.New("multipart body without boundary")
+	}
+
+	form := url.Values{}
+	files := url.Values{}
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return err
+		}
+
+		if part.FileName() != "" {
+			contentType := part.Header.Get("Content-Type")
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			files.Add(part.FormName(), bodyString(content, contentType))
+		} else {
+			form.Add(part.FormName(), string(content))
+		}
+	}
+
+	decoded.Form = flattenValues(form)
+	decoded.Files = flattenValues(files)
+	return nil
+}
+
+// bodyString returns text as is and binary data as a data URL, like httpbin
+func bodyString(b []byte, contentType string) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(b)
+}
+
+// flattenValues uses a plain string for keys with a single value
+func flattenValues(values url.Values) map[string]interface{} {
+	m := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if len(v) == 1 {
+			m[k] = v[0]
+		} else {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// headerValue looks up a header case insensitively
+func headerValue(headers map[string]string, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// addBodyFields adds httpbin's data, json, form and files keys
+func addBodyFields(response map[string]interface{}, res types.Response, srv *Server) {
+	decoded := decodeRequestBody(res, srv.MaxBodySize())
+	response["data"] = decoded.Data
+	response["json"] = decoded.JSON
+	response["form"] = decoded.Form
+	response["files"] = decoded.Files
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"mime/multipart"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// postBody sends a body to /post and returns the decoded echo
+func postBody(t *testing.T, srv *Server, body []byte, headers ...string) map[string]interface{} {
+	t.Helper()
+	res := types.Response{
+		Method:      "POST",
+		HTTPVersion: "HTTP/1.1",
+		Path:        "/post",
+		Http1:       &types.Http1Details{Headers: headers},
+		Body:        body,
+	}
+	var echo map[string]interface{}
+	if err := json.Unmarshal(httpbinPost(srv)(res, nil).Body, &echo); err != nil {
+		t.Fatal(err)
+	}
+	return echo
+}
+
+func TestDecodeFormBodies(t *testing.T) {
+	srv := NewServer()
+
+	echo := postBody(t, srv, []byte("a=1&b=2&b=3"), "Content-Type: application/x-www-form-urlencoded")
+	form, _ := echo["form"].(map[string]interface{})
+	if form["a"] != "1" || len(form["b"].([]interface{})) != 2 || echo["data"] != "" {
+		t.Fatalf("Unexpected form %+v", echo)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("name", "value")
+	fw, _ := mw.CreateFormFile("file", "a.txt")
+	fw.Write([]byte("file content"))
+	mw.Close()
+	echo = postBody(t, srv, buf.Bytes(), "Content-Type: "+mw.FormDataContentType())
+	form, _ = echo["form"].(map[string]interface{})
+	files, _ := echo["files"].(map[string]interface{})
+	if form["name"] != "value" || files["file"] != "file content" {
+		t.Fatalf("Unexpected multipart body %+v", echo)
+	}
+
+	// A multipart body without boundary is reported as data
+	echo = postBody(t, srv, []byte("plain"), "Content-Type: multipart/form-data")
+	if echo["data"] != "plain" {
+		t.Fatalf("Unexpected body without boundary %+v", echo)
+	}
+}
+
+func TestDecodeCompressedBodies(t *testing.T) {
+	srv := NewServer()
+	plain := []byte(`{"compressed": true}`)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(plain)
+	gw.Close()
+	var br bytes.Buffer
+	bw := brotli.NewWriter(&br)
+	bw.Write(plain)
+	bw.Close()
+	enc, _ := zstd.NewWriter(nil)
+	zst := enc.EncodeAll(plain, nil)
+
+	for encoding, body := range map[string][]byte{"gzip": gz.Bytes(), "br": br.Bytes(), "zstd": zst} {
+		echo := postBody(t, srv, body, "Content-Type: application/json", "Content-Encoding: "+encoding)
+		j, _ := echo["json"].(map[string]interface{})
+		if echo["data"] != string(plain) || j["compressed"] != true {
+			t.Fatalf("%s: unexpected body %+v", encoding, echo)
+		}
+	}
+}
+
+func TestDecodeBodyLimit(t *testing.T) {
+	srv := NewServer()
+	srv.GetConfig().MaxBodySize = 1024
+
+	bomb := func(size int) []byte {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write(bytes.Repeat([]byte("a"), size))
+		gw.Close()
+		return buf.Bytes()
+	}
+
+	echo := postBody(t, srv, bomb(1024), "Content-Encoding: gzip")
+	if echo["data"] != strings.Repeat("a", 1024) {
+		t.Fatalf("Expected a body at the limit to be decoded, got %d bytes", len(echo["data"].(string)))
+	}
+	// A small body that decompresses past max_body_size is kept compressed
+	compressed := bomb(1024*1024 + 1)
+	echo = postBody(t, srv, compressed, "Content-Encoding: gzip")
+	data, _ := echo["data"].(string)
+	if !strings.HasPrefix(data, "data:application/octet-stream;base64,") || len(data) > 2*len(compressed)+64 {
+		t.Fatalf("Expected the compressed body to be returned, got %d bytes", len(data))
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/tls"
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// compareSide is one side of a comparison, a stored request or a fingerprint
+type compareSide struct {
+	// Type is request, peetprint, ja3, ja4 or h2
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	response *types.Response
+}
+
+// Comparison is the difference between two requests or fingerprints, from
+// a to b. Only the parts both sides have are compared.
+type Comparison struct {
+	A     compareSide  `json:"a"`
+	B     compareSide  `json:"b"`
+	Equal bool         `json:"equal"`
+	TLS   *tls.TLSDiff `json:"tls,omitempty"`
+	// Elements are the lists of PeetPrints and JA3s that differ
+	Elements map[string]types.ListDiff  `json:"elements,omitempty"`
+	JA4      map[string]types.ValueDiff `json:"ja4,omitempty"`
+	HTTP2    *trackmehttp.H2Diff        `json:"http2,omitempty"`
+	Headers  *types.ListDiff            `json:"header_order,omitempty"`
+}
+
+// fingerprintType guesses the type of a fingerprint from its separators,
+// values of no known type are request IDs
+func fingerprintType(v string) string {
+	switch {
+	case strings.Count(v, "|") == 7:
+		return "peetprint"
+	case strings.Count(v, "|") == 3:
+		return "h2"
+	case strings.Count(v, ",") == 4:
+		return "ja3"
+	case strings.Count(v, "_") == 2:
+		return "ja4"
+	}
+	return "request"
+}
+
+// fingerprintOf returns the fingerprint of a type of a request
+func fingerprintOf(res *types.Response, typ string) string {
+	if typ == "h2" {
+		if res.Http2 != nil {
+			return res.Http2.AkamaiFingerprint
+		}
+		return ""
+	}
+	if res.TLS == nil {
+		return ""
+	}
+	switch typ {
+	case "peetprint":
+		return res.TLS.PeetPrint
+	case "ja3":
+		return res.TLS.JA3
+	case "ja4":
+		return res.TLS.JA4
+	}
+	return ""
+}
+
+// requestHeaders returns the header lines of a request
+func requestHeaders(res *types.Response) []string {
+	switch {
+	case res.Http1 != nil:
+		return res.Http1.Headers
+	case res.Http3 != nil:
+		return res.Http3.Headers
+	case res.Http2 != nil:
+		for _, f := range res.Http2.SendFrames {
+			if f.Type == "HEADERS" {
+				return f.Headers
+			}
+		}
+	}
+	return nil
+}
+
+func parseCompareSide(name string, u url.Values, srv *Server) (compareSide, RouteResponse, bool) {
+	v := utils.GetParam(name, u)
+	if v == "" {
+		return compareSide{}, jsonError(http.StatusBadRequest, "Missing "+name), false
+	}
+	side := compareSide{Type: fingerprintType(v), Value: v}
+	if side.Type != "request" {
+		return side, RouteResponse{}, true
+	}
+
+	if !srv.IsConnectedToDB() {
+		return side, jsonError(http.StatusNotFound, name+": not a fingerprint, and requests can not be looked up without a database"), false
+	}
+	snap, ok, err := loadSnapshot(srv, v)
+	if err != nil {
+		log.Println("Error loading snapshot:", err)
+		return side, jsonError(http.StatusInternalServerError, "Could not load the request"), false
+	}
+	if !ok {
+		return side, jsonError(http.StatusNotFound, name+": not a fingerprint or a stored request"), false
+	}
+	side.response = &snap.Response
+	return side, RouteResponse{}, true
+}
+
+// compareRequests compares everything two stored requests have in common
+func compareRequests(c *Comparison) {
+	a, b := c.A.response, c.B.response
+	if a.TLS != nil && b.TLS != nil {
+		d := tls.DiffTLS(a.TLS, b.TLS)
+		c.TLS = &d
+		c.JA4, _ = tls.DiffJA4(a.TLS.JA4, b.TLS.JA4)
+	}
+	if a.Http2 != nil && b.Http2 != nil {
+		if d, ok := trackmehttp.DiffAkamai(a.Http2.AkamaiFingerprint, b.Http2.AkamaiFingerprint); ok {
+			c.HTTP2 = &d
+		}
+	}
+	if ha, hb := requestHeaders(a), requestHeaders(b); len(ha) > 0 && len(hb) > 0 {
+		d := trackmehttp.DiffHeaderOrder(ha, hb)
+		c.Headers = &d
+	}
+}
+
+// compareFingerprints compares two fingerprints of a type
+func compareFingerprints(c *Comparison, typ, a, b string) bool {
+	switch typ {
+	case "peetprint", "ja3":
+		parse := tls.PeetPrintElements
+		if typ == "ja3" {
+			parse = tls.JA3Elements
+		}
+		ea, okA := parse(a)
+		eb, okB := parse(b)
+		if !okA || !okB {
+			return false
+		}
+		c.Elements = tls.DiffElements(ea, eb)
+		return true
+	case "ja4":
+		var ok bool
+		c.JA4, ok = tls.DiffJA4(a, b)
+		return ok
+	case "h2":
+		d, ok := trackmehttp.DiffAkamai(a, b)
+		c.HTTP2 = &d
+		return ok
+	}
+	return false
+}
+
+func apiCompare(srv *Server) RouteHandler {
+	return func(_ types.Response, u url.Values) RouteResponse {
+		a, rr, ok := parseCompareSide("a", u, srv)
+		if !ok {
+			return rr
+		}
+		b, rr, ok := parseCompareSide("b", u, srv)
+		if !ok {
+			return rr
+		}
+
+		c := Comparison{A: a, B: b}
+		if a.Type == "request" && b.Type == "request" {
+			compareRequests(&c)
+		} else {
+			// A request is compared by its fingerprint of the other type
+			typ, va, vb := a.Type, a.Value, b.Value
+			if typ == "request" {
+				typ, va = b.Type, fingerprintOf(a.response, b.Type)
+			} else if b.Type == "request" {
+				vb = fingerprintOf(b.response, a.Type)
+			} else if a.Type != b.Type {
+				return jsonError(http.StatusBadRequest, "a is a "+a.Type+" and b a "+b.Type+", they can not be compared")
+			}
+			if va == "" || vb == "" {
+				return jsonError(http.StatusBadRequest, "The request has no "+typ)
+			}
+			if !compareFingerprints(&c, typ, va, vb) {
+				return jsonError(http.StatusBadRequest, "Invalid "+typ)
+			}
+		}
+
+		c.Equal = len(c.Elements) == 0 && len(c.JA4) == 0 &&
+			(c.TLS == nil || !c.TLS.Changed()) &&
+			(c.HTTP2 == nil || !c.HTTP2.Changed()) &&
+			(c.Headers == nil || !c.Headers.Changed())
+		j, _ := json.MarshalIndent(c, "", "  ")
+		return respond(j, "application/json")
+	}
+}
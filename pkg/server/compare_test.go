@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/store"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestCompare(t *testing.T) {
+	srv := NewServer()
+	srv.SetStore(store.NewMemory())
+	srv.GetConfig().Snapshots = true
+	request := func(id, cipher, group, settings string, headers ...string) types.Response {
+		return types.Response{
+			RequestID: id,
+			TLS: &types.TLSDetails{
+				Ciphers: []string{"TLS_GREASE (0x" + id + ")", "TLS_AES_128_GCM_SHA256", cipher},
+				Extensions: []interface{}{
+					map[string]interface{}{"name": "TLS_GREASE (0x" + id + ")"},
+					map[string]interface{}{"name": "key_share (51)", "shared_keys": []interface{}{map[string]interface{}{group: id}}},
+					map[string]interface{}{"name": "padding (21)", "padding_data_length": len(id)},
+				},
+				JA4: "t13d1516h2_8daaf6152771_" + id,
+			},
+			Http2: &types.Http2Details{
+				AkamaiFingerprint: settings + "|15663105|0|m,a,s,p",
+				SendFrames:        []types.ParsedFrame{{Type: "HEADERS", Headers: headers}},
+			},
+		}
+	}
+	a := newSnapshot(request("aaaa", "TLS_AES_256_GCM_SHA384", "X25519MLKEM768", "1:65536;2:0", ":method: GET", "accept: */*", "user-agent: a"), time.Now().Unix(), "", srv)
+	b := newSnapshot(request("bbbb", "TLS_CHACHA20_POLY1305_SHA256", "X25519", "1:65536;2:1", ":method: GET", "user-agent: b", "accept: */*"), time.Now().Unix(), "", srv)
+	srv.GetStore().SaveSnapshots(*a, *b)
+
+	var c Comparison
+	json.Unmarshal(apiCompare(srv)(types.Response{}, url.Values{"a": {"aaaa"}, "b": {"bbbb"}}).Body, &c)
+	if c.Equal || c.TLS == nil || c.HTTP2 == nil || c.Headers == nil {
+		t.Fatalf("Expected the requests to differ: %+v", c)
+	}
+	if ciphers := c.TLS.Ciphers; len(ciphers.Added) != 1 || ciphers.Added[0] != "TLS_CHACHA20_POLY1305_SHA256" || len(ciphers.Removed) != 1 || c.TLS.Extensions.Changed() {
+		t.Fatalf("Unexpected TLS diff %+v", c.TLS)
+	}
+	if ks := c.TLS.Parameters["key_share (51)"]["shared_keys"]; len(ks.Added) != 1 || ks.Added[0] != "X25519" || len(c.TLS.Parameters) != 1 {
+		t.Fatalf("Unexpected extension parameters %+v", c.TLS.Parameters)
+	}
+	if c.HTTP2.Settings["ENABLE_PUSH"] != (types.ValueDiff{A: "0", B: "1"}) || c.HTTP2.PseudoHeaders.Changed() || !c.Headers.Reordered {
+		t.Fatalf("Unexpected HTTP diff %+v %+v", c.HTTP2, c.Headers)
+	}
+	if c.JA4["ja4_c"] != (types.ValueDiff{A: "aaaa", B: "bbbb"}) || len(c.JA4) != 1 {
+		t.Fatalf("Unexpected JA4 diff %+v", c.JA4)
+	}
+
+	// A request is compared by its fingerprint of the type of the other side
+	c = Comparison{}
+	json.Unmarshal(apiCompare(srv)(types.Response{}, url.Values{"a": {"aaaa"}, "b": {"1:65536;2:0|15663105|0|m,a,s,p"}}).Body, &c)
+	if !c.Equal || c.A.Type != "request" || c.B.Type != "h2" {
+		t.Fatalf("Expected the request to match the fingerprint: %+v", c)
+	}
+	if rr := apiCompare(srv)(types.Response{}, url.Values{"a": {"t13d1516h2_8daaf6152771_aaaa"}, "b": {"771,4865,0,29,0"}}); rr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for different types, got %d", rr.StatusCode)
+	}
+	if rr := apiCompare(srv)(types.Response{}, url.Values{"a": {"aaaa"}, "b": {"cccc"}}); rr.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown request, got %d", rr.StatusCode)
+	}
+}
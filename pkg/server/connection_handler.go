@@ -1,18 +1,17 @@
 package server
 
 import (
+	"bufio"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
-	"net/http"
-	"strconv"
+	"net/url"
 	"strings"
 	"time"
 
-	"github.com/pagpeter/quic-go/http3"
 	trackmehttp "github.com/pagpeter/trackme/pkg/http"
 	"github.com/pagpeter/trackme/pkg/tls"
 	"github.com/pagpeter/trackme/pkg/types"
@@ -22,46 +21,52 @@ import (
 
 const HTTP2_PREAMBLE = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
 
-// generateRequestID generates a simple random ID for request tracking
+// connStartTimeout is how long a new connection may take for the TLS
+// handshake and the first bytes of the request
+const connStartTimeout = 10 * time.Second
+
+// generateRequestID generates a random ID for request tracking. The IDs
+// are permalinks to the snapshots, so they come from crypto/rand and can
+// not be guessed.
 func generateRequestID() string {
 	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	b := make([]byte, 16)
+	rand.Read(b)
 	for i := range b {
-		b[i] = chars[rand.Intn(len(chars))]
+		b[i] = chars[int(b[i])%len(chars)]
 	}
 	return string(b)
 }
 
-// extractStatusCode extracts HTTP status code from /status/{code} paths
-func extractStatusCode(path string) int {
-	if !strings.HasPrefix(path, "/status/") {
-		return 200
-	}
-	parts := strings.Split(path, "/")
-	if len(parts) >= 3 {
-		if code, err := strconv.Atoi(parts[2]); err == nil && code >= 100 && code < 600 {
-			return code
-		}
-	}
-	return 200
-}
-
 func parseHTTP1(request []byte) types.Response {
-	// Split the request into lines
-	lines := strings.Split(string(request), "\r\n")
+	// Split the request into lines, bare LF line endings are tolerated
+	lines := strings.Split(string(request), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
 
 	// Split the first line into the method, path and http version
-	firstLine := strings.Split(lines[0], " ")
+	firstLine := strings.Fields(lines[0])
 
-	// Split the headers into an array
+	// Split the headers into an array, folded lines are joined to the
+	// header they continue
 	var headers []string
 	var userAgent string
-	for _, line := range lines {
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
 		if strings.Contains(line, ":") {
 			headers = append(headers, line)
-			if strings.HasPrefix(strings.ToLower(line), "user-agent") {
-				userAgent = strings.TrimSpace(strings.Split(line, ":")[1])
-			}
+		}
+	}
+	for _, h := range headers {
+		if name, value, _ := strings.Cut(h, ":"); strings.EqualFold(strings.TrimSpace(name), "user-agent") {
+			userAgent = strings.TrimSpace(value)
 		}
 	}
 
@@ -72,27 +77,45 @@ func parseHTTP1(request []byte) types.Response {
 			Path:        "--",
 		}
 	}
+
+	// Absolute-form targets are routed like their path
+	path := firstLine[1]
+	if !strings.HasPrefix(path, "/") {
+		if u, err := url.Parse(path); err == nil && u.Scheme != "" {
+			path = u.RequestURI()
+		}
+	}
+
+	format := trackmehttp.AnalyzeHTTP1Format(request)
 	return types.Response{
 		HTTPVersion: firstLine[2],
-		Path:        firstLine[1],
+		Path:        path,
 		Method:      firstLine[0],
 		UserAgent:   userAgent,
 		Http1: &types.Http1Details{
 			Headers: headers,
+			Raw:     string(request),
+			RawB64:  base64.StdEncoding.EncodeToString(request),
+			Format:  &format,
 		},
 	}
 }
 
 func (srv *Server) HandleTLSConnection(conn net.Conn) bool {
-	// Read the first line of the request
-	// We only read the first line to determine if the connection is HTTP1 or HTTP2
-	// If we know that it isnt HTTP2, we can read the rest of the request and then start processing it
-	// If we know that it is HTTP2, we start the HTTP2 handler
+	// Peek at the first bytes of the request to determine if the connection
+	// is HTTP1 or HTTP2. Both handlers then read from the same buffer.
 
-	l := len([]byte(HTTP2_PREAMBLE))
-	request := make([]byte, l)
+	timeline := newConnTimeline()
+	br := bufio.NewReader(conn)
 
-	_, err := conn.Read(request)
+	// Complete the handshake on its own so that it shows up in the timeline
+	var start []byte
+	conn.SetReadDeadline(time.Now().Add(connStartTimeout))
+	err := conn.(*utls.Conn).Handshake()
+	if err == nil {
+		timeline.mark(eventHandshake)
+		start, err = br.Peek(3)
+	}
 	if err != nil {
 		//log.Println("Error reading request", err)
 		if strings.HasSuffix(err.Error(), "unknown certificate") && srv.IsLocal() {
@@ -134,163 +157,77 @@ func (srv *Server) HandleTLSConnection(conn net.Conn) bool {
 		RawB64:           rawB64,
 	}
 
-	// Check if the first line is HTTP/2
-	if string(request) == HTTP2_PREAMBLE {
-		srv.handleHTTP2(conn, &tlsDetails)
-	} else {
-		// Read the rest of the request
-		r2 := make([]byte, 1024-l)
-		_, err := conn.Read(r2)
-		if err != nil {
-			log.Println(err)
-			return true
-		}
-		// Append it to the first line
-		request = append(request, r2...)
-
-		// Parse and handle the request
-		details := parseHTTP1(request)
-		details.IP = conn.RemoteAddr().String()
-		details.TLS = &tlsDetails
+	bconn := &bufferedConn{Conn: conn, r: br}
 
-		// Calculate JA4H for HTTP/1
-		if details.Http1 != nil && details.TLS != nil {
-			details.TLS.JA4H = trackmehttp.CalculateJA4H(details.Method, details.HTTPVersion, details.Http1.Headers)
-			details.TLS.JA4H_r = trackmehttp.CalculateJA4H_r(details.Method, details.HTTPVersion, details.Http1.Headers)
+	// Check if the connection starts with the HTTP/2 preface
+	if string(start) == HTTP2_PREAMBLE[:3] {
+		preface, err := br.Peek(len(HTTP2_PREAMBLE))
+		if err != nil || string(preface) != HTTP2_PREAMBLE {
+			return false
 		}
-
-		srv.respondToHTTP1(conn, details)
+		br.Discard(len(HTTP2_PREAMBLE))
+		timeline.mark(eventPreface)
+		// Idle HTTP/2 connections are closed by idleTimeoutLoop
+		conn.SetReadDeadline(time.Time{})
+		srv.handleHTTP2(bconn, &tlsDetails, timeline)
+	} else {
+		srv.serveHTTP1(bconn, br, &tlsDetails, timeline, nil)
 	}
 	return true
 }
 
-func (srv *Server) respondToHTTP1(conn net.Conn, resp types.Response) {
-	// log.Println("Request:", resp.ToJson())
-	// log.Println(len(resp.ToJson()))
+// respondToHTTP1 routes the request and writes the response. It reports
+// whether the connection can be used for the next request, which needs
+// keepAlive to be set.
+func (srv *Server) respondToHTTP1(conn net.Conn, resp types.Response, keepAlive bool) bool {
+	meta := newResponseMeta(resp.Method)
+	resp.RequestID = meta.requestID
 
-	// Track request timing
-	startTime := time.Now()
-	requestID := generateRequestID()
-
-	var isAdmin bool
-	var res []byte
-	var ctype = "text/plain"
+	rr := respond(nil, "text/plain")
 	if resp.Method != "OPTIONS" {
-		res, ctype = Router(resp.Path, resp, srv)
+		rr = Router(resp.Path, resp, srv)
 	} else {
-		isAdmin = true
+		meta.cors = true
 	}
 
-	key, isKeySet := srv.GetAdmin()
-	if isKeySet {
-		for _, a := range resp.Http1.Headers {
-			if strings.HasPrefix(a, key) {
-				isAdmin = true
-			}
-		}
+	if key, isKeySet := srv.GetAdmin(); isKeySet && hasHeader(resp.Http1.Headers, key) {
+		meta.cors = true
 	}
 
-	// Parse special content-type directives
-	var extraHeaders []string
-	statusCode := extractStatusCode(resp.Path)
-
-	// Handle redirect responses: "redirect:STATUS:LOCATION"
-	if strings.HasPrefix(ctype, "redirect:") {
-		parts := strings.SplitN(ctype, ":", 3)
-		if len(parts) >= 3 {
-			if code, err := strconv.Atoi(parts[1]); err == nil {
-				statusCode = code
-			}
-			location := parts[2]
-			extraHeaders = append(extraHeaders, "Location: "+location)
-			ctype = "text/html; charset=utf-8"
-			res = []byte{}
-		}
-	}
+	w := newHTTP1Writer(conn, keepAlive, resp.HTTPVersion == "HTTP/1.0")
+	err := writeRouteResponse(w, rr, meta)
+	logWriteError("HTTP/1", err)
+	// Streamed bodies to HTTP/1.0 clients end with the connection
+	return err == nil && w.keepAlive
+}
 
-	// Handle Set-Cookie responses: "set-cookies:COOKIE1|COOKIE2:ACTUAL_CONTENT_TYPE"
-	if strings.HasPrefix(ctype, "set-cookies:") {
-		parts := strings.SplitN(ctype, ":", 3)
-		if len(parts) >= 3 {
-			cookies := strings.Split(parts[1], "|")
-			for _, cookie := range cookies {
-				extraHeaders = append(extraHeaders, "Set-Cookie: "+cookie)
-			}
-			ctype = parts[2]
+// hasHeader reports whether a "Name: value" header list contains the header.
+// Names are compared case-insensitively, HTTP/2 and HTTP/3 send them in
+// lower case.
+func hasHeader(headers []string, name string) bool {
+	for _, h := range headers {
+		if n, _, ok := strings.Cut(h, ":"); ok && strings.EqualFold(strings.TrimSpace(n), name) {
+			return true
 		}
 	}
-
-	// Calculate response time
-	responseTime := time.Since(startTime).Milliseconds()
-
-	res1 := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
-	res1 += "Content-Length: " + fmt.Sprintf("%v\r\n", len(res))
-	res1 += "Content-Type: " + ctype + "; charset=utf-8\r\n"
-
-	// Add request tracking headers
-	res1 += "X-Request-Id: " + requestID + "\r\n"
-	res1 += "X-Response-Time: " + fmt.Sprintf("%d\r\n", responseTime)
-
-	// Add extra headers (redirects, cookies)
-	for _, h := range extraHeaders {
-		res1 += h + "\r\n"
-	}
-
-	// Add Content-Encoding header for compression endpoints
-	if strings.HasPrefix(resp.Path, "/gzip") {
-		res1 += "Content-Encoding: gzip\r\n"
-	} else if strings.HasPrefix(resp.Path, "/deflate") {
-		res1 += "Content-Encoding: deflate\r\n"
-	} else if strings.HasPrefix(resp.Path, "/brotli") {
-		res1 += "Content-Encoding: br\r\n"
-	}
-
-	if isAdmin {
-		res1 += "Access-Control-Allow-Origin: *\r\n"
-		res1 += "Access-Control-Allow-Methods: *\r\n"
-		res1 += "Access-Control-Allow-Headers: *\r\n"
-	}
-	res1 += "Server: TrackMe\r\n"
-	res1 += "Alt-Svc: h3=\":443\"; ma=86400\r\n"
-	res1 += "\r\n"
-	res1 += string(res)
-	res1 += "\r\n\r\n"
-
-	_, err := conn.Write([]byte(res1))
-	if err != nil {
-		log.Println("Error writing HTTP/1 data", err)
-		return
-	}
-
-	err = conn.Close()
-	if err != nil {
-		log.Println("Error closing HTTP/1 connection", err)
-		return
-	}
+	return false
 }
 
 // https://stackoverflow.com/questions/52002623/golang-tcp-server-how-to-write-http2-data
-func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails) {
+func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails, timeline *connTimeline) {
 	fr := http2.NewFramer(conn, conn)
-	h2conn := NewHTTP2Connection(conn, fr, tlsFingerprint, srv)
+	h2conn := NewHTTP2Connection(conn, fr, tlsFingerprint, timeline, srv)
 
-	// Send initial SETTINGS
-	// Same settings that google uses
-	err := fr.WriteSettings(
-		http2.Setting{
-			ID: http2.SettingInitialWindowSize, Val: 1048576,
-		},
-		http2.Setting{
-			ID: http2.SettingMaxConcurrentStreams, Val: 100,
-		},
-		http2.Setting{
-			ID: http2.SettingMaxHeaderListSize, Val: 65536,
-		},
-	)
-	if err != nil {
+	// Send initial SETTINGS from the configured profile
+	profile, ok := GetH2Profile(srv.GetConfig().H2Profile)
+	if !ok {
+		log.Println("Unknown h2 profile, using", profile.Name)
+	}
+	if err := h2conn.applyProfile(profile, false); err != nil {
 		log.Println("Failed to write settings:", err)
 		return
 	}
+	h2conn.timeline.mark(eventSettingsSent)
 
 	// Start idle timeout goroutine
 	go h2conn.idleTimeoutLoop()
@@ -298,98 +235,3 @@ func (srv *Server) handleHTTP2(conn net.Conn, tlsFingerprint *types.TLSDetails)
 	// Main frame processing loop
 	h2conn.processFrames()
 }
-
-// HandleHTTP3 handles HTTP/3 requests and returns a simple "Hello, World!" response
-func (srv *Server) HandleHTTP3() http.Handler {
-	mux := http.NewServeMux()
-
-	// WebSocket endpoint - must be registered before the catch-all "/" handler
-	mux.HandleFunc("/ws", HandleWebSocket)
-
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Track request timing
-		startTime := time.Now()
-		requestID := generateRequestID()
-
-		if h3w, ok := w.(*http3.ResponseWriter); ok {
-			h3c := h3w.Connection()
-			h3state := h3c.ConnectionState()
-
-			h3c.Settings()
-
-			// Safely extract connection state and settings
-			var used0RTT, supportsDatagrams, supportsStreamResetPartialDelivery bool
-			var version uint32
-			var gso bool
-			var settings types.Http3Settings
-
-			used0RTT = h3state.Used0RTT
-			supportsDatagrams = h3state.SupportsDatagrams
-			supportsStreamResetPartialDelivery = h3state.SupportsStreamResetPartialDelivery
-			version = uint32(h3state.Version)
-			gso = h3state.GSO
-			if h3c != nil && h3c.Settings() != nil {
-				settings = types.Http3Settings(*h3c.Settings())
-			}
-
-			resp := types.Response{
-				IP:          r.RemoteAddr,
-				HTTPVersion: "h3",
-				Path:        r.URL.Path,
-				Method:      r.Method,
-				UserAgent:   r.Header.Get("User-Agent"),
-				Http3: &types.Http3Details{
-					Information:                        "HTTP/3 support is work-in-progress. Use https://fp.impersonate.pro/api/http3 in the meantime.",
-					Used0RTT:                           used0RTT,
-					SupportsDatagrams:                  supportsDatagrams,
-					SupportsStreamResetPartialDelivery: supportsStreamResetPartialDelivery,
-					Version:                            version,
-					GSO:                                gso,
-					Settings:                           settings,
-				},
-			}
-
-			res, ctype := Router(r.URL.Path, resp, srv)
-
-			// Calculate response time
-			responseTime := time.Since(startTime).Milliseconds()
-
-			// Handle redirect responses: "redirect:STATUS:LOCATION"
-			if strings.HasPrefix(ctype, "redirect:") {
-				parts := strings.SplitN(ctype, ":", 3)
-				if len(parts) >= 3 {
-					statusCode := 302
-					if code, err := strconv.Atoi(parts[1]); err == nil {
-						statusCode = code
-					}
-					location := parts[2]
-					w.Header().Set("X-Request-Id", requestID)
-					w.Header().Set("X-Response-Time", strconv.FormatInt(responseTime, 10))
-					w.Header().Set("Location", location)
-					w.WriteHeader(statusCode)
-					return
-				}
-			}
-
-			// Handle Set-Cookie responses: "set-cookies:COOKIE1|COOKIE2:ACTUAL_CONTENT_TYPE"
-			if strings.HasPrefix(ctype, "set-cookies:") {
-				parts := strings.SplitN(ctype, ":", 3)
-				if len(parts) >= 3 {
-					cookies := strings.Split(parts[1], "|")
-					for _, cookie := range cookies {
-						w.Header().Add("Set-Cookie", cookie)
-					}
-					ctype = parts[2]
-				}
-			}
-
-			w.Header().Set("Content-Type", ctype)
-			w.Header().Set("Server", "TrackMe")
-			w.Header().Set("X-Request-Id", requestID)
-			w.Header().Set("X-Response-Time", strconv.FormatInt(responseTime, 10))
-			w.Write([]byte(res))
-		}
-	})
-
-	return mux
-}
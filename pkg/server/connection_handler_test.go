@@ -1,12 +1,27 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"io"
+	"math/big"
 	"net"
+	"net/http"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/pagpeter/quic-go/http3"
 	"github.com/pagpeter/trackme/pkg/types"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/hpack"
@@ -32,7 +47,7 @@ func TestHTTP2Multiplexing(t *testing.T) {
 			JA3:       "771,4865,0,10,23",
 			PeetPrint: "hash|h2|hash|sig",
 		}
-		srv.handleHTTP2(serverConn, tlsDetails)
+		srv.handleHTTP2(serverConn, tlsDetails, nil)
 	}()
 
 	// Client side
@@ -145,7 +160,7 @@ func TestHTTP2RedirectChain(t *testing.T) {
 			JA3:       "771,4865,0,10,23",
 			PeetPrint: "hash|h2|hash|sig",
 		}
-		srv.handleHTTP2(serverConn, tlsDetails)
+		srv.handleHTTP2(serverConn, tlsDetails, nil)
 	}()
 
 	fr := http2.NewFramer(clientConn, clientConn)
@@ -230,3 +245,923 @@ loop:
 		t.Fatal("Received premature GOAWAY for redirect/request")
 	}
 }
+
+func TestHTTP2ActiveProbe(t *testing.T) {
+	srv, clientConn, serverConn := setupTest()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		tlsDetails := &types.TLSDetails{
+			JA3:       "771,4865,0,10,23",
+			PeetPrint: "hash|h2|hash|sig",
+		}
+		srv.handleHTTP2(serverConn, tlsDetails, nil)
+	}()
+
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/api/h2/active?profile=ping"})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+
+	fr := http2.NewFramer(clientConn, clientConn)
+	fr.ReadFrame()
+	fr.WriteSettings()
+
+	// Behave like a well-mannered client: ACK every SETTINGS and PING. The
+	// frames are read and written by this goroutine only, the request is
+	// sent once the server acknowledged the client SETTINGS.
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	var data []byte
+	sent := false
+	for done := false; !done; {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal("Error waiting for the probe response:", err)
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				fr.WriteSettingsAck()
+			} else if !sent {
+				sent = true
+				if err := fr.WriteHeaders(http2.HeadersFrameParam{
+					StreamID:      1,
+					BlockFragment: buf.Bytes(),
+					EndHeaders:    true,
+					EndStream:     true,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				fr.WritePing(true, f.Data)
+			}
+		case *http2.DataFrame:
+			data = append(data, f.Data()...)
+			done = f.StreamEnded()
+		}
+	}
+
+	var res struct {
+		Active *types.ActiveH2Details `json:"active"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Active == nil {
+		t.Fatal("Expected an active fingerprint")
+	}
+	if res.Active.Profile != "ping" {
+		t.Fatalf("Expected profile ping, got %q", res.Active.Profile)
+	}
+	if !res.Active.SettingsAcked {
+		t.Fatal("Expected the SETTINGS to be acknowledged")
+	}
+	if len(res.Active.PingAckLatenciesMs) != 3 {
+		t.Fatalf("Expected 3 PING ACKs, got %d", len(res.Active.PingAckLatenciesMs))
+	}
+	if len(res.Active.Violations) != 0 {
+		t.Fatalf("Expected no violations, got %v", res.Active.Violations)
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	srv, clientConn, serverConn := setupTest()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go srv.HandlePlainConnection(serverConn)
+
+	// HEADER_TABLE_SIZE = 4096, INITIAL_WINDOW_SIZE = 65535
+	settings := base64.RawURLEncoding.EncodeToString([]byte{0, 1, 0, 0, 0x10, 0, 0, 4, 0, 0, 0xff, 0xff})
+	go clientConn.Write([]byte("GET /api/all HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"User-Agent: h2c-test\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\n" +
+		"HTTP2-Settings: " + settings + "\r\n\r\n"))
+
+	br := bufio.NewReader(clientConn)
+	status, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(status, "HTTP/1.1 101") {
+		t.Fatalf("Expected 101 Switching Protocols, got %q", status)
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	fr := http2.NewFramer(clientConn, br)
+	go func() {
+		clientConn.Write([]byte(HTTP2_PREAMBLE))
+		fr.WriteSettings()
+	}()
+
+	body := make(chan []byte, 1)
+	go func() {
+		var data []byte
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			if f, ok := f.(*http2.DataFrame); ok && f.StreamID == 1 {
+				data = append(data, f.Data()...)
+				if f.StreamEnded() {
+					body <- data
+					return
+				}
+			}
+		}
+	}()
+
+	var res types.Response
+	select {
+	case b := <-body:
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the response on stream 1")
+	}
+
+	if res.HTTPVersion != "h2" || res.Http2 == nil {
+		t.Fatalf("Expected an h2 response, got %q", res.HTTPVersion)
+	}
+	if !strings.HasPrefix(res.Http2.AkamaiFingerprint, "1:4096;4:65535|") {
+		t.Fatalf("Expected the HTTP2-Settings in the akamai fingerprint, got %q", res.Http2.AkamaiFingerprint)
+	}
+	if res.Http2.JA4H == "" {
+		t.Fatal("Expected a JA4H fingerprint for the cleartext connection")
+	}
+	if res.TLS != nil {
+		t.Fatal("Expected no TLS details on a cleartext connection")
+	}
+}
+
+func TestHTTP2PushCancelled(t *testing.T) {
+	srv, clientConn, serverConn := setupTest()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		tlsDetails := &types.TLSDetails{
+			JA3:       "771,4865,0,10,23",
+			PeetPrint: "hash|h2|hash|sig",
+		}
+		srv.handleHTTP2(serverConn, tlsDetails, nil)
+	}()
+
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/api/h2/push"})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+
+	fr := http2.NewFramer(clientConn, clientConn)
+	fr.ReadFrame()
+	fr.WriteSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 1})
+
+	// Refuse every pushed stream, like a client without a push handler.
+	// The request is sent once the SETTINGS enabling push were ACKed.
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	var data []byte
+	for done := false; !done; {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal("Error waiting for the push probe response:", err)
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				if err := fr.WriteHeaders(http2.HeadersFrameParam{
+					StreamID:      1,
+					BlockFragment: buf.Bytes(),
+					EndHeaders:    true,
+					EndStream:     true,
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		case *http2.PushPromiseFrame:
+			fr.WriteRSTStream(f.PromiseID, http2.ErrCodeCancel)
+		case *http2.DataFrame:
+			if f.StreamID == 1 {
+				data = append(data, f.Data()...)
+				done = f.StreamEnded()
+			}
+		}
+	}
+
+	var res types.H2PushDetails
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.EnablePush || len(res.Promises) != 1 {
+		t.Fatalf("Expected one promise, got %+v", res)
+	}
+	p := res.Promises[0]
+	if !p.Cancelled || p.Delivered || p.RSTCode != "CANCEL" {
+		t.Fatalf("Expected the promise to be cancelled, got %+v", p)
+	}
+	if res.Fingerprint != "E:1|rst:CANCEL" {
+		t.Fatalf("Unexpected push fingerprint %q", res.Fingerprint)
+	}
+}
+
+func TestHTTP2UploadFlowControl(t *testing.T) {
+	srv, clientConn, serverConn := setupTest()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		tlsDetails := &types.TLSDetails{
+			JA3:       "771,4865,0,10,23",
+			PeetPrint: "hash|h2|hash|sig",
+		}
+		srv.handleHTTP2(serverConn, tlsDetails, nil)
+	}()
+
+	fr := http2.NewFramer(clientConn, clientConn)
+	fr.ReadFrame()
+	fr.WriteSettings()
+
+	// More than the 65535 byte connection window, so the upload only
+	// completes if the server returns flow control credit
+	upload := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+	credit := make(chan uint32, 64)
+	body := make(chan []byte, 1)
+	go func() {
+		var data []byte
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f := f.(type) {
+			case *http2.WindowUpdateFrame:
+				if f.StreamID == 0 {
+					credit <- f.Increment
+				}
+			case *http2.DataFrame:
+				data = append(data, f.Data()...)
+				if f.StreamEnded() {
+					body <- data
+					return
+				}
+			}
+		}
+	}()
+
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: "POST"})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/upload"})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+	if err := fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: buf.Bytes(),
+		EndHeaders:    true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	window := uint32(65535)
+	for sent := 0; sent < len(upload); {
+		for window < 16384 {
+			select {
+			case inc := <-credit:
+				window += inc
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Server stopped returning flow control credit after %d bytes", sent)
+			}
+		}
+		end := sent + 16384
+		if end > len(upload) {
+			end = len(upload)
+		}
+		if err := fr.WriteData(1, end == len(upload), upload[sent:end]); err != nil {
+			t.Fatal(err)
+		}
+		window -= uint32(end - sent)
+		sent = end
+	}
+
+	var res struct {
+		Bytes      int      `json:"bytes"`
+		SHA256     string   `json:"sha256"`
+		FrameSizes []uint32 `json:"frame_sizes"`
+	}
+	select {
+	case b := <-body:
+		if err := json.Unmarshal(b, &res); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the upload response")
+	}
+
+	sum := sha256.Sum256(upload)
+	if res.Bytes != len(upload) || res.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("Upload was not received completely: %d bytes, sha256 %s", res.Bytes, res.SHA256)
+	}
+	if len(res.FrameSizes) != len(upload)/16384 {
+		t.Fatalf("Expected %d DATA frames, got %d", len(upload)/16384, len(res.FrameSizes))
+	}
+}
+
+func TestHTTP1KeepAlivePipelining(t *testing.T) {
+	srv, clientConn, serverConn := setupTest()
+	defer clientConn.Close()
+
+	go func() {
+		tlsDetails := &types.TLSDetails{
+			JA3:       "771,4865,0,10,23",
+			PeetPrint: "hash|h2|hash|sig",
+		}
+		srv.serveHTTP1(serverConn, bufio.NewReader(serverConn), tlsDetails, newConnTimeline(), nil)
+	}()
+
+	// Both requests are written before any response is read
+	go clientConn.Write([]byte("POST /post HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n6;ext=1\r\n world\r\n0\r\n\r\n" +
+		"GET /api/clean HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Connection: close\r\n\r\n"))
+
+	br := bufio.NewReader(clientConn)
+	first, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(first.Body)
+	var post struct {
+		Data string `json:"data"`
+	}
+	if err := json.Unmarshal(body, &post); err != nil {
+		t.Fatal(err)
+	}
+	if post.Data != "hello world" {
+		t.Fatalf("Expected the chunked body to be echoed, got %q", post.Data)
+	}
+	if first.Close {
+		t.Fatal("Expected the connection to be kept alive")
+	}
+
+	second, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(second.Body)
+	if !strings.Contains(string(body), "ja4h") {
+		t.Fatalf("Expected a fingerprint for the pipelined request, got %s", body)
+	}
+	if !second.Close {
+		t.Fatal("Expected the connection to be closed after Connection: close")
+	}
+}
+
+func TestHTTP1TransferEncoding(t *testing.T) {
+	for _, te := range []string{"gzip", "chunked, gzip"} {
+		srv, clientConn, serverConn := setupTest()
+
+		go srv.serveHTTP1(serverConn, bufio.NewReader(serverConn), &types.TLSDetails{}, newConnTimeline(), nil)
+		go clientConn.Write([]byte("POST /post HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Transfer-Encoding: " + te + "\r\n\r\n" +
+			"5\r\nhello\r\n0\r\n\r\n"))
+
+		res, err := http.ReadResponse(bufio.NewReader(clientConn), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", te, err)
+		}
+		if res.StatusCode != 400 || !res.Close {
+			t.Fatalf("%s: expected 400 and a closed connection, got %d (close %v)", te, res.StatusCode, res.Close)
+		}
+		clientConn.Close()
+	}
+}
+
+func TestHTTP1StreamedResponseWithTrailers(t *testing.T) {
+	rr := RouteResponse{
+		ContentType: "text/plain",
+		Trailers:    http.Header{"X-Checksum": []string{"abc"}},
+		Stream: func(w BodyWriter) error {
+			for _, part := range []string{"hello ", "world"} {
+				if _, err := io.WriteString(w, part); err != nil {
+					return err
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeRouteResponse(newHTTP1Writer(&buf, true, false), rr, newResponseMeta("GET")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "hello world" {
+		t.Fatalf("Unexpected body %q", body)
+	}
+	if len(res.TransferEncoding) != 1 || res.TransferEncoding[0] != "chunked" {
+		t.Fatalf("Expected a chunked response, got %v", res.TransferEncoding)
+	}
+	if res.Trailer.Get("X-Checksum") != "abc" {
+		t.Fatalf("Expected the trailer, got %v", res.Trailer)
+	}
+}
+
+func TestHTTP1Drip(t *testing.T) {
+	params := url.Values{"numbytes": {"5"}, "delay": {"0"}, "duration": {"0.05"}}
+	var buf bytes.Buffer
+	rr := httpbinDrip(types.Response{}, params)
+	if err := writeRouteResponse(newHTTP1Writer(&buf, true, false), rr, newResponseMeta("GET")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "*****" {
+		t.Fatalf("Unexpected body %q", body)
+	}
+	if res.ContentLength != 5 || len(res.TransferEncoding) != 0 {
+		t.Fatalf("Expected a fixed length body, got %d %v", res.ContentLength, res.TransferEncoding)
+	}
+}
+
+func TestHTTP1WebSocket(t *testing.T) {
+	srv, _, _ := setupTest()
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	go srv.serveHTTP1(serverConn, bufio.NewReader(serverConn), &types.TLSDetails{JA3: "771,4865,0,10,23", PeetPrint: "hash|h2|hash|sig"}, newConnTimeline(), nil)
+
+	clientConn.Write([]byte("GET /ws HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n\r\n"))
+
+	br := bufio.NewReader(clientConn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected handshake response %d %v", res.StatusCode, res.Header)
+	}
+
+	readMessage := func(opcode byte) []byte {
+		t.Helper()
+		f, err := readWSFrame(br, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.opcode != opcode || f.masked {
+			t.Fatalf("Expected an unmasked opcode %d, got %+v", opcode, f)
+		}
+		return f.payload
+	}
+	writeMasked := func(opcode byte, payload []byte) {
+		key := [4]byte{1, 2, 3, 4}
+		frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+		frame = append(frame, key[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^key[i%4])
+		}
+		clientConn.Write(frame)
+	}
+
+	var first types.Response
+	if err := json.Unmarshal(readMessage(wsOpText), &first); err != nil {
+		t.Fatal(err)
+	}
+	ws := first.WebSocket
+	if ws == nil || ws.Transport != "http/1.1" || !ws.KeyValid || ws.PermessageDeflate == nil || ws.PermessageDeflate.ClientMaxWindowBits != 15 {
+		t.Fatalf("Unexpected handshake details %+v", ws)
+	}
+	if !strings.HasPrefix(ws.Fingerprint, "http/1.1|host,upgrade,connection,") {
+		t.Fatalf("Unexpected fingerprint %s", ws.Fingerprint)
+	}
+
+	writeMasked(wsOpPong, readMessage(wsOpPing))
+	writeMasked(wsOpText, []byte("hello"))
+	if echo := readMessage(wsOpText); string(echo) != "hello" {
+		t.Fatalf("Expected the message echoed, got %q", echo)
+	}
+	writeMasked(wsOpText, []byte(wsFingerprintCommand))
+	var second types.Response
+	if err := json.Unmarshal(readMessage(wsOpText), &second); err != nil {
+		t.Fatal(err)
+	}
+	frames := second.WebSocket.Frames
+	if frames == nil || frames.Received != 3 || !frames.PongReceived || !frames.PongPayloadMatch || frames.Unmasked != 0 {
+		t.Fatalf("Unexpected frames %+v", frames)
+	}
+
+	writeMasked(wsOpClose, []byte{0x03, 0xe8})
+	if code := readMessage(wsOpClose); len(code) < 2 || code[0] != 0x03 || code[1] != 0xe8 {
+		t.Fatalf("Expected close code 1000, got %v", code)
+	}
+}
+
+func TestHTTP2WebSocket(t *testing.T) {
+	srv, _, _ := setupTest()
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	go srv.handleHTTP2(serverConn, &types.TLSDetails{JA3: "771,4865,0,10,23", PeetPrint: "hash|h2|hash|sig"}, nil)
+
+	fr := http2.NewFramer(clientConn, clientConn)
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectEnabled := false
+	f.(*http2.SettingsFrame).ForeachSetting(func(s http2.Setting) error {
+		connectEnabled = connectEnabled || (s.ID == http2.SettingEnableConnectProtocol && s.Val == 1)
+		return nil
+	})
+	if !connectEnabled {
+		t.Fatal("Expected SETTINGS_ENABLE_CONNECT_PROTOCOL")
+	}
+	fr.WriteSettings()
+	fr.WriteSettingsAck()
+
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: "CONNECT"})
+	enc.WriteField(hpack.HeaderField{Name: ":protocol", Value: "websocket"})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/ws"})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+	enc.WriteField(hpack.HeaderField{Name: "sec-websocket-version", Value: "13"})
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: buf.Bytes(), EndHeaders: true})
+
+	// The stream stays open, the messages arrive as DATA frames
+	var data []byte
+	status := ""
+	dec := hpack.NewDecoder(4096, func(h hpack.HeaderField) {
+		if h.Name == ":status" {
+			status = h.Value
+		}
+	})
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(data) == 0 || data[0] != 0x80|wsOpText {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := f.(type) {
+		case *http2.HeadersFrame:
+			dec.Write(f.HeaderBlockFragment())
+			if f.StreamEnded() {
+				t.Fatalf("Expected the stream to stay open, got status %s", status)
+			}
+		case *http2.DataFrame:
+			data = append(data, f.Data()...)
+		}
+	}
+	if status != "200" {
+		t.Fatalf("Expected status 200, got %s", status)
+	}
+
+	for {
+		msg, err := readWSFrame(bytes.NewReader(data), 1<<20)
+		if err == nil {
+			var res types.Response
+			if err := json.Unmarshal(msg.payload, &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.WebSocket == nil || res.WebSocket.Transport != "h2" || !strings.HasPrefix(res.WebSocket.Fingerprint, "h2|:method,:protocol,") {
+				t.Fatalf("Unexpected handshake details %+v", res.WebSocket)
+			}
+			return
+		}
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, ok := f.(*http2.DataFrame); ok {
+			data = append(data, d.Data()...)
+		}
+	}
+}
+
+// protoResponse is a response read completely by one of the test clients
+type protoResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+type protoClient struct {
+	name string
+	do   func(req *http.Request) (protoResponse, error)
+}
+
+// tcpPair returns both ends of a loopback TCP connection. Unlike net.Pipe
+// they buffer, so client and server can both write first.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientConn, serverConn
+}
+
+// testCertificate returns a self-signed certificate for localhost
+func testCertificate(t *testing.T) ([]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der, key
+}
+
+func readProtoResponse(res *http.Response) (protoResponse, error) {
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	return protoResponse{status: res.StatusCode, header: res.Header, body: body}, err
+}
+
+// protocolClients returns clients that send a request to srv over HTTP/1.1,
+// HTTP/2 and HTTP/3. The HTTP/3 server listens on localhost until the test
+// ends.
+func protocolClients(t *testing.T, srv *Server) []protoClient {
+	tlsDetails := &types.TLSDetails{
+		JA3:       "771,4865,0,10,23",
+		JA3Hash:   "abc",
+		PeetPrint: "hash|h2|hash|sig",
+	}
+
+	h1 := func(req *http.Request) (protoResponse, error) {
+		clientConn, serverConn := tcpPair(t)
+		defer clientConn.Close()
+		go srv.serveHTTP1(serverConn, bufio.NewReader(serverConn), tlsDetails, newConnTimeline(), nil)
+		if err := req.Write(clientConn); err != nil {
+			return protoResponse{}, err
+		}
+		res, err := http.ReadResponse(bufio.NewReader(clientConn), req)
+		if err != nil {
+			return protoResponse{}, err
+		}
+		return readProtoResponse(res)
+	}
+
+	h2 := func(req *http.Request) (protoResponse, error) {
+		clientConn, serverConn := tcpPair(t)
+		defer clientConn.Close()
+		go func() {
+			// The preface is read by the connection handler before
+			// handleHTTP2 takes over
+			preface := make([]byte, len(HTTP2_PREAMBLE))
+			if _, err := io.ReadFull(serverConn, preface); err != nil {
+				return
+			}
+			srv.handleHTTP2(serverConn, tlsDetails, nil)
+		}()
+		cc, err := (&http2.Transport{DisableCompression: true}).NewClientConn(clientConn)
+		if err != nil {
+			return protoResponse{}, err
+		}
+		defer cc.Close()
+		res, err := cc.RoundTrip(req)
+		if err != nil {
+			return protoResponse{}, err
+		}
+		return readProtoResponse(res)
+	}
+
+	der, key := testCertificate(t)
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3Server := &http3.Server{
+		Handler: srv.HandleHTTP3(),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+			NextProtos:   []string{"h3"},
+		}),
+	}
+	go h3Server.Serve(udpConn)
+	transport := &http3.Transport{
+		TLSClientConfig:    &tls.Config{ServerName: "localhost", InsecureSkipVerify: true, NextProtos: []string{"h3"}},
+		DisableCompression: true,
+	}
+	t.Cleanup(func() {
+		transport.Close()
+		h3Server.Close()
+		udpConn.Close()
+	})
+
+	h3 := func(req *http.Request) (protoResponse, error) {
+		req.URL.Host = udpConn.LocalAddr().String()
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			return protoResponse{}, err
+		}
+		return readProtoResponse(res)
+	}
+
+	return []protoClient{{"h1", h1}, {"h2", h2}, {"h3", h3}}
+}
+
+// TestProtocolParity sends a request to every route over HTTP/1.1, HTTP/2
+// and HTTP/3 and expects the same status and headers from all of them
+func TestProtocolParity(t *testing.T) {
+	srv, _, _ := setupTest()
+	clients := protocolClients(t, srv)
+
+	uploadBody := bytes.Repeat([]byte("upload"), 10000)
+	uploadSum := sha256.Sum256(uploadBody)
+
+	cases := []struct {
+		method, path, body string
+		header             map[string]string
+		status             int
+		// wantHeader must match exactly, contains must be part of the body
+		wantHeader map[string]string
+		contains   string
+	}{
+		{method: "GET", path: "/", status: 200},
+		{method: "GET", path: "/explore", status: 200},
+		{method: "GET", path: "/docs", status: 200},
+		{method: "GET", path: "/openapi.json", status: 200, contains: `"openapi"`},
+		{method: "GET", path: "/api/all", status: 200, wantHeader: map[string]string{"Content-Type": "application/json"}},
+		{method: "POST", path: "/api/tls", status: 200},
+		{method: "GET", path: "/api/clean", status: 200, contains: `"ja4h"`},
+		{method: "GET", path: "/api/raw", status: 200},
+		{method: "GET", path: "/api/sni", status: 200},
+		{method: "GET", path: "/api/h2/active", status: 200},
+		{method: "GET", path: "/api/h2/profiles", status: 200},
+		{method: "GET", path: "/api/h2/push", status: 200},
+		{method: "GET", path: "/api/h2/push/resource", status: 200},
+		{method: "GET", path: "/api/h2/push/result", status: 200},
+		{method: "GET", path: "/api/timeline", status: 200},
+		{method: "GET", path: "/api/rtt", status: 200},
+		{method: "GET", path: "/api/request-count", status: 200},
+		{method: "GET", path: "/api/log-queue", status: 200},
+		{method: "GET", path: "/api/fingerprint/ja3/abc", status: 200},
+		{method: "GET", path: "/api/new", status: 200},
+		{method: "GET", path: "/api/request/abc", status: 200},
+		{method: "GET", path: "/api/export", status: 403},
+		{method: "DELETE", path: "/api/admin/ip/192.0.2.1", status: 403},
+		{method: "GET", path: "/api/compare?a=t13d1516h2_8daaf6152771_e5627efa2ab1&b=t13d1517h2_8daaf6152771_b0da82dd1658", status: 200},
+		{method: "GET", path: "/api/similar?ja3=771,4865,0,29,0", status: 200},
+		{method: "GET", path: "/api/search-ja3?by=abc", status: 200},
+		{method: "GET", path: "/api/search-ja4?by=abc", status: 200},
+		{method: "GET", path: "/api/search-ja4h?by=abc", status: 200},
+		{method: "GET", path: "/api/search-h2?by=abc", status: 200},
+		{method: "GET", path: "/api/search-peetprint?by=abc", status: 200},
+		{method: "GET", path: "/api/search-browser?family=Chrome", status: 200},
+		{method: "GET", path: "/api/search-useragent?by=abc", status: 200},
+		{method: "GET", path: "/get?probe=1", status: 200, contains: `"probe": "1"`},
+		{method: "HEAD", path: "/get", status: 200},
+		{method: "POST", path: "/post", body: "hello", header: map[string]string{"Content-Type": "text/plain"}, status: 200, contains: `"data": "hello"`},
+		{method: "PUT", path: "/put", body: "hello", status: 200},
+		{method: "PATCH", path: "/patch", body: "hello", status: 200},
+		{method: "DELETE", path: "/delete", status: 200},
+		{method: "GET", path: "/anything", status: 200},
+		{method: "POST", path: "/anything/a/b", body: "x", status: 200},
+		{method: "POST", path: "/upload", body: string(uploadBody), status: 200, contains: hex.EncodeToString(uploadSum[:])},
+		{method: "GET", path: "/headers", header: map[string]string{"X-Probe": "yes"}, status: 200, contains: `"X-Probe": "yes"`},
+		{method: "GET", path: "/ip", status: 200},
+		{method: "GET", path: "/user-agent", header: map[string]string{"User-Agent": "parity"}, status: 200, contains: "parity"},
+		{method: "GET", path: "/gzip", status: 200, wantHeader: map[string]string{"Content-Encoding": "gzip"}},
+		{method: "GET", path: "/deflate", status: 200, wantHeader: map[string]string{"Content-Encoding": "deflate"}},
+		{method: "GET", path: "/brotli", status: 200, wantHeader: map[string]string{"Content-Encoding": "br"}},
+		{method: "GET", path: "/cookies", header: map[string]string{"Cookie": "a=1"}, status: 200, contains: `"a": "1"`},
+		{method: "GET", path: "/cookies/set?a=1", status: 200, wantHeader: map[string]string{"Set-Cookie": "a=1; Path=/"}},
+		{method: "GET", path: "/cookies/delete?a", status: 200},
+		{method: "GET", path: "/image/jpeg", status: 200, wantHeader: map[string]string{"Content-Type": "image/jpeg"}},
+		{method: "GET", path: "/image/png", status: 200, wantHeader: map[string]string{"Content-Type": "image/png"}},
+		{method: "GET", path: "/image/svg", status: 200},
+		{method: "GET", path: "/image/gif", status: 200},
+		{method: "GET", path: "/image/webp", status: 200},
+		{method: "GET", path: "/html", status: 200},
+		{method: "GET", path: "/xml", status: 200},
+		{method: "GET", path: "/json", status: 200},
+		{method: "GET", path: "/robots.txt", status: 200},
+		{method: "GET", path: "/deny", status: 200},
+		{method: "GET", path: "/bytes/16", status: 200, wantHeader: map[string]string{"Content-Length": "16"}},
+		{method: "GET", path: "/base64/aGVsbG8=", status: 200, contains: "hello"},
+		{method: "GET", path: "/status/418", status: 418},
+		{method: "GET", path: "/delay/1", status: 200, contains: `"delay": 1`},
+		{method: "GET", path: "/sse", status: 200, contains: "event: done"},
+		{method: "GET", path: "/sse/2?interval=10", status: 200, contains: "event: done"},
+		{method: "GET", path: "/stream/2", status: 200, contains: `"id":1`},
+		{method: "GET", path: "/drip?delay=0&duration=0&numbytes=3", status: 200, contains: "***"},
+		{method: "GET", path: "/redirect/2", status: 302, wantHeader: map[string]string{"Location": "https://tlsfingerprint.com/redirect/1"}},
+		{method: "GET", path: "/redirect-to?url=/get&status_code=307", status: 307, wantHeader: map[string]string{"Location": "https://tlsfingerprint.com/get"}},
+		{method: "GET", path: "/ws", status: 426},
+		{method: "POST", path: "/get", status: 405, wantHeader: map[string]string{"Allow": "GET, HEAD, OPTIONS"}},
+		{method: "GET", path: "/missing", status: 404},
+		{method: "OPTIONS", path: "/get", status: 200, wantHeader: map[string]string{"Access-Control-Allow-Origin": "*"}},
+		{method: "GET", path: "/api/clean", header: map[string]string{"X-Cors": "1"}, status: 200, wantHeader: map[string]string{"Access-Control-Allow-Origin": "*"}},
+	}
+
+	table := srv.routeTable()
+	covered := map[string]bool{}
+	for _, c := range cases {
+		if route, _, _ := table.lookup(c.method, strings.SplitN(c.path, "?", 2)[0]); route != nil {
+			covered[route.Pattern] = true
+		}
+
+		var contentType string
+		for i, client := range clients {
+			var body io.Reader
+			if c.body != "" {
+				body = strings.NewReader(c.body)
+			}
+			req, err := http.NewRequest(c.method, "https://localhost"+c.path, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range c.header {
+				req.Header.Set(k, v)
+			}
+
+			res, err := client.do(req)
+			if err != nil {
+				t.Fatalf("%s %s %s: %v", client.name, c.method, c.path, err)
+			}
+			if res.status != c.status {
+				t.Errorf("%s %s %s: expected status %d, got %d", client.name, c.method, c.path, c.status, res.status)
+			}
+			for k, v := range c.wantHeader {
+				if got := res.header.Get(k); got != v {
+					t.Errorf("%s %s %s: expected %s %q, got %q", client.name, c.method, c.path, k, v, got)
+				}
+			}
+			if !strings.Contains(string(res.body), c.contains) {
+				t.Errorf("%s %s %s: expected the body to contain %q, got %.200q", client.name, c.method, c.path, c.contains, res.body)
+			}
+			if c.method == "HEAD" && len(res.body) > 0 {
+				t.Errorf("%s HEAD %s: expected no body", client.name, c.path)
+			}
+			if i == 0 {
+				contentType = res.header.Get("Content-Type")
+			} else if got := res.header.Get("Content-Type"); got != contentType {
+				t.Errorf("%s %s %s: expected Content-Type %q like h1, got %q", client.name, c.method, c.path, contentType, got)
+			}
+		}
+	}
+
+	for _, r := range table.routes {
+		if !covered[r.Pattern] {
+			t.Errorf("Route %s is not covered", r.Pattern)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"io"
 	"log"
 	"net"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,7 +28,6 @@ type HTTP2Connection struct {
 	lastStreamID uint32
 
 	// Connection lifecycle
-	maxStreams   uint32
 	idleTimeout  time.Duration
 	lastActivity time.Time
 	closing      bool
@@ -42,18 +40,51 @@ type HTTP2Connection struct {
 	// HPACK Decoder for the connection
 	hpackDecoder *hpack.Decoder
 
-	// Connection level frames for fingerprinting (SETTINGS, etc.)
+	// Connection level frames for fingerprinting (SETTINGS, etc.), appended
+	// by the read loop and copied by the request goroutines
 	connectionFrames []types.ParsedFrame
+	framesMu         sync.Mutex
+
+	// Reactions to the advertised server profile
+	probe *h2Probe
+	// Reactions to server push
+	push *h2Push
+
+	// When frames and milestones happened, relative to the accept
+	timeline *connTimeline
+
+	// PINGs sent to measure the application level RTT
+	rtt *rttMeter
+
+	// Connection flow control credit not yet returned, only used by the
+	// frame loop
+	connUnacked uint32
 }
 
 type HTTP2Stream struct {
 	streamID uint32
 	state    StreamState
 	// We store parsed frames for fingerprinting
-	frames     []types.ParsedFrame
-	response   chan []byte
-	bodyClosed bool
-	mu         sync.Mutex
+	frames []types.ParsedFrame
+	// headersSeen is set once the request headers arrived, a later HEADERS
+	// frame carries trailers
+	headersSeen bool
+
+	// Request body, filled by the frame loop until bodyDone is closed
+	body     bytes.Buffer
+	bodyDone chan struct{}
+	// dataReady is signalled when DATA arrives on a tunnel
+	dataReady chan struct{}
+	// tunnel is set for extended CONNECT streams, their DATA is read while
+	// it arrives instead of after the stream ended
+	tunnel      bool
+	bodyErr     error
+	bodyClosed  bool
+	remoteEnded bool
+	lastData    time.Time
+	// Stream flow control credit not yet returned
+	unacked uint32
+	mu      sync.Mutex
 }
 
 type StreamState int
@@ -65,7 +96,10 @@ const (
 	StreamClosed
 )
 
-func NewHTTP2Connection(conn net.Conn, framer *http2.Framer, tlsDetails *types.TLSDetails, srv *Server) *HTTP2Connection {
+func NewHTTP2Connection(conn net.Conn, framer *http2.Framer, tlsDetails *types.TLSDetails, timeline *connTimeline, srv *Server) *HTTP2Connection {
+	if timeline == nil {
+		timeline = newConnTimeline()
+	}
 	decoder := hpack.NewDecoder(4096, func(hf hpack.HeaderField) {})
 	decoder.SetEmitEnabled(true)
 
@@ -74,12 +108,15 @@ func NewHTTP2Connection(conn net.Conn, framer *http2.Framer, tlsDetails *types.T
 		framer:           framer,
 		tlsFingerprint:   tlsDetails,
 		streams:          make(map[uint32]*HTTP2Stream),
-		maxStreams:       100, // Match SETTINGS_MAX_CONCURRENT_STREAMS
 		idleTimeout:      30 * time.Second,
 		lastActivity:     time.Now(),
 		srv:              srv,
 		hpackDecoder:     decoder,
 		connectionFrames: []types.ParsedFrame{},
+		probe:            newH2Probe(),
+		push:             newH2Push(),
+		timeline:         timeline,
+		rtt:              newRTTMeter(),
 	}
 }
 
@@ -92,10 +129,12 @@ func (c *HTTP2Connection) GetOrCreateStream(streamID uint32) *HTTP2Stream {
 	}
 
 	stream := &HTTP2Stream{
-		streamID: streamID,
-		state:    StreamOpen,
-		response: make(chan []byte, 10), // Buffered channel for body chunks
-		frames:   []types.ParsedFrame{},
+		streamID:  streamID,
+		state:     StreamOpen,
+		frames:    []types.ParsedFrame{},
+		bodyDone:  make(chan struct{}),
+		dataReady: make(chan struct{}, 1),
+		lastData:  time.Now(),
 	}
 	c.streams[streamID] = stream
 
@@ -113,10 +152,7 @@ func (c *HTTP2Connection) CloseStream(streamID uint32) {
 	if stream, exists := c.streams[streamID]; exists {
 		stream.state = StreamClosed
 		stream.mu.Lock()
-		if !stream.bodyClosed {
-			close(stream.response)
-			stream.bodyClosed = true
-		}
+		stream.finishBody(errStreamReset)
 		stream.mu.Unlock()
 		delete(c.streams, streamID)
 	}
@@ -142,27 +178,47 @@ func (c *HTTP2Connection) processFrames() {
 		}
 
 		c.lastActivity = time.Now()
+		c.probe.onFrame(frame.Header())
 
 		// Convert to ParsedFrame for fingerprinting
 		parsedFrame := c.convertFrame(frame)
+		parsedFrame.OffsetMs = c.timeline.offset()
+		c.timeline.frame(parsedFrame)
 
 		// Store connection-level frames
 		if frame.Header().StreamID == 0 {
+			c.framesMu.Lock()
 			c.connectionFrames = append(c.connectionFrames, parsedFrame)
+			c.framesMu.Unlock()
 		}
 
 		switch f := frame.(type) {
 		case *http2.SettingsFrame:
 			if !f.IsAck() {
+				c.push.onSettings(f)
 				c.writeMu.Lock()
 				c.framer.WriteSettingsAck()
 				c.writeMu.Unlock()
+			} else {
+				c.probe.onSettingsAck()
 			}
 
 		case *http2.HeadersFrame:
 			// Add frame to stream
 			stream := c.GetOrCreateStream(f.StreamID)
-			stream.frames = append(stream.frames, parsedFrame)
+			stream.addFrame(parsedFrame)
+			if stream.headersSeen {
+				// Trailers end the request body
+				stream.mu.Lock()
+				stream.remoteEnded = stream.remoteEnded || f.StreamEnded()
+				if f.StreamEnded() {
+					stream.finishBody(nil)
+				}
+				stream.mu.Unlock()
+				continue
+			}
+			stream.headersSeen = true
+			c.afterHeaders(f)
 
 			// Decode headers synchronously using persistent decoder
 			headers, err := c.hpackDecoder.DecodeFull(f.HeaderBlockFragment())
@@ -171,25 +227,28 @@ func (c *HTTP2Connection) processFrames() {
 				c.sendRSTStream(f.StreamID, http2.ErrCodeProtocol)
 				continue
 			}
+			if isExtendedConnect(headers) {
+				stream.mu.Lock()
+				stream.tunnel = true
+				stream.mu.Unlock()
+			}
 
 			go c.handleRequest(f.StreamID, headers, f.StreamEnded(), stream)
 
 		case *http2.DataFrame:
-			stream := c.GetOrCreateStream(f.StreamID)
-			stream.frames = append(stream.frames, parsedFrame)
-			c.handleData(f)
+			c.probe.onData(f.StreamID, f.Length)
+			c.handleData(f, parsedFrame)
 
 		case *http2.WindowUpdateFrame:
+			c.probe.onWindowUpdate(f.StreamID, f.Increment)
 			if f.StreamID != 0 {
-				stream := c.GetOrCreateStream(f.StreamID)
-				stream.frames = append(stream.frames, parsedFrame)
+				c.GetOrCreateStream(f.StreamID).addFrame(parsedFrame)
 			}
 			// Handle flow control (can be expanded later)
 
 		case *http2.PriorityFrame:
 			if f.StreamID != 0 {
-				stream := c.GetOrCreateStream(f.StreamID)
-				stream.frames = append(stream.frames, parsedFrame)
+				c.GetOrCreateStream(f.StreamID).addFrame(parsedFrame)
 			}
 
 		case *http2.PingFrame:
@@ -197,6 +256,8 @@ func (c *HTTP2Connection) processFrames() {
 				c.writeMu.Lock()
 				c.framer.WritePing(true, f.Data)
 				c.writeMu.Unlock()
+			} else if !c.probe.onPingAck(f.Data) {
+				c.rtt.onPingAck(f.Data)
 			}
 
 		case *http2.GoAwayFrame:
@@ -204,6 +265,7 @@ func (c *HTTP2Connection) processFrames() {
 			return
 
 		case *http2.RSTStreamFrame:
+			c.push.onReset(f.StreamID, f.ErrCode)
 			c.CloseStream(f.StreamID)
 		}
 	}
@@ -211,7 +273,7 @@ func (c *HTTP2Connection) processFrames() {
 
 func (c *HTTP2Connection) handleRequest(streamID uint32, headers []hpack.HeaderField, endStream bool, stream *HTTP2Stream) {
 	// Parse request details
-	var path, method, userAgent string
+	var path, method, userAgent, authority string
 	var parsedHeaders []string
 	for _, h := range headers {
 		switch h.Name {
@@ -219,21 +281,66 @@ func (c *HTTP2Connection) handleRequest(streamID uint32, headers []hpack.HeaderF
 			method = h.Value
 		case ":path":
 			path = h.Value
+		case ":authority":
+			authority = h.Value
 		case "user-agent":
 			userAgent = h.Value
 		}
 		parsedHeaders = append(parsedHeaders, fmt.Sprintf("%s: %s", h.Name, h.Value))
 	}
 
-	// Wait for body if not EndStream
-	if !endStream {
-		_ = c.waitForStreamBody(streamID)
+	// Wait for the whole body if not EndStream, tunnels are read while
+	// they are open
+	var body []byte
+	if !endStream && !stream.tunnel {
+		var err error
+		if contentLength(headers) > c.srv.MaxBodySize() {
+			// Do not wait for a body that is rejected anyway
+			err = errBodyTooLarge
+			stream.mu.Lock()
+			stream.finishBody(err)
+			stream.mu.Unlock()
+		} else {
+			body, err = c.waitForStreamBody(stream)
+		}
+		switch err {
+		case nil:
+		case errBodyTooLarge:
+			c.rejectBody(stream, 413)
+			return
+		case errBodyTimeout:
+			c.rejectBody(stream, 408)
+			return
+		default:
+			// The client reset the stream
+			return
+		}
+	}
+
+	// Advertise a different profile mid-connection when asked to
+	if strings.HasPrefix(path, "/api/h2/active") {
+		c.runActiveProbe(path)
+	}
+
+	// Time PINGs against the TCP RTT when asked to
+	var rtt *types.RTTDetails
+	if strings.HasPrefix(path, rttPath) {
+		rtt = c.measureRTT()
+	}
+
+	// Push a resource (or record the refetch of one) when asked to
+	if strings.HasPrefix(path, pushProbePath) {
+		c.runPushProbe(streamID, path, authority)
 	}
 
 	// Combine connection frames and stream frames for fingerprinting
+	c.framesMu.Lock()
+	stream.mu.Lock()
 	allFrames := make([]types.ParsedFrame, len(c.connectionFrames)+len(stream.frames))
 	copy(allFrames, c.connectionFrames)
 	copy(allFrames[len(c.connectionFrames):], stream.frames)
+	stream.mu.Unlock()
+	c.framesMu.Unlock()
 
 	// Build response object
 	resp := types.Response{
@@ -246,12 +353,19 @@ func (c *HTTP2Connection) handleRequest(streamID uint32, headers []hpack.HeaderF
 			SendFrames:            allFrames,
 			AkamaiFingerprint:     trackmehttp.GetAkamaiFingerprint(allFrames),
 			AkamaiFingerprintHash: utils.GetMD5Hash(trackmehttp.GetAkamaiFingerprint(allFrames)),
+			Active:                c.probe.Details(),
+			Push:                  c.push.Details(),
 		},
-		TLS: c.tlsFingerprint,
+		TLS:  c.tlsFingerprint,
+		RTT:  rtt,
+		Body: body,
+	}
+	if wantsTimeline(path) {
+		resp.Timeline = c.timeline.Events()
 	}
 
 	// Calculate JA4H for HTTP/2
-	if resp.Http2 != nil && resp.TLS != nil {
+	if resp.Http2 != nil {
 		// Extract headers from HTTP/2 frames
 		h2Headers := []string{}
 		for _, frame := range allFrames {
@@ -259,198 +373,65 @@ func (c *HTTP2Connection) handleRequest(streamID uint32, headers []hpack.HeaderF
 				h2Headers = append(h2Headers, frame.Headers...)
 			}
 		}
-		resp.TLS.JA4H = trackmehttp.CalculateJA4H(resp.Method, resp.HTTPVersion, h2Headers)
-		resp.TLS.JA4H_r = trackmehttp.CalculateJA4H_r(resp.Method, resp.HTTPVersion, h2Headers)
+		ja4h := trackmehttp.CalculateJA4H(resp.Method, resp.HTTPVersion, h2Headers)
+		ja4hR := trackmehttp.CalculateJA4H_r(resp.Method, resp.HTTPVersion, h2Headers)
+		if resp.TLS != nil {
+			resp.TLS.JA4H = ja4h
+			resp.TLS.JA4H_r = ja4hR
+		} else {
+			resp.Http2.JA4H = ja4h
+			resp.Http2.JA4H_r = ja4hR
+		}
 	}
 
-	// Route and send response
-	c.sendResponse(streamID, resp, path, method)
-}
-
-func (c *HTTP2Connection) handleData(f *http2.DataFrame) {
-	c.streamsMu.RLock()
-	stream, exists := c.streams[f.StreamID]
-	c.streamsMu.RUnlock()
-
-	if !exists {
-		// Stream might be closed or not created yet (shouldn't happen for DATA usually without HEADERS)
+	// Cleartext connections only serve the API
+	if c.tlsFingerprint == nil && !servedWithoutTLS(path) {
+		c.sendRedirect(streamID)
 		return
 	}
 
-	if f.Data() != nil {
-		select {
-		case stream.response <- f.Data():
-		default:
-			// Buffer full or channel closed
-		}
+	if stream.tunnel {
+		c.upgradeWebSocket(streamID, stream, resp, parsedHeaders)
+		return
 	}
 
-	if f.StreamEnded() {
-		stream.mu.Lock()
-		if !stream.bodyClosed {
-			close(stream.response)
-			stream.bodyClosed = true
-		}
-		stream.mu.Unlock()
-	}
+	// Route and send response
+	c.sendResponse(streamID, resp, path, method)
 }
 
-func (c *HTTP2Connection) waitForStreamBody(streamID uint32) []byte {
+// handleData adds a DATA frame to the body of its stream and returns the
+// flow control credit. DATA for streams that are already closed is dropped.
+func (c *HTTP2Connection) handleData(f *http2.DataFrame, p types.ParsedFrame) {
 	c.streamsMu.RLock()
-	stream := c.streams[streamID]
+	stream, exists := c.streams[f.StreamID]
 	c.streamsMu.RUnlock()
 
-	if stream == nil {
-		return nil
-	}
-
-	// Wait for data frames with timeout
-	timeout := time.After(5 * time.Second)
-	var body []byte
-
-	for {
-		select {
-		case data, ok := <-stream.response:
-			if !ok {
-				return body
-			}
-			body = append(body, data...)
-		case <-timeout:
-			return body
-		}
+	if exists {
+		stream.onData(p, f.Data(), f.StreamEnded(), c.srv.MaxBodySize())
 	}
+	c.replenishWindow(stream, f.Length, exists && !f.StreamEnded())
 }
 
 func (c *HTTP2Connection) sendResponse(streamID uint32, resp types.Response, path, method string) {
-	// Track request timing
-	startTime := time.Now()
-	requestID := generateRequestID()
-
-	res, ctype := Router(path, resp, c.srv)
-
-	var isAdmin bool
-	key, isKeySet := c.srv.GetAdmin()
-	if isKeySet && method == "OPTIONS" {
-		isAdmin = true
-	} else if isKeySet {
-		// Headers in HTTP/2 are in resp.Http2.SendFrames, but easier to check if we parsed them
-		// For simplicity, we assume Router handled auth checks or we check parsed headers if needed
-		// But here we need to know if we should send CORS headers.
-		// Let's check parsed headers from the frame logic if available?
-		// Actually, Router already ran.
-		// Let's just check if we need to add admin headers.
-		// In legacy code:
-		/*
-		   if isKeySet {
-		       for _, a := range resp.Http1.Headers { ... }
-		   }
-		*/
-		// We don't have easy access to headers map here without reparsing.
-		// But `resp.Http2.SendFrames` has HEADERS frames.
-		for _, f := range resp.Http2.SendFrames {
-			if f.Type == "HEADERS" {
-				for _, h := range f.Headers {
-					if strings.HasPrefix(h, key) {
-						isAdmin = true
-					}
-				}
-			}
-		}
-	}
-
-	// Handle redirects
-	statusCode := extractStatusCode(path)
-	var extraHeaders []hpack.HeaderField
-
-	// Handle redirect responses: "redirect:STATUS:LOCATION"
-	if strings.HasPrefix(ctype, "redirect:") {
-		parts := strings.SplitN(ctype, ":", 3)
-		if len(parts) >= 3 {
-			if code, err := strconv.Atoi(parts[1]); err == nil {
-				statusCode = code
-			}
-			location := parts[2]
-			extraHeaders = append(extraHeaders, hpack.HeaderField{Name: "location", Value: location})
-			ctype = "text/html; charset=utf-8"
-			res = []byte{}
-		}
+	meta := newResponseMeta(method)
+	resp.RequestID = meta.requestID
+
+	rr := respond(nil, "text/plain")
+	if method != "OPTIONS" {
+		rr = Router(path, resp, c.srv)
+	} else {
+		meta.cors = true
 	}
 
-	// Handle Set-Cookie responses
-	if strings.HasPrefix(ctype, "set-cookies:") {
-		parts := strings.SplitN(ctype, ":", 3)
-		if len(parts) >= 3 {
-			cookies := strings.Split(parts[1], "|")
-			for _, cookie := range cookies {
-				extraHeaders = append(extraHeaders, hpack.HeaderField{Name: "set-cookie", Value: cookie})
+	if key, isKeySet := c.srv.GetAdmin(); isKeySet {
+		for _, f := range resp.Http2.SendFrames {
+			if f.Type == "HEADERS" && hasHeader(f.Headers, key) {
+				meta.cors = true
 			}
-			ctype = parts[2]
 		}
 	}
 
-	if res == nil {
-		res = []byte{}
-	}
-
-	responseTime := time.Since(startTime).Milliseconds()
-
-	// Build HEADERS frame
-	hbuf := bytes.NewBuffer([]byte{})
-	encoder := hpack.NewEncoder(hbuf)
-	encoder.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(statusCode)})
-	encoder.WriteField(hpack.HeaderField{Name: "server", Value: "TrackMe.peet.ws"})
-	encoder.WriteField(hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(res))})
-	encoder.WriteField(hpack.HeaderField{Name: "content-type", Value: ctype})
-
-	// Add request tracking headers
-	encoder.WriteField(hpack.HeaderField{Name: "x-request-id", Value: requestID})
-	encoder.WriteField(hpack.HeaderField{Name: "x-response-time", Value: strconv.FormatInt(responseTime, 10)})
-
-	for _, h := range extraHeaders {
-		encoder.WriteField(h)
-	}
-
-	// Add Content-Encoding header
-	if strings.HasPrefix(path, "/gzip") {
-		encoder.WriteField(hpack.HeaderField{Name: "content-encoding", Value: "gzip"})
-	} else if strings.HasPrefix(path, "/deflate") {
-		encoder.WriteField(hpack.HeaderField{Name: "content-encoding", Value: "deflate"})
-	} else if strings.HasPrefix(path, "/brotli") {
-		encoder.WriteField(hpack.HeaderField{Name: "content-encoding", Value: "br"})
-	}
-
-	encoder.WriteField(hpack.HeaderField{Name: "alt-svc", Value: "h3=\":443\"; ma=86400"})
-
-	if isAdmin {
-		encoder.WriteField(hpack.HeaderField{Name: "access-control-allow-origin", Value: "*"})
-		encoder.WriteField(hpack.HeaderField{Name: "access-control-allow-methods", Value: "*"})
-		encoder.WriteField(hpack.HeaderField{Name: "access-control-allow-headers", Value: "*"})
-	}
-
-	// Write HEADERS
-	c.writeMu.Lock()
-	err := c.framer.WriteHeaders(http2.HeadersFrameParam{
-		StreamID:      streamID,
-		BlockFragment: hbuf.Bytes(),
-		EndHeaders:    true,
-		EndStream:     len(res) == 0, // EndStream if no body
-	})
-	c.writeMu.Unlock()
-	if err != nil {
-		log.Println("Error writing headers:", err)
-		return
-	}
-
-	// Write DATA frames if body exists
-	if len(res) > 0 {
-		chunks := utils.SplitBytesIntoChunks(res, 16384) // 16KB chunks
-		for i, chunk := range chunks {
-			endStream := i == len(chunks)-1
-			c.writeMu.Lock()
-			c.framer.WriteData(streamID, endStream, chunk)
-			c.writeMu.Unlock()
-		}
-	}
+	logWriteError("HTTP/2", writeRouteResponse(&h2Writer{c: c, streamID: streamID}, rr, meta))
 
 	// Close this stream in our map
 	c.CloseStream(streamID)
@@ -560,8 +541,6 @@ func (c *HTTP2Connection) convertFrame(frame http2.Frame) types.ParsedFrame {
 				p.Priority.Exclusive = 1
 			}
 		}
-	case *http2.DataFrame:
-		p.Payload = frame.Data()
 	case *http2.WindowUpdateFrame:
 		p.Increment = frame.Increment
 	case *http2.PriorityFrame:
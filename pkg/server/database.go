@@ -1,26 +1,29 @@
 package server
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/pagpeter/trackme/pkg/store"
 	"github.com/pagpeter/trackme/pkg/types"
 	"github.com/pagpeter/trackme/pkg/utils"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
-type RequestLog struct {
-	UserAgent string `bson:"user_agent"`
-	JA3       string `bson:"ja3"`
-	JA4       string `bson:"ja4"`
-	JA4H      string `bson:"ja4h"`
-	H2        string `bson:"h2"`
-	PeetPrint string `bson:"peetprint"`
-	IP        string `bson:"ip"`
-	Time      int64
+// SearchMeta describes the logs a search matched. Distinct has the number
+// of different values of every returned field, the counts are paged with
+// limit and offset or cursor.
+type SearchMeta struct {
+	Total      int64            `json:"total"`
+	FirstSeen  int64            `json:"first_seen"`
+	LastSeen   int64            `json:"last_seen"`
+	Distinct   map[string]int64 `json:"distinct"`
+	NextCursor string           `json:"next_cursor,omitempty"`
 }
 
 type ByJA3 struct {
@@ -28,6 +31,7 @@ type ByJA3 struct {
 	H2         map[string]int `json:"h2_fps"`
 	PeetPrint  map[string]int `json:"peet_prints"`
 	UserAgents map[string]int `json:"user_agents"`
+	SearchMeta
 }
 
 type ByPeetPrint struct {
@@ -35,6 +39,7 @@ type ByPeetPrint struct {
 	JA3        map[string]int `json:"ja3s"`
 	H2         map[string]int `json:"h2_fps"`
 	UserAgents map[string]int `json:"user_agents"`
+	SearchMeta
 }
 
 type ByH2 struct {
@@ -42,6 +47,7 @@ type ByH2 struct {
 	JA3        map[string]int `json:"ja3s"`
 	PeetPrint  map[string]int `json:"peet_prints"`
 	UserAgents map[string]int `json:"user_agents"`
+	SearchMeta
 }
 
 type ByUserAgent struct {
@@ -51,6 +57,21 @@ type ByUserAgent struct {
 	JA4       map[string]int `json:"ja4s"`
 	JA4H      map[string]int `json:"ja4hs"`
 	PeetPrint map[string]int `json:"peet_prints"`
+	SearchMeta
+}
+
+// ByBrowser is the distribution of the fingerprints of a browser group,
+// selected by the user agents parsed when the requests were logged
+type ByBrowser struct {
+	Family    string         `json:"family,omitempty"`
+	Major     string         `json:"major,omitempty"`
+	OS        string         `json:"os,omitempty"`
+	Device    string         `json:"device,omitempty"`
+	Majors    map[string]int `json:"majors"`
+	JA4       map[string]int `json:"ja4s"`
+	H2        map[string]int `json:"h2_fps"`
+	PeetPrint map[string]int `json:"peet_prints"`
+	SearchMeta
 }
 
 type ByJA4 struct {
@@ -60,6 +81,7 @@ type ByJA4 struct {
 	H2         map[string]int `json:"h2_fps"`
 	PeetPrint  map[string]int `json:"peet_prints"`
 	UserAgents map[string]int `json:"user_agents"`
+	SearchMeta
 }
 
 type ByJA4H struct {
@@ -69,16 +91,19 @@ type ByJA4H struct {
 	H2         map[string]int `json:"h2_fps"`
 	PeetPrint  map[string]int `json:"peet_prints"`
 	UserAgents map[string]int `json:"user_agents"`
+	SearchMeta
 }
 
 func SaveRequest(req types.Response, srv *Server) {
 	if srv.IsConnectedToDB() && srv.State.Config.LogToDB {
-		reqLog := RequestLog{
-			JA3:       req.TLS.JA3,
-			JA4:       req.TLS.JA4,
-			JA4H:      req.TLS.JA4H,
-			PeetPrint: req.TLS.PeetPrint,
-			Time:      time.Now().Unix(),
+		reqLog := store.RequestLog{
+			Time: time.Now().Unix(),
+		}
+		if req.TLS != nil {
+			reqLog.JA3 = req.TLS.JA3
+			reqLog.JA4 = req.TLS.JA4
+			reqLog.JA4H = req.TLS.JA4H
+			reqLog.PeetPrint = req.TLS.PeetPrint
 		}
 
 		if req.HTTPVersion == "h2" {
@@ -86,25 +111,114 @@ func SaveRequest(req types.Response, srv *Server) {
 		} else if req.HTTPVersion == "http/1.1" {
 			reqLog.H2 = "-"
 		}
-		if srv.GetConfig().LogIPs {
-			parts := strings.Split(req.IP, ":")
-			ip := strings.Join(parts[0:len(parts)-1], ":")
-			reqLog.IP = ip
-		}
+		reqLog.IP = storedIP(req.IP, srv.GetConfig())
 		reqLog.UserAgent = GetUserAgent(req)
+		ua := utils.ParseUserAgent(reqLog.UserAgent)
+		reqLog.Browser, reqLog.BrowserMajor, reqLog.OS, reqLog.Device = ua.Family, ua.Major, ua.OS, ua.Device
 
-		_, err := srv.GetMongoCollection().InsertOne(srv.GetMongoContext(), reqLog)
-		if err != nil {
-			log.Println(err)
+		srv.requestLogger().enqueue(reqLog, newSnapshot(req, reqLog.Time, reqLog.IP, srv))
+	}
+}
+
+const (
+	defaultSnapshotSize = 256 * 1024
+	defaultSnapshotTTL  = 7 * 24
+)
+
+// RequestSnapshot is everything that was parsed from a request, as served
+// by /api/request/{id}
+type RequestSnapshot struct {
+	RequestID string `json:"request_id"`
+	Time      int64  `json:"time"`
+	ExpiresAt int64  `json:"expires_at"`
+	Permalink string `json:"permalink"`
+	// ClientHello is the raw ClientHello record, base64 encoded
+	ClientHello string         `json:"client_hello_b64,omitempty"`
+	Response    types.Response `json:"response"`
+}
+
+// newSnapshot returns the snapshot of a request, or nil if snapshots are
+// off or it is larger than snapshot_max_size. ip is the client IP the way
+// it is stored.
+func newSnapshot(req types.Response, now int64, ip string, srv *Server) *store.Snapshot {
+	c := srv.GetConfig()
+	if !c.Snapshots || req.RequestID == "" {
+		return nil
+	}
+	maxSize, ttl := c.SnapshotSize, c.SnapshotTTL
+	if maxSize <= 0 {
+		maxSize = defaultSnapshotSize
+	}
+	if ttl <= 0 {
+		ttl = defaultSnapshotTTL
+	}
+
+	req.IP = ip
+	if ipMode(c) != ipModeFull {
+		req.TCPIP.IP.SrcIP = ""
+	}
+	snap := RequestSnapshot{
+		RequestID: req.RequestID,
+		Time:      now,
+		ExpiresAt: now + ttl*3600,
+		Permalink: permalink(req, c),
+		Response:  req,
+	}
+	if req.TLS != nil {
+		snap.ClientHello = req.TLS.RawB64
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		log.Println("Error encoding snapshot:", err)
+		return nil
+	}
+	if len(data) > maxSize {
+		srv.requestLogger().oversized.Add(1)
+		return nil
+	}
+	return &store.Snapshot{ID: snap.RequestID, Time: snap.Time, Expires: snap.ExpiresAt, IP: ip, Data: data}
+}
+
+// permalink returns the address of the snapshot of a request. It is below
+// public_url if that is set, else below the host the request was sent to.
+func permalink(req types.Response, c *types.Config) string {
+	base := strings.TrimSuffix(c.PublicURL, "/")
+	if base == "" {
+		if host := requestHost(req); host != "" {
+			base = "https://" + host
 		}
 	}
+	return base + "/api/request/" + req.RequestID
+}
+
+// requestHost returns the :authority or Host of a request. HTTP/3 requests
+// only keep the SNI.
+func requestHost(req types.Response) string {
+	host := headerValue(extractHeaders(req), "Host")
+	if req.Http2 != nil {
+		for _, frame := range req.Http2.SendFrames {
+			for _, h := range frame.Headers {
+				if v, ok := strings.CutPrefix(h, ":authority: "); ok {
+					host = v
+				}
+			}
+		}
+	}
+	if host == "" && req.Http3 != nil {
+		host = req.Http3.SNI
+	}
+	// The header is sent by the client, only use it if it is a host
+	if strings.ContainsAny(host, "/?#@\\ ") {
+		return ""
+	}
+	return host
 }
 
 func GetTotalRequestCount(srv *Server) int64 {
 	if !srv.IsConnectedToDB() {
 		return 999
 	}
-	itemCount, err := srv.GetMongoCollection().CountDocuments(srv.GetMongoContext(), bson.M{})
+	itemCount, err := srv.GetStore().Count()
 	if err != nil {
 		log.Println(err)
 		return -1
@@ -112,290 +226,221 @@ func GetTotalRequestCount(srv *Server) int64 {
 	return itemCount
 }
 
-func queryDB(query, val string, srv *Server) []RequestLog {
-	dbRes := []RequestLog{}
-	cur, err := srv.GetMongoCollection().Find(srv.GetMongoContext(), bson.D{{Key: query, Value: val}})
-	if err != nil {
-		log.Println("Error quering data:", err)
-		return dbRes
-	}
+const (
+	defaultSearchLimit = 10
+	maxSearchLimit     = 1000
+)
+
+// searchParams page the search results and restrict them to a time range
+type searchParams struct {
+	page  store.Page
+	since int64
+	until int64
+}
 
-	for cur.Next(srv.GetMongoContext()) {
-		var b RequestLog
-		err := cur.Decode(&b)
+// parseSearchParams reads limit, offset, cursor, since and until. Times are
+// unix seconds or RFC 3339.
+func parseSearchParams(params url.Values) (searchParams, error) {
+	p := searchParams{page: store.Page{Limit: defaultSearchLimit}}
+	if v := utils.GetParam("limit", params); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			return p, fmt.Errorf("limit must be between 1 and %d", maxSearchLimit)
+		}
+		p.page.Limit = n
+	}
+	if v := utils.GetParam("offset", params); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("offset must be a positive number")
+		}
+		p.page.Offset = n
+	}
+	if v := utils.GetParam("cursor", params); v != "" {
+		n, err := decodeCursor(v)
 		if err != nil {
-			log.Println("Error decoding:", err)
-			return dbRes
+			return p, fmt.Errorf("invalid cursor")
 		}
-		dbRes = append(dbRes, b)
+		p.page.Offset = n
 	}
 
-	if err := cur.Err(); err != nil {
-		log.Println("Error - cur.Err()", err)
-		return dbRes
+	var err error
+	if p.since, err = parseTime(utils.GetParam("since", params)); err != nil {
+		return p, fmt.Errorf("since: %w", err)
 	}
-
-	if cur.Close(srv.GetMongoContext()) != nil {
-		log.Println("Could not close")
+	if p.until, err = parseTime(utils.GetParam("until", params)); err != nil {
+		return p, fmt.Errorf("until: %w", err)
 	}
-	return dbRes
+	return p, nil
 }
 
-const COUNT = 10
-
-func GetByJa3(val string, srv *Server) ByJA3 {
-	res := ByJA3{
-		JA3:        val,
-		H2:         map[string]int{},
-		PeetPrint:  map[string]int{},
-		UserAgents: map[string]int{},
+func parseTime(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
 	}
-
-	dbRes := queryDB("ja3", val, srv)
-
-	for _, r := range dbRes {
-		if v, ok := res.H2[r.H2]; ok {
-			res.H2[r.H2] = v + 1
-		} else {
-			res.H2[r.H2] = 1
-		}
-
-		if v, ok := res.PeetPrint[r.PeetPrint]; ok {
-			res.PeetPrint[r.PeetPrint] = v + 1
-		} else {
-			res.PeetPrint[r.PeetPrint] = 1
-		}
-
-		if v, ok := res.UserAgents[r.UserAgent]; ok {
-			res.UserAgents[r.UserAgent] = v + 1
-		} else {
-			res.UserAgents[r.UserAgent] = 1
-		}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return n, nil
 	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, fmt.Errorf("expected unix seconds or RFC 3339")
+	}
+	return t.Unix(), nil
+}
 
-	res.PeetPrint = utils.SortByVal(res.PeetPrint, COUNT)
-	res.H2 = utils.SortByVal(res.H2, COUNT)
-	res.UserAgents = utils.SortByVal(res.UserAgents, COUNT)
-
-	return res
+// The cursor is opaque to clients, it carries the offset of the next page
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("o" + strconv.Itoa(offset)))
 }
 
-func GetByH2(val string, srv *Server) ByH2 {
-	res := ByH2{
-		H2:         val,
-		JA3:        map[string]int{},
-		PeetPrint:  map[string]int{},
-		UserAgents: map[string]int{},
+func decodeCursor(cursor string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) < 2 || b[0] != 'o' {
+		return 0, fmt.Errorf("invalid cursor")
 	}
+	n, err := strconv.Atoi(string(b[1:]))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return n, nil
+}
 
-	dbRes := queryDB("h2", val, srv)
-
-	for _, r := range dbRes {
-		if v, ok := res.JA3[r.JA3]; ok {
-			res.JA3[r.JA3] = v + 1
-		} else {
-			res.JA3[r.JA3] = 1
-		}
+// searchStore aggregates the logs where field equals val by the groups
+func searchStore(field, val string, p searchParams, srv *Server, groups ...string) (store.Aggregation, SearchMeta) {
+	return searchQuery(store.Query{Field: field, Value: val}, p, srv, groups...)
+}
 
-		if v, ok := res.PeetPrint[r.PeetPrint]; ok {
-			res.PeetPrint[r.PeetPrint] = v + 1
-		} else {
-			res.PeetPrint[r.PeetPrint] = 1
-		}
+// searchQuery aggregates the logs selected by q, within the time range of
+// the params, by the groups
+func searchQuery(q store.Query, p searchParams, srv *Server, groups ...string) (store.Aggregation, SearchMeta) {
+	q.Since, q.Until = p.since, p.until
+	a, err := srv.GetStore().Aggregate(q, groups, p.page)
+	if err != nil {
+		log.Println("Error quering data:", err)
+	}
 
-		if v, ok := res.UserAgents[r.UserAgent]; ok {
-			res.UserAgents[r.UserAgent] = v + 1
-		} else {
-			res.UserAgents[r.UserAgent] = 1
-		}
+	meta := SearchMeta{
+		Total:     a.Total,
+		FirstSeen: a.FirstSeen,
+		LastSeen:  a.LastSeen,
+		Distinct:  map[string]int64{},
+	}
+	for _, g := range groups {
+		meta.Distinct[g] = a.Groups[g].Distinct
+	}
+	if a.HasMore(p.page) {
+		meta.NextCursor = encodeCursor(p.page.Offset + p.page.Limit)
 	}
+	return a, meta
+}
 
-	res.PeetPrint = utils.SortByVal(res.PeetPrint, COUNT)
-	res.JA3 = utils.SortByVal(res.JA3, COUNT)
-	res.UserAgents = utils.SortByVal(res.UserAgents, COUNT)
+// counts returns the page of a group as value to count
+func counts(a store.Aggregation, group string) map[string]int {
+	res := map[string]int{}
+	for _, v := range a.Groups[group].Values {
+		res[v.Value] = int(v.Count)
+	}
 	return res
 }
 
-func GetByPeetPrint(val string, srv *Server) ByPeetPrint {
-	res := ByPeetPrint{
-		PeetPrint:  val,
-		H2:         map[string]int{},
-		JA3:        map[string]int{},
-		UserAgents: map[string]int{},
+func GetByJa3(val string, p searchParams, srv *Server) ByJA3 {
+	a, meta := searchStore("ja3", val, p, srv, "h2", "peetprint", "user_agent")
+	return ByJA3{
+		JA3:        val,
+		H2:         counts(a, "h2"),
+		PeetPrint:  counts(a, "peetprint"),
+		UserAgents: counts(a, "user_agent"),
+		SearchMeta: meta,
 	}
+}
 
-	dbRes := queryDB("peetprint", val, srv)
-
-	for _, r := range dbRes {
-		if v, ok := res.H2[r.H2]; ok {
-			res.H2[r.H2] = v + 1
-		} else {
-			res.H2[r.H2] = 1
-		}
-
-		if v, ok := res.JA3[r.JA3]; ok {
-			res.JA3[r.JA3] = v + 1
-		} else {
-			res.JA3[r.JA3] = 1
-		}
-
-		if v, ok := res.UserAgents[r.UserAgent]; ok {
-			res.UserAgents[r.UserAgent] = v + 1
-		} else {
-			res.UserAgents[r.UserAgent] = 1
-		}
+func GetByH2(val string, p searchParams, srv *Server) ByH2 {
+	a, meta := searchStore("h2", val, p, srv, "ja3", "peetprint", "user_agent")
+	return ByH2{
+		H2:         val,
+		JA3:        counts(a, "ja3"),
+		PeetPrint:  counts(a, "peetprint"),
+		UserAgents: counts(a, "user_agent"),
+		SearchMeta: meta,
 	}
-	res.JA3 = utils.SortByVal(res.JA3, COUNT)
-	res.H2 = utils.SortByVal(res.H2, COUNT)
-	res.UserAgents = utils.SortByVal(res.UserAgents, COUNT)
-
-	return res
 }
 
-func GetByUserAgent(val string, srv *Server) ByUserAgent {
-	res := ByUserAgent{
-		UserAgent: val,
-		H2:        map[string]int{},
-		JA3:       map[string]int{},
-		PeetPrint: map[string]int{},
+func GetByPeetPrint(val string, p searchParams, srv *Server) ByPeetPrint {
+	a, meta := searchStore("peetprint", val, p, srv, "ja3", "h2", "user_agent")
+	return ByPeetPrint{
+		PeetPrint:  val,
+		JA3:        counts(a, "ja3"),
+		H2:         counts(a, "h2"),
+		UserAgents: counts(a, "user_agent"),
+		SearchMeta: meta,
 	}
+}
 
+func GetByUserAgent(val string, p searchParams, srv *Server) ByUserAgent {
 	decodedValue, err := url.QueryUnescape(val)
 	if err != nil {
-		return res
+		return ByUserAgent{UserAgent: val}
 	}
-	fmt.Println(val)
-
-	dbRes := queryDB("user_agent", decodedValue, srv)
 
-	for _, r := range dbRes {
-		if v, ok := res.H2[r.H2]; ok {
-			res.H2[r.H2] = v + 1
-		} else {
-			res.H2[r.H2] = 1
-		}
+	a, meta := searchStore("user_agent", decodedValue, p, srv, "h2", "ja3", "ja4", "ja4h", "peetprint")
+	return ByUserAgent{
+		UserAgent:  val,
+		H2:         counts(a, "h2"),
+		JA3:        counts(a, "ja3"),
+		JA4:        counts(a, "ja4"),
+		JA4H:       counts(a, "ja4h"),
+		PeetPrint:  counts(a, "peetprint"),
+		SearchMeta: meta,
+	}
+}
 
-		if v, ok := res.JA3[r.JA3]; ok {
-			res.JA3[r.JA3] = v + 1
-		} else {
-			res.JA3[r.JA3] = 1
+// GetByBrowser searches by the parsed user agent. Empty attributes match
+// any value, family, os or device must be set.
+func GetByBrowser(b ByBrowser, p searchParams, srv *Server) ByBrowser {
+	q := store.Query{Where: map[string]string{}}
+	for _, attr := range [][2]string{{"browser", b.Family}, {"browser_major", b.Major}, {"os", b.OS}, {"device", b.Device}} {
+		if attr[1] == "" {
+			continue
 		}
-
-		if v, ok := res.PeetPrint[r.PeetPrint]; ok {
-			res.PeetPrint[r.PeetPrint] = v + 1
+		// The first attribute selects the logs by its index
+		if q.Field == "" {
+			q.Field, q.Value = attr[0], attr[1]
 		} else {
-			res.PeetPrint[r.PeetPrint] = 1
+			q.Where[attr[0]] = attr[1]
 		}
 	}
-	res.JA3 = utils.SortByVal(res.JA3, COUNT)
-	res.H2 = utils.SortByVal(res.H2, COUNT)
-	res.PeetPrint = utils.SortByVal(res.PeetPrint, COUNT)
 
-	return res
+	a, meta := searchQuery(q, p, srv, "browser_major", "ja4", "h2", "peetprint")
+	b.Majors = counts(a, "browser_major")
+	b.JA4 = counts(a, "ja4")
+	b.H2 = counts(a, "h2")
+	b.PeetPrint = counts(a, "peetprint")
+	b.SearchMeta = meta
+	return b
 }
 
-func GetByJA4(val string, srv *Server) ByJA4 {
-	res := ByJA4{
+func GetByJA4(val string, p searchParams, srv *Server) ByJA4 {
+	a, meta := searchStore("ja4", val, p, srv, "ja3", "ja4h", "h2", "peetprint", "user_agent")
+	return ByJA4{
 		JA4:        val,
-		JA3:        map[string]int{},
-		JA4H:       map[string]int{},
-		H2:         map[string]int{},
-		PeetPrint:  map[string]int{},
-		UserAgents: map[string]int{},
-	}
-
-	dbRes := queryDB("ja4", val, srv)
-
-	for _, r := range dbRes {
-		if v, ok := res.JA3[r.JA3]; ok {
-			res.JA3[r.JA3] = v + 1
-		} else {
-			res.JA3[r.JA3] = 1
-		}
-
-		if v, ok := res.JA4H[r.JA4H]; ok {
-			res.JA4H[r.JA4H] = v + 1
-		} else {
-			res.JA4H[r.JA4H] = 1
-		}
-
-		if v, ok := res.H2[r.H2]; ok {
-			res.H2[r.H2] = v + 1
-		} else {
-			res.H2[r.H2] = 1
-		}
-
-		if v, ok := res.PeetPrint[r.PeetPrint]; ok {
-			res.PeetPrint[r.PeetPrint] = v + 1
-		} else {
-			res.PeetPrint[r.PeetPrint] = 1
-		}
-
-		if v, ok := res.UserAgents[r.UserAgent]; ok {
-			res.UserAgents[r.UserAgent] = v + 1
-		} else {
-			res.UserAgents[r.UserAgent] = 1
-		}
+		JA3:        counts(a, "ja3"),
+		JA4H:       counts(a, "ja4h"),
+		H2:         counts(a, "h2"),
+		PeetPrint:  counts(a, "peetprint"),
+		UserAgents: counts(a, "user_agent"),
+		SearchMeta: meta,
 	}
-
-	res.JA3 = utils.SortByVal(res.JA3, COUNT)
-	res.JA4H = utils.SortByVal(res.JA4H, COUNT)
-	res.H2 = utils.SortByVal(res.H2, COUNT)
-	res.PeetPrint = utils.SortByVal(res.PeetPrint, COUNT)
-	res.UserAgents = utils.SortByVal(res.UserAgents, COUNT)
-
-	return res
 }
 
-func GetByJA4H(val string, srv *Server) ByJA4H {
-	res := ByJA4H{
+func GetByJA4H(val string, p searchParams, srv *Server) ByJA4H {
+	a, meta := searchStore("ja4h", val, p, srv, "ja3", "ja4", "h2", "peetprint", "user_agent")
+	return ByJA4H{
 		JA4H:       val,
-		JA3:        map[string]int{},
-		JA4:        map[string]int{},
-		H2:         map[string]int{},
-		PeetPrint:  map[string]int{},
-		UserAgents: map[string]int{},
-	}
-
-	dbRes := queryDB("ja4h", val, srv)
-
-	for _, r := range dbRes {
-		if v, ok := res.JA3[r.JA3]; ok {
-			res.JA3[r.JA3] = v + 1
-		} else {
-			res.JA3[r.JA3] = 1
-		}
-
-		if v, ok := res.JA4[r.JA4]; ok {
-			res.JA4[r.JA4] = v + 1
-		} else {
-			res.JA4[r.JA4] = 1
-		}
-
-		if v, ok := res.H2[r.H2]; ok {
-			res.H2[r.H2] = v + 1
-		} else {
-			res.H2[r.H2] = 1
-		}
-
-		if v, ok := res.PeetPrint[r.PeetPrint]; ok {
-			res.PeetPrint[r.PeetPrint] = v + 1
-		} else {
-			res.PeetPrint[r.PeetPrint] = 1
-		}
-
-		if v, ok := res.UserAgents[r.UserAgent]; ok {
-			res.UserAgents[r.UserAgent] = v + 1
-		} else {
-			res.UserAgents[r.UserAgent] = 1
-		}
+		JA3:        counts(a, "ja3"),
+		JA4:        counts(a, "ja4"),
+		H2:         counts(a, "h2"),
+		PeetPrint:  counts(a, "peetprint"),
+		UserAgents: counts(a, "user_agent"),
+		SearchMeta: meta,
 	}
-
-	res.JA3 = utils.SortByVal(res.JA3, COUNT)
-	res.JA4 = utils.SortByVal(res.JA4, COUNT)
-	res.H2 = utils.SortByVal(res.H2, COUNT)
-	res.PeetPrint = utils.SortByVal(res.PeetPrint, COUNT)
-	res.UserAgents = utils.SortByVal(res.UserAgents, COUNT)
-
-	return res
 }
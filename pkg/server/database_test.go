@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestPermalink(t *testing.T) {
+	h1 := func(host string) types.Response {
+		return types.Response{RequestID: "id", Http1: &types.Http1Details{Headers: []string{"Host: " + host}}}
+	}
+	h2 := types.Response{RequestID: "id", Http2: &types.Http2Details{SendFrames: []types.ParsedFrame{
+		{Type: "HEADERS", Headers: []string{":method: GET", ":authority: h2.example:8443", ":path: /"}},
+	}}}
+	h3 := types.Response{RequestID: "id", Http3: &types.Http3Details{SNI: "h3.example"}}
+
+	tests := []struct {
+		req       types.Response
+		publicURL string
+		want      string
+	}{
+		{h1("example.com"), "", "https://example.com/api/request/id"},
+		{h2, "", "https://h2.example:8443/api/request/id"},
+		{h3, "", "https://h3.example/api/request/id"},
+		{h1("evil.example/x?"), "", "/api/request/id"},
+		{types.Response{RequestID: "id"}, "", "/api/request/id"},
+		{h1("example.com"), "https://fp.example/", "https://fp.example/api/request/id"},
+	}
+	for _, tt := range tests {
+		if got := permalink(tt.req, &types.Config{PublicURL: tt.publicURL}); got != tt.want {
+			t.Fatalf("Expected %s, got %s", tt.want, got)
+		}
+	}
+}
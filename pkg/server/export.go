@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/store"
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// exportContentTypes maps the export formats to their content type
+var exportContentTypes = map[string]string{
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv; charset=utf-8",
+}
+
+// ParseExport reads the format and filters of an export: type and value,
+// ua (a user agent substring), since and until. It is shared by
+// /api/export and the export command.
+func ParseExport(params url.Values) (string, store.ExportQuery, error) {
+	q := store.ExportQuery{UserAgent: utils.GetParam("ua", params)}
+	format := strings.ToLower(utils.GetParam("format", params))
+	if format == "" {
+		format = store.ExportFormats[0]
+	}
+	if _, ok := exportContentTypes[format]; !ok {
+		return "", q, fmt.Errorf("unknown format, use one of: %s", strings.Join(store.ExportFormats, ", "))
+	}
+
+	typ, value := utils.GetParam("type", params), utils.GetParam("value", params)
+	if alias, ok := rollupTypeAliases[typ]; ok {
+		typ = alias
+	}
+	if typ != "" && !store.IsRollupType(typ) {
+		return "", q, fmt.Errorf("unknown type, use one of: %s", strings.Join(store.RollupTypes, ", "))
+	}
+	if (typ == "") != (value == "") {
+		return "", q, fmt.Errorf("type and value must be given together")
+	}
+	q.Field, q.Value = typ, value
+
+	var err error
+	if q.Since, err = parseTime(utils.GetParam("since", params)); err != nil {
+		return "", q, fmt.Errorf("since: %w", err)
+	}
+	if q.Until, err = parseTime(utils.GetParam("until", params)); err != nil {
+		return "", q, fmt.Errorf("until: %w", err)
+	}
+	return format, q, nil
+}
+
+// apiExport streams the matching request logs. The logs carry the stored
+// IPs, so only the admin may export them. It is not wrapped by negotiated,
+// format selects the export format.
+func apiExport(srv *Server) RouteHandler {
+	return func(res types.Response, u url.Values) RouteResponse {
+		if rr, denied := checkAdmin(res, srv.GetConfig()); denied {
+			return rr
+		}
+		if !srv.IsConnectedToDB() {
+			return respond([]byte("{\"error\": \"Not connected to database.\"}"), "application/json")
+		}
+		format, q, err := ParseExport(u)
+		if err != nil {
+			return jsonError(http.StatusBadRequest, err.Error())
+		}
+
+		st := srv.GetStore()
+		return RouteResponse{
+			ContentType: exportContentTypes[format],
+			Headers:     http.Header{"Content-Disposition": {"attachment; filename=requests." + format}},
+			Stream: func(w BodyWriter) error {
+				n, err := store.Export(st, w, format, q)
+				if err != nil {
+					log.Printf("Export stopped after %d logs: %v", n, err)
+				}
+				return err
+			},
+		}
+	}
+}
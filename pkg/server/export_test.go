@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/pagpeter/trackme/pkg/store"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// exportBody collects a streamed export
+type exportBody struct{ bytes.Buffer }
+
+func (b *exportBody) Flush() error { return nil }
+
+func TestExport(t *testing.T) {
+	srv := storeServer(t, searchLogs...)
+	admin := types.Response{Http1: &types.Http1Details{Headers: []string{"Authorization: Bearer admin"}}}
+	if rr := apiExport(srv)(admin, nil); rr.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 without an admin token, got %d", rr.StatusCode)
+	}
+	srv.GetConfig().AdminToken = "admin"
+	if rr := apiExport(srv)(types.Response{}, nil); rr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without the admin token, got %d", rr.StatusCode)
+	}
+
+	export := func(params url.Values) string {
+		rr := apiExport(srv)(admin, params)
+		if rr.Stream == nil {
+			t.Fatalf("Expected a streamed export, got %d %s", rr.StatusCode, rr.Body)
+		}
+		var b exportBody
+		if err := rr.Stream(&b); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	lines := strings.Split(strings.TrimSpace(export(url.Values{"type": {"ja3"}, "value": {"a"}})), "\n")
+	var first store.RequestLog
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[0]), &first) != nil || first.Time != 1 || first.H2 != "h2-a" {
+		t.Fatalf("Unexpected NDJSON export %q", lines)
+	}
+	csv := export(url.Values{"format": {"csv"}, "ua": {"CHROME"}, "since": {"2"}})
+	if csv != "time,user_agent,ja3,ja4,ja4h,h2,peetprint,ip,browser,browser_major,os,device\n3,chrome,b,,,h2-a,,,,,,\n" {
+		t.Fatalf("Unexpected CSV export %q", csv)
+	}
+	if got := export(url.Values{"ua": {"curl"}, "until": {"1"}}); strings.Count(got, "\n") != 1 {
+		t.Fatalf("Unexpected time range export %q", got)
+	}
+	for _, params := range []url.Values{{"format": {"xml"}}, {"type": {"ip"}, "value": {"x"}}, {"type": {"ja3"}}} {
+		if rr := apiExport(srv)(admin, params); rr.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v, got %d", params, rr.StatusCode)
+		}
+	}
+}
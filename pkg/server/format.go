@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// outputFormat encodes a decoded JSON response in another format
+type outputFormat struct {
+	name        string
+	contentType string
+	// mediaTypes are the Accept values that select the format
+	mediaTypes []string
+	encode     func(v interface{}) ([]byte, error)
+}
+
+// outputFormats are the formats the fingerprint API can answer in, the first
+// one is the default
+var outputFormats = []outputFormat{
+	{"json", "application/json", []string{"application/json"}, func(v interface{}) ([]byte, error) {
+		return json.MarshalIndent(v, "", "  ")
+	}},
+	{"compact", "application/json", nil, json.Marshal},
+	{"yaml", "application/yaml", []string{"application/yaml", "application/x-yaml", "text/yaml"}, yaml.Marshal},
+	{"cbor", "application/cbor", []string{"application/cbor"}, encodeCBOR},
+	{"msgpack", "application/msgpack", []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}, encodeMsgPack},
+	{"text", "text/plain; charset=utf-8", []string{"text/plain"}, encodeText},
+}
+
+func formatNames() []string {
+	names := make([]string, len(outputFormats))
+	for i, f := range outputFormats {
+		names[i] = f.name
+	}
+	return names
+}
+
+// negotiated lets a JSON route answer in the format selected by ?format= or
+// the Accept header, reduced to the paths listed in ?fields=
+func negotiated(h RouteHandler) RouteHandler {
+	return func(res types.Response, params url.Values) RouteResponse {
+		rr := h(res, params)
+		if rr.Stream != nil || !strings.HasPrefix(rr.ContentType, "application/json") {
+			return rr
+		}
+
+		format, ok := selectFormat(utils.GetParam("format", params), extractHeaders(res)["Accept"])
+		if !ok {
+			r := respond([]byte(fmt.Sprintf(`{"error": "Unknown format, use one of: %s"}`, strings.Join(formatNames(), ", "))), "application/json")
+			r.StatusCode = http.StatusBadRequest
+			return r
+		}
+		fields := utils.GetParam("fields", params)
+		rr = rr.withHeader("Vary", "Accept")
+		if format.name == "json" && fields == "" {
+			return rr
+		}
+		if format.name == "compact" && fields == "" {
+			// Compacting keeps the field order of the handler
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, rr.Body); err == nil {
+				rr.Body = buf.Bytes()
+			}
+			return rr
+		}
+
+		v, err := decodeJSON(rr.Body)
+		if err != nil {
+			return rr
+		}
+		if fields != "" {
+			v = project(v, strings.Split(fields, ","))
+		}
+		body, err := format.encode(v)
+		if err != nil {
+			r := respond([]byte(`{"error": "Encoding failed"}`), "application/json")
+			r.StatusCode = http.StatusInternalServerError
+			return r
+		}
+		rr.Body = body
+		rr.ContentType = format.contentType
+		return rr
+	}
+}
+
+// selectFormat picks the format from the query or else from the Accept
+// header. Accept values without a matching format fall back to JSON.
+func selectFormat(name, accept string) (outputFormat, bool) {
+	if name != "" {
+		for _, f := range outputFormats {
+			if f.name == strings.ToLower(name) {
+				return f, true
+			}
+		}
+		return outputFormat{}, false
+	}
+
+	best, bestQ := outputFormats[0], 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, q := parseMediaRange(part)
+		for _, f := range outputFormats {
+			for _, mt := range f.mediaTypes {
+				if mt == mediaType && q > bestQ {
+					best, bestQ = f, q
+				}
+			}
+		}
+	}
+	return best, true
+}
+
+// parseMediaRange returns the media type of an Accept entry and its quality
+func parseMediaRange(s string) (string, float64) {
+	parts := strings.Split(s, ";")
+	q := 1.0
+	for _, p := range parts[1:] {
+		if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && k == "q" {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(parts[0])), q
+}
+
+// decodeJSON decodes a response body, numbers become int64 where they fit
+// so the binary formats encode them as integers
+func decodeJSON(body []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return normalizeNumbers(v), nil
+}
+
+func normalizeNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = normalizeNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = normalizeNumbers(e)
+		}
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
+
+// project keeps only the dotted paths, array elements are selected by index.
+// Paths that do not exist are left out.
+func project(v interface{}, paths []string) interface{} {
+	out := map[string]interface{}{}
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		keys := strings.Split(path, ".")
+		value, ok := lookupPath(v, keys)
+		if !ok {
+			continue
+		}
+		m := out
+		for _, k := range keys[:len(keys)-1] {
+			next, ok := m[k].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				m[k] = next
+			}
+			m = next
+		}
+		m[keys[len(keys)-1]] = value
+	}
+	return out
+}
+
+func lookupPath(v interface{}, keys []string) (interface{}, bool) {
+	for _, k := range keys {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			next, ok := t[k]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			v = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func encodeCBOR(v interface{}) ([]byte, error) {
+	// Sorted map keys keep the output stable
+	mode, err := cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		return nil, err
+	}
+	return mode.Marshal(v)
+}
+
+func encodeMsgPack(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetSortMapKeys(true)
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+
+// encodeText writes one path=value line per leaf, sorted by path, so shell
+// scripts can grep and cut the output
+func encodeText(v interface{}) ([]byte, error) {
+	var lines []string
+	flatten("", v, &lines)
+	sort.Strings(lines)
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+func flatten(prefix string, v interface{}, lines *[]string) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			flatten(join(k), e, lines)
+		}
+	case []interface{}:
+		for i, e := range t {
+			flatten(join(strconv.Itoa(i)), e, lines)
+		}
+	case nil:
+		*lines = append(*lines, prefix+"=")
+	case string:
+		if strings.ContainsAny(t, "\r\n") {
+			t = strconv.Quote(t)
+		}
+		*lines = append(*lines, prefix+"="+t)
+	default:
+		*lines = append(*lines, fmt.Sprintf("%s=%v", prefix, t))
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestAPIFormatNegotiation(t *testing.T) {
+	res := types.Response{
+		IP:          "1.2.3.4:5",
+		HTTPVersion: "h2",
+		Method:      "GET",
+		TLS:         &types.TLSDetails{JA4: "t13d1516h2_8daaf6152771_02713d6af862"},
+		Http2:       &types.Http2Details{AkamaiFingerprint: "1:65536|15663105|0|m,a,s,p"},
+		TCPIP:       types.TCPIPDetails{IP: types.IPDetails{TTL: 64}},
+	}
+	handler := negotiated(apiAll)
+	fields := "tls.ja4,http2.akamai_fingerprint,tcpip.ip.ttl,missing.path"
+
+	rr := handler(res, url.Values{"format": {"text"}, "fields": {fields}})
+	want := "http2.akamai_fingerprint=1:65536|15663105|0|m,a,s,p\ntcpip.ip.ttl=64\ntls.ja4=t13d1516h2_8daaf6152771_02713d6af862\n"
+	if string(rr.Body) != want || !strings.HasPrefix(rr.ContentType, "text/plain") {
+		t.Fatalf("Unexpected text output %q (%s)", rr.Body, rr.ContentType)
+	}
+
+	rr = handler(res, url.Values{"format": {"compact"}, "fields": {"tcpip.ip.ttl"}})
+	if string(rr.Body) != `{"tcpip":{"ip":{"ttl":64}}}` {
+		t.Fatalf("Unexpected compact output %s", rr.Body)
+	}
+
+	// The Accept header is used without ?format=
+	res.Http1 = &types.Http1Details{Headers: []string{"Accept: application/json;q=0.5, application/cbor"}}
+	rr = handler(res, url.Values{"fields": {"tcpip.ip.ttl"}})
+	var decoded map[string]map[string]map[string]int
+	if err := cbor.Unmarshal(rr.Body, &decoded); err != nil || rr.ContentType != "application/cbor" {
+		t.Fatalf("Expected CBOR, got %s: %v", rr.ContentType, err)
+	}
+	if decoded["tcpip"]["ip"]["ttl"] != 64 {
+		t.Fatalf("Unexpected CBOR output %v", decoded)
+	}
+
+	if rr := handler(res, url.Values{"format": {"xml"}}); rr.status() != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown format, got %d", rr.status())
+	}
+}
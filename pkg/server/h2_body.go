@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// windowUpdateThreshold is how much flow control credit is collected
+	// before it is returned to the client. It is well below the windows the
+	// client starts with, so uploads never stall.
+	windowUpdateThreshold = 16384
+	// bodyIdleTimeout is how long a request body may go without DATA
+	bodyIdleTimeout = 10 * time.Second
+)
+
+var (
+	errBodyTimeout = errors.New("request body timed out")
+	errStreamReset = errors.New("stream closed before the body was complete")
+)
+
+// addFrame records a frame of the stream for the fingerprint
+func (s *HTTP2Stream) addFrame(p types.ParsedFrame) {
+	s.mu.Lock()
+	s.frames = append(s.frames, p)
+	s.mu.Unlock()
+}
+
+// onData stores the payload of a DATA frame in the body, the frame itself
+// only keeps its length and flags. Once the body grew past the limit it is
+// dropped and the stream is marked as too large.
+func (s *HTTP2Stream) onData(p types.ParsedFrame, data []byte, endStream bool, limit int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastData = time.Now()
+	s.remoteEnded = s.remoteEnded || endStream
+	if s.bodyClosed {
+		return
+	}
+
+	if int64(s.body.Len()+len(data)) > limit {
+		s.body.Reset()
+		s.finishBody(errBodyTooLarge)
+		return
+	}
+	if s.tunnel {
+		// Tunnel DATA is not part of the fingerprint
+		s.body.Write(data)
+		select {
+		case s.dataReady <- struct{}{}:
+		default:
+		}
+	} else {
+		s.frames = append(s.frames, p)
+		s.body.Write(data)
+	}
+	if endStream {
+		s.finishBody(nil)
+	}
+}
+
+// Read reads the DATA of a tunnel as it arrives. Once the client ended the
+// stream it returns io.EOF, or the error that closed the body.
+func (s *HTTP2Stream) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.body.Len() > 0 {
+			n, _ := s.body.Read(p)
+			s.mu.Unlock()
+			return n, nil
+		}
+		if s.bodyClosed {
+			err := s.bodyErr
+			s.mu.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.dataReady:
+		case <-s.bodyDone:
+		}
+	}
+}
+
+// finishBody marks the body as complete, err is set if it was cut short.
+// The caller has to hold s.mu.
+func (s *HTTP2Stream) finishBody(err error) {
+	if s.bodyClosed {
+		return
+	}
+	s.bodyErr = err
+	s.bodyClosed = true
+	close(s.bodyDone)
+}
+
+// waitForStreamBody waits until the client ended the stream. It only gives
+// up if the client stops sending DATA for bodyIdleTimeout, so slow uploads
+// are read completely.
+func (c *HTTP2Connection) waitForStreamBody(stream *HTTP2Stream) ([]byte, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stream.bodyDone:
+			stream.mu.Lock()
+			defer stream.mu.Unlock()
+			return stream.body.Bytes(), stream.bodyErr
+		case <-ticker.C:
+			stream.mu.Lock()
+			if time.Since(stream.lastData) > bodyIdleTimeout {
+				stream.finishBody(errBodyTimeout)
+			}
+			stream.mu.Unlock()
+		}
+	}
+}
+
+// replenishWindow returns the flow control credit used by a DATA frame.
+// Connection credit is always returned, stream credit only while the client
+// may still send on the stream. Only called from the frame loop.
+func (c *HTTP2Connection) replenishWindow(stream *HTTP2Stream, length uint32, streamOpen bool) {
+	if length == 0 {
+		return
+	}
+
+	var connIncrement, streamIncrement uint32
+	c.connUnacked += length
+	if c.connUnacked >= windowUpdateThreshold {
+		connIncrement = c.connUnacked
+		c.connUnacked = 0
+	}
+	if stream != nil && streamOpen {
+		stream.unacked += length
+		if stream.unacked >= windowUpdateThreshold {
+			streamIncrement = stream.unacked
+			stream.unacked = 0
+		}
+	}
+	if connIncrement == 0 && streamIncrement == 0 {
+		return
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if connIncrement > 0 {
+		c.framer.WriteWindowUpdate(0, connIncrement)
+	}
+	if streamIncrement > 0 {
+		c.framer.WriteWindowUpdate(stream.streamID, streamIncrement)
+	}
+}
+
+// rejectBody answers a request whose body was not accepted. If the client
+// is still sending, the stream is reset so it stops uploading.
+func (c *HTTP2Connection) rejectBody(stream *HTTP2Stream, code int) {
+	hbuf := bytes.NewBuffer([]byte{})
+	encoder := hpack.NewEncoder(hbuf)
+	encoder.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(code)})
+	encoder.WriteField(hpack.HeaderField{Name: "server", Value: "TrackMe.peet.ws"})
+	encoder.WriteField(hpack.HeaderField{Name: "content-length", Value: "0"})
+
+	stream.mu.Lock()
+	remoteEnded := stream.remoteEnded
+	stream.mu.Unlock()
+
+	c.writeMu.Lock()
+	err := c.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      stream.streamID,
+		BlockFragment: hbuf.Bytes(),
+		EndHeaders:    true,
+		EndStream:     true,
+	})
+	if err == nil && !remoteEnded {
+		err = c.framer.WriteRSTStream(stream.streamID, http2.ErrCodeNo)
+	}
+	c.writeMu.Unlock()
+	if err != nil {
+		log.Println("Error rejecting request body:", err)
+	}
+	c.CloseStream(stream.streamID)
+}
+
+// contentLength returns the content-length request header, or -1
+func contentLength(headers []hpack.HeaderField) int64 {
+	for _, h := range headers {
+		if h.Name == "content-length" {
+			if n, err := strconv.ParseInt(h.Value, 10, 64); err == nil {
+				return n
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,511 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+	"golang.org/x/net/http2"
+)
+
+const defaultH2Profile = "google"
+
+// H2Profile describes what the server advertises at the start of an HTTP/2
+// connection (or when a probe is requested mid-connection)
+type H2Profile struct {
+	Name        string
+	Description string
+	Settings    []http2.Setting
+	// ExtraPings is the number of PING frames sent right after the SETTINGS
+	ExtraPings int
+	// GoAwayEarly sends a GOAWAY right after the probe, allowing only the
+	// streams that are already open to finish
+	GoAwayEarly bool
+	// GrantDelay is how long the server waits before opening the window of a
+	// stream when the profile advertises an INITIAL_WINDOW_SIZE of zero
+	GrantDelay time.Duration
+}
+
+// googleSettings are the settings google sends, used as the passive baseline
+var googleSettings = []http2.Setting{
+	{ID: http2.SettingInitialWindowSize, Val: 1048576},
+	{ID: http2.SettingMaxConcurrentStreams, Val: 100},
+	{ID: http2.SettingMaxHeaderListSize, Val: 65536},
+}
+
+var h2Profiles = map[string]H2Profile{
+	"google": {
+		Description: "Same settings that google uses (passive baseline)",
+		Settings:    googleSettings,
+	},
+	"header-table": {
+		Description: "HEADER_TABLE_SIZE of 0, clients must emit a dynamic table size update",
+		Settings: append([]http2.Setting{
+			{ID: http2.SettingHeaderTableSize, Val: 0},
+		}, googleSettings...),
+	},
+	"max-frame": {
+		Description: "Largest allowed MAX_FRAME_SIZE, shows whether clients send frames above 16384 bytes",
+		Settings: append([]http2.Setting{
+			{ID: http2.SettingMaxFrameSize, Val: 16777215},
+		}, googleSettings...),
+	},
+	"low-concurrency": {
+		Description: "MAX_CONCURRENT_STREAMS of 1",
+		Settings: []http2.Setting{
+			{ID: http2.SettingInitialWindowSize, Val: 1048576},
+			{ID: http2.SettingMaxConcurrentStreams, Val: 1},
+			{ID: http2.SettingMaxHeaderListSize, Val: 65536},
+		},
+	},
+	"zero-window": {
+		Description: "INITIAL_WINDOW_SIZE of 0, request bodies may only be sent after a WINDOW_UPDATE",
+		Settings: []http2.Setting{
+			{ID: http2.SettingInitialWindowSize, Val: 0},
+			{ID: http2.SettingMaxConcurrentStreams, Val: 100},
+			{ID: http2.SettingMaxHeaderListSize, Val: 65536},
+		},
+		GrantDelay: 100 * time.Millisecond,
+	},
+	"ping": {
+		Description: "Baseline settings followed by three PING frames",
+		Settings:    googleSettings,
+		ExtraPings:  3,
+	},
+	"goaway": {
+		Description: "Baseline settings followed by an early GOAWAY",
+		Settings:    googleSettings,
+		GoAwayEarly: true,
+	},
+}
+
+// GetH2Profile returns the profile with the given name, falling back to the
+// passive baseline
+func GetH2Profile(name string) (H2Profile, bool) {
+	if name == "" {
+		name = defaultH2Profile
+	}
+	p, ok := h2Profiles[name]
+	if !ok {
+		p = h2Profiles[defaultH2Profile]
+		name = defaultH2Profile
+	}
+	p.Name = name
+	return p, ok
+}
+
+// H2ProfileNames returns the names of all built-in profiles, sorted
+func H2ProfileNames() []string {
+	names := make([]string, 0, len(h2Profiles))
+	for name := range h2Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// settingValue returns the value of a setting in the profile
+func (p H2Profile) settingValue(id http2.SettingID) (uint32, bool) {
+	for _, s := range p.Settings {
+		if s.ID == id {
+			return s.Val, true
+		}
+	}
+	return 0, false
+}
+
+// h2Probe records how a client reacts to what the server advertised
+type h2Probe struct {
+	mu sync.Mutex
+
+	profile H2Profile
+	// active is true once a non-baseline profile was applied
+	active bool
+	// goAwayPending is set when the GOAWAY should follow the next request
+	goAwayPending bool
+
+	settingsSentAt time.Time
+	settingsAcked  bool
+	settingsAckLat time.Duration
+	ackWaiters     []chan struct{}
+
+	pingsSent    map[[8]byte]time.Time
+	pingLatency  []time.Duration
+	pingsPending int
+
+	windowUpdates    []string
+	tableSizeUpdates []uint32
+	maxFrameSize     uint32
+	maxConcurrent    int
+	goAwaySent       bool
+	goAwayLastStream uint32
+	afterGoAway      int
+	windowGranted    map[uint32]bool
+
+	violations []string
+}
+
+func newH2Probe() *h2Probe {
+	return &h2Probe{
+		pingsSent:     make(map[[8]byte]time.Time),
+		windowGranted: make(map[uint32]bool),
+	}
+}
+
+// apply resets the recorded reactions for a freshly advertised profile
+func (p *h2Probe) apply(profile H2Profile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.profile = profile
+	p.active = p.active || profile.Name != defaultH2Profile
+	p.settingsSentAt = time.Now()
+	p.settingsAcked = false
+	p.settingsAckLat = 0
+	p.pingLatency = nil
+	p.windowUpdates = nil
+	p.tableSizeUpdates = nil
+	p.maxFrameSize = 0
+	p.maxConcurrent = 0
+	p.violations = nil
+}
+
+func (p *h2Probe) onSettingsAck() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.settingsAcked || p.settingsSentAt.IsZero() {
+		return
+	}
+	p.settingsAcked = true
+	p.settingsAckLat = time.Since(p.settingsSentAt)
+	p.notify()
+}
+
+// newPing registers a PING payload that is about to be sent
+func (p *h2Probe) newPing(seq uint64) [8]byte {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], uint64(time.Now().UnixNano())^seq)
+	p.mu.Lock()
+	p.pingsSent[data] = time.Now()
+	p.pingsPending++
+	p.mu.Unlock()
+	return data
+}
+
+// onPingAck returns false if the ACK does not belong to a probe PING
+func (p *h2Probe) onPingAck(data [8]byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sent, ok := p.pingsSent[data]
+	if !ok {
+		return false
+	}
+	delete(p.pingsSent, data)
+	p.pingsPending--
+	p.pingLatency = append(p.pingLatency, time.Since(sent))
+	p.notify()
+	return true
+}
+
+func (p *h2Probe) onWindowUpdate(streamID, increment uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if streamID == 0 {
+		p.windowUpdates = append(p.windowUpdates, fmt.Sprintf("0:%d", increment))
+	} else {
+		p.windowUpdates = append(p.windowUpdates, fmt.Sprintf("s:%d", increment))
+	}
+}
+
+func (p *h2Probe) onFrame(header http2.FrameHeader) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if header.Length > p.maxFrameSize {
+		p.maxFrameSize = header.Length
+	}
+	limit, ok := p.profile.settingValue(http2.SettingMaxFrameSize)
+	if !ok {
+		limit = 16384
+	}
+	if p.settingsAcked && header.Length > limit {
+		p.addViolation(fmt.Sprintf("frame of %d bytes exceeds MAX_FRAME_SIZE %d", header.Length, limit))
+	}
+}
+
+// onHeaders inspects a new request for the limits advertised in the profile
+func (p *h2Probe) onHeaders(streamID uint32, fragment []byte, openStreams int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// A dynamic table size update is the first field of a header block
+	// and starts with the bit pattern 001
+	if len(fragment) > 0 && fragment[0]&0xe0 == 0x20 {
+		p.tableSizeUpdates = append(p.tableSizeUpdates, decodeHpackInt(fragment, 5))
+	}
+	if size, ok := p.profile.settingValue(http2.SettingHeaderTableSize); ok && p.settingsAcked && size < 4096 {
+		if len(p.tableSizeUpdates) == 0 {
+			p.addViolation(fmt.Sprintf("no dynamic table size update after HEADER_TABLE_SIZE %d", size))
+		}
+	}
+
+	if openStreams > p.maxConcurrent {
+		p.maxConcurrent = openStreams
+	}
+	if limit, ok := p.profile.settingValue(http2.SettingMaxConcurrentStreams); ok && p.settingsAcked && uint32(openStreams) > limit {
+		p.addViolation(fmt.Sprintf("%d concurrent streams exceed MAX_CONCURRENT_STREAMS %d", openStreams, limit))
+	}
+
+	if p.goAwaySent && streamID > p.goAwayLastStream {
+		p.afterGoAway++
+		p.addViolation(fmt.Sprintf("stream %d opened after GOAWAY", streamID))
+	}
+}
+
+// onData records request bodies that were sent before the window was opened
+func (p *h2Probe) onData(streamID uint32, length uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if length == 0 {
+		return
+	}
+	if size, ok := p.profile.settingValue(http2.SettingInitialWindowSize); ok && size == 0 && p.settingsAcked && !p.windowGranted[streamID] {
+		p.addViolation(fmt.Sprintf("DATA on stream %d before WINDOW_UPDATE with INITIAL_WINDOW_SIZE 0", streamID))
+	}
+}
+
+func (p *h2Probe) grantWindow(streamID uint32) {
+	p.mu.Lock()
+	p.windowGranted[streamID] = true
+	p.mu.Unlock()
+}
+
+func (p *h2Probe) onGoAway(lastStreamID uint32) {
+	p.mu.Lock()
+	p.goAwaySent = true
+	p.goAwayLastStream = lastStreamID
+	p.mu.Unlock()
+}
+
+func (p *h2Probe) addViolation(v string) {
+	for _, existing := range p.violations {
+		if existing == v {
+			return
+		}
+	}
+	p.violations = append(p.violations, v)
+}
+
+// notify wakes up everyone waiting for the probe to settle
+func (p *h2Probe) notify() {
+	if !p.settingsAcked || p.pingsPending > 0 {
+		return
+	}
+	for _, ch := range p.ackWaiters {
+		close(ch)
+	}
+	p.ackWaiters = nil
+}
+
+// wait blocks until the SETTINGS and all PINGs were acknowledged or the
+// timeout expired
+func (p *h2Probe) wait(timeout time.Duration) {
+	p.mu.Lock()
+	if p.settingsAcked && p.pingsPending == 0 {
+		p.mu.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	p.ackWaiters = append(p.ackWaiters, ch)
+	p.mu.Unlock()
+
+	select {
+	case <-ch:
+	case <-time.After(timeout):
+	}
+}
+
+// Details returns the active fingerprint, or nil if only the passive
+// baseline was ever advertised
+func (p *h2Probe) Details() *types.ActiveH2Details {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.active {
+		return nil
+	}
+
+	d := &types.ActiveH2Details{
+		Profile:                p.profile.Name,
+		AdvertisedSettings:     []string{},
+		SettingsAcked:          p.settingsAcked,
+		SettingsAckLatencyMs:   -1,
+		PingsSent:              p.profile.ExtraPings,
+		PingAckLatenciesMs:     []float64{},
+		WindowUpdates:          append([]string{}, p.windowUpdates...),
+		HeaderTableSizeUpdates: append([]uint32{}, p.tableSizeUpdates...),
+		MaxFrameSizeSeen:       p.maxFrameSize,
+		MaxConcurrentStreams:   p.maxConcurrent,
+		StreamsAfterGoAway:     p.afterGoAway,
+		Violations:             append([]string{}, p.violations...),
+	}
+	for _, s := range p.profile.Settings {
+		d.AdvertisedSettings = append(d.AdvertisedSettings, s.String())
+	}
+	if p.settingsAcked {
+		d.SettingsAckLatencyMs = durationMs(p.settingsAckLat)
+	}
+	for _, l := range p.pingLatency {
+		d.PingAckLatenciesMs = append(d.PingAckLatenciesMs, durationMs(l))
+	}
+
+	// The fingerprint only contains the behaviour, never timings, so that it
+	// stays stable across networks
+	acked := "0"
+	if p.settingsAcked {
+		acked = "1"
+	}
+	tableUpdates := []string{}
+	for _, u := range p.tableSizeUpdates {
+		tableUpdates = append(tableUpdates, fmt.Sprintf("%d", u))
+	}
+	d.Fingerprint = fmt.Sprintf("%s|A:%s|P:%d/%d|W:%s|T:%s|V:%d",
+		p.profile.Name,
+		acked,
+		len(p.pingLatency), p.profile.ExtraPings,
+		strings.Join(p.windowUpdates, ","),
+		strings.Join(tableUpdates, ","),
+		len(p.violations),
+	)
+	d.FingerprintHash = utils.GetMD5Hash(d.Fingerprint)
+	return d
+}
+
+// decodeHpackInt decodes an HPACK integer with an N-bit prefix (RFC 7541 5.1)
+func decodeHpackInt(b []byte, n uint) uint32 {
+	mask := byte(1<<n - 1)
+	v := uint32(b[0] & mask)
+	if v < uint32(mask) {
+		return v
+	}
+	var m uint
+	for _, c := range b[1:] {
+		v += uint32(c&0x7f) << m
+		m += 7
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	return v
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// applyProfile advertises a profile on the connection and records the
+// reactions to it. At the start of a connection the early GOAWAY of a profile
+// is deferred until the first request arrived, as it would otherwise forbid
+// every request.
+func (c *HTTP2Connection) applyProfile(profile H2Profile, midConnection bool) error {
+	c.probe.apply(profile)
+
+	settings := profile.Settings
+	if !midConnection {
+		// WebSockets are opened with an extended CONNECT (RFC 8441)
+		settings = append(append([]http2.Setting{}, settings...), http2.Setting{ID: http2.SettingEnableConnectProtocol, Val: 1})
+	}
+
+	c.writeMu.Lock()
+	err := c.framer.WriteSettings(settings...)
+	c.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < profile.ExtraPings; i++ {
+		data := c.probe.newPing(uint64(i))
+		c.writeMu.Lock()
+		err := c.framer.WritePing(false, data)
+		c.writeMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	if profile.GoAwayEarly {
+		if midConnection {
+			c.sendProbeGoAway()
+		} else {
+			c.probe.mu.Lock()
+			c.probe.goAwayPending = true
+			c.probe.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// sendProbeGoAway sends a GOAWAY that still allows the open streams to finish
+func (c *HTTP2Connection) sendProbeGoAway() {
+	c.streamsMu.RLock()
+	lastStreamID := c.lastStreamID
+	c.streamsMu.RUnlock()
+
+	c.probe.onGoAway(lastStreamID)
+	c.writeMu.Lock()
+	c.framer.WriteGoAway(lastStreamID, http2.ErrCodeNo, []byte("probe"))
+	c.writeMu.Unlock()
+}
+
+// afterHeaders runs the deferred parts of a profile once a request arrived
+func (c *HTTP2Connection) afterHeaders(f *http2.HeadersFrame) {
+	c.probe.onHeaders(f.StreamID, f.HeaderBlockFragment(), c.ActiveStreamCount())
+
+	c.probe.mu.Lock()
+	goAway := c.probe.goAwayPending
+	c.probe.goAwayPending = false
+	grantDelay := c.probe.profile.GrantDelay
+	size, zeroWindow := c.probe.profile.settingValue(http2.SettingInitialWindowSize)
+	c.probe.mu.Unlock()
+
+	if goAway {
+		c.sendProbeGoAway()
+	}
+
+	// With a zero initial window the client may only send the body once we
+	// opened the stream window
+	if zeroWindow && size == 0 && !f.StreamEnded() {
+		go func(streamID uint32) {
+			time.Sleep(grantDelay)
+			c.probe.grantWindow(streamID)
+			c.writeMu.Lock()
+			c.framer.WriteWindowUpdate(streamID, googleSettings[0].Val)
+			c.writeMu.Unlock()
+		}(f.StreamID)
+	}
+}
+
+// runActiveProbe advertises the profile requested by the path mid-connection
+// and waits for the client to acknowledge it
+func (c *HTTP2Connection) runActiveProbe(path string) {
+	name := defaultH2Profile
+	if u, err := url.Parse(path); err == nil {
+		if p := u.Query().Get("profile"); p != "" {
+			name = p
+		}
+	}
+	profile, _ := GetH2Profile(name)
+	c.probe.mu.Lock()
+	c.probe.active = true
+	c.probe.mu.Unlock()
+
+	if err := c.applyProfile(profile, true); err != nil {
+		log.Println("Failed to apply h2 profile:", err)
+		return
+	}
+	c.probe.wait(time.Second)
+}
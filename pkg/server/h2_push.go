@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	pushProbePath    = "/api/h2/push"
+	pushResourcePath = "/api/h2/push/resource"
+	pushResultPath   = "/api/h2/push/result"
+
+	// pushCancelWait is how long the server waits for a RST_STREAM before it
+	// delivers a pushed response
+	pushCancelWait = 500 * time.Millisecond
+)
+
+// pushResourceBody is the body of the pushed (or refetched) resource
+var pushResourceBody = []byte("{\"pushed\": true}")
+
+type pushPromise struct {
+	promisedStream uint32
+	path           string
+	sentAt         time.Time
+	delivered      bool
+	cancelled      bool
+	rstCode        http2.ErrCode
+	cancelLatency  time.Duration
+	refetched      bool
+	done           chan struct{}
+}
+
+// h2Push records how a client handles server push
+type h2Push struct {
+	mu sync.Mutex
+
+	// enabled is the client ENABLE_PUSH setting, which defaults to 1
+	enabled bool
+	// probed is set once one of the push endpoints was requested
+	probed       bool
+	nextPromised uint32
+	promises     []*pushPromise
+}
+
+func newH2Push() *h2Push {
+	return &h2Push{
+		enabled:      true,
+		nextPromised: 2,
+	}
+}
+
+func (p *h2Push) onSettings(f *http2.SettingsFrame) {
+	if v, ok := f.Value(http2.SettingEnablePush); ok {
+		p.mu.Lock()
+		p.enabled = v == 1
+		p.mu.Unlock()
+	}
+}
+
+// newPromise reserves a server initiated stream for a pushed path
+func (p *h2Push) newPromise(path string) *pushPromise {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	promise := &pushPromise{
+		promisedStream: p.nextPromised,
+		path:           path,
+		sentAt:         time.Now(),
+		done:           make(chan struct{}),
+	}
+	p.nextPromised += 2
+	p.promises = append(p.promises, promise)
+	return promise
+}
+
+// onReset returns false if the stream was not a promised one
+func (p *h2Push) onReset(streamID uint32, code http2.ErrCode) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, promise := range p.promises {
+		if promise.promisedStream != streamID || promise.cancelled {
+			continue
+		}
+		promise.cancelled = true
+		promise.rstCode = code
+		promise.cancelLatency = time.Since(promise.sentAt)
+		close(promise.done)
+		return true
+	}
+	return false
+}
+
+// onFetch marks every delivered promise for the path as refetched
+func (p *h2Push) onFetch(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.probed = true
+	for _, promise := range p.promises {
+		if promise.path == path && promise.delivered {
+			promise.refetched = true
+		}
+	}
+}
+
+// Details returns the push fingerprint, or nil if the push endpoints were
+// never requested
+func (p *h2Push) Details() *types.H2PushDetails {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.probed {
+		return nil
+	}
+
+	d := &types.H2PushDetails{
+		EnablePush: p.enabled,
+		Promises:   []types.H2PushPromise{},
+	}
+	outcomes := []string{}
+	for _, promise := range p.promises {
+		pp := types.H2PushPromise{
+			PromisedStream:  promise.promisedStream,
+			Path:            promise.path,
+			Delivered:       promise.delivered,
+			Cancelled:       promise.cancelled,
+			CancelLatencyMs: -1,
+			Refetched:       promise.refetched,
+		}
+		outcome := "accepted"
+		if promise.cancelled {
+			pp.RSTCode = promise.rstCode.String()
+			pp.CancelLatencyMs = durationMs(promise.cancelLatency)
+			outcome = "rst:" + pp.RSTCode
+		}
+		if promise.refetched {
+			outcome += "+refetch"
+		}
+		d.Promises = append(d.Promises, pp)
+		outcomes = append(outcomes, outcome)
+	}
+
+	enabled := "0"
+	if p.enabled {
+		enabled = "1"
+	}
+	d.Fingerprint = fmt.Sprintf("E:%s|%s", enabled, strings.Join(outcomes, ","))
+	d.FingerprintHash = utils.GetMD5Hash(d.Fingerprint)
+	return d
+}
+
+// runPushProbe pushes a resource before the push probe is answered and waits
+// for the client to either cancel it or let it through
+func (c *HTTP2Connection) runPushProbe(streamID uint32, path, authority string) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return
+	}
+
+	switch u.Path {
+	case pushResourcePath:
+		c.push.onFetch(u.Path)
+		return
+	case pushResultPath:
+		c.push.mu.Lock()
+		c.push.probed = true
+		c.push.mu.Unlock()
+		return
+	case pushProbePath:
+	default:
+		return
+	}
+
+	c.push.mu.Lock()
+	c.push.probed = true
+	enabled := c.push.enabled
+	c.push.mu.Unlock()
+	if !enabled {
+		return
+	}
+
+	promise := c.push.newPromise(pushResourcePath)
+	if err := c.sendPushPromise(streamID, promise, authority); err != nil {
+		log.Println("Error writing push promise:", err)
+		return
+	}
+
+	select {
+	case <-promise.done:
+		return
+	case <-time.After(pushCancelWait):
+	}
+
+	c.push.mu.Lock()
+	cancelled := promise.cancelled
+	if !cancelled {
+		promise.delivered = true
+	}
+	c.push.mu.Unlock()
+	if !cancelled {
+		c.sendPushedResponse(promise)
+	}
+}
+
+func (c *HTTP2Connection) sendPushPromise(streamID uint32, promise *pushPromise, authority string) error {
+	scheme := "https"
+	if c.tlsFingerprint == nil {
+		scheme = "http"
+	}
+
+	hbuf := bytes.NewBuffer([]byte{})
+	encoder := hpack.NewEncoder(hbuf)
+	encoder.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+	encoder.WriteField(hpack.HeaderField{Name: ":scheme", Value: scheme})
+	encoder.WriteField(hpack.HeaderField{Name: ":authority", Value: authority})
+	encoder.WriteField(hpack.HeaderField{Name: ":path", Value: promise.path})
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.framer.WritePushPromise(http2.PushPromiseParam{
+		StreamID:      streamID,
+		PromiseID:     promise.promisedStream,
+		BlockFragment: hbuf.Bytes(),
+		EndHeaders:    true,
+	})
+}
+
+func (c *HTTP2Connection) sendPushedResponse(promise *pushPromise) {
+	hbuf := bytes.NewBuffer([]byte{})
+	encoder := hpack.NewEncoder(hbuf)
+	encoder.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+	encoder.WriteField(hpack.HeaderField{Name: "server", Value: "TrackMe.peet.ws"})
+	encoder.WriteField(hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(pushResourceBody))})
+	encoder.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/json"})
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	err := c.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      promise.promisedStream,
+		BlockFragment: hbuf.Bytes(),
+		EndHeaders:    true,
+	})
+	if err != nil {
+		log.Println("Error writing pushed headers:", err)
+		return
+	}
+	c.framer.WriteData(promise.promisedStream, true, pushResourceBody)
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestH2PushRefetch(t *testing.T) {
+	p := newH2Push()
+	delivered := p.newPromise(pushResourcePath)
+	delivered.delivered = true
+	cancelled := p.newPromise(pushResourcePath)
+	p.onReset(cancelled.promisedStream, http2.ErrCodeCancel)
+	p.newPromise(pushResourcePath)
+
+	// Only a pushed copy the client got can be refetched instead of used
+	p.onFetch(pushResourcePath)
+	if d := p.Details(); d.Fingerprint != "E:1|accepted+refetch,rst:CANCEL,accepted" {
+		t.Fatalf("Unexpected push fingerprint %q", d.Fingerprint)
+	}
+}
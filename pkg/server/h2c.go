@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// bufferedConn lets already peeked bytes be read again by the next handler
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// servedWithoutTLS reports whether a path is answered on cleartext
+// connections. Everything else is redirected to the TLS site.
+func servedWithoutTLS(path string) bool {
+	return strings.HasPrefix(path, "/api/")
+}
+
+// HandlePlainConnection handles a connection on the plain HTTP port. HTTP/2
+// with prior knowledge and h2c upgrades are fingerprinted like on the TLS
+// port, HTTP/1 requests to the API are answered and everything else is
+// redirected to the configured HTTPS URL.
+func (srv *Server) HandlePlainConnection(conn net.Conn) bool {
+	timeline := newConnTimeline()
+	br := bufio.NewReader(conn)
+	bconn := &bufferedConn{Conn: conn, r: br}
+
+	conn.SetReadDeadline(time.Now().Add(connStartTimeout))
+	start, err := br.Peek(3)
+	if err != nil {
+		return false
+	}
+
+	// HTTP/2 with prior knowledge
+	if string(start) == "PRI" {
+		preface, err := br.Peek(len(HTTP2_PREAMBLE))
+		if err != nil || string(preface) != HTTP2_PREAMBLE {
+			return false
+		}
+		br.Discard(len(HTTP2_PREAMBLE))
+		timeline.mark(eventPreface)
+		conn.SetReadDeadline(time.Time{})
+		srv.handleHTTP2(bconn, nil, timeline)
+		return true
+	}
+
+	req, err := readHTTP1Request(br, conn, srv.MaxBodySize())
+	if err != nil {
+		switch err {
+		case errBodyTooLarge:
+			writeHTTP1Error(conn, 413)
+		case errMalformedRequest:
+			writeHTTP1Error(conn, 400)
+		}
+		return false
+	}
+	timeline.mark(eventRequest)
+	req.details.IP = conn.RemoteAddr().String()
+
+	if req.upgrade {
+		if srv.handleH2CUpgrade(bconn, req.details, req.upgradeSettings, timeline) {
+			return true
+		}
+	}
+
+	srv.serveHTTP1(bconn, br, nil, timeline, req)
+	return true
+}
+
+// redirectHTTP1 sends the client to the HTTPS version of the site
+func (srv *Server) redirectHTTP1(conn net.Conn) {
+	res := "HTTP/1.1 301 Moved Permanently\r\n"
+	res += "Location: " + srv.GetConfig().HTTPRedirect + "\r\n"
+	res += "Content-Length: 0\r\n"
+	res += "Connection: close\r\n"
+	res += "\r\n"
+	if _, err := conn.Write([]byte(res)); err != nil {
+		log.Println("Error writing redirect", err)
+	}
+	conn.Close()
+}
+
+// h2cUpgradeSettings returns the decoded HTTP2-Settings payload if the request
+// asks for an h2c upgrade (RFC 7540, section 3.2)
+func h2cUpgradeSettings(headers []string) ([]byte, bool) {
+	var upgrade, connection, settings string
+	var hasSettings, hasBody bool
+	for _, h := range headers {
+		name, value, found := strings.Cut(h, ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "upgrade":
+			upgrade = value
+		case "connection":
+			connection = value
+		case "http2-settings":
+			settings = value
+			hasSettings = true
+		case "content-length":
+			hasBody = value != "0"
+		case "transfer-encoding":
+			hasBody = true
+		}
+	}
+
+	// Bodies would have to be read before switching, which is not supported
+	if !hasSettings || hasBody || !headerHasToken(upgrade, "h2c") || !headerHasToken(connection, "upgrade") {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(settings, "="))
+	if err != nil || len(payload)%6 != 0 {
+		return nil, false
+	}
+	return payload, true
+}
+
+func headerHasToken(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// h2cDroppedHeaders are connection specific and not carried over to HTTP/2
+var h2cDroppedHeaders = map[string]bool{
+	"connection":        true,
+	"upgrade":           true,
+	"http2-settings":    true,
+	"host":              true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"te":                true,
+}
+
+// handleH2CUpgrade switches an HTTP/1.1 connection to HTTP/2. The request that
+// carried the upgrade is answered on stream 1, with its headers converted to
+// a HEADERS frame and HTTP2-Settings used as the client SETTINGS frame.
+func (srv *Server) handleH2CUpgrade(conn *bufferedConn, details types.Response, settings []byte, timeline *connTimeline) bool {
+	// The frames that arrived over HTTP/1.1 are stamped with the request time
+	requestOffset := timeline.offset()
+
+	settingsFrame, err := synthesizeFrame(func(fr *http2.Framer) error {
+		return fr.WriteRawFrame(http2.FrameSettings, 0, 0, settings)
+	})
+	if err != nil {
+		return false
+	}
+
+	authority := ""
+	fields := []hpack.HeaderField{}
+	for _, h := range details.Http1.Headers {
+		name, value, found := strings.Cut(h, ":")
+		if !found {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if name == "host" {
+			authority = value
+		}
+		if h2cDroppedHeaders[name] {
+			continue
+		}
+		fields = append(fields, hpack.HeaderField{Name: name, Value: value})
+	}
+	fields = append([]hpack.HeaderField{
+		{Name: ":method", Value: details.Method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: authority},
+		{Name: ":path", Value: details.Path},
+	}, fields...)
+
+	headersFrame, err := synthesizeFrame(func(fr *http2.Framer) error {
+		hbuf := bytes.NewBuffer([]byte{})
+		encoder := hpack.NewEncoder(hbuf)
+		for _, f := range fields {
+			encoder.WriteField(f)
+		}
+		return fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: hbuf.Bytes(),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+	})
+	if err != nil {
+		return false
+	}
+
+	_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		return true
+	}
+
+	fr := http2.NewFramer(conn, conn)
+	h2conn := NewHTTP2Connection(conn, fr, nil, timeline, srv)
+	timeline.mark(eventUpgrade)
+
+	clientSettings := h2conn.convertFrame(settingsFrame)
+	clientSettings.OffsetMs = requestOffset
+	timeline.frame(clientSettings)
+	h2conn.connectionFrames = append(h2conn.connectionFrames, clientSettings)
+	h2conn.push.onSettings(settingsFrame.(*http2.SettingsFrame))
+
+	profile, _ := GetH2Profile(srv.GetConfig().H2Profile)
+	if err := h2conn.applyProfile(profile, false); err != nil {
+		log.Println("Failed to write settings:", err)
+		conn.Close()
+		return true
+	}
+	timeline.mark(eventSettingsSent)
+
+	// The client sends its connection preface after receiving the 101
+	conn.SetReadDeadline(time.Now().Add(http1ReadTimeout))
+	preface := make([]byte, len(HTTP2_PREAMBLE))
+	if _, err := io.ReadFull(conn, preface); err != nil || string(preface) != HTTP2_PREAMBLE {
+		conn.Close()
+		return true
+	}
+	conn.SetReadDeadline(time.Time{})
+	timeline.mark(eventPreface)
+
+	stream := h2conn.GetOrCreateStream(1)
+	upgradeHeaders := h2conn.convertFrame(headersFrame)
+	upgradeHeaders.OffsetMs = requestOffset
+	timeline.frame(upgradeHeaders)
+	stream.frames = append(stream.frames, upgradeHeaders)
+	go h2conn.handleRequest(1, fields, true, stream)
+
+	go h2conn.idleTimeoutLoop()
+	h2conn.processFrames()
+	return true
+}
+
+// synthesizeFrame writes a frame into a buffer and reads it back, so frames
+// that arrived over HTTP/1.1 can be fingerprinted like real ones
+func synthesizeFrame(write func(*http2.Framer) error) (http2.Frame, error) {
+	buf := bytes.NewBuffer([]byte{})
+	fr := http2.NewFramer(buf, buf)
+	if err := write(fr); err != nil {
+		return nil, err
+	}
+	return fr.ReadFrame()
+}
+
+// sendRedirect answers a cleartext HTTP/2 request with a redirect to the
+// configured HTTPS URL
+func (c *HTTP2Connection) sendRedirect(streamID uint32) {
+	hbuf := bytes.NewBuffer([]byte{})
+	encoder := hpack.NewEncoder(hbuf)
+	encoder.WriteField(hpack.HeaderField{Name: ":status", Value: "301"})
+	encoder.WriteField(hpack.HeaderField{Name: "location", Value: c.srv.GetConfig().HTTPRedirect})
+	encoder.WriteField(hpack.HeaderField{Name: "content-length", Value: "0"})
+
+	c.writeMu.Lock()
+	err := c.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: hbuf.Bytes(),
+		EndHeaders:    true,
+		EndStream:     true,
+	})
+	c.writeMu.Unlock()
+	if err != nil {
+		log.Println("Error writing headers:", err)
+	}
+	c.CloseStream(streamID)
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+const (
+	// maxHTTP1HeaderSize caps the request line and headers of one request
+	maxHTTP1HeaderSize = 64 * 1024
+	// http1IdleTimeout is how long a keep-alive connection may wait for the
+	// next request
+	http1IdleTimeout = 10 * time.Second
+	// http1HeadTimeout is how long the request line and headers may take
+	// once the request started
+	http1HeadTimeout = 10 * time.Second
+	// http1ReadTimeout is how long a body may go without receiving data, so
+	// slow uploads are not cut off
+	http1ReadTimeout = 10 * time.Second
+)
+
+var (
+	errMalformedRequest = errors.New("malformed HTTP/1 request")
+	errBodyTooLarge     = errors.New("request body too large")
+)
+
+// http1Request is a single request read from a connection
+type http1Request struct {
+	details   types.Response
+	keepAlive bool
+	// upgradeSettings is the HTTP2-Settings payload of an h2c upgrade
+	upgradeSettings []byte
+	upgrade         bool
+}
+
+// deadlineReader extends the read deadline of the connection before every
+// read
+type deadlineReader struct {
+	r    io.Reader
+	conn net.Conn
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(http1ReadTimeout))
+	return d.r.Read(p)
+}
+
+// readHTTP1Request reads one request, including its body, from the
+// connection. Bodies are read according to Content-Length or chunked
+// Transfer-Encoding, so pipelined requests stay in the reader. Bodies larger
+// than maxBody are rejected with errBodyTooLarge. The head has to arrive
+// within http1HeadTimeout, the body only times out when the client stops
+// sending it.
+func readHTTP1Request(br *bufio.Reader, conn net.Conn, maxBody int64) (*http1Request, error) {
+	conn.SetReadDeadline(time.Now().Add(http1HeadTimeout))
+	head, err := readRequestHead(br)
+	if err != nil {
+		return nil, err
+	}
+
+	details := parseHTTP1(head)
+	if details.Http1 == nil {
+		return nil, errMalformedRequest
+	}
+
+	var contentLength int64 = -1
+	var transferEncoding, chunked, closeConn, keepAliveHeader, expectContinue bool
+	for _, h := range details.Http1.Headers {
+		name, value, _ := strings.Cut(h, ":")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "content-length":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 || (contentLength >= 0 && n != contentLength) {
+				return nil, errMalformedRequest
+			}
+			contentLength = n
+		case "transfer-encoding":
+			// Only the last coding of the last header counts
+			codings := strings.Split(value, ",")
+			transferEncoding = true
+			chunked = strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+		case "connection":
+			closeConn = headerHasToken(value, "close")
+			keepAliveHeader = headerHasToken(value, "keep-alive")
+		case "expect":
+			expectContinue = strings.EqualFold(value, "100-continue")
+		}
+	}
+
+	// The length of a body whose final coding is not chunked is unknown
+	// (RFC 9112, section 6.3)
+	if transferEncoding && !chunked {
+		return nil, errMalformedRequest
+	}
+
+	req := &http1Request{details: details}
+	if details.HTTPVersion == "HTTP/1.1" {
+		req.keepAlive = !closeConn
+	} else {
+		req.keepAlive = keepAliveHeader && !closeConn
+	}
+	req.upgradeSettings, req.upgrade = h2cUpgradeSettings(details.Http1.Headers)
+
+	// Do not ask for a body that would be rejected anyway
+	if !chunked && contentLength > maxBody {
+		return nil, errBodyTooLarge
+	}
+
+	hasBody := chunked || contentLength > 0
+	if hasBody && expectContinue {
+		if _, err := conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n")); err != nil {
+			return nil, err
+		}
+	}
+
+	// Transfer-Encoding overrides Content-Length (RFC 9112, section 6.3)
+	switch {
+	case chunked:
+		req.details.Body, err = readChunkedBody(br, conn, maxBody)
+		if err != nil {
+			return nil, err
+		}
+		// The framing was ambiguous, do not reuse the connection
+		if contentLength >= 0 {
+			req.keepAlive = false
+		}
+	case contentLength > 0:
+		req.details.Body = make([]byte, contentLength)
+		if _, err := io.ReadFull(deadlineReader{br, conn}, req.details.Body); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// readRequestHead reads an HTTP/1 request line and headers, including the
+// terminating empty line. Empty lines before the request line are skipped.
+func readRequestHead(br *bufio.Reader) ([]byte, error) {
+	var head []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			if len(head) > 0 && err == io.EOF {
+				return nil, errMalformedRequest
+			}
+			return nil, err
+		}
+		if len(head) == 0 && (string(line) == "\r\n" || string(line) == "\n") {
+			continue
+		}
+		head = append(head, line...)
+		if len(head) > maxHTTP1HeaderSize {
+			return nil, errMalformedRequest
+		}
+		if bytes.HasSuffix(head, []byte("\n\n")) || bytes.HasSuffix(head, []byte("\n\r\n")) {
+			return head, nil
+		}
+	}
+}
+
+// readChunkedBody decodes a chunked body. Trailers are read and dropped.
+func readChunkedBody(br *bufio.Reader, conn net.Conn, limit int64) ([]byte, error) {
+	body := []byte{}
+	for {
+		conn.SetReadDeadline(time.Now().Add(http1ReadTimeout))
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		sizeStr, _, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+		if err != nil || size < 0 {
+			return nil, errMalformedRequest
+		}
+
+		if size == 0 {
+			for {
+				trailer, err := readLine(br)
+				if err != nil {
+					return nil, err
+				}
+				if trailer == "" {
+					return body, nil
+				}
+			}
+		}
+
+		if int64(len(body))+size > limit {
+			return nil, errBodyTooLarge
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(deadlineReader{br, conn}, chunk); err != nil {
+			return nil, err
+		}
+		body = append(body, chunk...)
+
+		if end, err := readLine(br); err != nil || end != "" {
+			return nil, errMalformedRequest
+		}
+	}
+}
+
+// readLine reads a line of at most maxHTTP1HeaderSize bytes without its
+// line ending
+func readLine(br *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		part, err := br.ReadSlice('\n')
+		line = append(line, part...)
+		if len(line) > maxHTTP1HeaderSize {
+			return "", errMalformedRequest
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// serveHTTP1 answers requests on the connection until the client or a
+// response closes it. Pipelined requests are answered in order. If first is
+// set, it was already read from the connection by the caller.
+func (srv *Server) serveHTTP1(conn net.Conn, br *bufio.Reader, tlsDetails *types.TLSDetails, timeline *connTimeline, first *http1Request) {
+	defer conn.Close()
+
+	for {
+		req := first
+		first = nil
+		if req == nil {
+			// The idle timeout only applies until the next request starts
+			conn.SetReadDeadline(time.Now().Add(http1IdleTimeout))
+			if _, err := br.Peek(1); err != nil {
+				return
+			}
+			var err error
+			req, err = readHTTP1Request(br, conn, srv.MaxBodySize())
+			if err != nil {
+				switch err {
+				case errBodyTooLarge:
+					writeHTTP1Error(conn, 413)
+				case errMalformedRequest:
+					writeHTTP1Error(conn, 400)
+				}
+				return
+			}
+			timeline.mark(eventRequest)
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		details := req.details
+		details.IP = conn.RemoteAddr().String()
+		if wantsTimeline(details.Path) {
+			details.Timeline = timeline.Events()
+		}
+
+		// Calculate JA4H for every request, on TLS connections it is part
+		// of the (per request) TLS details
+		ja4h := trackmehttp.CalculateJA4H(details.Method, details.HTTPVersion, details.Http1.Headers)
+		ja4hR := trackmehttp.CalculateJA4H_r(details.Method, details.HTTPVersion, details.Http1.Headers)
+		if tlsDetails != nil {
+			reqTLS := *tlsDetails
+			reqTLS.JA4H = ja4h
+			reqTLS.JA4H_r = ja4hR
+			details.TLS = &reqTLS
+		} else {
+			if !servedWithoutTLS(details.Path) {
+				srv.redirectHTTP1(conn)
+				return
+			}
+			details.Http1.JA4H = ja4h
+			details.Http1.JA4H_r = ja4hR
+		}
+
+		if isWebSocketUpgrade(details) {
+			srv.upgradeHTTP1WebSocket(conn, br, details)
+			return
+		}
+
+		if !srv.respondToHTTP1(conn, details, req.keepAlive) {
+			return
+		}
+	}
+}
+
+// writeHTTP1Error answers a request that could not be read
+func writeHTTP1Error(conn net.Conn, code int) {
+	res := fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	res += "Content-Length: 0\r\n"
+	res += "Connection: close\r\n"
+	res += "\r\n"
+	if _, err := conn.Write([]byte(res)); err != nil {
+		log.Println("Error writing HTTP/1 error", err)
+	}
+}
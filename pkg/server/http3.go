@@ -0,0 +1,120 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pagpeter/quic-go/http3"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// h3SettingsWait is how long a request waits for the client SETTINGS
+const h3SettingsWait = 100 * time.Millisecond
+
+// HandleHTTP3 answers HTTP/3 requests through the same router and response
+// writer as HTTP/1 and HTTP/2
+func (srv *Server) HandleHTTP3() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		meta := newResponseMeta(r.Method)
+		hw := &h3Writer{w: w}
+
+		resp, err := srv.readHTTP3Request(w, r)
+		if err != nil {
+			status := http.StatusBadRequest
+			if err == errBodyTooLarge {
+				status = http.StatusRequestEntityTooLarge
+			}
+			logWriteError("HTTP/3", writeRouteResponse(hw, RouteResponse{StatusCode: status}, meta))
+			return
+		}
+
+		resp.RequestID = meta.requestID
+		rr := respond(nil, "text/plain")
+		if r.Method != "OPTIONS" {
+			rr = Router(resp.Path, resp, srv)
+		} else {
+			meta.cors = true
+		}
+		if key, isKeySet := srv.GetAdmin(); isKeySet && r.Header.Get(key) != "" {
+			meta.cors = true
+		}
+		logWriteError("HTTP/3", writeRouteResponse(hw, rr, meta))
+	})
+}
+
+// readHTTP3Request reads the request body and collects what the QUIC
+// connection exposes about the client
+func (srv *Server) readHTTP3Request(w http.ResponseWriter, r *http.Request) (types.Response, error) {
+	maxBody := srv.MaxBodySize()
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+	if err != nil {
+		return types.Response{}, err
+	}
+	if int64(len(body)) > maxBody {
+		return types.Response{}, errBodyTooLarge
+	}
+
+	// Header names are lowercase on the wire. net/http does not keep their
+	// order, so they are sorted and no JA4H is computed, it hashes the
+	// headers in the order they were sent.
+	var h3Headers []string
+	for name, values := range r.Header {
+		for _, v := range values {
+			h3Headers = append(h3Headers, strings.ToLower(name)+": "+v)
+		}
+	}
+	sort.Strings(h3Headers)
+
+	details := &types.Http3Details{
+		Information: "HTTP/3 support is work-in-progress. Use https://fp.impersonate.pro/api/http3 in the meantime.",
+		Headers:     h3Headers,
+	}
+	if r.TLS != nil {
+		details.SNI = r.TLS.ServerName
+	}
+
+	// The path is routed with its query, like on the other protocols
+	resp := types.Response{
+		IP:          r.RemoteAddr,
+		HTTPVersion: "h3",
+		Path:        r.URL.RequestURI(),
+		Method:      r.Method,
+		UserAgent:   r.Header.Get("User-Agent"),
+		Http3:       details,
+		Body:        body,
+	}
+
+	h3w, ok := w.(*http3.ResponseWriter)
+	if !ok {
+		return resp, nil
+	}
+	h3c := h3w.Connection()
+	state := h3c.ConnectionState()
+	details.Used0RTT = state.Used0RTT
+	details.SupportsDatagrams = state.SupportsDatagrams
+	details.SupportsStreamResetPartialDelivery = state.SupportsStreamResetPartialDelivery
+	details.Version = uint32(state.Version)
+	details.GSO = state.GSO
+	// Settings may only be read once they were received, the client sends
+	// them first on its control stream, so they are usually there
+	details.Settings = types.Http3Settings{}
+	select {
+	case <-h3c.ReceivedSettings():
+		if settings := h3c.Settings(); settings != nil {
+			details.Settings = types.Http3Settings(*settings)
+		}
+	case <-time.After(h3SettingsWait):
+	}
+
+	// QUIC keeps its own RTT estimate from the ACKs of every packet
+	// (including keep-alive PINGs) the server sent
+	if r.URL.Path == rttPath {
+		stats := h3c.Conn.ConnectionStats()
+		tcpRTT, tcpMinRTT, source := srv.snifferRTT(r.RemoteAddr, true)
+		resp.RTT = buildRTTDetails("quic", appRTT{latest: stats.LatestRTT, min: stats.MinRTT, smoothed: stats.SmoothedRTT}, tcpRTT, tcpMinRTT, source)
+	}
+	return resp, nil
+}
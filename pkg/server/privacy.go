@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// How client IPs are stored, see storedIP
+const (
+	ipModeNone     = "none"
+	ipModeFull     = "full"
+	ipModeHash     = "hash"
+	ipModeTruncate = "truncate"
+)
+
+const (
+	defaultIPv4Prefix = 24
+	defaultIPv6Prefix = 48
+)
+
+// ipMode returns how client IPs are stored. Configs without log_ip_mode
+// store full IPs if mongo_log_ips is set.
+func ipMode(c *types.Config) string {
+	if c.IPMode != "" {
+		return c.IPMode
+	}
+	if c.LogIPs {
+		return ipModeFull
+	}
+	return ipModeNone
+}
+
+// CheckPrivacyConfig returns an error for an unknown IP mode, or the hash
+// mode without a key
+func CheckPrivacyConfig(c *types.Config) error {
+	switch ipMode(c) {
+	case ipModeNone, ipModeFull, ipModeTruncate:
+	case ipModeHash:
+		if c.IPHashKey == "" {
+			return fmt.Errorf("log_ip_mode hash needs an ip_hash_key")
+		}
+	default:
+		return fmt.Errorf("unknown log_ip_mode %q, use none, full, hash or truncate", c.IPMode)
+	}
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 || c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("ip_v4_prefix must be at most 32 and ip_v6_prefix at most 128")
+	}
+	return nil
+}
+
+// storedIP returns an address the way it is stored: the full IP, a keyed
+// hash of it, its network (e.g. 203.0.113.0/24) or nothing. The address
+// may have a port.
+func storedIP(addr string, c *types.Config) string {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+
+	switch ipMode(c) {
+	case ipModeFull:
+		return ip.String()
+	case ipModeHash:
+		if c.IPHashKey == "" {
+			return ""
+		}
+		mac := hmac.New(sha256.New, []byte(c.IPHashKey))
+		mac.Write([]byte(ip.String()))
+		return hex.EncodeToString(mac.Sum(nil))[:32]
+	case ipModeTruncate:
+		bits, prefix := 128, c.IPv6Prefix
+		if prefix == 0 {
+			prefix = defaultIPv6Prefix
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits, prefix = ip4, 32, c.IPv4Prefix
+			if prefix == 0 {
+				prefix = defaultIPv4Prefix
+			}
+		}
+		mask := net.CIDRMask(prefix, bits)
+		return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+	}
+	return ""
+}
+
+// isAdmin reports whether the request carries the admin token as a bearer
+// token. Without an admin_token nobody is.
+func isAdmin(res types.Response, c *types.Config) bool {
+	if c.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(headerValue(extractHeaders(res), "Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(c.AdminToken)) == 1
+}
+
+// checkAdmin returns the error answer of an admin endpoint for requests
+// without the admin token, false if the request may go on
+func checkAdmin(res types.Response, c *types.Config) (RouteResponse, bool) {
+	if c.AdminToken == "" {
+		return jsonError(http.StatusForbidden, "Admin endpoints are disabled, set admin_token"), true
+	}
+	if !isAdmin(res, c) {
+		return jsonError(http.StatusUnauthorized, "Missing or wrong admin token"), true
+	}
+	return RouteResponse{}, false
+}
+
+func apiAdminDeleteIP(srv *Server) RouteHandler {
+	return func(res types.Response, _ url.Values) RouteResponse {
+		c := srv.GetConfig()
+		if rr, denied := checkAdmin(res, c); denied {
+			return rr
+		}
+		if !srv.IsConnectedToDB() {
+			return respond([]byte("{\"error\": \"Not connected to database.\"}"), "application/json")
+		}
+
+		ip := pathParam(res, "ip")
+		if net.ParseIP(ip) == nil {
+			return jsonError(http.StatusBadRequest, "Invalid IP")
+		}
+		// The IP is stored the way it is stored for new requests
+		stored := storedIP(ip, c)
+		if stored == "" {
+			return jsonError(http.StatusBadRequest, "IPs are not stored with log_ip_mode "+ipMode(c))
+		}
+		n, err := srv.GetStore().DeleteIP(stored)
+		if err != nil {
+			log.Println("Error deleting IP:", err)
+			return jsonError(http.StatusInternalServerError, "Could not delete the data")
+		}
+		log.Printf("Deleted %d records of IP %s", n, stored)
+		j, _ := json.MarshalIndent(map[string]interface{}{
+			"ip":      stored,
+			"deleted": n,
+		}, "", "  ")
+		return respond(j, "application/json")
+	}
+}
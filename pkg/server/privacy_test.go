@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/store"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestPrivacy(t *testing.T) {
+	cases := []struct {
+		config types.Config
+		addr   string
+		want   string
+	}{
+		{types.Config{}, "192.0.2.1:443", ""},
+		{types.Config{LogIPs: true}, "[2001:db8::1]:443", "2001:db8::1"},
+		{types.Config{IPMode: "truncate"}, "192.0.2.77:443", "192.0.2.0/24"},
+		{types.Config{IPMode: "truncate", IPv6Prefix: 32}, "[2001:db8:1::1]:443", "2001:db8::/32"},
+		{types.Config{IPMode: "hash", IPHashKey: "secret"}, "192.0.2.1:443", storedIP("192.0.2.1", &types.Config{IPMode: "hash", IPHashKey: "secret"})},
+	}
+	for _, c := range cases {
+		if got := storedIP(c.addr, &c.config); got != c.want {
+			t.Errorf("storedIP(%q) with %+v = %q, want %q", c.addr, c.config, got, c.want)
+		}
+	}
+	hashed := storedIP("192.0.2.1", &types.Config{IPMode: "hash", IPHashKey: "secret"})
+	if len(hashed) != 32 || hashed == storedIP("192.0.2.1", &types.Config{IPMode: "hash", IPHashKey: "other"}) {
+		t.Fatalf("Expected a 32 character keyed hash, got %q", hashed)
+	}
+	if err := CheckPrivacyConfig(&types.Config{IPMode: "hash"}); err == nil {
+		t.Fatal("Expected the hash mode without a key to be rejected")
+	}
+
+	path := t.TempDir() + "/requests.jsonl"
+	st, err := store.NewJSONL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	st.Save(
+		store.RequestLog{JA3: "a", IP: "192.0.2.0/24", Time: now},
+		store.RequestLog{JA3: "a", IP: "198.51.100.0/24", Time: now},
+		store.RequestLog{JA3: "b", IP: "198.51.100.0/24", Time: now - 40*24*3600},
+	)
+	st.SaveSnapshots(store.Snapshot{ID: "x", IP: "192.0.2.0/24", Time: now, Data: []byte("{}")})
+	srv := NewServer()
+	srv.GetConfig().IPMode = "truncate"
+	srv.GetConfig().LogDays = 30
+	srv.GetConfig().RollupDays = 60
+	srv.SetStore(st)
+
+	del := func(token string) RouteResponse {
+		res := types.Response{
+			Http1:      &types.Http1Details{Headers: []string{"Authorization: Bearer " + token}},
+			PathParams: map[string]string{"ip": "192.0.2.9"},
+		}
+		return apiAdminDeleteIP(srv)(res, nil)
+	}
+	if rr := del("admin"); rr.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 without an admin token, got %d", rr.StatusCode)
+	}
+	srv.GetConfig().AdminToken = "admin"
+	if rr := del("wrong"); rr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a wrong token, got %d", rr.StatusCode)
+	}
+	var deleted struct {
+		IP      string `json:"ip"`
+		Deleted int64  `json:"deleted"`
+	}
+	json.Unmarshal(del("admin").Body, &deleted)
+	if deleted.IP != "192.0.2.0/24" || deleted.Deleted != 2 {
+		t.Fatalf("Unexpected delete result %+v", deleted)
+	}
+
+	// Old logs go after their retention, their rollups stay until theirs
+	srv.requestLogger().purge(time.Now())
+	if n, _ := st.Count(); n != 1 {
+		t.Fatalf("Expected 1 log after the purge, got %d", n)
+	}
+	if _, ok, _ := st.Rollup("ja3", "b"); !ok {
+		t.Fatal("Expected the rollup of the purged log to be kept")
+	}
+	srv.Close()
+
+	// The deletions are written to the files
+	st, err = store.NewJSONL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if found, _ := st.Find("ja3", "a"); len(found) != 1 || found[0].IP != "198.51.100.0/24" {
+		t.Fatalf("Unexpected logs after reopening %+v", found)
+	}
+	if _, ok, _ := st.Snapshot("x"); ok {
+		t.Fatal("Expected the snapshot of the IP to be deleted")
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/store"
+)
+
+const (
+	defaultLogQueueSize = 10000
+	defaultLogBatchSize = 100
+	// logFlushInterval bounds how long a log waits for its batch to fill up
+	logFlushInterval = time.Second
+	// purgeInterval is how often expired snapshots, logs and rollups are
+	// deleted
+	purgeInterval = 10 * time.Minute
+)
+
+// retention is how long logs and rollups are kept, 0 keeps them forever
+type retention struct {
+	logs    time.Duration
+	rollups time.Duration
+}
+
+// LogQueueStats describes the queue of request logs waiting to be stored
+type LogQueueStats struct {
+	Policy   string `json:"policy"`
+	Depth    int    `json:"depth"`
+	Capacity int    `json:"capacity"`
+	Written  uint64 `json:"written"`
+	Dropped  uint64 `json:"dropped"`
+	Failed   uint64 `json:"failed"`
+	Batches  uint64 `json:"batches"`
+	// Snapshots counts the stored snapshots, Oversized the ones skipped
+	// for exceeding snapshot_max_size
+	Snapshots uint64 `json:"snapshots"`
+	Oversized uint64 `json:"snapshots_oversized"`
+}
+
+// logEntry is a queued log and the snapshot of its request, if one is kept
+type logEntry struct {
+	log      store.RequestLog
+	snapshot *store.Snapshot
+}
+
+// requestLogger stores request logs in batches from a background goroutine,
+// so a slow or unreachable store does not delay the responses
+type requestLogger struct {
+	st        store.Store
+	queue     chan logEntry
+	batchSize int
+	// block makes enqueue wait for room instead of dropping the log
+	block     bool
+	retention retention
+
+	// mu guards closed, enqueue holds it for reading while sending
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+
+	written atomic.Uint64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+	batches atomic.Uint64
+
+	snapshots atomic.Uint64
+	oversized atomic.Uint64
+}
+
+func newRequestLogger(st store.Store, queueSize, batchSize int, block bool, keep retention) *requestLogger {
+	if queueSize <= 0 {
+		queueSize = defaultLogQueueSize
+	}
+	if batchSize <= 0 {
+		batchSize = defaultLogBatchSize
+	}
+	l := &requestLogger{
+		st:        st,
+		queue:     make(chan logEntry, queueSize),
+		batchSize: batchSize,
+		block:     block,
+		retention: keep,
+		done:      make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// enqueue queues a log and an optional snapshot. If the queue is full they
+// are dropped, or with the block policy enqueue waits until the writer
+// catches up.
+func (l *requestLogger) enqueue(r store.RequestLog, snap *store.Snapshot) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		l.dropped.Add(1)
+		return
+	}
+	e := logEntry{log: r, snapshot: snap}
+	if l.block {
+		l.queue <- e
+		return
+	}
+	select {
+	case l.queue <- e:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+func (l *requestLogger) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+	purge := time.NewTicker(purgeInterval)
+	defer purge.Stop()
+	l.purge(time.Now())
+
+	batch := make([]logEntry, 0, l.batchSize)
+	for {
+		select {
+		case e, ok := <-l.queue:
+			if !ok {
+				l.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= l.batchSize {
+				l.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			l.flush(batch)
+			batch = batch[:0]
+		case now := <-purge.C:
+			l.purge(now)
+		}
+	}
+}
+
+// purge deletes the expired snapshots and the logs and rollups older than
+// their retention
+func (l *requestLogger) purge(now time.Time) {
+	if _, err := l.st.DeleteExpiredSnapshots(now.Unix()); err != nil {
+		log.Println("Error deleting expired snapshots:", err)
+	}
+	if l.retention.logs > 0 {
+		if _, err := l.st.DeleteBefore(now.Add(-l.retention.logs).Unix()); err != nil {
+			log.Println("Error deleting old request logs:", err)
+		}
+	}
+	if l.retention.rollups > 0 {
+		if _, err := l.st.DeleteRollupsBefore(now.Add(-l.retention.rollups).Unix()); err != nil {
+			log.Println("Error deleting old rollups:", err)
+		}
+	}
+}
+
+func (l *requestLogger) flush(batch []logEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	l.batches.Add(1)
+	logs := make([]store.RequestLog, len(batch))
+	var snapshots []store.Snapshot
+	for i, e := range batch {
+		logs[i] = e.log
+		if e.snapshot != nil {
+			snapshots = append(snapshots, *e.snapshot)
+		}
+	}
+
+	if err := l.st.Save(logs...); err != nil {
+		log.Printf("Error storing %d request logs: %v", len(logs), err)
+		l.failed.Add(uint64(len(logs)))
+		return
+	}
+	l.written.Add(uint64(len(logs)))
+
+	if len(snapshots) == 0 {
+		return
+	}
+	if err := l.st.SaveSnapshots(snapshots...); err != nil {
+		log.Printf("Error storing %d snapshots: %v", len(snapshots), err)
+		return
+	}
+	l.snapshots.Add(uint64(len(snapshots)))
+}
+
+// close stores the queued logs and stops the writer. Logs enqueued
+// afterwards are dropped.
+func (l *requestLogger) close() {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.mu.Unlock()
+	<-l.done
+}
+
+func (l *requestLogger) stats() LogQueueStats {
+	policy := "drop"
+	if l.block {
+		policy = "block"
+	}
+	return LogQueueStats{
+		Policy:   policy,
+		Depth:    len(l.queue),
+		Capacity: cap(l.queue),
+		Written:  l.written.Load(),
+		Dropped:  l.dropped.Load(),
+		Failed:   l.failed.Load(),
+		Batches:  l.batches.Load(),
+
+		Snapshots: l.snapshots.Load(),
+		Oversized: l.oversized.Load(),
+	}
+}
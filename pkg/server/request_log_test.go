@@ -0,0 +1,44 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/pagpeter/trackme/pkg/store"
+)
+
+// slowStore blocks every Save until it is released
+type slowStore struct {
+	*store.Memory
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) Save(logs ...store.RequestLog) error {
+	s.saving <- struct{}{}
+	<-s.release
+	return s.Memory.Save(logs...)
+}
+
+func TestRequestLoggerDropsWhenFull(t *testing.T) {
+	st := &slowStore{Memory: store.NewMemory(), saving: make(chan struct{}, 2), release: make(chan struct{})}
+	l := newRequestLogger(st, 1, 1, false, retention{})
+
+	// The first log is taken by the writer, the second waits in the queue
+	// and the third finds it full
+	l.enqueue(store.RequestLog{JA3: "1"}, nil)
+	<-st.saving
+	l.enqueue(store.RequestLog{JA3: "2"}, nil)
+	l.enqueue(store.RequestLog{JA3: "3"}, nil)
+	if s := l.stats(); s.Depth != 1 || s.Dropped != 1 || s.Written != 0 {
+		t.Fatalf("Unexpected stats while the store is slow: %+v", s)
+	}
+
+	close(st.release)
+	l.close()
+	if s := l.stats(); s.Depth != 0 || s.Written != 2 || s.Batches != 2 {
+		t.Fatalf("Expected the queue to be flushed on close: %+v", s)
+	}
+	if n, _ := st.Count(); n != 2 {
+		t.Fatalf("Expected 2 stored logs, got %d", n)
+	}
+}
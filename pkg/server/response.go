@@ -0,0 +1,371 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// RouteHandler answers a request to one route
+type RouteHandler func(types.Response, url.Values) RouteResponse
+
+// RouteResponse is what a route returns. writeRouteResponse sends it the
+// same way over HTTP/1, HTTP/2 and HTTP/3.
+type RouteResponse struct {
+	StatusCode  int // 0 means 200
+	ContentType string
+	Headers     http.Header // Additional headers (e.g., Set-Cookie, Location)
+	Trailers    http.Header // Sent after the body
+	Body        []byte
+	// Stream writes the body in parts instead of Body. The length is not
+	// known up front, so HTTP/1 responses use chunked encoding.
+	Stream func(w BodyWriter) error
+}
+
+// BodyWriter receives a streamed body, Flush sends what was written so far
+// to the client
+type BodyWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// respond returns a 200 response with the body
+func respond(body []byte, contentType string) RouteResponse {
+	return RouteResponse{Body: body, ContentType: contentType}
+}
+
+// redirectTo returns a redirect without a body
+func redirectTo(code int, location string) RouteResponse {
+	return RouteResponse{StatusCode: code}.withHeader("Location", location)
+}
+
+// withHeader returns the response with an additional header
+func (r RouteResponse) withHeader(name, value string) RouteResponse {
+	headers := r.Headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	headers.Add(name, value)
+	r.Headers = headers
+	return r
+}
+
+func (r RouteResponse) status() int {
+	if r.StatusCode == 0 {
+		return http.StatusOK
+	}
+	return r.StatusCode
+}
+
+// bodyAllowed reports whether a response with the status may have a body
+// (RFC 9110, section 6.4.1)
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// wireWriter sends a response in the framing of one protocol
+type wireWriter interface {
+	BodyWriter
+	// writeHeader sends the status and headers, endStream is set if
+	// nothing follows
+	writeHeader(status int, header http.Header, endStream bool) error
+	// finish ends the body, sending the trailers if there are any
+	finish(trailers http.Header) error
+}
+
+// responseMeta is the part of a response that does not come from the route
+type responseMeta struct {
+	method    string
+	start     time.Time
+	requestID string
+	// cors adds the CORS headers for admin requests
+	cors bool
+}
+
+// newResponseMeta starts timing a request
+func newResponseMeta(method string) responseMeta {
+	return responseMeta{
+		method:    method,
+		start:     time.Now(),
+		requestID: generateRequestID(),
+	}
+}
+
+// writeRouteResponse writes a route response with the headers every
+// response carries. It is the only place where responses are put together,
+// the protocols only differ in framing.
+func writeRouteResponse(w wireWriter, rr RouteResponse, meta responseMeta) error {
+	status := rr.status()
+	header := http.Header{}
+	if rr.ContentType != "" {
+		header.Set("Content-Type", rr.ContentType)
+	}
+	header.Set("Server", "TrackMe")
+	header.Set("X-Request-Id", meta.requestID)
+	header.Set("X-Response-Time", strconv.FormatInt(time.Since(meta.start).Milliseconds(), 10))
+	header.Set("Alt-Svc", "h3=\":443\"; ma=86400")
+	if meta.cors {
+		header.Set("Access-Control-Allow-Origin", "*")
+		header.Set("Access-Control-Allow-Methods", "*")
+		header.Set("Access-Control-Allow-Headers", "*")
+	}
+	for name, values := range rr.Headers {
+		header[http.CanonicalHeaderKey(name)] = append(header[http.CanonicalHeaderKey(name)], values...)
+	}
+	if rr.Stream == nil && bodyAllowed(status) {
+		header.Set("Content-Length", strconv.Itoa(len(rr.Body)))
+	}
+	if len(rr.Trailers) > 0 {
+		header.Set("Trailer", strings.Join(sortedKeys(rr.Trailers), ", "))
+	}
+
+	noBody := meta.method == "HEAD" || !bodyAllowed(status)
+	if err := w.writeHeader(status, header, noBody); err != nil {
+		return err
+	}
+	if noBody {
+		return nil
+	}
+
+	if rr.Stream != nil {
+		if err := rr.Stream(w); err != nil {
+			return err
+		}
+	} else if len(rr.Body) > 0 {
+		if _, err := w.Write(rr.Body); err != nil {
+			return err
+		}
+	}
+	return w.finish(rr.Trailers)
+}
+
+func sortedKeys(h http.Header) []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, http.CanonicalHeaderKey(k))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// http1Writer frames a response for HTTP/1.1. Bodies of unknown length and
+// bodies with trailers are sent chunked.
+type http1Writer struct {
+	bw        *bufio.Writer
+	keepAlive bool
+	// http10 clients do not understand chunked encoding, streamed bodies
+	// end with the connection instead
+	http10  bool
+	chunked bool
+}
+
+func newHTTP1Writer(w io.Writer, keepAlive, http10 bool) *http1Writer {
+	return &http1Writer{
+		bw:        bufio.NewWriter(w),
+		keepAlive: keepAlive,
+		http10:    http10,
+	}
+}
+
+func (w *http1Writer) writeHeader(status int, header http.Header, endStream bool) error {
+	if !endStream && (header.Get("Content-Length") == "" || header.Get("Trailer") != "") {
+		if w.http10 {
+			header.Del("Trailer")
+			w.keepAlive = false
+		} else {
+			header.Del("Content-Length")
+			header.Set("Transfer-Encoding", "chunked")
+			w.chunked = true
+		}
+	}
+	if w.keepAlive {
+		header.Set("Connection", "keep-alive")
+	} else {
+		header.Set("Connection", "close")
+	}
+
+	fmt.Fprintf(w.bw, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if err := header.Write(w.bw); err != nil {
+		return err
+	}
+	if _, err := w.bw.WriteString("\r\n"); err != nil {
+		return err
+	}
+	if endStream {
+		return w.bw.Flush()
+	}
+	return nil
+}
+
+func (w *http1Writer) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !w.chunked {
+		return w.bw.Write(p)
+	}
+	fmt.Fprintf(w.bw, "%x\r\n", len(p))
+	w.bw.Write(p)
+	if _, err := w.bw.WriteString("\r\n"); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *http1Writer) Flush() error {
+	return w.bw.Flush()
+}
+
+func (w *http1Writer) finish(trailers http.Header) error {
+	if w.chunked {
+		w.bw.WriteString("0\r\n")
+		trailers.Write(w.bw)
+		w.bw.WriteString("\r\n")
+	}
+	return w.bw.Flush()
+}
+
+// h2Writer frames a response as HEADERS and DATA frames. The last DATA
+// frame is held back so it can carry END_STREAM.
+type h2Writer struct {
+	c        *HTTP2Connection
+	streamID uint32
+	pending  []byte
+}
+
+func (w *h2Writer) writeHeader(status int, header http.Header, endStream bool) error {
+	hbuf := bytes.NewBuffer([]byte{})
+	encoder := hpack.NewEncoder(hbuf)
+	encoder.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(status)})
+	writeHPACKHeaders(encoder, header)
+
+	w.c.writeMu.Lock()
+	defer w.c.writeMu.Unlock()
+	return w.c.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      w.streamID,
+		BlockFragment: hbuf.Bytes(),
+		EndHeaders:    true,
+		EndStream:     endStream,
+	})
+}
+
+func (w *h2Writer) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	w.pending = append([]byte{}, p...)
+	return len(p), nil
+}
+
+// Flush sends the held back data
+func (w *h2Writer) Flush() error {
+	return w.writeData(false)
+}
+
+func (w *h2Writer) writeData(endStream bool) error {
+	chunks := utils.SplitBytesIntoChunks(w.pending, 16384) // 16KB chunks
+	w.pending = nil
+	if len(chunks) == 0 && endStream {
+		chunks = [][]byte{nil}
+	}
+
+	w.c.writeMu.Lock()
+	defer w.c.writeMu.Unlock()
+	for i, chunk := range chunks {
+		if err := w.c.framer.WriteData(w.streamID, endStream && i == len(chunks)-1, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *h2Writer) finish(trailers http.Header) error {
+	if len(trailers) == 0 {
+		return w.writeData(true)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	hbuf := bytes.NewBuffer([]byte{})
+	writeHPACKHeaders(hpack.NewEncoder(hbuf), trailers)
+	w.c.writeMu.Lock()
+	defer w.c.writeMu.Unlock()
+	return w.c.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      w.streamID,
+		BlockFragment: hbuf.Bytes(),
+		EndHeaders:    true,
+		EndStream:     true,
+	})
+}
+
+// writeHPACKHeaders encodes the headers in a stable order. Header names are
+// lower case and connection specific headers are dropped (RFC 9113,
+// section 8.2.2).
+func writeHPACKHeaders(encoder *hpack.Encoder, header http.Header) {
+	for _, name := range sortedKeys(header) {
+		switch name {
+		case "Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade":
+			continue
+		}
+		for _, value := range header[name] {
+			encoder.WriteField(hpack.HeaderField{Name: strings.ToLower(name), Value: value})
+		}
+	}
+}
+
+// h3Writer writes a response through the net/http interface of quic-go
+type h3Writer struct {
+	w http.ResponseWriter
+}
+
+func (w *h3Writer) writeHeader(status int, header http.Header, endStream bool) error {
+	for name, values := range header {
+		w.w.Header()[name] = values
+	}
+	w.w.WriteHeader(status)
+	return nil
+}
+
+func (w *h3Writer) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func (w *h3Writer) Flush() error {
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (w *h3Writer) finish(trailers http.Header) error {
+	// Trailers announced in the Trailer header are sent once the handler
+	// returns
+	for name, values := range trailers {
+		w.w.Header()[http.CanonicalHeaderKey(name)] = values
+	}
+	return nil
+}
+
+// logWriteError logs errors other than the client going away
+func logWriteError(proto string, err error) {
+	if err != nil && !isConnectionClosed(err) {
+		log.Println("Error writing "+proto+" response:", err)
+	}
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// Route registers a handler for a path pattern. Segments in braces are path
+// parameters: {name} matches one segment, {name:int} one integer segment and
+// {name...} the rest of the path.
+type Route struct {
+	Pattern string
+	// Methods lists the methods the route answers, nil answers every method.
+	// HEAD is allowed wherever GET is.
+	Methods []string
+	Handler RouteHandler
+	// Doc describes the route in /openapi.json, routes without one are not
+	// listed
+	Doc *RouteDoc
+}
+
+// RouteDoc is the OpenAPI description of a route
+type RouteDoc struct {
+	Tag         string
+	Summary     string
+	Description string
+	// Params documents query parameters and the bounds of path parameters,
+	// path parameters are listed even if they are not documented here
+	Params []DocParam
+	// RequestTypes are the accepted request body content types
+	RequestTypes []string
+	// Responses maps status codes to their description, the default is a
+	// single 200 response
+	Responses map[string]string
+	// Schema is the JSON schema of the 200 response
+	Schema map[string]interface{}
+}
+
+// DocParam documents a path or query parameter
+type DocParam struct {
+	Name        string
+	In          string // "path" or "query", defaults to "query"
+	Type        string // defaults to "string"
+	Description string
+	Required    bool
+	// Min and Max bound integer parameters if Max is set
+	Min, Max int
+}
+
+// Segment kinds, in the order they win when several routes match a path
+const (
+	segmentStatic = iota
+	segmentInt
+	segmentString
+	segmentRest
+)
+
+type routeSegment struct {
+	kind  int
+	value string // the static text or the parameter name
+}
+
+type compiledRoute struct {
+	Route
+	segments []routeSegment
+}
+
+// routeTable is compiled once from the registered routes. Static paths are
+// looked up directly, the others are tried from the most to the least
+// specific pattern, so the same path always resolves to the same route.
+type routeTable struct {
+	routes  []Route
+	static  map[string][]*compiledRoute
+	dynamic []*compiledRoute
+}
+
+func newRouteTable(routes []Route) *routeTable {
+	t := &routeTable{
+		routes: routes,
+		static: map[string][]*compiledRoute{},
+	}
+	for _, r := range routes {
+		cr := &compiledRoute{Route: r, segments: parsePattern(r.Pattern)}
+		if cr.isStatic() {
+			t.static[r.Pattern] = append(t.static[r.Pattern], cr)
+		} else {
+			t.dynamic = append(t.dynamic, cr)
+		}
+	}
+	sort.SliceStable(t.dynamic, func(i, j int) bool {
+		return moreSpecific(t.dynamic[i], t.dynamic[j])
+	})
+	return t
+}
+
+func parsePattern(pattern string) []routeSegment {
+	var segments []routeSegment
+	for _, part := range strings.Split(strings.TrimPrefix(pattern, "/"), "/") {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			segments = append(segments, routeSegment{kind: segmentStatic, value: part})
+			continue
+		}
+		name := part[1 : len(part)-1]
+		switch {
+		case strings.HasSuffix(name, "..."):
+			segments = append(segments, routeSegment{kind: segmentRest, value: strings.TrimSuffix(name, "...")})
+		case strings.HasSuffix(name, ":int"):
+			segments = append(segments, routeSegment{kind: segmentInt, value: strings.TrimSuffix(name, ":int")})
+		default:
+			segments = append(segments, routeSegment{kind: segmentString, value: name})
+		}
+	}
+	return segments
+}
+
+func (r *compiledRoute) isStatic() bool {
+	for _, s := range r.segments {
+		if s.kind != segmentStatic {
+			return false
+		}
+	}
+	return true
+}
+
+// moreSpecific orders routes segment by segment, static text before typed
+// parameters before untyped ones before the rest of the path
+func moreSpecific(a, b *compiledRoute) bool {
+	for i := 0; i < len(a.segments) && i < len(b.segments); i++ {
+		if a.segments[i].kind != b.segments[i].kind {
+			return a.segments[i].kind < b.segments[i].kind
+		}
+	}
+	if len(a.segments) != len(b.segments) {
+		return len(a.segments) > len(b.segments)
+	}
+	return a.Pattern < b.Pattern
+}
+
+// match returns the path parameters if the route matches the path segments
+func (r *compiledRoute) match(parts []string) (map[string]string, bool) {
+	params := map[string]string{}
+	for i, s := range r.segments {
+		if s.kind == segmentRest {
+			params[s.value] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch s.kind {
+		case segmentStatic:
+			if parts[i] != s.value {
+				return nil, false
+			}
+		case segmentInt:
+			if _, err := strconv.Atoi(parts[i]); err != nil {
+				return nil, false
+			}
+			params[s.value] = parts[i]
+		case segmentString:
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[s.value] = parts[i]
+		}
+	}
+	return params, len(parts) == len(r.segments)
+}
+
+func (r *compiledRoute) allows(method string) bool {
+	if r.Methods == nil {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == method || (m == "GET" && method == "HEAD") {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup finds the route for a request. If the path matches but no route
+// allows the method, the allowed methods are returned instead.
+func (t *routeTable) lookup(method, path string) (*compiledRoute, map[string]string, []string) {
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+
+	var allowed []string
+	for _, r := range t.static[path] {
+		if r.allows(method) {
+			return r, map[string]string{}, nil
+		}
+		allowed = append(allowed, r.Methods...)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for _, r := range t.dynamic {
+		params, ok := r.match(parts)
+		if !ok {
+			continue
+		}
+		if r.allows(method) {
+			return r, params, nil
+		}
+		allowed = append(allowed, r.Methods...)
+	}
+	return nil, nil, allowed
+}
+
+// methodNotAllowed answers a request to a known path with the wrong method
+func methodNotAllowed(allowed []string) RouteResponse {
+	seen := map[string]bool{}
+	methods := []string{}
+	for _, m := range append(allowed, "OPTIONS") {
+		if !seen[m] {
+			seen[m] = true
+			methods = append(methods, m)
+		}
+		if m == "GET" && !seen["HEAD"] {
+			seen["HEAD"] = true
+			methods = append(methods, "HEAD")
+		}
+	}
+	sort.Strings(methods)
+
+	r := respond([]byte("{\"error\": \"Method not allowed\"}"), "application/json")
+	r.StatusCode = http.StatusMethodNotAllowed
+	return r.withHeader("Allow", strings.Join(methods, ", "))
+}
+
+// pathParam returns a path parameter of the matched route
+func pathParam(res types.Response, name string) string {
+	return res.PathParams[name]
+}
+
+// pathInt returns an integer path parameter, or def if it is out of bounds
+func pathInt(res types.Response, name string, def, min, max int) int {
+	n, err := strconv.Atoi(res.PathParams[name])
+	if err != nil || n < min || n > max {
+		return def
+	}
+	return n
+}
+
+// openAPIPaths documents every route with a RouteDoc
+func (t *routeTable) openAPIPaths() map[string]interface{} {
+	paths := map[string]interface{}{}
+	for _, r := range t.routes {
+		if r.Doc == nil {
+			continue
+		}
+		cr := compiledRoute{Route: r, segments: parsePattern(r.Pattern)}
+
+		path := "/"
+		var parts []string
+		for _, s := range cr.segments {
+			if s.kind == segmentStatic {
+				parts = append(parts, s.value)
+			} else {
+				parts = append(parts, "{"+s.value+"}")
+			}
+		}
+		path += strings.Join(parts, "/")
+
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+		methods := r.Methods
+		if methods == nil {
+			// Routes answering every method are listed as GET
+			methods = []string{"GET"}
+		}
+		for _, m := range methods {
+			item[strings.ToLower(m)] = cr.operation()
+		}
+	}
+	return paths
+}
+
+func (r *compiledRoute) operation() map[string]interface{} {
+	doc := r.Doc
+	op := map[string]interface{}{
+		"tags":    []string{doc.Tag},
+		"summary": doc.Summary,
+	}
+	if doc.Description != "" {
+		op["description"] = doc.Description
+	}
+	if r.Methods == nil {
+		op["x-any-method"] = true
+	}
+
+	documented := map[string]DocParam{}
+	for _, p := range doc.Params {
+		documented[p.Name] = p
+	}
+	params := []map[string]interface{}{}
+	for _, s := range r.segments {
+		if s.kind == segmentStatic {
+			continue
+		}
+		p, ok := documented[s.value]
+		if !ok {
+			p = DocParam{Name: s.value}
+		}
+		if p.Type == "" && s.kind == segmentInt {
+			p.Type = "integer"
+		}
+		p.In = "path"
+		p.Required = true
+		params = append(params, p.openAPI())
+	}
+	for _, p := range doc.Params {
+		if p.In == "" || p.In == "query" {
+			p.In = "query"
+			params = append(params, p.openAPI())
+		}
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if len(doc.RequestTypes) > 0 {
+		content := map[string]interface{}{}
+		for _, ct := range doc.RequestTypes {
+			schema := map[string]string{"type": "object"}
+			if ct == "application/octet-stream" {
+				schema = map[string]string{"type": "string", "format": "binary"}
+			}
+			content[ct] = map[string]interface{}{"schema": schema}
+		}
+		op["requestBody"] = map[string]interface{}{"content": content}
+	}
+
+	responses := map[string]interface{}{}
+	if len(doc.Responses) == 0 {
+		responses["200"] = map[string]interface{}{"description": "Successful response"}
+	}
+	for code, description := range doc.Responses {
+		responses[code] = map[string]interface{}{"description": description}
+	}
+	if doc.Schema != nil {
+		ok, _ := responses["200"].(map[string]interface{})
+		if ok == nil {
+			ok = map[string]interface{}{"description": "Successful response"}
+			responses["200"] = ok
+		}
+		ok["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": doc.Schema},
+		}
+	}
+	if r.Methods != nil {
+		responses["405"] = map[string]interface{}{"description": "Method not allowed"}
+	}
+	op["responses"] = responses
+	return op
+}
+
+func (p DocParam) openAPI() map[string]interface{} {
+	schema := map[string]interface{}{"type": "string"}
+	if p.Type != "" {
+		schema["type"] = p.Type
+	}
+	if p.Max > 0 {
+		schema["minimum"] = p.Min
+		schema["maximum"] = p.Max
+	}
+	param := map[string]interface{}{
+		"name":   p.Name,
+		"in":     p.In,
+		"schema": schema,
+	}
+	if p.Required {
+		param["required"] = true
+	}
+	if p.Description != "" {
+		param["description"] = p.Description
+	}
+	return param
+}
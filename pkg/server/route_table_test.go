@@ -0,0 +1,51 @@
+package server
+
+import "testing"
+
+func TestRouteTable(t *testing.T) {
+	srv, _, _ := setupTest()
+	table := srv.routeTable()
+
+	cases := []struct {
+		method, path, pattern string
+		params                map[string]string
+	}{
+		{"GET", "/redirect-to", "/redirect-to", nil},
+		{"GET", "/redirect/3", "/redirect/{n:int}", map[string]string{"n": "3"}},
+		{"GET", "/sse", "/sse", nil},
+		{"GET", "/sse/", "/sse", nil},
+		{"GET", "/sse/5", "/sse/{n:int}", map[string]string{"n": "5"}},
+		{"POST", "/status/200,500:2", "/status/{codes}", map[string]string{"codes": "200,500:2"}},
+		{"PUT", "/anything/a/b", "/anything/{path...}", map[string]string{"path": "a/b"}},
+		{"HEAD", "/get", "/get", nil},
+	}
+	for _, c := range cases {
+		route, params, _ := table.lookup(c.method, c.path)
+		if route == nil || route.Pattern != c.pattern {
+			t.Fatalf("%s %s: expected %s, got %+v", c.method, c.path, c.pattern, route)
+		}
+		for k, v := range c.params {
+			if params[k] != v {
+				t.Fatalf("%s %s: expected %s=%s, got %v", c.method, c.path, k, v, params)
+			}
+		}
+	}
+
+	if route, _, _ := table.lookup("GET", "/delay/abc"); route != nil {
+		t.Fatalf("Expected /delay/abc not to match, got %s", route.Pattern)
+	}
+	route, _, allowed := table.lookup("GET", "/post")
+	if route != nil || len(allowed) != 1 || allowed[0] != "POST" {
+		t.Fatalf("Expected GET /post to be rejected, got %v %v", route, allowed)
+	}
+	if res := methodNotAllowed(allowed); res.StatusCode != 405 || res.Headers.Get("Allow") != "OPTIONS, POST" {
+		t.Fatalf("Unexpected 405 response %d %v", res.StatusCode, res.Headers)
+	}
+
+	paths := table.openAPIPaths()
+	for _, p := range []string{"/get", "/status/{codes}", "/delay/{n}", "/api/all"} {
+		if _, ok := paths[p]; !ok {
+			t.Fatalf("Expected %s in the OpenAPI paths", p)
+		}
+	}
+}
@@ -21,8 +21,38 @@ func cleanIP(ip string) string {
 	return strings.Trim(ip, "[]")
 }
 
-// Router returns bytes and content type that should be sent to the client
-func Router(path string, res types.Response, srv *Server) ([]byte, string) {
+// Router returns the response that should be sent to the client
+func Router(path string, res types.Response, srv *Server) RouteResponse {
+	res = completeResponse(res, srv)
+
+	u, err := url.Parse("https://tls.peet.ws" + path)
+	var m map[string][]string
+	if err != nil || u == nil {
+		m = make(map[string][]string)
+	} else {
+		m, _ = url.ParseQuery(u.RawQuery)
+	}
+
+	if u != nil {
+		route, params, allowed := srv.routeTable().lookup(res.Method, u.Path)
+		if route != nil {
+			res.PathParams = params
+			return route.Handler(res, m)
+		}
+		if len(allowed) > 0 {
+			return methodNotAllowed(allowed)
+		}
+	}
+	// 404
+	b, _ := utils.ReadFile("static/404.html")
+	page := respond([]byte(strings.ReplaceAll(string(b), "/*DATA*/", fmt.Sprintf("%v", GetTotalRequestCount(srv)))), "text/html")
+	page.StatusCode = 404
+	return page
+}
+
+// completeResponse adds what every response reports (TCP/IP and JA4
+// fingerprints) and logs the request
+func completeResponse(res types.Response, srv *Server) types.Response {
 	if v, ok := srv.GetTCPFingerprints().Load(res.IP); ok {
 		res.TCPIP = v.(types.TCPIPDetails)
 	}
@@ -40,31 +70,5 @@ func Router(path string, res types.Response, srv *Server) ([]byte, string) {
 	if srv.GetConfig().LogToDB && res.Path != "/favicon.ico" {
 		SaveRequest(res, srv)
 	}
-
-	u, err := url.Parse("https://tls.peet.ws" + path)
-	var m map[string][]string
-	if err != nil || u == nil {
-		m = make(map[string][]string)
-	} else {
-		m, _ = url.ParseQuery(u.RawQuery)
-	}
-
-	paths := getAllPaths(srv)
-	if u != nil {
-		// Try exact match first
-		if val, ok := paths[u.Path]; ok {
-			return val(res, m)
-		}
-
-		// Try dynamic path matching (prefix-based)
-		dynamicPaths := getDynamicPaths()
-		for prefix, handler := range dynamicPaths {
-			if strings.HasPrefix(u.Path, prefix) {
-				return handler(res, m)
-			}
-		}
-	}
-	// 404
-	b, _ := utils.ReadFile("static/404.html")
-	return []byte(strings.ReplaceAll(string(b), "/*DATA*/", fmt.Sprintf("%v", GetTotalRequestCount(srv)))), "text/html"
+	return res
 }
@@ -1,33 +1,39 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"log"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/pagpeter/trackme/pkg/store"
 	"github.com/pagpeter/trackme/pkg/types"
 	"github.com/pagpeter/trackme/pkg/utils"
 )
 
-func staticFile(file string) func(types.Response, url.Values) ([]byte, string) {
-	return func(types.Response, url.Values) ([]byte, string) {
+func staticFile(file string) RouteHandler {
+	return func(types.Response, url.Values) RouteResponse {
 		b, _ := utils.ReadFile(file)
-		return b, "text/html"
+		return respond(b, "text/html")
 	}
 }
 
-func apiAll(res types.Response, _ url.Values) ([]byte, string) {
-	return []byte(res.ToJson()), "application/json"
+func apiAll(res types.Response, _ url.Values) RouteResponse {
+	return respond([]byte(res.ToJson()), "application/json")
 }
 
-func apiTLS(res types.Response, _ url.Values) ([]byte, string) {
-	return []byte(types.Response{
+func apiTLS(res types.Response, _ url.Values) RouteResponse {
+	return respond([]byte(types.Response{
 		TLS: res.TLS,
-	}.ToJson()), "application/json"
+	}.ToJson()), "application/json")
 }
 
-func apiClean(res types.Response, _ url.Values) ([]byte, string) {
+func apiClean(res types.Response, _ url.Values) RouteResponse {
 	akamai := "-"
 	hash := "-"
 	if res.HTTPVersion == "h2" {
@@ -51,16 +57,19 @@ func apiClean(res types.Response, _ url.Values) ([]byte, string) {
 		smallRes.PeetPrintHash = res.TLS.PeetPrintHash
 	}
 
-	return []byte(smallRes.ToJson()), "application/json"
+	return respond([]byte(smallRes.ToJson()), "application/json")
 }
 
-func apiRaw(res types.Response, _ url.Values) ([]byte, string) {
-	return []byte(fmt.Sprintf(`{"raw": "%s", "raw_b64": "%s"}`, res.TLS.RawBytes, res.TLS.RawB64)), "application/json"
+func apiRaw(res types.Response, _ url.Values) RouteResponse {
+	if res.TLS == nil {
+		return respond([]byte("{\"error\": \"No TLS handshake on this connection\"}"), "application/json")
+	}
+	return respond([]byte(fmt.Sprintf(`{"raw": "%s", "raw_b64": "%s"}`, res.TLS.RawBytes, res.TLS.RawB64)), "application/json")
 }
 
 // apiSNI extracts and returns the Server Name Indication (SNI) from TLS handshake
 // This allows clients to verify their SNI override is working correctly
-func apiSNI(res types.Response, _ url.Values) ([]byte, string) {
+func apiSNI(res types.Response, _ url.Values) RouteResponse {
 	sni := ""
 	if res.TLS != nil {
 		// Extract SNI from extensions array
@@ -72,6 +81,8 @@ func apiSNI(res types.Response, _ url.Values) ([]byte, string) {
 				}
 			}
 		}
+	} else if res.Http3 != nil {
+		sni = res.Http3.SNI
 	}
 	response := map[string]interface{}{
 		"sni":         sni,
@@ -79,94 +90,547 @@ func apiSNI(res types.Response, _ url.Values) ([]byte, string) {
 		"http_version": res.HTTPVersion,
 	}
 	j, _ := json.Marshal(response)
-	return j, "application/json"
+	return respond(j, "application/json")
+}
+
+// apiH2Active returns how the client reacted to the probing profile that was
+// advertised before this request was answered
+func apiH2Active(res types.Response, _ url.Values) RouteResponse {
+	if res.Http2 == nil {
+		return respond([]byte("{\"error\": \"Active probing is only available over HTTP/2\"}"), "application/json")
+	}
+	response := map[string]interface{}{
+		"akamai_fingerprint":      res.Http2.AkamaiFingerprint,
+		"akamai_fingerprint_hash": res.Http2.AkamaiFingerprintHash,
+		"active":                  res.Http2.Active,
+	}
+	j, _ := json.MarshalIndent(response, "", "  ")
+	return respond(j, "application/json")
+}
+
+// apiH2Profiles lists the server SETTINGS profiles that can be probed with
+func apiH2Profiles(_ types.Response, _ url.Values) RouteResponse {
+	profiles := []map[string]interface{}{}
+	for _, name := range H2ProfileNames() {
+		p, _ := GetH2Profile(name)
+		settings := []string{}
+		for _, s := range p.Settings {
+			settings = append(settings, s.String())
+		}
+		profiles = append(profiles, map[string]interface{}{
+			"name":        p.Name,
+			"description": p.Description,
+			"settings":    settings,
+			"extra_pings": p.ExtraPings,
+			"goaway":      p.GoAwayEarly,
+		})
+	}
+	j, _ := json.MarshalIndent(profiles, "", "  ")
+	return respond(j, "application/json")
+}
+
+// apiH2Push returns how the client handled the resources pushed on this
+// connection
+func apiH2Push(res types.Response, _ url.Values) RouteResponse {
+	if res.Http2 == nil || res.Http2.Push == nil {
+		return respond([]byte("{\"error\": \"Server push is only available over HTTP/2\"}"), "application/json")
+	}
+	j, _ := json.MarshalIndent(res.Http2.Push, "", "  ")
+	return respond(j, "application/json")
+}
+
+// apiH2PushResource is the resource that gets pushed, requesting it directly
+// marks the pushed copy as not reused
+func apiH2PushResource(_ types.Response, _ url.Values) RouteResponse {
+	return respond(pushResourceBody, "application/json")
+}
+
+// apiTimeline returns the frames and milestones of the current connection
+// with their offset from the moment it was accepted
+func apiTimeline(res types.Response, _ url.Values) RouteResponse {
+	if res.Timeline == nil {
+		return respond([]byte("{\"error\": \"No timeline is recorded for this connection\"}"), "application/json")
+	}
+	response := map[string]interface{}{
+		"http_version": res.HTTPVersion,
+		"timeline":     res.Timeline,
+	}
+	j, _ := json.MarshalIndent(response, "", "  ")
+	return respond(j, "application/json")
+}
+
+// apiRTT compares the application level RTT with the TCP RTT
+func apiRTT(res types.Response, _ url.Values) RouteResponse {
+	if res.RTT == nil {
+		return respond([]byte("{\"error\": \"RTT measurements are only available over HTTP/2 and HTTP/3\"}"), "application/json")
+	}
+	j, _ := json.MarshalIndent(res.RTT, "", "  ")
+	return respond(j, "application/json")
 }
 
-func apiRequestCount(srv *Server) func(types.Response, url.Values) ([]byte, string) {
-	return func(_ types.Response, _ url.Values) ([]byte, string) {
+func apiRequestCount(srv *Server) RouteHandler {
+	return func(_ types.Response, _ url.Values) RouteResponse {
 		if !srv.IsConnectedToDB() {
-			return []byte("{\"error\": \"Not connected to database.\"}"), "application/json"
+			return respond([]byte("{\"error\": \"Not connected to database.\"}"), "application/json")
 		}
-		return []byte(fmt.Sprintf(`{"total_requests": %v}`, GetTotalRequestCount(srv))), "application/json"
+		return respond([]byte(fmt.Sprintf(`{"total_requests": %v}`, GetTotalRequestCount(srv))), "application/json")
+	}
+}
+
+func apiLogQueue(srv *Server) RouteHandler {
+	return func(_ types.Response, _ url.Values) RouteResponse {
+		if !srv.IsConnectedToDB() {
+			return respond([]byte("{\"error\": \"Not connected to database.\"}"), "application/json")
+		}
+		j, _ := json.MarshalIndent(srv.requestLogger().stats(), "", "  ")
+		return respond(j, "application/json")
 	}
 }
 
 // apiSearchHandler creates a search endpoint handler with common validation logic
-func apiSearchHandler(srv *Server, searchFn func(string, *Server) interface{}) func(types.Response, url.Values) ([]byte, string) {
-	return func(_ types.Response, u url.Values) ([]byte, string) {
+func apiSearchHandler(srv *Server, searchFn func(string, searchParams, *Server) interface{}) RouteHandler {
+	return func(_ types.Response, u url.Values) RouteResponse {
 		if !srv.IsConnectedToDB() {
-			return []byte("{\"error\": \"Not connected to database.\"}"), "application/json"
+			return respond([]byte("{\"error\": \"Not connected to database.\"}"), "application/json")
 		}
 		by := utils.GetParam("by", u)
 		if by == "" {
-			return []byte("{\"error\": \"No 'by' param present\"}"), "application/json"
+			return respond([]byte("{\"error\": \"No 'by' param present\"}"), "application/json")
+		}
+		p, err := parseSearchParams(u)
+		if err != nil {
+			return jsonError(http.StatusBadRequest, err.Error())
 		}
-		res := searchFn(by, srv)
+		res := searchFn(by, p, srv)
 		j, _ := json.MarshalIndent(res, "", "\t")
-		return j, "application/json"
+		return respond(j, "application/json")
 	}
 }
 
-func apiSearchJA3(srv *Server) func(types.Response, url.Values) ([]byte, string) {
-	return apiSearchHandler(srv, func(by string, s *Server) interface{} { return GetByJa3(by, s) })
+func apiSearchJA3(srv *Server) RouteHandler {
+	return apiSearchHandler(srv, func(by string, p searchParams, s *Server) interface{} { return GetByJa3(by, p, s) })
 }
 
-func apiSearchH2(srv *Server) func(types.Response, url.Values) ([]byte, string) {
-	return apiSearchHandler(srv, func(by string, s *Server) interface{} { return GetByH2(by, s) })
+func apiSearchH2(srv *Server) RouteHandler {
+	return apiSearchHandler(srv, func(by string, p searchParams, s *Server) interface{} { return GetByH2(by, p, s) })
 }
 
-func apiSearchPeetPrint(srv *Server) func(types.Response, url.Values) ([]byte, string) {
-	return apiSearchHandler(srv, func(by string, s *Server) interface{} { return GetByPeetPrint(by, s) })
+func apiSearchPeetPrint(srv *Server) RouteHandler {
+	return apiSearchHandler(srv, func(by string, p searchParams, s *Server) interface{} { return GetByPeetPrint(by, p, s) })
 }
 
-func apiSearchUserAgent(srv *Server) func(types.Response, url.Values) ([]byte, string) {
-	return apiSearchHandler(srv, func(by string, s *Server) interface{} { return GetByUserAgent(by, s) })
+func apiSearchUserAgent(srv *Server) RouteHandler {
+	return apiSearchHandler(srv, func(by string, p searchParams, s *Server) interface{} { return GetByUserAgent(by, p, s) })
+}
+
+func apiSearchBrowser(srv *Server) RouteHandler {
+	return func(_ types.Response, u url.Values) RouteResponse {
+		if !srv.IsConnectedToDB() {
+			return respond([]byte("{\"error\": \"Not connected to database.\"}"), "application/json")
+		}
+		b := ByBrowser{
+			Family: utils.GetParam("family", u),
+			Major:  utils.GetParam("major", u),
+			OS:     utils.GetParam("os", u),
+			Device: utils.GetParam("device", u),
+		}
+		if b.Family == "" && b.OS == "" && b.Device == "" {
+			return jsonError(http.StatusBadRequest, "family, os or device is needed")
+		}
+		if b.Major != "" && b.Family == "" {
+			return jsonError(http.StatusBadRequest, "major needs a family")
+		}
+		p, err := parseSearchParams(u)
+		if err != nil {
+			return jsonError(http.StatusBadRequest, err.Error())
+		}
+		j, _ := json.MarshalIndent(GetByBrowser(b, p, srv), "", "\t")
+		return respond(j, "application/json")
+	}
 }
 
-func index(r types.Response, v url.Values) ([]byte, string) {
-	res, ct := staticFile("static/index.html")(r, v)
+func index(r types.Response, v url.Values) RouteResponse {
+	page := staticFile("static/index.html")(r, v)
 	data, _ := json.Marshal(r)
-	return []byte(strings.ReplaceAll(string(res), "/*DATA*/", string(data))), ct
+	page.Body = []byte(strings.ReplaceAll(string(page.Body), "/*DATA*/", string(data)))
+	return page
 }
 
-func apiSearchJA4(srv *Server) func(types.Response, url.Values) ([]byte, string) {
-	return apiSearchHandler(srv, func(by string, s *Server) interface{} { return GetByJA4(by, s) })
+func apiSearchJA4(srv *Server) RouteHandler {
+	return apiSearchHandler(srv, func(by string, p searchParams, s *Server) interface{} { return GetByJA4(by, p, s) })
 }
 
-func apiSearchJA4H(srv *Server) func(types.Response, url.Values) ([]byte, string) {
-	return apiSearchHandler(srv, func(by string, s *Server) interface{} { return GetByJA4H(by, s) })
+func apiSearchJA4H(srv *Server) RouteHandler {
+	return apiSearchHandler(srv, func(by string, p searchParams, s *Server) interface{} { return GetByJA4H(by, p, s) })
+}
+
+// FingerprintRollup is the answer of /api/fingerprint
+type FingerprintRollup struct {
+	Type      string                        `json:"type"`
+	Value     string                        `json:"value"`
+	Count     int64                         `json:"count"`
+	FirstSeen int64                         `json:"first_seen"`
+	LastSeen  int64                         `json:"last_seen"`
+	Daily     map[string]int64              `json:"daily"`
+	Related   map[string][]store.ValueCount `json:"related"`
+}
+
+// rollupTypeAliases lets clients use the names the fingerprints are known by
+var rollupTypeAliases = map[string]string{"akamai": "h2", "useragent": "user_agent"}
+
+func apiFingerprint(srv *Server) RouteHandler {
+	return func(res types.Response, _ url.Values) RouteResponse {
+		if !srv.IsConnectedToDB() {
+			return respond([]byte("{\"error\": \"Not connected to database.\"}"), "application/json")
+		}
+		typ := pathParam(res, "type")
+		if alias, ok := rollupTypeAliases[typ]; ok {
+			typ = alias
+		}
+		if !store.IsRollupType(typ) {
+			return jsonError(http.StatusBadRequest, "Unknown type, use one of: "+strings.Join(store.RollupTypes, ", "))
+		}
+
+		value := pathParam(res, "value")
+		r, ok, err := srv.GetStore().Rollup(typ, value)
+		if err != nil {
+			log.Println("Error loading rollup:", err)
+			return jsonError(http.StatusInternalServerError, "Could not load the fingerprint")
+		}
+		if !ok {
+			return jsonError(http.StatusNotFound, "Fingerprint not seen yet")
+		}
+
+		out := FingerprintRollup{
+			Type:      r.Type,
+			Value:     r.Value,
+			Count:     r.Count,
+			FirstSeen: r.FirstSeen,
+			LastSeen:  r.LastSeen,
+			Daily:     r.Daily,
+			Related:   map[string][]store.ValueCount{},
+		}
+		for t := range r.Related {
+			out.Related[t] = r.Top(t)
+		}
+		j, _ := json.MarshalIndent(out, "", "  ")
+		return respond(j, "application/json")
+	}
 }
 
-func getAllPaths(srv *Server) map[string]func(types.Response, url.Values) ([]byte, string) {
-	// Start with existing routes
-	paths := map[string]func(types.Response, url.Values) ([]byte, string){
-		"/":                     index,
-		"/explore":              staticFile("static/explore.html"),
-		"/docs":                 staticFile("static/docs.html"),
-		"/openapi.json":         httpbinOpenAPI,
-		"/api/all":              apiAll,
-		"/api/tls":              apiTLS,
-		"/api/clean":            apiClean,
-		"/api/raw":              apiRaw,
-		"/api/sni":              apiSNI,
-		"/api/request-count":    apiRequestCount(srv),
-		"/api/search-ja3":       apiSearchJA3(srv),
-		"/api/search-ja4":       apiSearchJA4(srv),
-		"/api/search-ja4h":      apiSearchJA4H(srv),
-		"/api/search-h2":        apiSearchH2(srv),
-		"/api/search-peetprint": apiSearchPeetPrint(srv),
-		"/api/search-useragent": apiSearchUserAgent(srv),
+const (
+	defaultNewLimit = 100
+	// defaultNewWindow is searched when /api/new has no since
+	defaultNewWindow = 24 * time.Hour
+)
+
+func apiRequest(srv *Server) RouteHandler {
+	return func(res types.Response, _ url.Values) RouteResponse {
+		if !srv.IsConnectedToDB() {
+			return respond([]byte("{\"error\": \"Not connected to database.\"}"), "application/json")
+		}
+		snap, ok, err := srv.GetStore().Snapshot(pathParam(res, "id"))
+		if err != nil {
+			log.Println("Error loading snapshot:", err)
+			return jsonError(http.StatusInternalServerError, "Could not load the request")
+		}
+		if !ok {
+			return jsonError(http.StatusNotFound, "Request not found or expired")
+		}
+		var out bytes.Buffer
+		json.Indent(&out, snap.Data, "", "  ")
+		return respond(out.Bytes(), "application/json")
 	}
+}
 
-	// Add HTTPBin-compatible routes
-	for path, handler := range getHTTPBinPaths() {
-		paths[path] = handler
+func apiNew(srv *Server) RouteHandler {
+	return func(_ types.Response, u url.Values) RouteResponse {
+		if !srv.IsConnectedToDB() {
+			return respond([]byte("{\"error\": \"Not connected to database.\"}"), "application/json")
+		}
+		since, err := parseTime(utils.GetParam("since", u))
+		if err != nil {
+			return jsonError(http.StatusBadRequest, "since: "+err.Error())
+		}
+		if since == 0 {
+			since = time.Now().Add(-defaultNewWindow).Unix()
+		}
+		typ := utils.GetParam("type", u)
+		if alias, ok := rollupTypeAliases[typ]; ok {
+			typ = alias
+		}
+		if typ != "" && !store.IsRollupType(typ) {
+			return jsonError(http.StatusBadRequest, "Unknown type, use one of: "+strings.Join(store.RollupTypes, ", "))
+		}
+		limit := defaultNewLimit
+		if v := utils.GetParam("limit", u); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxSearchLimit {
+				return jsonError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit))
+			}
+		}
+
+		rollups, err := srv.GetStore().NewRollups(since, typ, limit)
+		if err != nil {
+			log.Println("Error loading rollups:", err)
+			return jsonError(http.StatusInternalServerError, "Could not load the fingerprints")
+		}
+		// Only the summary, the details are at /api/fingerprint
+		for i := range rollups {
+			rollups[i].Daily, rollups[i].Related = nil, nil
+		}
+		j, _ := json.MarshalIndent(map[string]interface{}{
+			"since":        since,
+			"fingerprints": rollups,
+		}, "", "  ")
+		return respond(j, "application/json")
 	}
+}
+
+// jsonError returns {"error": msg} with the status
+func jsonError(status int, msg string) RouteResponse {
+	j, _ := json.Marshal(map[string]string{"error": msg})
+	r := respond(j, "application/json")
+	r.StatusCode = status
+	return r
+}
 
-	return paths
+// searchDoc documents a search endpoint
+func searchDoc(identifier string) *RouteDoc {
+	return &RouteDoc{
+		Tag:         "Database",
+		Summary:     "Identifiers seen together with a " + identifier,
+		Description: "Counts the other identifiers of the stored requests with this " + identifier + ", most seen first. Every list is paged with limit and offset, or the next_cursor of the previous page. total, first_seen and last_seen cover all matching requests.",
+		Params: []DocParam{
+			{Name: "by", Description: "The " + identifier + " to search for", Required: true},
+			{Name: "limit", Type: "integer", Description: "Values per list, 10 by default", Min: 1, Max: maxSearchLimit},
+			{Name: "offset", Type: "integer", Description: "Values to skip in every list"},
+			{Name: "cursor", Description: "next_cursor of the previous page, replaces offset"},
+			{Name: "since", Description: "Only requests at or after this time, unix seconds or RFC 3339"},
+			{Name: "until", Description: "Only requests at or before this time, unix seconds or RFC 3339"},
+		},
+		Responses: map[string]string{"200": "Identifier counts", "400": "Invalid paging or time range"},
+	}
 }
 
-// getDynamicPaths returns handlers that match path prefixes (e.g., /delay/5)
-func getDynamicPaths() map[string]func(types.Response, url.Values) ([]byte, string) {
-	return getDynamicHTTPBinPaths()
+// getRoutes returns every route the server answers
+func getRoutes(srv *Server) []Route {
+	get := []string{"GET"}
+	fingerprint := "TLS Fingerprinting"
+
+	// The fingerprinting endpoints answer every method, so any request can
+	// be fingerprinted
+	routes := []Route{
+		{Pattern: "/", Methods: get, Handler: index},
+		{Pattern: "/explore", Methods: get, Handler: staticFile("static/explore.html")},
+		{Pattern: "/docs", Methods: get, Handler: staticFile("static/docs.html")},
+		{Pattern: "/openapi.json", Methods: get, Handler: httpbinOpenAPI(srv)},
+		{Pattern: "/api/all", Handler: apiAll, Doc: &RouteDoc{
+			Tag:         fingerprint,
+			Summary:     "Returns complete TLS fingerprint data",
+			Description: "Returns full TLS fingerprint including JA3, JA4, PeetPrint, Akamai fingerprint, and all extensions",
+			Responses:   map[string]string{"200": "Complete fingerprint response"},
+		}},
+		{Pattern: "/api/tls", Handler: apiTLS, Doc: &RouteDoc{
+			Tag:         fingerprint,
+			Summary:     "Returns TLS-only fingerprint data",
+			Description: "Returns only the TLS fingerprint data (JA3, JA4, extensions) without HTTP details",
+			Responses:   map[string]string{"200": "TLS fingerprint response"},
+		}},
+		{Pattern: "/api/clean", Handler: apiClean, Doc: &RouteDoc{
+			Tag:         fingerprint,
+			Summary:     "Returns clean fingerprint summary",
+			Description: "Returns a minimal fingerprint summary with just the hash values",
+			Responses:   map[string]string{"200": "Clean fingerprint response"},
+		}},
+		{Pattern: "/api/raw", Handler: apiRaw},
+		{Pattern: "/api/sni", Handler: apiSNI, Doc: &RouteDoc{
+			Tag:         fingerprint,
+			Summary:     "Returns the SNI (Server Name Indication) from TLS handshake",
+			Description: "Extracts and returns the SNI hostname sent during TLS handshake. Useful for verifying SNI override functionality.",
+			Responses:   map[string]string{"200": "SNI information"},
+			Schema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"sni":          map[string]string{"type": "string", "description": "Server Name Indication hostname"},
+					"ip":           map[string]string{"type": "string", "description": "Client IP address"},
+					"http_version": map[string]string{"type": "string", "description": "HTTP version (h1, h2, h3)"},
+				},
+			},
+		}},
+		{Pattern: "/api/h2/active", Handler: apiH2Active, Doc: &RouteDoc{
+			Tag:         fingerprint,
+			Summary:     "Actively probes the HTTP/2 client",
+			Description: "Advertises a server SETTINGS profile mid-connection and reports how the client reacted (ACK latency, WINDOW_UPDATE pattern, honoured limits). HTTP/2 only.",
+			Params: []DocParam{
+				{Name: "profile", Description: "Profile name, see /api/h2/profiles"},
+			},
+			Responses: map[string]string{"200": "Active HTTP/2 fingerprint"},
+		}},
+		{Pattern: "/api/h2/profiles", Handler: apiH2Profiles, Doc: &RouteDoc{
+			Tag:       fingerprint,
+			Summary:   "Lists the server SETTINGS profiles used for active probing",
+			Responses: map[string]string{"200": "Available profiles"},
+		}},
+		{Pattern: "/api/h2/push", Handler: apiH2Push, Doc: &RouteDoc{
+			Tag:         fingerprint,
+			Summary:     "Probes HTTP/2 server push handling",
+			Description: "Sends a PUSH_PROMISE for /api/h2/push/resource when the client enabled push and reports whether it was cancelled with RST_STREAM and how quickly. HTTP/2 only.",
+			Responses:   map[string]string{"200": "Push fingerprint"},
+		}},
+		{Pattern: "/api/h2/push/resource", Handler: apiH2PushResource, Doc: &RouteDoc{
+			Tag:         fingerprint,
+			Summary:     "The resource pushed by /api/h2/push",
+			Description: "Requesting it on the same connection marks the pushed copy as refetched (not reused).",
+			Responses:   map[string]string{"200": "Pushed resource"},
+		}},
+		{Pattern: "/api/h2/push/result", Handler: apiH2Push, Doc: &RouteDoc{
+			Tag:       fingerprint,
+			Summary:   "Push fingerprint of the connection without pushing again",
+			Responses: map[string]string{"200": "Push fingerprint"},
+		}},
+		{Pattern: "/api/timeline", Handler: apiTimeline, Doc: &RouteDoc{
+			Tag:         fingerprint,
+			Summary:     "Frame timeline of the current connection",
+			Description: "Returns the TLS handshake, preface and every received frame with its offset in milliseconds from the moment the connection was accepted. HTTP/1 and HTTP/2 only.",
+			Responses:   map[string]string{"200": "Ordered connection timeline"},
+		}},
+		{Pattern: "/api/rtt", Handler: apiRTT, Doc: &RouteDoc{
+			Tag:         fingerprint,
+			Summary:     "Compares the application RTT with the TCP RTT",
+			Description: "Times HTTP/2 PINGs (or reads the QUIC RTT for HTTP/3) and compares them with the TCP RTT from TCP_INFO or the sniffer. A large gap means a TLS terminating proxy is likely.",
+			Responses:   map[string]string{"200": "RTT comparison and proxy flag"},
+		}},
+		{Pattern: "/api/request-count", Handler: apiRequestCount(srv)},
+		{Pattern: "/api/log-queue", Handler: apiLogQueue(srv), Doc: &RouteDoc{
+			Tag:         "Database",
+			Summary:     "State of the request log queue",
+			Description: "Request logs are queued and stored in batches by a background writer. Returns the queue depth and capacity, the full queue policy (drop or block) and how many logs were written, dropped or failed to store.",
+			Responses:   map[string]string{"200": "Queue counters"},
+		}},
+		{Pattern: "/api/search-ja3", Handler: apiSearchJA3(srv), Doc: searchDoc("JA3")},
+		{Pattern: "/api/search-ja4", Handler: apiSearchJA4(srv), Doc: searchDoc("JA4")},
+		{Pattern: "/api/search-ja4h", Handler: apiSearchJA4H(srv), Doc: searchDoc("JA4H")},
+		{Pattern: "/api/search-h2", Handler: apiSearchH2(srv), Doc: searchDoc("Akamai HTTP/2 fingerprint")},
+		{Pattern: "/api/search-peetprint", Handler: apiSearchPeetPrint(srv), Doc: searchDoc("PeetPrint")},
+		{Pattern: "/api/search-useragent", Handler: apiSearchUserAgent(srv), Doc: searchDoc("user agent")},
+		{Pattern: "/api/search-browser", Handler: apiSearchBrowser(srv), Doc: &RouteDoc{
+			Tag:         "Database",
+			Summary:     "Fingerprint distribution of a browser group",
+			Description: "Counts the JA4s, Akamai HTTP/2 fingerprints, PeetPrints and major versions of the requests whose user agent was parsed as the given browser family, major version, OS and device. Requests logged before user agents were parsed are not matched.",
+			Params: []DocParam{
+				{Name: "family", Description: "Browser family, e.g. Chrome, Firefox, Safari, Edge, Opera, curl or Other"},
+				{Name: "major", Description: "Major version, e.g. 124, needs family"},
+				{Name: "os", Description: "Windows, macOS, iOS, Android, ChromeOS or Linux"},
+				{Name: "device", Description: "Desktop, Mobile, Tablet or Bot"},
+				{Name: "limit", Type: "integer", Description: "Values per list, 10 by default", Min: 1, Max: maxSearchLimit},
+				{Name: "offset", Type: "integer", Description: "Values to skip in every list"},
+				{Name: "cursor", Description: "next_cursor of the previous page, replaces offset"},
+				{Name: "since", Description: "Only requests at or after this time, unix seconds or RFC 3339"},
+				{Name: "until", Description: "Only requests at or before this time, unix seconds or RFC 3339"},
+			},
+			Responses: map[string]string{"200": "Fingerprint counts", "400": "No attribute, or invalid paging or time range"},
+		}},
+		{Pattern: "/api/fingerprint/{type}/{value...}", Handler: apiFingerprint(srv), Doc: &RouteDoc{
+			Tag:         "Database",
+			Summary:     "Rollup of one fingerprint value",
+			Description: "Total count, first and last seen time, daily counts (90 days) and the most seen co-occurring values of the other types. Types: ja3, ja4, ja4h, h2 (or akamai), peetprint, user_agent. Values with slashes can be sent as they are.",
+			Params: []DocParam{
+				{Name: "type", In: "path", Description: "Fingerprint type", Required: true},
+				{Name: "value", In: "path", Description: "Fingerprint value", Required: true},
+			},
+			Responses: map[string]string{"200": "Fingerprint rollup", "400": "Unknown type", "404": "Fingerprint not seen yet"},
+		}},
+		{Pattern: "/api/new", Handler: apiNew(srv), Doc: &RouteDoc{
+			Tag:         "Database",
+			Summary:     "Fingerprints first seen recently",
+			Description: "Lists the fingerprint values first seen at or after since, newest first, e.g. to spot a browser release with a new fingerprint.",
+			Params: []DocParam{
+				{Name: "since", Description: "Unix seconds or RFC 3339, 24 hours ago by default"},
+				{Name: "type", Description: "Only this fingerprint type"},
+				{Name: "limit", Type: "integer", Description: "At most this many, 100 by default", Min: 1, Max: maxSearchLimit},
+			},
+			Responses: map[string]string{"200": "New fingerprints", "400": "Invalid params"},
+		}},
+		{Pattern: "/api/similar", Handler: apiSimilar(srv), Doc: &RouteDoc{
+			Tag:         "Database",
+			Summary:     "Stored fingerprints closest to a fingerprint",
+			Description: "Scores every stored PeetPrint (or JA3, or Akamai HTTP/2 fingerprint if that is all that is given) by the Jaccard similarity of its ciphers, extensions, groups, signature algorithms and HTTP/2 settings, averaged, and lists the differing elements of each. The HTTP/2 settings of a stored fingerprint are those most seen with it. With ja4 or its sections, the stored JA4s are scored by the sections they share.",
+			Params: []DocParam{
+				{Name: "id", Description: "X-Request-Id of a request with a stored snapshot"},
+				{Name: "peetprint", Description: "PeetPrint"},
+				{Name: "ja3", Description: "JA3 string"},
+				{Name: "h2", Description: "Akamai HTTP/2 fingerprint, alone or with a TLS fingerprint"},
+				{Name: "ja4", Description: "JA4, compared section by section"},
+				{Name: "ja4_a", Description: "JA4 a section, e.g. t13d1516h2"},
+				{Name: "ja4_b", Description: "JA4 b section (cipher hash)"},
+				{Name: "ja4_c", Description: "JA4 c section (extension hash)"},
+				{Name: "limit", Type: "integer", Description: "At most this many, 10 by default", Min: 1, Max: maxSearchLimit},
+			},
+			Responses: map[string]string{"200": "Closest fingerprints", "400": "Invalid params", "404": "Request not found"},
+		}},
+		{Pattern: "/api/compare", Handler: apiCompare(srv), Doc: &RouteDoc{
+			Tag:         fingerprint,
+			Summary:     "Difference between two requests or fingerprints",
+			Description: "a and b are X-Request-Ids of requests with a stored snapshot, or PeetPrint, JA3, JA4 or Akamai HTTP/2 fingerprints. Two requests are compared by their cipher suites (added, removed and reordered), extensions and their parameters (e.g. key_share groups, ALPN protocols), JA4 sections, HTTP/2 SETTINGS, window update, priority and pseudo-header order, and header order. A request and a fingerprint are compared by the fingerprint of the request of that type. GREASE and the extension order are ignored, since clients randomize them.",
+			Params: []DocParam{
+				{Name: "a", Description: "Request ID or fingerprint", Required: true},
+				{Name: "b", Description: "Request ID or fingerprint", Required: true},
+			},
+			Responses: map[string]string{"200": "Structured diff", "400": "Invalid or incomparable fingerprints", "404": "Request not found"},
+		}},
+		{Pattern: "/api/admin/ip/{ip}", Methods: []string{"DELETE"}, Handler: apiAdminDeleteIP(srv), Doc: &RouteDoc{
+			Tag:         "Database",
+			Summary:     "Delete all data of an IP",
+			Description: "Deletes the request logs and snapshots stored with the IP, as it is stored with the current log_ip_mode (with truncate, the whole network). The anonymous rollups are kept. Needs the admin_token as a bearer token in the Authorization header.",
+			Params: []DocParam{
+				{Name: "ip", In: "path", Description: "IPv4 or IPv6 address", Required: true},
+			},
+			Responses: map[string]string{"200": "Number of deleted records", "400": "Invalid IP, or IPs are not stored", "401": "Wrong admin token", "403": "No admin_token configured"},
+		}},
+		{Pattern: "/api/request/{id}", Handler: apiRequest(srv), Doc: &RouteDoc{
+			Tag:         "Database",
+			Summary:     "Snapshot of a past request",
+			Description: "Everything parsed from the request with this X-Request-Id: the raw ClientHello, TLS extensions, HTTP/2 frames and headers. Snapshots are only kept with the snapshots option, until snapshot_ttl_hours have passed, and the returned permalink can be shared.",
+			Params: []DocParam{
+				{Name: "id", In: "path", Description: "X-Request-Id of the request", Required: true},
+			},
+			Responses: map[string]string{"200": "Request snapshot", "404": "Not stored or expired"},
+		}},
+	}
+
+	// The API answers in the format the client asks for
+	formatParams := []DocParam{
+		{Name: "format", Description: "Output format: " + strings.Join(formatNames(), ", ") + ". Defaults to the Accept header, then indented JSON"},
+		{Name: "fields", Description: "Comma separated paths to return, e.g. tls.ja4,http2.akamai_fingerprint"},
+	}
+	for i, r := range routes {
+		if !strings.HasPrefix(r.Pattern, "/api/") {
+			continue
+		}
+		routes[i].Handler = negotiated(r.Handler)
+		if r.Doc != nil {
+			doc := *r.Doc
+			doc.Params = append(append([]DocParam{}, doc.Params...), formatParams...)
+			routes[i].Doc = &doc
+		}
+	}
+
+	// The export streams its own formats, so it is added after negotiation
+	routes = append(routes, Route{Pattern: "/api/export", Methods: get, Handler: apiExport(srv), Doc: &RouteDoc{
+		Tag:         "Database",
+		Summary:     "Streams the stored request logs",
+		Description: "Streams every stored request log matching the filters, oldest first, as NDJSON (one JSON object per line) or CSV with a header row. The logs are read in batches, so exports of any size use the same memory. The logs include the stored IPs, so this needs the admin_token as a bearer token in the Authorization header.",
+		Params: []DocParam{
+			{Name: "format", Description: "ndjson (default) or csv"},
+			{Name: "type", Description: "Fingerprint type to filter by: ja3, ja4, ja4h, h2, peetprint or user_agent"},
+			{Name: "value", Description: "Fingerprint value, needs type"},
+			{Name: "ua", Description: "Only user agents containing this, ignoring case"},
+			{Name: "since", Description: "Only requests at or after this time, unix seconds or RFC 3339"},
+			{Name: "until", Description: "Only requests at or before this time, unix seconds or RFC 3339"},
+		},
+		Responses: map[string]string{"200": "NDJSON or CSV stream", "400": "Invalid filters", "401": "Wrong admin token", "403": "No admin_token configured"},
+	}})
+
+	// Add HTTPBin-compatible routes
+	return append(routes, getHTTPBinRoutes(srv)...)
 }
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"math/rand"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,20 +20,6 @@ import (
 	"github.com/pagpeter/trackme/pkg/utils"
 )
 
-// =============================================================================
-// RouteResponse - Extended response type for special handling
-// =============================================================================
-
-// RouteResponse encapsulates response data with optional metadata for redirects,
-// cookies, and custom status codes
-type RouteResponse struct {
-	Body        []byte
-	ContentType string
-	StatusCode  int               // 0 means use default (200 or extracted from path)
-	Headers     map[string]string // Additional headers (e.g., Set-Cookie, Location)
-	IsRedirect  bool              // True if this is a redirect response
-}
-
 // =============================================================================
 // Helper Functions
 // =============================================================================
@@ -60,15 +50,36 @@ func buildTLSFields(res types.Response) map[string]interface{} {
 	return fields
 }
 
+// ja3Hash returns the JA3 hash, HTTP/3 requests have none
+func ja3Hash(res types.Response) string {
+	if res.TLS == nil {
+		return ""
+	}
+	return res.TLS.JA3Hash
+}
+
 // extractHeaders extracts headers from HTTP/1 or HTTP/2 response
 func extractHeaders(res types.Response) map[string]string {
 	headers := make(map[string]string)
 
 	if res.Http1 != nil {
 		for _, h := range res.Http1.Headers {
+			if name, value, found := strings.Cut(h, ":"); found {
+				headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+			}
+		}
+	}
+
+	if res.Http3 != nil {
+		for _, h := range res.Http3.Headers {
 			parts := strings.SplitN(h, ": ", 2)
 			if len(parts) == 2 {
-				headers[parts[0]] = parts[1]
+				headerName := normalizeHeaderName(parts[0])
+				if existing, ok := headers[headerName]; ok {
+					headers[headerName] = existing + "; " + parts[1]
+				} else {
+					headers[headerName] = parts[1]
+				}
 			}
 		}
 	}
@@ -114,20 +125,6 @@ func normalizeHeaderName(name string) string {
 	return strings.Join(parts, "-")
 }
 
-// extractBody extracts the request body from HTTP/2 DATA frames
-func extractBody(res types.Response) []byte {
-	if res.Http2 != nil {
-		var body []byte
-		for _, frame := range res.Http2.SendFrames {
-			if frame.Type == "DATA" {
-				body = append(body, frame.Payload...)
-			}
-		}
-		return body
-	}
-	return nil
-}
-
 // buildBaseResponse creates the common response structure with TLS fields
 func buildBaseResponse(res types.Response, params url.Values) map[string]interface{} {
 	response := buildTLSFields(res)
@@ -165,79 +162,80 @@ func toJSON(data interface{}) []byte {
 // =============================================================================
 
 // httpbinGet handles GET /get - echoes request details
-func httpbinGet(res types.Response, params url.Values) ([]byte, string) {
+func httpbinGet(res types.Response, params url.Values) RouteResponse {
 	response := buildBaseResponse(res, params)
 	response["headers"] = extractHeaders(res)
-	return toJSON(response), "application/json"
+	return respond(toJSON(response), "application/json")
 }
 
 // httpbinPost handles POST /post - echoes POST body and form data
-func httpbinPost(res types.Response, params url.Values) ([]byte, string) {
-	response := buildBaseResponse(res, params)
-	response["headers"] = extractHeaders(res)
+func httpbinPost(srv *Server) RouteHandler {
+	return func(res types.Response, params url.Values) RouteResponse {
+		response := buildBaseResponse(res, params)
+		response["headers"] = extractHeaders(res)
 
-	// Extract body from HTTP/2 DATA frames
-	body := extractBody(res)
-	if len(body) > 0 {
-		response["data"] = string(body)
-		// Try to parse as JSON
-		var jsonData interface{}
-		if json.Unmarshal(body, &jsonData) == nil {
-			response["json"] = jsonData
-		} else {
-			response["json"] = nil
-		}
-	} else {
-		response["data"] = ""
-		response["json"] = nil
-	}
-	response["files"] = map[string]interface{}{}
-	response["form"] = map[string]interface{}{}
+		// Decode the body the same way for every protocol
+		addBodyFields(response, res, srv)
 
-	return toJSON(response), "application/json"
+		return respond(toJSON(response), "application/json")
+	}
 }
 
 // httpbinPut handles PUT /put
-func httpbinPut(res types.Response, params url.Values) ([]byte, string) {
-	return httpbinPost(res, params)
+func httpbinPut(srv *Server) RouteHandler {
+	return httpbinPost(srv)
 }
 
 // httpbinPatch handles PATCH /patch
-func httpbinPatch(res types.Response, params url.Values) ([]byte, string) {
-	return httpbinPost(res, params)
+func httpbinPatch(srv *Server) RouteHandler {
+	return httpbinPost(srv)
+}
+
+// httpbinUpload handles POST /upload. It reports what arrived instead of
+// echoing the body, so large uploads can be checked for completeness.
+func httpbinUpload(res types.Response, params url.Values) RouteResponse {
+	body := res.Body
+	sum := sha256.Sum256(body)
+
+	// DATA frame payload lengths, only HTTP/2 exposes its framing
+	frameSizes := []uint32{}
+	if res.Http2 != nil {
+		for _, frame := range res.Http2.SendFrames {
+			if frame.Type == "DATA" {
+				frameSizes = append(frameSizes, frame.Length)
+			}
+		}
+	}
+
+	response := map[string]interface{}{
+		"method":       res.Method,
+		"http_version": res.HTTPVersion,
+		"bytes":        len(body),
+		"sha256":       hex.EncodeToString(sum[:]),
+		"frames":       len(frameSizes),
+		"frame_sizes":  frameSizes,
+	}
+	return respond(toJSON(response), "application/json")
 }
 
 // httpbinDelete handles DELETE /delete
-func httpbinDelete(res types.Response, params url.Values) ([]byte, string) {
+func httpbinDelete(res types.Response, params url.Values) RouteResponse {
 	response := buildBaseResponse(res, params)
 	response["headers"] = extractHeaders(res)
-	return toJSON(response), "application/json"
+	return respond(toJSON(response), "application/json")
 }
 
 // httpbinAnything handles any method to /anything
-func httpbinAnything(res types.Response, params url.Values) ([]byte, string) {
-	response := buildBaseResponse(res, params)
-	response["headers"] = extractHeaders(res)
+func httpbinAnything(srv *Server) RouteHandler {
+	return func(res types.Response, params url.Values) RouteResponse {
+		response := buildBaseResponse(res, params)
+		response["headers"] = extractHeaders(res)
 
-	// Extract body from HTTP/2 DATA frames
-	body := extractBody(res)
-	if len(body) > 0 {
-		response["data"] = string(body)
-		// Try to parse as JSON
-		var jsonData interface{}
-		if json.Unmarshal(body, &jsonData) == nil {
-			response["json"] = jsonData
-		} else {
-			response["json"] = nil
-		}
-	} else {
-		response["data"] = ""
-		response["json"] = nil
-	}
-	response["files"] = map[string]interface{}{}
-	response["form"] = map[string]interface{}{}
+		// Decode the body the same way for every protocol
+		addBodyFields(response, res, srv)
 
-	return toJSON(response), "application/json"
+		return respond(toJSON(response), "application/json")
+	}
 }
 
 // =============================================================================
@@ -245,24 +243,24 @@ func httpbinAnything(res types.Response, params url.Values) ([]byte, string) {
 // =============================================================================
 
 // httpbinHeaders handles GET /headers - returns request headers
-func httpbinHeaders(res types.Response, params url.Values) ([]byte, string) {
+func httpbinHeaders(res types.Response, params url.Values) RouteResponse {
 	response := buildTLSFields(res)
 	response["headers"] = extractHeaders(res)
-	return toJSON(response), "application/json"
+	return respond(toJSON(response), "application/json")
 }
 
 // httpbinIP handles GET /ip - returns client IP
-func httpbinIP(res types.Response, params url.Values) ([]byte, string) {
+func httpbinIP(res types.Response, params url.Values) RouteResponse {
 	response := buildTLSFields(res)
 	response["origin"] = cleanIP(res.IP)
-	return toJSON(response), "application/json"
+	return respond(toJSON(response), "application/json")
 }
 
 // httpbinUserAgent handles GET /user-agent - returns User-Agent
-func httpbinUserAgent(res types.Response, params url.Values) ([]byte, string) {
+func httpbinUserAgent(res types.Response, params url.Values) RouteResponse {
 	response := buildTLSFields(res)
 	response["user-agent"] = res.UserAgent
-	return toJSON(response), "application/json"
+	return respond(toJSON(response), "application/json")
 }
 
 // =============================================================================
@@ -270,7 +268,7 @@ func httpbinUserAgent(res types.Response, params url.Values) ([]byte, string) {
 // =============================================================================
 
 // httpbinGzip handles GET /gzip - returns gzip-compressed response
-func httpbinGzip(res types.Response, params url.Values) ([]byte, string) {
+func httpbinGzip(res types.Response, params url.Values) RouteResponse {
 	response := buildBaseResponse(res, params)
 	response["headers"] = extractHeaders(res)
 	response["gzipped"] = true
@@ -282,12 +280,12 @@ func httpbinGzip(res types.Response, params url.Values) ([]byte, string) {
 	gz.Write(jsonData)
 	gz.Close()
 
-	return buf.Bytes(), "application/json; charset=utf-8"
+	return respond(buf.Bytes(), "application/json; charset=utf-8").withHeader("Content-Encoding", "gzip")
 }
 
 // httpbinDeflate handles GET /deflate - returns deflate-compressed response
 // Note: HTTP "deflate" Content-Encoding expects zlib format (RFC 1950), not raw DEFLATE (RFC 1951)
-func httpbinDeflate(res types.Response, params url.Values) ([]byte, string) {
+func httpbinDeflate(res types.Response, params url.Values) RouteResponse {
 	response := buildBaseResponse(res, params)
 	response["headers"] = extractHeaders(res)
 	response["deflated"] = true
@@ -299,11 +297,11 @@ func httpbinDeflate(res types.Response, params url.Values) ([]byte, string) {
 	zw.Write(jsonData)
 	zw.Close()
 
-	return buf.Bytes(), "application/json; charset=utf-8"
+	return respond(buf.Bytes(), "application/json; charset=utf-8").withHeader("Content-Encoding", "deflate")
 }
 
 // httpbinBrotli handles GET /brotli - returns brotli-compressed response
-func httpbinBrotli(res types.Response, params url.Values) ([]byte, string) {
+func httpbinBrotli(res types.Response, params url.Values) RouteResponse {
 	response := buildBaseResponse(res, params)
 	response["headers"] = extractHeaders(res)
 	response["brotli"] = true
@@ -315,7 +313,7 @@ func httpbinBrotli(res types.Response, params url.Values) ([]byte, string) {
 	bw.Write(jsonData)
 	bw.Close()
 
-	return buf.Bytes(), "application/json; charset=utf-8"
+	return respond(buf.Bytes(), "application/json; charset=utf-8").withHeader("Content-Encoding", "br")
 }
 
 // =============================================================================
@@ -323,7 +321,7 @@ func httpbinBrotli(res types.Response, params url.Values) ([]byte, string) {
 // =============================================================================
 
 // httpbinCookies handles GET /cookies - returns cookies from request
-func httpbinCookies(res types.Response, params url.Values) ([]byte, string) {
+func httpbinCookies(res types.Response, params url.Values) RouteResponse {
 	response := buildTLSFields(res)
 
 	// Extract cookies from headers
@@ -341,12 +339,12 @@ func httpbinCookies(res types.Response, params url.Values) ([]byte, string) {
 	}
 
 	response["cookies"] = cookies
-	return toJSON(response), "application/json"
+	return respond(toJSON(response), "application/json")
 }
 
 // httpbinCookiesSet handles GET /cookies/set - sets cookies via query params
 // Returns Set-Cookie headers for each query parameter
-func httpbinCookiesSet(res types.Response, params url.Values) ([]byte, string) {
+func httpbinCookiesSet(res types.Response, params url.Values) RouteResponse {
 	response := buildTLSFields(res)
 
 	// Build cookies and Set-Cookie header list
@@ -358,25 +356,22 @@ func httpbinCookiesSet(res types.Response, params url.Values) ([]byte, string) {
 			setCookies = append(setCookies, k+"="+v[0]+"; Path=/")
 		}
 	}
+	sort.Strings(setCookies)
 
 	response["cookies"] = cookies
 
-	// Return special content-type that signals Set-Cookie headers
-	// Format: "set-cookies:COOKIE1|COOKIE2|...:application/json"
-	// The body follows normal JSON format
-	if len(setCookies) > 0 {
-		cookieList := strings.Join(setCookies, "|")
-		return toJSON(response), "set-cookies:" + cookieList + ":application/json"
+	r := respond(toJSON(response), "application/json")
+	for _, cookie := range setCookies {
+		r = r.withHeader("Set-Cookie", cookie)
 	}
-
-	return toJSON(response), "application/json"
+	return r
 }
 
 // httpbinCookiesDelete handles GET /cookies/delete - deletes cookies
-func httpbinCookiesDelete(res types.Response, params url.Values) ([]byte, string) {
+func httpbinCookiesDelete(res types.Response, params url.Values) RouteResponse {
 	response := buildTLSFields(res)
 	response["cookies"] = map[string]string{}
-	return toJSON(response), "application/json"
+	return respond(toJSON(response), "application/json")
 }
 
 // =============================================================================
@@ -447,47 +442,40 @@ var webpImage = []byte{
 	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFE, 0xFB, 0x94, 0x00, 0x00,
 }
 
-func httpbinImageJPEG(res types.Response, params url.Values) ([]byte, string) {
-	return jpegImage, "image/jpeg"
+func httpbinImageJPEG(res types.Response, params url.Values) RouteResponse {
+	return respond(jpegImage, "image/jpeg")
 }
 
-func httpbinImagePNG(res types.Response, params url.Values) ([]byte, string) {
-	return pngImage, "image/png"
+func httpbinImagePNG(res types.Response, params url.Values) RouteResponse {
+	return respond(pngImage, "image/png")
 }
 
-func httpbinImageSVG(res types.Response, params url.Values) ([]byte, string) {
-	return svgImage, "image/svg+xml"
+func httpbinImageSVG(res types.Response, params url.Values) RouteResponse {
+	return respond(svgImage, "image/svg+xml")
 }
 
-func httpbinImageGIF(res types.Response, params url.Values) ([]byte, string) {
-	return gifImage, "image/gif"
+func httpbinImageGIF(res types.Response, params url.Values) RouteResponse {
+	return respond(gifImage, "image/gif")
 }
 
-func httpbinImageWebP(res types.Response, params url.Values) ([]byte, string) {
-	return webpImage, "image/webp"
+func httpbinImageWebP(res types.Response, params url.Values) RouteResponse {
+	return respond(webpImage, "image/webp")
 }
 
 // httpbinBytes handles /bytes/{n}
 // GET: returns n random bytes
 // POST/PUT: echoes back the request body (for binary data testing)
-func httpbinBytes(res types.Response, params url.Values) ([]byte, string) {
+func httpbinBytes(res types.Response, params url.Values) RouteResponse {
 	// For POST/PUT requests, echo back the body for binary testing
 	if res.Method == "POST" || res.Method == "PUT" {
-		body := extractBody(res)
+		body := res.Body
 		if len(body) > 0 {
-			return body, "application/octet-stream"
+			return respond(body, "application/octet-stream")
 		}
 	}
 
-	// GET behavior: Extract n from path: /bytes/100
-	path := res.Path
-	parts := strings.Split(path, "/")
-	n := 100 // default
-	if len(parts) >= 3 {
-		if parsed, err := strconv.Atoi(parts[2]); err == nil && parsed > 0 && parsed <= 102400 {
-			n = parsed
-		}
-	}
+	// GET behavior: /bytes/100
+	n := pathInt(res, "n", 100, 1, 102400)
 
 	// Generate random-ish bytes (deterministic for testing)
 	data := make([]byte, n)
@@ -495,22 +483,17 @@ func httpbinBytes(res types.Response, params url.Values) ([]byte, string) {
 		data[i] = byte(i % 256)
 	}
 
-	return data, "application/octet-stream"
+	return respond(data, "application/octet-stream")
 }
 
 // httpbinBase64 handles GET /base64/{value} - decodes base64 and returns
-func httpbinBase64(res types.Response, params url.Values) ([]byte, string) {
-	// Extract value from path: /base64/SGVsbG8gV29ybGQ=
-	path := res.Path
-	parts := strings.Split(path, "/")
-	if len(parts) >= 3 {
-		encoded := parts[2]
-		decoded, err := base64.StdEncoding.DecodeString(encoded)
-		if err == nil {
-			return decoded, "text/html; charset=utf-8"
-		}
+func httpbinBase64(res types.Response, params url.Values) RouteResponse {
+	// /base64/SGVsbG8gV29ybGQ=
+	decoded, err := base64.StdEncoding.DecodeString(pathParam(res, "value"))
+	if err == nil {
+		return respond(decoded, "text/html; charset=utf-8")
 	}
-	return []byte("Invalid base64"), "text/plain"
+	return respond([]byte("Invalid base64"), "text/plain")
 }
 
 // =============================================================================
@@ -519,16 +502,8 @@ func httpbinBase64(res types.Response, params url.Values) ([]byte, string) {
 
 // httpbinRedirect handles GET /redirect/{n} - returns 302 redirect
 // Redirects to /redirect/{n-1} until n=1, then redirects to /get
-func httpbinRedirect(res types.Response, params url.Values) ([]byte, string) {
-	// Extract n from path
-	path := res.Path
-	parts := strings.Split(path, "/")
-	n := 1
-	if len(parts) >= 3 {
-		if parsed, err := strconv.Atoi(parts[2]); err == nil && parsed > 0 && parsed <= 10 {
-			n = parsed
-		}
-	}
+func httpbinRedirect(res types.Response, params url.Values) RouteResponse {
+	n := pathInt(res, "n", 1, 1, 10)
 
 	// Use absolute URLs for redirects (some HTTP/2 clients have issues with relative URLs)
 	baseURL := "https://tlsfingerprint.com"
@@ -539,14 +514,12 @@ func httpbinRedirect(res types.Response, params url.Values) ([]byte, string) {
 		location = baseURL + "/get"
 	}
 
-	// Return special content-type that signals redirect to connection_handler
-	// Format: "redirect:STATUS_CODE:LOCATION"
-	return []byte{}, "redirect:302:" + location
+	return redirectTo(302, location)
 }
 
 // httpbinRedirectTo handles /redirect-to?url=...
 // Returns 302 redirect to the specified URL
-func httpbinRedirectTo(res types.Response, params url.Values) ([]byte, string) {
+func httpbinRedirectTo(res types.Response, params url.Values) RouteResponse {
 	targetURL := utils.GetParam("url", params)
 	if targetURL == "" {
 		targetURL = "https://tlsfingerprint.com/get"
@@ -562,685 +535,623 @@ func httpbinRedirectTo(res types.Response, params url.Values) ([]byte, string) {
 		}
 	}
 
-	// Return special content-type that signals redirect to connection_handler
-	return []byte{}, "redirect:" + strconv.Itoa(statusCode) + ":" + targetURL
+	return redirectTo(statusCode, targetURL)
 }
 
-// httpbinStatus handles /status/{code}
-func httpbinStatus(res types.Response, params url.Values) ([]byte, string) {
-	// Extract status code from path
-	path := res.Path
-	parts := strings.Split(path, "/")
-	code := 200
-	if len(parts) >= 3 {
-		if parsed, err := strconv.Atoi(parts[2]); err == nil && parsed >= 100 && parsed < 600 {
-			code = parsed
-		}
+// httpbinStatus handles /status/{codes}. Like httpbin, a comma separated list
+// of codes picks one at random, optionally weighted with code:weight.
+func httpbinStatus(res types.Response, params url.Values) RouteResponse {
+	code, ok := pickStatusCode(pathParam(res, "codes"))
+	if !ok {
+		r := respond([]byte("{\"error\": \"Invalid status code\"}"), "application/json")
+		r.StatusCode = 400
+		return r
 	}
 
 	response := buildTLSFields(res)
 	response["status_code"] = code
-	return toJSON(response), "application/json"
+	r := respond(toJSON(response), "application/json")
+	r.StatusCode = code
+	return r
 }
 
-// =============================================================================
-// Delay Endpoint: /delay/{seconds}
-// =============================================================================
+// pickStatusCode chooses a status code from a list like "200:0.8,500:0.2"
+func pickStatusCode(list string) (int, bool) {
+	var codes []int
+	var weights []float64
+	var total float64
+	for _, choice := range strings.Split(list, ",") {
+		codeStr, weightStr, hasWeight := strings.Cut(strings.TrimSpace(choice), ":")
+		code, err := strconv.Atoi(codeStr)
+		if err != nil || code < 100 || code > 599 {
+			return 0, false
+		}
+		weight := 1.0
+		if hasWeight {
+			weight, err = strconv.ParseFloat(weightStr, 64)
+			if err != nil || weight < 0 {
+				return 0, false
+			}
+		}
+		codes = append(codes, code)
+		weights = append(weights, weight)
+		total += weight
+	}
+	if total == 0 {
+		return codes[0], true
+	}
 
-// httpbinDelay handles /delay/{seconds} - delays response
-func httpbinDelay(res types.Response, params url.Values) ([]byte, string) {
-	// Extract seconds from path
-	path := res.Path
-	parts := strings.Split(path, "/")
-	seconds := 1
-	if len(parts) >= 3 {
-		if parsed, err := strconv.Atoi(parts[2]); err == nil && parsed > 0 && parsed <= 10 {
-			seconds = parsed
+	pick := rand.Float64() * total
+	for i, w := range weights {
+		if pick < w {
+			return codes[i], true
 		}
+		pick -= w
 	}
+	return codes[len(codes)-1], true
+}
 
-	// Actually delay
-	time.Sleep(time.Duration(seconds) * time.Second)
+// =============================================================================
+// Delay Endpoint: /delay/{seconds}
+// =============================================================================
+
+// httpbinDelay handles /delay/{seconds}. The headers are sent right away,
+// the body once the delay is over.
+func httpbinDelay(res types.Response, params url.Values) RouteResponse {
+	seconds := pathInt(res, "n", 1, 1, 10)
 
 	response := buildBaseResponse(res, params)
 	response["headers"] = extractHeaders(res)
 	response["delay"] = seconds
+	body := toJSON(response)
 
-	return toJSON(response), "application/json"
+	r := RouteResponse{
+		ContentType: "application/json",
+		Stream: func(w BodyWriter) error {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			time.Sleep(time.Duration(seconds) * time.Second)
+			return writeEvent(w, body, 0, false)
+		},
+	}
+	return r.withHeader("Content-Length", strconv.Itoa(len(body)))
 }
 
 // =============================================================================
 // Response Format Endpoints: /html, /xml, /json
 // =============================================================================
 
-func httpbinHTML(res types.Response, params url.Values) ([]byte, string) {
+func httpbinHTML(res types.Response, params url.Values) RouteResponse {
 	html := `<!DOCTYPE html>
 <html>
 <head><title>TLS Fingerprint HTTPBin</title></head>
 <body>
 <h1>Hello from TLS Fingerprint HTTPBin!</h1>
-<p>JA3 Hash: ` + res.TLS.JA3Hash + `</p>
+<p>JA3 Hash: ` + ja3Hash(res) + `</p>
 </body>
 </html>`
-	return []byte(html), "text/html; charset=utf-8"
+	return respond([]byte(html), "text/html; charset=utf-8")
 }
 
-func httpbinXML(res types.Response, params url.Values) ([]byte, string) {
+func httpbinXML(res types.Response, params url.Values) RouteResponse {
 	xml := `<?xml version="1.0" encoding="UTF-8"?>
 <response>
-  <ja3_hash>` + res.TLS.JA3Hash + `</ja3_hash>
+  <ja3_hash>` + ja3Hash(res) + `</ja3_hash>
   <origin>` + cleanIP(res.IP) + `</origin>
 </response>`
-	return []byte(xml), "application/xml"
+	return respond([]byte(xml), "application/xml")
 }
 
-func httpbinJSON(res types.Response, params url.Values) ([]byte, string) {
+func httpbinJSON(res types.Response, params url.Values) RouteResponse {
 	response := buildTLSFields(res)
 	response["slideshow"] = map[string]interface{}{
 		"author": "TLS Fingerprint",
 		"title":  "Sample Slideshow",
 	}
-	return toJSON(response), "application/json"
+	return respond(toJSON(response), "application/json")
 }
 
-func httpbinRobots(res types.Response, params url.Values) ([]byte, string) {
-	return []byte("User-agent: *\nDisallow: /deny\n"), "text/plain"
+func httpbinRobots(res types.Response, params url.Values) RouteResponse {
+	return respond([]byte("User-agent: *\nDisallow: /deny\n"), "text/plain")
 }
 
-func httpbinDeny(res types.Response, params url.Values) ([]byte, string) {
-	return []byte("YOU SHOULDN'T BE HERE"), "text/plain"
+func httpbinDeny(res types.Response, params url.Values) RouteResponse {
+	return respond([]byte("YOU SHOULDN'T BE HERE"), "text/plain")
 }
 
 // =============================================================================
-// SSE Endpoint: /sse, /sse/{n}
+// Streaming Endpoints: /sse, /sse/{n}, /stream/{n}, /drip
 // =============================================================================
 
-// httpbinSSE handles /sse - returns SSE-formatted response
-// Note: True SSE streaming requires connection_handler modification
-// This returns a complete SSE response that CycleTLS can parse
-func httpbinSSE(res types.Response, params url.Values) ([]byte, string) {
-	// Extract count from path if present: /sse/5
-	path := res.Path
-	parts := strings.Split(path, "/")
-	count := 3 // default
-	if len(parts) >= 3 {
-		if parsed, err := strconv.Atoi(parts[2]); err == nil && parsed > 0 && parsed <= 100 {
-			count = parsed
-		}
-	}
+const (
+	// maxStreamDuration caps how long a streamed response may take, it has
+	// to stay below the connection timeout
+	maxStreamDuration = 10 * time.Second
+	// maxDripBytes caps the body of /drip
+	maxDripBytes = 10 * 1024 * 1024
+)
 
-	ja3Hash := ""
-	if res.TLS != nil {
-		ja3Hash = res.TLS.JA3Hash
+// streamInterval returns the pause between events from ?interval= (in
+// milliseconds), shortened so that all events fit into maxStreamDuration
+func streamInterval(params url.Values, events int) time.Duration {
+	ms, err := strconv.Atoi(utils.GetParam("interval", params))
+	if err != nil || ms <= 0 || events <= 1 {
+		return 0
+	}
+	interval := time.Duration(ms) * time.Millisecond
+	if max := maxStreamDuration / time.Duration(events-1); interval > max {
+		interval = max
 	}
+	return interval
+}
 
-	var buf bytes.Buffer
-	for i := 1; i <= count; i++ {
-		data := map[string]interface{}{
-			"count":    i,
-			"ja3_hash": ja3Hash,
-		}
-		jsonData, _ := json.Marshal(data)
-		buf.WriteString("event: message\n")
-		buf.WriteString("id: " + strconv.Itoa(i) + "\n")
-		buf.WriteString("data: " + string(jsonData) + "\n\n")
+// secondsParam parses a (fractional) number of seconds from the query
+func secondsParam(params url.Values, name string, def time.Duration) time.Duration {
+	v, err := strconv.ParseFloat(utils.GetParam(name, params), 64)
+	if err != nil || v < 0 {
+		return def
+	}
+	d := time.Duration(v * float64(time.Second))
+	if d > maxStreamDuration {
+		d = maxStreamDuration
 	}
+	return d
+}
 
-	// Final done event
-	buf.WriteString("event: done\n")
-	buf.WriteString("id: " + strconv.Itoa(count+1) + "\n")
-	buf.WriteString("data: {\"total\": " + strconv.Itoa(count) + "}\n\n")
+// httpbinSSE handles /sse and /sse/{n}. Every event is flushed on its own,
+// ?interval= sets the pause between them in milliseconds.
+func httpbinSSE(res types.Response, params url.Values) RouteResponse {
+	// Count from the path if present: /sse/5
+	count := pathInt(res, "n", 3, 1, 100)
+	interval := streamInterval(params, count+1)
+
+	hash := ja3Hash(res)
+
+	r := RouteResponse{
+		ContentType: "text/event-stream",
+		Stream: func(w BodyWriter) error {
+			for i := 1; i <= count; i++ {
+				data := map[string]interface{}{
+					"count":    i,
+					"ja3_hash": hash,
+				}
+				jsonData, _ := json.Marshal(data)
+				event := "event: message\n" +
+					"id: " + strconv.Itoa(i) + "\n" +
+					"data: " + string(jsonData) + "\n\n"
+				if err := writeEvent(w, []byte(event), interval, i > 1); err != nil {
+					return err
+				}
+			}
 
-	return buf.Bytes(), "text/event-stream"
+			// Final done event
+			done := "event: done\n" +
+				"id: " + strconv.Itoa(count+1) + "\n" +
+				"data: {\"total\": " + strconv.Itoa(count) + "}\n\n"
+			return writeEvent(w, []byte(done), interval, count > 0)
+		},
+	}
+	return r.withHeader("Cache-Control", "no-cache")
 }
 
-// =============================================================================
-// Stream Endpoint: /stream/{n}
-// =============================================================================
-
-// httpbinStream handles /stream/{n} - returns n newline-delimited JSON objects
+// httpbinStream handles /stream/{n} - streams n newline-delimited JSON objects
 // This is compatible with HTTPBin's /stream endpoint used by CycleTLS tests
-func httpbinStream(res types.Response, params url.Values) ([]byte, string) {
-	// Extract n from path: /stream/5
-	path := res.Path
-	parts := strings.Split(path, "/")
-	n := 3 // default
-	if len(parts) >= 3 {
-		if parsed, err := strconv.Atoi(parts[2]); err == nil && parsed > 0 && parsed <= 100 {
-			n = parsed
-		}
+func httpbinStream(res types.Response, params url.Values) RouteResponse {
+	n := pathInt(res, "n", 3, 1, 100)
+	interval := streamInterval(params, n)
+
+	hash := ja3Hash(res)
+
+	return RouteResponse{
+		ContentType: "application/json",
+		Stream: func(w BodyWriter) error {
+			for i := 0; i < n; i++ {
+				data := map[string]interface{}{
+					"id":       i,
+					"ja3_hash": hash,
+					"origin":   cleanIP(res.IP),
+					"url":      "https://tlsfingerprint.com" + res.Path,
+				}
+				jsonData, _ := json.Marshal(data)
+				if err := writeEvent(w, append(jsonData, '\n'), interval, i > 0); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// httpbinDrip handles /drip?duration=&numbytes=&delay=&code= - after delay
+// seconds, numbytes asterisks are sent spread evenly over duration seconds
+func httpbinDrip(res types.Response, params url.Values) RouteResponse {
+	numBytes := 10
+	if n, err := strconv.Atoi(utils.GetParam("numbytes", params)); err == nil && n >= 0 {
+		numBytes = n
+	}
+	if numBytes > maxDripBytes {
+		numBytes = maxDripBytes
+	}
+	delay := secondsParam(params, "delay", 2*time.Second)
+	duration := secondsParam(params, "duration", 2*time.Second)
+	if delay+duration > maxStreamDuration {
+		duration = maxStreamDuration - delay
 	}
 
-	ja3Hash := ""
-	if res.TLS != nil {
-		ja3Hash = res.TLS.JA3Hash
+	code := 200
+	if c, err := strconv.Atoi(utils.GetParam("code", params)); err == nil && c >= 200 && c < 600 {
+		code = c
 	}
 
-	var buf bytes.Buffer
-	for i := 0; i < n; i++ {
-		data := map[string]interface{}{
-			"id":       i,
-			"ja3_hash": ja3Hash,
-			"origin":   cleanIP(res.IP),
-			"url":      "https://tlsfingerprint.com" + res.Path,
-		}
-		jsonData, _ := json.Marshal(data)
-		buf.Write(jsonData)
-		buf.WriteByte('\n')
+	// The length is known, so HTTP/1 does not need chunked encoding
+	r := RouteResponse{
+		StatusCode:  code,
+		ContentType: "application/octet-stream",
+		Stream: func(w BodyWriter) error {
+			// Send the headers before waiting
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			time.Sleep(delay)
+			if numBytes == 0 {
+				return nil
+			}
+
+			// Never more than 1000 writes, large bodies drip in bigger pieces
+			writes := numBytes
+			if writes > 1000 {
+				writes = 1000
+			}
+			interval := duration / time.Duration(writes)
+			sent := 0
+			for i := 1; i <= writes; i++ {
+				size := numBytes*i/writes - sent
+				if err := writeEvent(w, bytes.Repeat([]byte("*"), size), interval, true); err != nil {
+					return err
+				}
+				sent += size
+			}
+			return nil
+		},
 	}
+	return r.withHeader("Content-Length", strconv.Itoa(numBytes))
+}
 
-	return buf.Bytes(), "application/json"
+// writeEvent writes and flushes one part of a streamed body, waiting for the
+// interval first if wait is set
+func writeEvent(w BodyWriter, p []byte, interval time.Duration, wait bool) error {
+	if wait && interval > 0 {
+		time.Sleep(interval)
+	}
+	if _, err := w.Write(p); err != nil {
+		return err
+	}
+	return w.Flush()
 }
 
 // =============================================================================
 // Register all HTTPBin routes
 // =============================================================================
 
-// getHTTPBinPaths returns all httpbin-compatible routes
-func getHTTPBinPaths() map[string]func(types.Response, url.Values) ([]byte, string) {
-	return map[string]func(types.Response, url.Values) ([]byte, string){
+// getHTTPBinRoutes returns all httpbin-compatible routes
+func getHTTPBinRoutes(srv *Server) []Route {
+	get := []string{"GET"}
+	echo := map[string]interface{}{"$ref": "#/components/schemas/EchoResponse"}
+	bodyTypes := []string{"application/json", "application/x-www-form-urlencoded", "multipart/form-data"}
+
+	return []Route{
 		// Echo endpoints
-		"/get":      httpbinGet,
-		"/post":     httpbinPost,
-		"/put":      httpbinPut,
-		"/patch":    httpbinPatch,
-		"/delete":   httpbinDelete,
-		"/anything": httpbinAnything,
+		{Pattern: "/get", Methods: get, Handler: httpbinGet, Doc: &RouteDoc{
+			Tag:         "HTTP Methods",
+			Summary:     "Returns GET request data",
+			Description: "Returns the request's query parameters, headers, and TLS fingerprints",
+			Schema:      echo,
+		}},
+		{Pattern: "/post", Methods: []string{"POST"}, Handler: httpbinPost(srv), Doc: &RouteDoc{
+			Tag:          "HTTP Methods",
+			Summary:      "Returns POST request data",
+			Description:  "Returns the request's body, form data, headers, and TLS fingerprints",
+			RequestTypes: bodyTypes,
+			Schema:       echo,
+		}},
+		{Pattern: "/put", Methods: []string{"PUT"}, Handler: httpbinPut(srv), Doc: &RouteDoc{
+			Tag:          "HTTP Methods",
+			Summary:      "Returns PUT request data",
+			RequestTypes: bodyTypes,
+			Schema:       echo,
+		}},
+		{Pattern: "/patch", Methods: []string{"PATCH"}, Handler: httpbinPatch(srv), Doc: &RouteDoc{
+			Tag:          "HTTP Methods",
+			Summary:      "Returns PATCH request data",
+			RequestTypes: bodyTypes,
+			Schema:       echo,
+		}},
+		{Pattern: "/delete", Methods: []string{"DELETE"}, Handler: httpbinDelete, Doc: &RouteDoc{
+			Tag:     "HTTP Methods",
+			Summary: "Returns DELETE request data",
+			Schema:  echo,
+		}},
+		{Pattern: "/anything", Handler: httpbinAnything(srv), Doc: &RouteDoc{
+			Tag:     "HTTP Methods",
+			Summary: "Returns anything passed in request data (accepts any method)",
+			Schema:  echo,
+		}},
+		{Pattern: "/anything/{path...}", Handler: httpbinAnything(srv), Doc: &RouteDoc{
+			Tag:     "HTTP Methods",
+			Summary: "Returns anything passed in request data (accepts any method)",
+			Schema:  echo,
+		}},
+		{Pattern: "/upload", Methods: []string{"POST", "PUT"}, Handler: httpbinUpload, Doc: &RouteDoc{
+			Tag:          "HTTP Methods",
+			Summary:      "Reports the size and SHA-256 of the request body",
+			Description:  "Returns the number of body bytes received, their SHA-256 and, for HTTP/2, the size of every DATA frame. Bodies above max_body_size are rejected with 413.",
+			RequestTypes: []string{"application/octet-stream"},
+			Responses:    map[string]string{"200": "Successful response", "413": "Request body too large"},
+		}},
 
 		// Request inspection
-		"/headers":    httpbinHeaders,
-		"/ip":         httpbinIP,
-		"/user-agent": httpbinUserAgent,
+		{Pattern: "/headers", Methods: get, Handler: httpbinHeaders, Doc: &RouteDoc{
+			Tag:       "Request Inspection",
+			Summary:   "Returns request headers",
+			Responses: map[string]string{"200": "Headers in response"},
+		}},
+		{Pattern: "/ip", Methods: get, Handler: httpbinIP, Doc: &RouteDoc{
+			Tag:       "Request Inspection",
+			Summary:   "Returns the client's IP address",
+			Responses: map[string]string{"200": "IP address"},
+		}},
+		{Pattern: "/user-agent", Methods: get, Handler: httpbinUserAgent, Doc: &RouteDoc{
+			Tag:       "Request Inspection",
+			Summary:   "Returns the User-Agent header",
+			Responses: map[string]string{"200": "User-Agent string"},
+		}},
 
 		// Compression
-		"/gzip":    httpbinGzip,
-		"/deflate": httpbinDeflate,
-		"/brotli":  httpbinBrotli,
+		{Pattern: "/gzip", Methods: get, Handler: httpbinGzip, Doc: &RouteDoc{
+			Tag:       "Compression",
+			Summary:   "Returns gzip-compressed response",
+			Responses: map[string]string{"200": "Gzip-encoded response"},
+		}},
+		{Pattern: "/deflate", Methods: get, Handler: httpbinDeflate, Doc: &RouteDoc{
+			Tag:       "Compression",
+			Summary:   "Returns deflate-compressed response",
+			Responses: map[string]string{"200": "Deflate-encoded response"},
+		}},
+		{Pattern: "/brotli", Methods: get, Handler: httpbinBrotli, Doc: &RouteDoc{
+			Tag:       "Compression",
+			Summary:   "Returns brotli-compressed response",
+			Responses: map[string]string{"200": "Brotli-encoded response"},
+		}},
 
 		// Cookies
-		"/cookies":        httpbinCookies,
-		"/cookies/set":    httpbinCookiesSet,
-		"/cookies/delete": httpbinCookiesDelete,
+		{Pattern: "/cookies", Methods: get, Handler: httpbinCookies, Doc: &RouteDoc{
+			Tag:       "Cookies",
+			Summary:   "Returns cookies from the request",
+			Responses: map[string]string{"200": "Cookies object"},
+		}},
+		{Pattern: "/cookies/set", Methods: get, Handler: httpbinCookiesSet, Doc: &RouteDoc{
+			Tag:       "Cookies",
+			Summary:   "Sets cookies via query parameters",
+			Params:    []DocParam{{Name: "name", Description: "Cookie name=value pairs"}},
+			Responses: map[string]string{"200": "Set-Cookie headers in response"},
+		}},
+		{Pattern: "/cookies/delete", Methods: get, Handler: httpbinCookiesDelete, Doc: &RouteDoc{
+			Tag:       "Cookies",
+			Summary:   "Deletes cookies via query parameters",
+			Responses: map[string]string{"200": "Expired Set-Cookie headers"},
+		}},
 
 		// Binary/Images
-		"/image/jpeg": httpbinImageJPEG,
-		"/image/png":  httpbinImagePNG,
-		"/image/svg":  httpbinImageSVG,
-		"/image/gif":  httpbinImageGIF,
-		"/image/webp": httpbinImageWebP,
+		{Pattern: "/image/jpeg", Methods: get, Handler: httpbinImageJPEG, Doc: &RouteDoc{
+			Tag:       "Images",
+			Summary:   "Returns a JPEG image",
+			Responses: map[string]string{"200": "JPEG image"},
+		}},
+		{Pattern: "/image/png", Methods: get, Handler: httpbinImagePNG, Doc: &RouteDoc{
+			Tag:       "Images",
+			Summary:   "Returns a PNG image",
+			Responses: map[string]string{"200": "PNG image"},
+		}},
+		{Pattern: "/image/svg", Methods: get, Handler: httpbinImageSVG, Doc: &RouteDoc{
+			Tag:       "Images",
+			Summary:   "Returns an SVG image",
+			Responses: map[string]string{"200": "SVG image"},
+		}},
+		{Pattern: "/image/gif", Methods: get, Handler: httpbinImageGIF, Doc: &RouteDoc{
+			Tag:       "Images",
+			Summary:   "Returns a GIF image",
+			Responses: map[string]string{"200": "GIF image"},
+		}},
+		{Pattern: "/image/webp", Methods: get, Handler: httpbinImageWebP, Doc: &RouteDoc{
+			Tag:       "Images",
+			Summary:   "Returns a WebP image",
+			Responses: map[string]string{"200": "WebP image"},
+		}},
 
 		// Response formats
-		"/html":       httpbinHTML,
-		"/xml":        httpbinXML,
-		"/json":       httpbinJSON,
-		"/robots.txt": httpbinRobots,
-		"/deny":       httpbinDeny,
+		{Pattern: "/html", Methods: get, Handler: httpbinHTML, Doc: &RouteDoc{
+			Tag:       "Response Formats",
+			Summary:   "Returns HTML response",
+			Responses: map[string]string{"200": "HTML page"},
+		}},
+		{Pattern: "/xml", Methods: get, Handler: httpbinXML, Doc: &RouteDoc{
+			Tag:       "Response Formats",
+			Summary:   "Returns XML response",
+			Responses: map[string]string{"200": "XML document"},
+		}},
+		{Pattern: "/json", Methods: get, Handler: httpbinJSON, Doc: &RouteDoc{
+			Tag:       "Response Formats",
+			Summary:   "Returns JSON response",
+			Responses: map[string]string{"200": "JSON object"},
+		}},
+		{Pattern: "/robots.txt", Methods: get, Handler: httpbinRobots, Doc: &RouteDoc{
+			Tag:       "Response Formats",
+			Summary:   "Returns robots.txt",
+			Responses: map[string]string{"200": "Robots.txt file"},
+		}},
+		{Pattern: "/deny", Methods: get, Handler: httpbinDeny, Doc: &RouteDoc{
+			Tag:       "Response Formats",
+			Summary:   "Returns denied message",
+			Responses: map[string]string{"200": "Access denied text"},
+		}},
+
+		// Dynamic
+		{Pattern: "/bytes/{n:int}", Methods: []string{"GET", "POST", "PUT"}, Handler: httpbinBytes, Doc: &RouteDoc{
+			Tag:         "Dynamic",
+			Summary:     "Returns n random bytes",
+			Description: "POST and PUT requests get their body echoed back instead",
+			Params:      []DocParam{{Name: "n", Min: 1, Max: 102400}},
+			Responses:   map[string]string{"200": "Random bytes"},
+		}},
+		{Pattern: "/base64/{value}", Methods: get, Handler: httpbinBase64, Doc: &RouteDoc{
+			Tag:       "Dynamic",
+			Summary:   "Decodes base64 string",
+			Responses: map[string]string{"200": "Decoded value"},
+		}},
+		{Pattern: "/status/{codes}", Handler: httpbinStatus, Doc: &RouteDoc{
+			Tag:         "Dynamic",
+			Summary:     "Returns specified HTTP status code",
+			Description: "A comma separated list picks one of the codes at random, weights are given as code:weight (e.g. 200:0.8,500:0.2)",
+			Params:      []DocParam{{Name: "codes", Description: "Status code between 100 and 599, or a weighted list of codes"}},
+			Responses:   map[string]string{"default": "Response with specified status", "400": "Invalid status code"},
+		}},
+		{Pattern: "/delay/{n:int}", Handler: httpbinDelay, Doc: &RouteDoc{
+			Tag:       "Dynamic",
+			Summary:   "Delays response by n seconds",
+			Params:    []DocParam{{Name: "n", Min: 1, Max: 10}},
+			Responses: map[string]string{"200": "Delayed response"},
+		}},
+		{Pattern: "/sse", Methods: get, Handler: httpbinSSE, Doc: &RouteDoc{
+			Tag:       "Dynamic",
+			Summary:   "Server-Sent Events stream",
+			Params:    []DocParam{{Name: "interval", Type: "integer", Description: "Milliseconds between events"}},
+			Responses: map[string]string{"200": "SSE stream"},
+		}},
+		{Pattern: "/sse/{n:int}", Methods: get, Handler: httpbinSSE, Doc: &RouteDoc{
+			Tag:     "Dynamic",
+			Summary: "Server-Sent Events stream with n events",
+			Params: []DocParam{
+				{Name: "n", Min: 1, Max: 100},
+				{Name: "interval", Type: "integer", Description: "Milliseconds between events"},
+			},
+			Responses: map[string]string{"200": "SSE stream"},
+		}},
+		{Pattern: "/stream/{n:int}", Methods: get, Handler: httpbinStream, Doc: &RouteDoc{
+			Tag:     "Dynamic",
+			Summary: "Streams n newline-delimited JSON objects",
+			Params: []DocParam{
+				{Name: "n", Min: 1, Max: 100},
+				{Name: "interval", Type: "integer", Description: "Milliseconds between objects"},
+			},
+			Responses: map[string]string{"200": "Newline-delimited JSON objects"},
+		}},
+		{Pattern: "/drip", Methods: get, Handler: httpbinDrip, Doc: &RouteDoc{
+			Tag:         "Dynamic",
+			Summary:     "Drips data over a duration after an optional initial delay",
+			Description: "Sends numbytes asterisks spread evenly over duration seconds, after waiting delay seconds. Delay and duration together are capped at 10 seconds.",
+			Params: []DocParam{
+				{Name: "duration", Type: "number", Description: "Seconds over which the data is sent (default 2)"},
+				{Name: "numbytes", Type: "integer", Description: "Number of bytes to send (default 10)"},
+				{Name: "delay", Type: "number", Description: "Seconds before the first byte (default 2)"},
+				{Name: "code", Type: "integer", Description: "Status code of the response (default 200)"},
+			},
+			Responses: map[string]string{"200": "Dripped bytes"},
+		}},
+
+		// Redirects
+		{Pattern: "/redirect/{n:int}", Methods: get, Handler: httpbinRedirect, Doc: &RouteDoc{
+			Tag:       "Redirects",
+			Summary:   "Redirect chain with n redirects",
+			Params:    []DocParam{{Name: "n", Min: 1, Max: 10}},
+			Responses: map[string]string{"302": "Redirect response"},
+		}},
+		{Pattern: "/redirect-to", Handler: httpbinRedirectTo, Doc: &RouteDoc{
+			Tag:     "Redirects",
+			Summary: "Redirect to specified URL",
+			Params: []DocParam{
+				{Name: "url", Required: true},
+				{Name: "status_code", Type: "integer", Min: 300, Max: 399},
+			},
+			Responses: map[string]string{"302": "Redirect to URL"},
+		}},
+
+		// WebSocket
+		{Pattern: "/ws", Methods: get, Handler: httpbinWebSocket, Doc: &RouteDoc{
+			Tag:         "WebSocket",
+			Summary:     "WebSocket fingerprint and echo endpoint",
+			Description: "Upgrades over HTTP/1.1 or an HTTP/2 extended CONNECT (RFC 8441). The first message is the fingerprint of the client, including the handshake, followed by a PING. Other messages are echoed, the text message \"fingerprint\" is answered with the fingerprint including the frames received so far. Sessions end after 12 seconds.",
+			Responses:   map[string]string{"101": "Switching Protocols - WebSocket connection established", "426": "Not a WebSocket upgrade"},
+		}},
 	}
 }
 
-// getDynamicHTTPBinPaths returns handlers for dynamic path patterns
-// These need prefix matching in the router
-func getDynamicHTTPBinPaths() map[string]func(types.Response, url.Values) ([]byte, string) {
-	return map[string]func(types.Response, url.Values) ([]byte, string){
-		"/bytes/":      httpbinBytes,
-		"/base64/":     httpbinBase64,
-		"/redirect/":   httpbinRedirect,
-		"/redirect-to": httpbinRedirectTo,
-		"/status/":     httpbinStatus,
-		"/delay/":      httpbinDelay,
-		"/sse":         httpbinSSE,
-		"/sse/":        httpbinSSE,
-		"/stream/":     httpbinStream,
-		"/anything/":   httpbinAnything,
-	}
+// httpbinWebSocket answers /ws requests that were not upgraded
+func httpbinWebSocket(res types.Response, params url.Values) RouteResponse {
+	r := respond([]byte("{\"error\": \"WebSocket upgrade required, use HTTP/1.1 or an HTTP/2 extended CONNECT\"}"), "application/json")
+	r.StatusCode = 426
+	return r
 }
 
 // =============================================================================
 // OpenAPI Specification Endpoint
 // =============================================================================
 
-// httpbinOpenAPI returns the OpenAPI 3.0 specification for all httpbin endpoints
-func httpbinOpenAPI(res types.Response, params url.Values) ([]byte, string) {
-	spec := map[string]interface{}{
-		"openapi": "3.0.3",
-		"info": map[string]interface{}{
-			"title":       "TLS Fingerprint HTTPBin API",
-			"description": "A simple HTTP Request & Response Service with TLS fingerprinting. All responses include JA3, JA4, PeetPrint, and Akamai fingerprints.",
-			"version":     "1.0.0",
-			"contact": map[string]string{
-				"name": "TLS Fingerprint",
-				"url":  "https://tlsfingerprint.com",
-			},
-		},
-		"servers": []map[string]string{
-			{"url": "https://tlsfingerprint.com", "description": "Production server"},
-			{"url": "https://localhost:8443", "description": "Local development"},
-		},
-		"tags": []map[string]string{
-			{"name": "TLS Fingerprinting", "description": "TLS fingerprint and SNI inspection"},
-			{"name": "HTTP Methods", "description": "Testing different HTTP verbs"},
-			{"name": "Request Inspection", "description": "Inspect request details"},
-			{"name": "Compression", "description": "Compressed responses"},
-			{"name": "Cookies", "description": "Cookie operations"},
-			{"name": "Images", "description": "Binary image responses"},
-			{"name": "Response Formats", "description": "Different response formats"},
-			{"name": "Redirects", "description": "Redirect operations"},
-			{"name": "Dynamic", "description": "Dynamic response generation"},
-			{"name": "WebSocket", "description": "WebSocket echo endpoint (HTTP/3 only)"},
-		},
-		"paths": buildOpenAPIPaths(),
-	}
-	return toJSON(spec), "application/json"
-}
-
-func buildOpenAPIPaths() map[string]interface{} {
-	return map[string]interface{}{
-		"/get": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":        []string{"HTTP Methods"},
-				"summary":     "Returns GET request data",
-				"description": "Returns the request's query parameters, headers, and TLS fingerprints",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{
-						"description": "Successful response",
-						"content": map[string]interface{}{
-							"application/json": map[string]interface{}{
-								"schema": map[string]string{"$ref": "#/components/schemas/EchoResponse"},
-							},
-						},
-					},
-				},
-			},
-		},
-		"/post": map[string]interface{}{
-			"post": map[string]interface{}{
-				"tags":        []string{"HTTP Methods"},
-				"summary":     "Returns POST request data",
-				"description": "Returns the request's body, form data, headers, and TLS fingerprints",
-				"requestBody": map[string]interface{}{
-					"content": map[string]interface{}{
-						"application/json":                  map[string]interface{}{"schema": map[string]string{"type": "object"}},
-						"application/x-www-form-urlencoded": map[string]interface{}{"schema": map[string]string{"type": "object"}},
-					},
-				},
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{
-						"description": "Successful response",
-						"content": map[string]interface{}{
-							"application/json": map[string]interface{}{
-								"schema": map[string]string{"$ref": "#/components/schemas/EchoResponse"},
-							},
-						},
-					},
-				},
-			},
-		},
-		"/put": map[string]interface{}{
-			"put": map[string]interface{}{
-				"tags":    []string{"HTTP Methods"},
-				"summary": "Returns PUT request data",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Successful response"},
-				},
-			},
-		},
-		"/patch": map[string]interface{}{
-			"patch": map[string]interface{}{
-				"tags":    []string{"HTTP Methods"},
-				"summary": "Returns PATCH request data",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Successful response"},
-				},
-			},
-		},
-		"/delete": map[string]interface{}{
-			"delete": map[string]interface{}{
-				"tags":    []string{"HTTP Methods"},
-				"summary": "Returns DELETE request data",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Successful response"},
-				},
-			},
-		},
-		"/anything": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"HTTP Methods"},
-				"summary": "Returns anything passed in request data (accepts any method)",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Successful response"},
-				},
-			},
-		},
-		"/headers": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Request Inspection"},
-				"summary": "Returns request headers",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Headers in response"},
-				},
-			},
-		},
-		"/ip": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Request Inspection"},
-				"summary": "Returns the client's IP address",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "IP address"},
-				},
-			},
-		},
-		"/user-agent": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Request Inspection"},
-				"summary": "Returns the User-Agent header",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "User-Agent string"},
-				},
-			},
-		},
-		"/gzip": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Compression"},
-				"summary": "Returns gzip-compressed response",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Gzip-encoded response"},
-				},
-			},
-		},
-		"/deflate": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Compression"},
-				"summary": "Returns deflate-compressed response",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Deflate-encoded response"},
-				},
-			},
-		},
-		"/brotli": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Compression"},
-				"summary": "Returns brotli-compressed response",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Brotli-encoded response"},
-				},
-			},
-		},
-		"/cookies": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Cookies"},
-				"summary": "Returns cookies from the request",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Cookies object"},
-				},
-			},
-		},
-		"/cookies/set": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Cookies"},
-				"summary": "Sets cookies via query parameters",
-				"parameters": []map[string]interface{}{
-					{"name": "name", "in": "query", "schema": map[string]string{"type": "string"}, "description": "Cookie name=value pairs"},
-				},
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Set-Cookie headers in response"},
-				},
-			},
-		},
-		"/cookies/delete": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Cookies"},
-				"summary": "Deletes cookies via query parameters",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Expired Set-Cookie headers"},
-				},
-			},
-		},
-		"/image/jpeg": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Images"},
-				"summary": "Returns a JPEG image",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "JPEG image", "content": map[string]interface{}{"image/jpeg": map[string]interface{}{}}},
-				},
-			},
-		},
-		"/image/png": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Images"},
-				"summary": "Returns a PNG image",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "PNG image"},
-				},
-			},
-		},
-		"/image/svg": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Images"},
-				"summary": "Returns an SVG image",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "SVG image"},
-				},
-			},
-		},
-		"/image/gif": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Images"},
-				"summary": "Returns a GIF image",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "GIF image"},
+// httpbinOpenAPI returns the OpenAPI 3.0 specification, generated from the
+// registered routes
+func httpbinOpenAPI(srv *Server) RouteHandler {
+	return func(res types.Response, params url.Values) RouteResponse {
+		spec := map[string]interface{}{
+			"openapi": "3.0.3",
+			"info": map[string]interface{}{
+				"title":       "TLS Fingerprint HTTPBin API",
+				"description": "A simple HTTP Request & Response Service with TLS fingerprinting. All responses include JA3, JA4, PeetPrint, and Akamai fingerprints.",
+				"version":     "1.0.0",
+				"contact": map[string]string{
+					"name": "TLS Fingerprint",
+					"url":  "https://tlsfingerprint.com",
 				},
 			},
-		},
-		"/image/webp": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Images"},
-				"summary": "Returns a WebP image",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "WebP image"},
-				},
-			},
-		},
-		"/html": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Response Formats"},
-				"summary": "Returns HTML response",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "HTML page"},
-				},
-			},
-		},
-		"/xml": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Response Formats"},
-				"summary": "Returns XML response",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "XML document"},
-				},
-			},
-		},
-		"/json": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Response Formats"},
-				"summary": "Returns JSON response",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "JSON object"},
-				},
-			},
-		},
-		"/robots.txt": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Response Formats"},
-				"summary": "Returns robots.txt",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Robots.txt file"},
-				},
-			},
-		},
-		"/deny": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Response Formats"},
-				"summary": "Returns denied message",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Access denied text"},
-				},
-			},
-		},
-		"/bytes/{n}": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Dynamic"},
-				"summary": "Returns n random bytes",
-				"parameters": []map[string]interface{}{
-					{"name": "n", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 102400}},
-				},
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Random bytes"},
-				},
-			},
-		},
-		"/base64/{value}": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Dynamic"},
-				"summary": "Decodes base64 string",
-				"parameters": []map[string]interface{}{
-					{"name": "value", "in": "path", "required": true, "schema": map[string]string{"type": "string"}},
-				},
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Decoded value"},
-				},
-			},
-		},
-		"/redirect/{n}": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Redirects"},
-				"summary": "Redirect chain with n redirects",
-				"parameters": []map[string]interface{}{
-					{"name": "n", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 10}},
-				},
-				"responses": map[string]interface{}{
-					"302": map[string]interface{}{"description": "Redirect response"},
-				},
-			},
-		},
-		"/redirect-to": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Redirects"},
-				"summary": "Redirect to specified URL",
-				"parameters": []map[string]interface{}{
-					{"name": "url", "in": "query", "required": true, "schema": map[string]string{"type": "string"}},
-				},
-				"responses": map[string]interface{}{
-					"302": map[string]interface{}{"description": "Redirect to URL"},
-				},
-			},
-		},
-		"/status/{code}": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Dynamic"},
-				"summary": "Returns specified HTTP status code",
-				"parameters": []map[string]interface{}{
-					{"name": "code", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer", "minimum": 100, "maximum": 599}},
-				},
-				"responses": map[string]interface{}{
-					"default": map[string]interface{}{"description": "Response with specified status"},
-				},
-			},
-		},
-		"/delay/{seconds}": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Dynamic"},
-				"summary": "Delays response by n seconds",
-				"parameters": []map[string]interface{}{
-					{"name": "seconds", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 10}},
-				},
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Delayed response"},
-				},
-			},
-		},
-		"/sse": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Dynamic"},
-				"summary": "Server-Sent Events stream",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "SSE stream"},
-				},
+			"servers": []map[string]string{
+				{"url": "https://tlsfingerprint.com", "description": "Production server"},
+				{"url": "https://localhost:8443", "description": "Local development"},
 			},
-		},
-		"/stream/{n}": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":    []string{"Dynamic"},
-				"summary": "Streams n newline-delimited JSON objects",
-				"parameters": []map[string]interface{}{
-					{"name": "n", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 100}},
-				},
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Newline-delimited JSON objects"},
-				},
+			"tags": []map[string]string{
+				{"name": "TLS Fingerprinting", "description": "TLS fingerprint and SNI inspection"},
+				{"name": "HTTP Methods", "description": "Testing different HTTP verbs"},
+				{"name": "Request Inspection", "description": "Inspect request details"},
+				{"name": "Compression", "description": "Compressed responses"},
+				{"name": "Cookies", "description": "Cookie operations"},
+				{"name": "Images", "description": "Binary image responses"},
+				{"name": "Response Formats", "description": "Different response formats"},
+				{"name": "Redirects", "description": "Redirect operations"},
+				{"name": "Dynamic", "description": "Dynamic response generation"},
+				{"name": "WebSocket", "description": "WebSocket echo endpoint (HTTP/3 only)"},
 			},
-		},
-		"/ws": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":        []string{"WebSocket"},
-				"summary":     "WebSocket echo endpoint",
-				"description": "Upgrades to WebSocket connection and echoes back any message received. Note: WebSocket is only available over HTTP/3.",
-				"responses": map[string]interface{}{
-					"101": map[string]interface{}{"description": "Switching Protocols - WebSocket connection established"},
-				},
-			},
-		},
-		"/api/sni": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":        []string{"TLS Fingerprinting"},
-				"summary":     "Returns the SNI (Server Name Indication) from TLS handshake",
-				"description": "Extracts and returns the SNI hostname sent during TLS handshake. Useful for verifying SNI override functionality.",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{
-						"description": "SNI information",
-						"content": map[string]interface{}{
-							"application/json": map[string]interface{}{
-								"schema": map[string]interface{}{
-									"type": "object",
-									"properties": map[string]interface{}{
-										"sni":          map[string]string{"type": "string", "description": "Server Name Indication hostname"},
-										"ip":           map[string]string{"type": "string", "description": "Client IP address"},
-										"http_version": map[string]string{"type": "string", "description": "HTTP version (h1, h2, h3)"},
-									},
-								},
-							},
+			"paths": srv.routeTable().openAPIPaths(),
+			"components": map[string]interface{}{
+				"schemas": map[string]interface{}{
+					"EchoResponse": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"args":         map[string]string{"type": "object"},
+							"headers":      map[string]string{"type": "object"},
+							"origin":       map[string]string{"type": "string"},
+							"url":          map[string]string{"type": "string"},
+							"method":       map[string]string{"type": "string"},
+							"data":         map[string]string{"type": "string"},
+							"form":         map[string]string{"type": "object"},
+							"files":        map[string]string{"type": "object"},
+							"json":         map[string]string{"type": "object"},
+							"http_version": map[string]string{"type": "string"},
+							"ja3":          map[string]string{"type": "string"},
+							"ja4":          map[string]string{"type": "string"},
+							"akamai":       map[string]string{"type": "string"},
 						},
 					},
 				},
 			},
-		},
-		"/api/all": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":        []string{"TLS Fingerprinting"},
-				"summary":     "Returns complete TLS fingerprint data",
-				"description": "Returns full TLS fingerprint including JA3, JA4, PeetPrint, Akamai fingerprint, and all extensions",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Complete fingerprint response"},
-				},
-			},
-		},
-		"/api/tls": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":        []string{"TLS Fingerprinting"},
-				"summary":     "Returns TLS-only fingerprint data",
-				"description": "Returns only the TLS fingerprint data (JA3, JA4, extensions) without HTTP details",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "TLS fingerprint response"},
-				},
-			},
-		},
-		"/api/clean": map[string]interface{}{
-			"get": map[string]interface{}{
-				"tags":        []string{"TLS Fingerprinting"},
-				"summary":     "Returns clean fingerprint summary",
-				"description": "Returns a minimal fingerprint summary with just the hash values",
-				"responses": map[string]interface{}{
-					"200": map[string]interface{}{"description": "Clean fingerprint response"},
-				},
-			},
-		},
+		}
+		return respond(toJSON(spec), "application/json")
 	}
 }
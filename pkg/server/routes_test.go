@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/store"
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// storeServer returns a server with a memory store holding the logs
+func storeServer(t *testing.T, logs ...store.RequestLog) *Server {
+	st := store.NewMemory()
+	if err := st.Save(logs...); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer()
+	srv.SetStore(st)
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// searchLogs are three logs sharing their JA3 and HTTP/2 fingerprints
+var searchLogs = []store.RequestLog{
+	{JA3: "a", H2: "h2-a", UserAgent: "curl", Time: 1},
+	{JA3: "a", H2: "h2-b", UserAgent: "curl", Time: 2},
+	{JA3: "b", H2: "h2-a", UserAgent: "chrome", Time: 3},
+}
+
+func TestSearch(t *testing.T) {
+	srv := storeServer(t, searchLogs...)
+	var byJA3 ByJA3
+	rr := apiSearchJA3(srv)(types.Response{}, url.Values{"by": {"a"}})
+	if err := json.Unmarshal(rr.Body, &byJA3); err != nil {
+		t.Fatal(err)
+	}
+	if byJA3.UserAgents["curl"] != 2 || byJA3.H2["h2-a"] != 1 || byJA3.H2["h2-b"] != 1 {
+		t.Fatalf("Unexpected search result %+v", byJA3)
+	}
+	if byJA3.Total != 2 || byJA3.FirstSeen != 1 || byJA3.LastSeen != 2 || byJA3.Distinct["h2"] != 2 || byJA3.NextCursor != "" {
+		t.Fatalf("Unexpected search totals %+v", byJA3.SearchMeta)
+	}
+
+	// Paging walks the lists most seen first, ties ordered by value
+	var page ByH2
+	json.Unmarshal(apiSearchH2(srv)(types.Response{}, url.Values{"by": {"h2-a"}, "limit": {"1"}}).Body, &page)
+	if len(page.JA3) != 1 || page.JA3["a"] != 1 || page.NextCursor == "" {
+		t.Fatalf("Unexpected first page %+v", page)
+	}
+	cursor := page.NextCursor
+	page = ByH2{}
+	json.Unmarshal(apiSearchH2(srv)(types.Response{}, url.Values{"by": {"h2-a"}, "limit": {"1"}, "cursor": {cursor}}).Body, &page)
+	if len(page.JA3) != 1 || page.JA3["b"] != 1 || page.NextCursor != "" || page.Total != 2 {
+		t.Fatalf("Unexpected second page %+v", page)
+	}
+	page = ByH2{}
+	json.Unmarshal(apiSearchH2(srv)(types.Response{}, url.Values{"by": {"h2-a"}, "since": {"2"}}).Body, &page)
+	if page.Total != 1 || page.FirstSeen != 3 || page.JA3["b"] != 1 {
+		t.Fatalf("Unexpected time range result %+v", page)
+	}
+	if rr := apiSearchH2(srv)(types.Response{}, url.Values{"by": {"h2-a"}, "limit": {"0"}}); rr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid limit, got %d", rr.StatusCode)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	srv := storeServer(t, searchLogs...)
+	var fp FingerprintRollup
+	rr := apiFingerprint(srv)(types.Response{PathParams: map[string]string{"type": "akamai", "value": "h2-a"}}, nil)
+	if err := json.Unmarshal(rr.Body, &fp); err != nil {
+		t.Fatal(err)
+	}
+	if fp.Type != "h2" || fp.Count != 2 || fp.FirstSeen != 1 || fp.LastSeen != 3 || fp.Daily["1970-01-01"] != 2 {
+		t.Fatalf("Unexpected rollup %+v", fp)
+	}
+	if ja3 := fp.Related["ja3"]; len(ja3) != 2 || ja3[0] != (store.ValueCount{Value: "a", Count: 1}) {
+		t.Fatalf("Unexpected related values %+v", fp.Related)
+	}
+	if rr := apiFingerprint(srv)(types.Response{PathParams: map[string]string{"type": "ja3", "value": "c"}}, nil); rr.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown value, got %d", rr.StatusCode)
+	}
+}
+
+func TestNewFingerprints(t *testing.T) {
+	srv := storeServer(t, searchLogs...)
+	var fresh struct {
+		Fingerprints []store.Rollup `json:"fingerprints"`
+	}
+	json.Unmarshal(apiNew(srv)(types.Response{}, url.Values{"since": {"2"}, "type": {"ja3"}}).Body, &fresh)
+	if len(fresh.Fingerprints) != 1 || fresh.Fingerprints[0].Value != "b" || fresh.Fingerprints[0].FirstSeen != 3 {
+		t.Fatalf("Unexpected new fingerprints %+v", fresh.Fingerprints)
+	}
+}
+
+func TestRequestSnapshot(t *testing.T) {
+	srv := storeServer(t)
+	srv.GetConfig().Snapshots = true
+	res := types.Response{RequestID: "live", IP: "1.2.3.4:5", Method: "GET", TLS: &types.TLSDetails{JA3: "a", RawB64: "FgMB"},
+		Http1: &types.Http1Details{Headers: []string{"Host: trackme.local:8443"}}}
+	live := newSnapshot(res, time.Now().Unix(), "", srv)
+	res.RequestID = "old"
+	old := newSnapshot(res, time.Now().Unix()-8*24*3600, "", srv)
+	if err := srv.GetStore().SaveSnapshots(*live, *old); err != nil {
+		t.Fatal(err)
+	}
+	// Snapshots over the size cap are counted, not stored
+	srv.GetConfig().SnapshotSize = 100
+	res.RequestID = "big"
+	if big := newSnapshot(res, time.Now().Unix(), "", srv); big != nil || srv.requestLogger().stats().Oversized != 1 {
+		t.Fatal("Expected the oversized snapshot to be skipped")
+	}
+
+	var snap RequestSnapshot
+	rr := apiRequest(srv)(types.Response{PathParams: map[string]string{"id": "live"}}, nil)
+	if err := json.Unmarshal(rr.Body, &snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.RequestID != "live" || snap.Permalink != "https://trackme.local:8443/api/request/live" || snap.ClientHello != "FgMB" || snap.Response.TLS.JA3 != "a" {
+		t.Fatalf("Unexpected snapshot %+v", snap)
+	}
+	if snap.Response.IP != "" || snap.ExpiresAt != snap.Time+defaultSnapshotTTL*3600 {
+		t.Fatalf("Expected the IP to be left out and the default TTL, got %+v", snap)
+	}
+	for _, id := range []string{"old", "big"} {
+		if rr := apiRequest(srv)(types.Response{PathParams: map[string]string{"id": id}}, nil); rr.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected 404 for snapshot %s, got %d", id, rr.StatusCode)
+		}
+	}
+}
+
+func TestSearchBrowser(t *testing.T) {
+	const (
+		chromeMac = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+		chromeWin = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/123.0.0.0 Safari/537.36"
+		edge      = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.2478.51"
+	)
+	var logs []store.RequestLog
+	for i, ua := range []string{chromeMac, chromeMac, chromeWin, edge} {
+		p := utils.ParseUserAgent(ua)
+		logs = append(logs, store.RequestLog{UserAgent: ua, JA4: fmt.Sprint("ja4-", i%2), H2: "h2", Time: 1,
+			Browser: p.Family, BrowserMajor: p.Major, OS: p.OS, Device: p.Device})
+	}
+	srv := storeServer(t, logs...)
+
+	search := func(params url.Values) ByBrowser {
+		var b ByBrowser
+		rr := apiSearchBrowser(srv)(types.Response{}, params)
+		if err := json.Unmarshal(rr.Body, &b); err != nil || rr.StatusCode != 0 {
+			t.Fatalf("Unexpected response %d %s", rr.StatusCode, rr.Body)
+		}
+		return b
+	}
+	b := search(url.Values{"family": {"Chrome"}})
+	if b.Total != 3 || b.Majors["124"] != 2 || b.Majors["123"] != 1 || b.JA4["ja4-0"] != 2 || b.H2["h2"] != 3 {
+		t.Fatalf("Unexpected family result %+v", b)
+	}
+	b = search(url.Values{"family": {"Chrome"}, "major": {"124"}, "os": {"macOS"}})
+	if b.Total != 2 || b.JA4["ja4-0"] != 1 || b.JA4["ja4-1"] != 1 {
+		t.Fatalf("Unexpected version result %+v", b)
+	}
+	if b = search(url.Values{"os": {"Windows"}, "device": {"Desktop"}}); b.Total != 2 {
+		t.Fatalf("Unexpected OS result %+v", b)
+	}
+	for _, params := range []url.Values{{}, {"major": {"124"}}} {
+		if rr := apiSearchBrowser(srv)(types.Response{}, params); rr.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v, got %d", params, rr.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+const (
+	rttPath = "/api/rtt"
+	// rttPings is the number of PINGs sent one after another for /api/rtt
+	rttPings   = 5
+	rttTimeout = 2 * time.Second
+
+	// A connection is flagged as proxied when the application RTT exceeds
+	// the TCP RTT by both the minimum gap and the ratio
+	proxyMinGap = 15 * time.Millisecond
+	proxyRatio  = 2
+)
+
+// rttMeter times the PINGs the server sends on an HTTP/2 connection
+type rttMeter struct {
+	mu      sync.Mutex
+	sent    map[[8]byte]time.Time
+	waiters map[[8]byte]chan time.Duration
+}
+
+func newRTTMeter() *rttMeter {
+	return &rttMeter{
+		sent:    make(map[[8]byte]time.Time),
+		waiters: make(map[[8]byte]chan time.Duration),
+	}
+}
+
+// newPing registers a PING payload and returns the channel its RTT is
+// delivered on
+func (m *rttMeter) newPing(seq uint64) ([8]byte, chan time.Duration) {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], uint64(time.Now().UnixNano())+seq)
+	ch := make(chan time.Duration, 1)
+	m.mu.Lock()
+	m.sent[data] = time.Now()
+	m.waiters[data] = ch
+	m.mu.Unlock()
+	return data, ch
+}
+
+// onPingAck returns false if the ACK does not belong to an RTT PING
+func (m *rttMeter) onPingAck(data [8]byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent, ok := m.sent[data]
+	if !ok {
+		return false
+	}
+	m.waiters[data] <- time.Since(sent)
+	delete(m.sent, data)
+	delete(m.waiters, data)
+	return true
+}
+
+// cancel forgets a PING that was not answered in time
+func (m *rttMeter) cancel(data [8]byte) {
+	m.mu.Lock()
+	delete(m.sent, data)
+	delete(m.waiters, data)
+	m.mu.Unlock()
+}
+
+// measureRTT sends PINGs one after another, so that they never queue behind
+// each other, and compares their RTT with the one of the TCP connection
+func (c *HTTP2Connection) measureRTT() *types.RTTDetails {
+	deadline := time.After(rttTimeout)
+	samples := []time.Duration{}
+
+pings:
+	for i := 0; i < rttPings; i++ {
+		data, ch := c.rtt.newPing(uint64(i))
+		c.writeMu.Lock()
+		err := c.framer.WritePing(false, data)
+		c.writeMu.Unlock()
+		if err != nil {
+			c.rtt.cancel(data)
+			break
+		}
+		select {
+		case d := <-ch:
+			samples = append(samples, d)
+		case <-deadline:
+			c.rtt.cancel(data)
+			break pings
+		}
+	}
+
+	d := appRTT{samples: samples}
+	for _, s := range samples {
+		if d.min == 0 || s < d.min {
+			d.min = s
+		}
+	}
+	if len(samples) > 0 {
+		d.latest = samples[len(samples)-1]
+	}
+	tcpRTT, tcpMinRTT, source := c.srv.transportRTT(c.conn, false)
+	return buildRTTDetails("h2_ping", d, tcpRTT, tcpMinRTT, source)
+}
+
+// transportRTT returns the RTT of the TCP connection from TCP_INFO, falling
+// back to the handshake RTT seen by the sniffer. With anyPort the sniffer is
+// searched for any connection from the same IP, which is used for HTTP/3.
+func (srv *Server) transportRTT(conn net.Conn, anyPort bool) (time.Duration, time.Duration, string) {
+	if conn != nil {
+		if rtt, minRTT, ok := tcpInfoRTT(conn); ok {
+			return rtt, minRTT, "tcp_info"
+		}
+	}
+
+	var addr string
+	if conn != nil {
+		addr = conn.RemoteAddr().String()
+	}
+	return srv.snifferRTT(addr, anyPort)
+}
+
+func (srv *Server) snifferRTT(addr string, anyPort bool) (time.Duration, time.Duration, string) {
+	if !anyPort {
+		if v, ok := srv.GetTCPFingerprints().Load(addr); ok {
+			if ms := v.(types.TCPIPDetails).HandshakeRTTMs; ms > 0 {
+				d := time.Duration(ms * float64(time.Millisecond))
+				return d, d, "sniffer"
+			}
+		}
+		return 0, 0, ""
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, 0, ""
+	}
+	var best time.Duration
+	srv.GetTCPFingerprints().Range(func(key, value interface{}) bool {
+		k, _ := key.(string)
+		if !strings.HasPrefix(k, host+":") {
+			return true
+		}
+		if ms := value.(types.TCPIPDetails).HandshakeRTTMs; ms > 0 {
+			d := time.Duration(ms * float64(time.Millisecond))
+			if best == 0 || d < best {
+				best = d
+			}
+		}
+		return true
+	})
+	if best == 0 {
+		return 0, 0, ""
+	}
+	return best, best, "sniffer"
+}
+
+// underlyingTCPConn unwraps TLS and buffered connections
+func underlyingTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case *bufferedConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// appRTT is the round trip measured inside the encrypted connection,
+// either from PING samples or from the estimates of the QUIC connection
+type appRTT struct {
+	samples               []time.Duration
+	latest, min, smoothed time.Duration
+}
+
+func buildRTTDetails(method string, app appRTT, tcpRTT, tcpMinRTT time.Duration, source string) *types.RTTDetails {
+	d := &types.RTTDetails{
+		Method:           method,
+		AppLatestRTTMs:   durationMs(app.latest),
+		AppMinRTTMs:      durationMs(app.min),
+		AppSmoothedRTTMs: durationMs(app.smoothed),
+		TCPRTTMs:         durationMs(tcpRTT),
+		TCPMinRTTMs:      durationMs(tcpMinRTT),
+		TCPRTTSource:     source,
+	}
+	for _, s := range app.samples {
+		d.AppRTTSamplesMs = append(d.AppRTTSamplesMs, durationMs(s))
+	}
+	appMin := app.min
+
+	// The minimum is compared, as it is the least affected by queueing
+	tcpRef := tcpMinRTT
+	if tcpRef == 0 {
+		tcpRef = tcpRTT
+	}
+	if appMin == 0 || source == "" {
+		return d
+	}
+	gap := appMin - tcpRef
+	d.GapMs = durationMs(gap)
+	d.ProxyLikely = gap > proxyMinGap && appMin > proxyRatio*tcpRef
+	return d
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestBuildRTTDetails(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name           string
+		appMin         time.Duration
+		tcpRTT, tcpMin time.Duration
+		source         string
+		proxy          bool
+		gap            float64
+	}{
+		{"direct", 21 * ms, 20 * ms, 20 * ms, "tcp_info", false, 1},
+		{"proxied", 60 * ms, 20 * ms, 20 * ms, "tcp_info", true, 40},
+		// Twice the TCP RTT but within the minimum gap
+		{"close to the server", 12 * ms, 5 * ms, 5 * ms, "tcp_info", false, 7},
+		// A gap above the minimum but below the ratio
+		{"slow link", 50 * ms, 30 * ms, 30 * ms, "tcp_info", false, 20},
+		// Without the minimum the smoothed TCP RTT is compared
+		{"no min", 60 * ms, 20 * ms, 0, "sniffer", true, 40},
+		{"no transport RTT", 60 * ms, 0, 0, "", false, 0},
+		{"no samples", 0, 20 * ms, 20 * ms, "tcp_info", false, 0},
+	}
+	for _, tt := range tests {
+		app := appRTT{min: tt.appMin, latest: tt.appMin}
+		if tt.appMin > 0 {
+			app.samples = []time.Duration{tt.appMin}
+		}
+		d := buildRTTDetails("h2_ping", app, tt.tcpRTT, tt.tcpMin, tt.source)
+		if d.ProxyLikely != tt.proxy || d.GapMs != tt.gap {
+			t.Fatalf("%s: expected proxy_likely %v and a gap of %vms, got %+v", tt.name, tt.proxy, tt.gap, d)
+		}
+		if len(d.AppRTTSamplesMs) != len(app.samples) {
+			t.Fatalf("%s: expected %d samples, got %+v", tt.name, len(app.samples), d)
+		}
+	}
+}
+
+func TestRTTMeter(t *testing.T) {
+	m := newRTTMeter()
+	answered, ch := m.newPing(0)
+	unanswered, _ := m.newPing(1)
+	if answered == unanswered {
+		t.Fatal("Expected every PING to have its own payload")
+	}
+
+	if !m.onPingAck(answered) {
+		t.Fatal("Expected the ACK to match the PING")
+	}
+	select {
+	case <-ch:
+	default:
+		t.Fatal("Expected the RTT to be delivered")
+	}
+	if m.onPingAck(answered) {
+		t.Fatal("Expected a second ACK to be ignored")
+	}
+
+	// A PING that timed out is forgotten, a late ACK does not block
+	m.cancel(unanswered)
+	if m.onPingAck(unanswered) || len(m.sent) != 0 || len(m.waiters) != 0 {
+		t.Fatalf("Expected the cancelled PING to be forgotten, got %d pending", len(m.sent))
+	}
+	if m.onPingAck([8]byte{1}) {
+		t.Fatal("Expected an unknown ACK to be ignored")
+	}
+}
+
+func TestTransportRTT(t *testing.T) {
+	srv, _, _ := setupTest()
+	srv.GetTCPFingerprints().Store("1.2.3.4:1000", types.TCPIPDetails{HandshakeRTTMs: 30})
+	srv.GetTCPFingerprints().Store("1.2.3.4:2000", types.TCPIPDetails{HandshakeRTTMs: 20})
+	srv.GetTCPFingerprints().Store("1.2.3.40:3000", types.TCPIPDetails{HandshakeRTTMs: 10})
+
+	if rtt, _, source := srv.snifferRTT("1.2.3.4:1000", false); rtt != 30*time.Millisecond || source != "sniffer" {
+		t.Fatalf("Expected the RTT of the connection, got %v %q", rtt, source)
+	}
+	// HTTP/3 takes the lowest RTT of the IP, other IPs sharing the prefix
+	// are left out
+	if rtt, _, source := srv.snifferRTT("1.2.3.4:5000", true); rtt != 20*time.Millisecond || source != "sniffer" {
+		t.Fatalf("Expected the lowest RTT of the IP, got %v %q", rtt, source)
+	}
+	if rtt, _, source := srv.snifferRTT("1.2.3.4:5000", false); rtt != 0 || source != "" {
+		t.Fatalf("Expected no RTT for an unknown connection, got %v %q", rtt, source)
+	}
+
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+	// Other systems have no TCP_INFO and the sniffer did not see the
+	// connection
+	want := "tcp_info"
+	if runtime.GOOS != "linux" {
+		want = ""
+	}
+	if _, _, source := srv.transportRTT(&bufferedConn{Conn: serverConn}, false); source != want {
+		t.Fatalf("Expected the TCP RTT from %q, got %q", want, source)
+	}
+}
@@ -1,28 +1,33 @@
 package server
 
 import (
-	"context"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/pagpeter/trackme/pkg/store"
 	"github.com/pagpeter/trackme/pkg/types"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// defaultMaxBodySize is used when the config does not set max_body_size
+const defaultMaxBodySize = 16 * 1024 * 1024
+
 // State holds all the global state previously scattered across the application
 type State struct {
 	Config          *types.Config
-	ConnectedToDB   bool
 	TCPFingerprints sync.Map
-	MongoClient     *mongo.Client
-	MongoCollection *mongo.Collection
-	MongoContext    context.Context
+	Store           store.Store
 	Local           bool
 }
 
 // Server provides access to shared state and functionality
 type Server struct {
 	State *State
+
+	routesOnce sync.Once
+	routes     *routeTable
+
+	logger *requestLogger
 }
 
 // NewServer creates a new server instance with initialized state
@@ -30,9 +35,7 @@ func NewServer() *Server {
 	return &Server{
 		State: &State{
 			Config:          &types.Config{},
-			ConnectedToDB:   false,
 			TCPFingerprints: sync.Map{},
-			MongoContext:    context.TODO(),
 		},
 	}
 }
@@ -42,9 +45,25 @@ func (s *Server) GetConfig() *types.Config {
 	return s.State.Config
 }
 
-// IsConnectedToDB returns whether the database connection is active
+// MaxBodySize returns the largest request body the server accepts
+func (s *Server) MaxBodySize() int64 {
+	if s.State.Config.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return s.State.Config.MaxBodySize
+}
+
+// routeTable returns the routes, compiled on first use
+func (s *Server) routeTable() *routeTable {
+	s.routesOnce.Do(func() {
+		s.routes = newRouteTable(getRoutes(s))
+	})
+	return s.routes
+}
+
+// IsConnectedToDB returns whether a store is set
 func (s *Server) IsConnectedToDB() bool {
-	return s.State.ConnectedToDB
+	return s.State.Store != nil
 }
 
 // GetTCPFingerprints returns the TCP fingerprints map
@@ -52,21 +71,35 @@ func (s *Server) GetTCPFingerprints() *sync.Map {
 	return &s.State.TCPFingerprints
 }
 
-// GetMongoCollection returns the MongoDB collection
-func (s *Server) GetMongoCollection() *mongo.Collection {
-	return s.State.MongoCollection
+// GetStore returns the store the requests are logged to
+func (s *Server) GetStore() store.Store {
+	return s.State.Store
+}
+
+// SetStore sets the store the requests are logged to and starts the
+// writer that stores them in batches and deletes them after their retention
+func (s *Server) SetStore(st store.Store) {
+	s.State.Store = st
+	c := s.State.Config
+	keep := retention{
+		logs:    time.Duration(c.LogDays) * 24 * time.Hour,
+		rollups: time.Duration(c.RollupDays) * 24 * time.Hour,
+	}
+	s.logger = newRequestLogger(st, c.LogQueueSize, c.LogBatchSize, c.LogPolicy == "block", keep)
 }
 
-// GetMongoContext returns the MongoDB context
-func (s *Server) GetMongoContext() context.Context {
-	return s.State.MongoContext
+// requestLogger returns the writer of the request logs
+func (s *Server) requestLogger() *requestLogger {
+	return s.logger
 }
 
-// SetMongoConnection sets the database connection details
-func (s *Server) SetMongoConnection(client *mongo.Client, collection *mongo.Collection) {
-	s.State.MongoClient = client
-	s.State.MongoCollection = collection
-	s.State.ConnectedToDB = true
+// Close stores the queued request logs and closes the store
+func (s *Server) Close() error {
+	if s.State.Store == nil {
+		return nil
+	}
+	s.logger.close()
+	return s.State.Store.Close()
 }
 
 // GetAdmin returns the CORS key configuration
@@ -76,7 +109,7 @@ func (s *Server) GetAdmin() (string, bool) {
 
 // GetUserAgent extracts the user agent from a response
 func GetUserAgent(res types.Response) string {
-	if res.HTTPVersion == "h2" {
+	if res.HTTPVersion == "h2" || res.HTTPVersion == "h3" {
 		return res.UserAgent
 	}
 	if res.Http1 == nil {
@@ -99,4 +132,4 @@ func (s *Server) SetLocal(local bool) {
 // IsLocal returns whether we're running in local development mode
 func (s *Server) IsLocal() bool {
 	return s.State.Local
-}
\ No newline at end of file
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/store"
+	"github.com/pagpeter/trackme/pkg/tls"
+	"github.com/pagpeter/trackme/pkg/types"
+	"github.com/pagpeter/trackme/pkg/utils"
+)
+
+// similarElements are the lists the similarity score is averaged over
+var similarElements = []string{"ciphers", "extensions", "groups", "signature_algorithms", "settings"}
+
+// ja4Sections are the JA4 sections that can be searched for on their own
+var ja4Sections = []string{"ja4_a", "ja4_b", "ja4_c"}
+
+// SimilarElement compares one list of a stored fingerprint with the target.
+// Missing are only in the target, Extra only in the stored fingerprint.
+type SimilarElement struct {
+	Similarity float64  `json:"similarity"`
+	Missing    []string `json:"missing,omitempty"`
+	Extra      []string `json:"extra,omitempty"`
+}
+
+// SimilarMatch is a stored fingerprint and how close it is to the target
+type SimilarMatch struct {
+	Type  string  `json:"type"`
+	Value string  `json:"value"`
+	Count int64   `json:"count"`
+	Score float64 `json:"score"`
+	// H2 and UserAgent are the values most seen with the fingerprint
+	H2        string                    `json:"h2,omitempty"`
+	UserAgent string                    `json:"user_agent,omitempty"`
+	Elements  map[string]SimilarElement `json:"elements"`
+}
+
+// similarTarget is the fingerprint the stored ones are compared with
+type similarTarget struct {
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+	H2    string `json:"h2,omitempty"`
+	// Sections are the searched JA4 sections
+	Sections map[string]string `json:"sections,omitempty"`
+	elements map[string][]string
+}
+
+// loadSnapshot loads and decodes the snapshot of a request
+func loadSnapshot(srv *Server, id string) (RequestSnapshot, bool, error) {
+	var snap RequestSnapshot
+	s, ok, err := srv.GetStore().Snapshot(id)
+	if err != nil || !ok {
+		return snap, ok, err
+	}
+	return snap, true, json.Unmarshal(s.Data, &snap)
+}
+
+// parseSimilarTarget reads the target from the ja4 sections, a request id
+// or a peetprint, ja3 or h2 fingerprint
+func parseSimilarTarget(u url.Values, srv *Server) (similarTarget, RouteResponse, bool) {
+	t := similarTarget{Sections: map[string]string{}, elements: map[string][]string{}}
+
+	if ja4 := utils.GetParam("ja4", u); ja4 != "" {
+		a, b, c, ok := tls.JA4Sections(ja4)
+		if !ok {
+			return t, jsonError(http.StatusBadRequest, "ja4 must have three sections"), false
+		}
+		t.Sections = map[string]string{"ja4_a": a, "ja4_b": b, "ja4_c": c}
+	}
+	for _, s := range ja4Sections {
+		if v := utils.GetParam(s, u); v != "" {
+			t.Sections[s] = v
+		}
+	}
+	if len(t.Sections) > 0 {
+		t.Type = "ja4"
+		return t, RouteResponse{}, true
+	}
+
+	peetprint, ja3, h2 := utils.GetParam("peetprint", u), utils.GetParam("ja3", u), utils.GetParam("h2", u)
+	if id := utils.GetParam("id", u); id != "" {
+		snap, ok, err := loadSnapshot(srv, id)
+		if err != nil {
+			log.Println("Error loading snapshot:", err)
+			return t, jsonError(http.StatusInternalServerError, "Could not load the request"), false
+		}
+		if !ok {
+			return t, jsonError(http.StatusNotFound, "Request not found or expired"), false
+		}
+		if snap.Response.TLS != nil {
+			peetprint = snap.Response.TLS.PeetPrint
+		}
+		if snap.Response.Http2 != nil {
+			h2 = snap.Response.Http2.AkamaiFingerprint
+		}
+	}
+
+	var ok bool
+	switch {
+	case peetprint != "":
+		t.Type, t.Value = "peetprint", peetprint
+		t.elements, ok = tls.PeetPrintElements(peetprint)
+	case ja3 != "":
+		t.Type, t.Value = "ja3", ja3
+		t.elements, ok = tls.JA3Elements(ja3)
+	case h2 != "":
+		t.Type, t.Value, ok = "h2", h2, true
+	default:
+		return t, jsonError(http.StatusBadRequest, "Missing id, peetprint, ja3, h2, ja4 or ja4_a, ja4_b, ja4_c"), false
+	}
+	if !ok {
+		return t, jsonError(http.StatusBadRequest, "Invalid "+t.Type), false
+	}
+	if h2 != "" {
+		h2Elements, ok := trackmehttp.AkamaiElements(h2)
+		if !ok {
+			return t, jsonError(http.StatusBadRequest, "Invalid h2"), false
+		}
+		if t.Type != "h2" {
+			t.H2 = h2
+		}
+		t.elements["settings"] = h2Elements["settings"]
+	}
+	return t, RouteResponse{}, true
+}
+
+// similar scores the stored fingerprints of the target type, best first
+func similar(t similarTarget, rollups []store.Rollup) []SimilarMatch {
+	matches := []SimilarMatch{}
+	for _, r := range rollups {
+		m := SimilarMatch{Type: r.Type, Value: r.Value, Count: r.Count, UserAgent: topValue(r, "user_agent"), Elements: map[string]SimilarElement{}}
+		h2 := r.Value
+		if r.Type != "h2" {
+			h2 = topValue(r, "h2")
+			m.H2 = h2
+		}
+
+		if t.Type == "ja4" {
+			compareSections(t, r.Value, m.Elements)
+		} else {
+			compareElements(t, r.Type, r.Value, h2, m.Elements)
+		}
+		if len(m.Elements) == 0 {
+			continue
+		}
+		for _, e := range m.Elements {
+			m.Score += e.Similarity
+		}
+		m.Score = math.Round(m.Score/float64(len(m.Elements))*1000) / 1000
+		if m.Score > 0 {
+			matches = append(matches, m)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Value < b.Value
+	})
+	return matches
+}
+
+// compareSections compares the searched sections with a stored JA4
+func compareSections(t similarTarget, ja4 string, res map[string]SimilarElement) {
+	a, b, c, ok := tls.JA4Sections(ja4)
+	if !ok {
+		return
+	}
+	stored := map[string]string{"ja4_a": a, "ja4_b": b, "ja4_c": c}
+	for name, v := range t.Sections {
+		if stored[name] == v {
+			res[name] = SimilarElement{Similarity: 1}
+		} else {
+			res[name] = SimilarElement{Missing: []string{v}, Extra: []string{stored[name]}}
+		}
+	}
+}
+
+// compareElements compares the lists of the target with the stored
+// fingerprint and the h2 fingerprint most seen with it
+func compareElements(t similarTarget, typ, value, h2 string, res map[string]SimilarElement) {
+	var stored map[string][]string
+	switch typ {
+	case "peetprint":
+		stored, _ = tls.PeetPrintElements(value)
+	case "ja3":
+		stored, _ = tls.JA3Elements(value)
+	}
+	if h2Elements, ok := trackmehttp.AkamaiElements(h2); ok {
+		if stored == nil {
+			stored = map[string][]string{}
+		}
+		stored["settings"] = h2Elements["settings"]
+	}
+
+	for _, name := range similarElements {
+		want, ok := t.elements[name]
+		if !ok {
+			continue
+		}
+		got, ok := stored[name]
+		if !ok {
+			continue
+		}
+		res[name] = jaccard(want, got)
+	}
+}
+
+// jaccard compares two lists as sets, two empty lists are the same
+func jaccard(want, got []string) SimilarElement {
+	inWant, inGot := map[string]bool{}, map[string]bool{}
+	for _, v := range want {
+		inWant[v] = true
+	}
+	for _, v := range got {
+		inGot[v] = true
+	}
+
+	e := SimilarElement{}
+	shared := 0
+	for v := range inWant {
+		if inGot[v] {
+			shared++
+		} else {
+			e.Missing = append(e.Missing, v)
+		}
+	}
+	for v := range inGot {
+		if !inWant[v] {
+			e.Extra = append(e.Extra, v)
+		}
+	}
+	sort.Strings(e.Missing)
+	sort.Strings(e.Extra)
+
+	union := len(inWant) + len(inGot) - shared
+	if union == 0 {
+		e.Similarity = 1
+	} else {
+		e.Similarity = math.Round(float64(shared)/float64(union)*1000) / 1000
+	}
+	return e
+}
+
+// topValue returns the value of a type most seen with the rollup
+func topValue(r store.Rollup, typ string) string {
+	if top := r.Top(typ); len(top) > 0 {
+		return top[0].Value
+	}
+	return ""
+}
+
+const (
+	defaultSimilarLimit = 10
+	// maxSimilarCandidates caps the stored fingerprints a search compares
+	// with, so a request does not load every rollup
+	maxSimilarCandidates = 5000
+)
+
+func apiSimilar(srv *Server) RouteHandler {
+	return func(_ types.Response, u url.Values) RouteResponse {
+		if !srv.IsConnectedToDB() {
+			return respond([]byte("{\"error\": \"Not connected to database.\"}"), "application/json")
+		}
+		t, rr, ok := parseSimilarTarget(u, srv)
+		if !ok {
+			return rr
+		}
+		limit := defaultSimilarLimit
+		if v := utils.GetParam("limit", u); v != "" {
+			var err error
+			if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxSearchLimit {
+				return jsonError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit))
+			}
+		}
+
+		// The newest stored fingerprints of the type are the candidates
+		rollups, err := srv.GetStore().NewRollups(0, t.Type, maxSimilarCandidates)
+		if err != nil {
+			log.Println("Error loading rollups:", err)
+			return jsonError(http.StatusInternalServerError, "Could not load the fingerprints")
+		}
+		matches := similar(t, rollups)
+		if len(matches) > limit {
+			matches = matches[:limit]
+		}
+		j, _ := json.MarshalIndent(map[string]interface{}{
+			"target":  t,
+			"results": matches,
+		}, "", "  ")
+		return respond(j, "application/json")
+	}
+}
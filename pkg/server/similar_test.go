@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/pagpeter/trackme/pkg/store"
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestSimilar(t *testing.T) {
+	const (
+		chrome  = "772-771|2-1.1|GREASE-29-23-24|1027-2052|1|2|GREASE-4865-4866-4867|0-10-13-16-43-45-51-GREASE"
+		firefox = "772-771|2-1.1|29-23-24-25-256|1027-1283-2052|1||4865-4867-4866-49195|0-10-13-16-28-43-45-51"
+	)
+	st := store.NewMemory()
+	st.Save(
+		store.RequestLog{PeetPrint: chrome, H2: "1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p", JA4: "t13d1516h2_8daaf6152771_e5627efa2ab1", UserAgent: "chrome", Time: 1},
+		store.RequestLog{PeetPrint: firefox, H2: "1:65536;4:131072;5:16384|12517377|0|m,p,a,s", JA4: "t13d1715h2_5b57614c22b0_3d5424432f57", UserAgent: "firefox", Time: 2},
+	)
+	srv := NewServer()
+	srv.SetStore(st)
+
+	// A client that sends Chrome's hello without ALPN extension 16
+	var res struct {
+		Results []SimilarMatch `json:"results"`
+	}
+	u := url.Values{"peetprint": {"772-771|2-1.1|29-23-24|1027-2052|1|2|4865-4866-4867|0-10-13-43-45-51"}, "h2": {"1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p"}}
+	json.Unmarshal(apiSimilar(srv)(types.Response{}, u).Body, &res)
+	if len(res.Results) != 2 || res.Results[0].Value != chrome || res.Results[0].UserAgent != "chrome" {
+		t.Fatalf("Expected Chrome to be closest, got %+v", res.Results)
+	}
+	ext := res.Results[0].Elements["extensions"]
+	if ext.Similarity != 0.857 || len(ext.Extra) != 1 || ext.Extra[0] != "16" || res.Results[0].Elements["settings"].Similarity != 1 {
+		t.Fatalf("Unexpected elements %+v", res.Results[0].Elements)
+	}
+
+	res.Results = nil
+	json.Unmarshal(apiSimilar(srv)(types.Response{}, url.Values{"ja4_a": {"t13d1516h2"}, "ja4_c": {"3d5424432f57"}}).Body, &res)
+	if len(res.Results) != 2 || res.Results[0].Score != 0.5 || res.Results[0].Elements["ja4_a"].Similarity != 1 {
+		t.Fatalf("Unexpected JA4 section matches %+v", res.Results)
+	}
+	if rr := apiSimilar(srv)(types.Response{}, url.Values{"ja3": {"771,4865"}}); rr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid JA3, got %d", rr.StatusCode)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpInfoRTT reads the smoothed and minimum RTT the kernel measured for the
+// TCP connection
+func tcpInfoRTT(conn net.Conn) (time.Duration, time.Duration, bool) {
+	tcpConn, ok := underlyingTCPConn(conn)
+	if !ok {
+		return 0, 0, false
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var info *unix.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil || sockErr != nil {
+		return 0, 0, false
+	}
+	return time.Duration(info.Rtt) * time.Microsecond, time.Duration(info.Min_rtt) * time.Microsecond, true
+}
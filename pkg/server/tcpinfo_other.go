@@ -0,0 +1,13 @@
+//go:build !linux
+
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// tcpInfoRTT is only implemented on Linux, other platforms rely on the sniffer
+func tcpInfoRTT(_ net.Conn) (time.Duration, time.Duration, bool) {
+	return 0, 0, false
+}
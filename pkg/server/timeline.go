@@ -0,0 +1,108 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+const timelinePath = "/api/timeline"
+
+// Timeline milestones
+const (
+	eventAccept       = "accept"
+	eventHandshake    = "tls_handshake_done"
+	eventPreface      = "preface"
+	eventRequest      = "request"
+	eventSettingsSent = "settings_sent"
+	eventUpgrade      = "h2c_upgrade"
+	eventFrame        = "frame"
+	eventTruncated    = "timeline_truncated"
+)
+
+// maxTimelineEvents caps the timeline of a connection. Long-lived
+// connections, large uploads and WebSocket tunnels would grow it without
+// bound, so only the first events are kept and the rest counted.
+const maxTimelineEvents = 1000
+
+// connTimeline records when frames and milestones happened on a connection.
+// Offsets use the monotonic clock, so they are not affected by clock changes.
+type connTimeline struct {
+	start time.Time
+
+	mu     sync.Mutex
+	events []types.TimelineEvent
+	// dropped counts the events after maxTimelineEvents, droppedAt is the
+	// offset of the first of them
+	dropped   int
+	droppedAt float64
+}
+
+// newConnTimeline starts a timeline at the moment the connection was accepted
+func newConnTimeline() *connTimeline {
+	t := &connTimeline{start: time.Now()}
+	t.mark(eventAccept)
+	return t
+}
+
+// offset returns the milliseconds since the connection was accepted
+func (t *connTimeline) offset() float64 {
+	return durationMs(time.Since(t.start))
+}
+
+func (t *connTimeline) mark(event string) {
+	t.add(types.TimelineEvent{
+		OffsetMs: t.offset(),
+		Event:    event,
+	})
+}
+
+// frame records a received frame, the frame has to be stamped already
+func (t *connTimeline) frame(p types.ParsedFrame) {
+	t.add(types.TimelineEvent{
+		OffsetMs: p.OffsetMs,
+		Event:    eventFrame,
+		Frame:    p.Type,
+		Stream:   p.Stream,
+		Length:   p.Length,
+		Flags:    p.Flags,
+	})
+}
+
+func (t *connTimeline) add(e types.TimelineEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.events) >= maxTimelineEvents {
+		if t.dropped == 0 {
+			t.droppedAt = e.OffsetMs
+		}
+		t.dropped++
+		return
+	}
+	t.events = append(t.events, e)
+}
+
+// Events returns a copy of the timeline in the order things happened. If
+// it was truncated, the last event says how many events were dropped.
+func (t *connTimeline) Events() []types.TimelineEvent {
+	t.mu.Lock()
+	events := append([]types.TimelineEvent{}, t.events...)
+	if t.dropped > 0 {
+		events = append(events, types.TimelineEvent{OffsetMs: t.droppedAt, Event: eventTruncated, Dropped: t.dropped})
+	}
+	t.mu.Unlock()
+
+	// Frames synthesized from an h2c upgrade are recorded late
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].OffsetMs < events[j].OffsetMs
+	})
+	return events
+}
+
+// wantsTimeline reports whether the timeline should be added to the response
+func wantsTimeline(path string) bool {
+	return strings.HasPrefix(path, timelinePath)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+	utls "github.com/wwhtrbbtt/utls"
+	"golang.org/x/net/http2"
+)
+
+func TestTimelineOrder(t *testing.T) {
+	tl := newConnTimeline()
+	tl.frame(types.ParsedFrame{Type: "SETTINGS", OffsetMs: tl.offset()})
+	late := tl.offset()
+	time.Sleep(time.Millisecond)
+	tl.mark(eventRequest)
+	// Frames of an h2c upgrade are stamped before they are recorded
+	tl.frame(types.ParsedFrame{Type: "HEADERS", Stream: 1, OffsetMs: late})
+
+	events := tl.Events()
+	want := []string{eventAccept, "SETTINGS", "HEADERS", eventRequest}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %+v", len(want), events)
+	}
+	for i, e := range events {
+		name := e.Event
+		if e.Event == eventFrame {
+			name = e.Frame
+		}
+		if name != want[i] {
+			t.Fatalf("Expected %s at %d, got %+v", want[i], i, events)
+		}
+	}
+}
+
+func TestTimelineTruncated(t *testing.T) {
+	tl := newConnTimeline()
+	for i := 0; i < maxTimelineEvents+4; i++ {
+		tl.frame(types.ParsedFrame{Type: "DATA", Stream: 1, OffsetMs: tl.offset()})
+	}
+
+	events := tl.Events()
+	if len(events) != maxTimelineEvents+1 {
+		t.Fatalf("Expected %d events, got %d", maxTimelineEvents+1, len(events))
+	}
+	last := events[len(events)-1]
+	// The accept milestone counts towards the cap
+	if last.Event != eventTruncated || last.Dropped != 5 {
+		t.Fatalf("Expected the last event to count 5 dropped events, got %+v", last)
+	}
+	if last.OffsetMs < events[len(events)-2].OffsetMs {
+		t.Fatalf("Expected the truncation after the kept events, got %+v", last)
+	}
+}
+
+func TestTimelineMilestones(t *testing.T) {
+	srv, _, _ := setupTest()
+	der, key := testCertificate(t)
+	clientConn, serverConn := tcpPair(t)
+	defer clientConn.Close()
+
+	go srv.HandleTLSConnection(utls.Server(serverConn, &utls.Config{
+		NextProtos:   []string{"h2"},
+		Certificates: []utls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}))
+
+	tlsConn := tls.Client(clientConn, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	cc, err := (&http2.Transport{}).NewClientConn(tlsConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	req, _ := http.NewRequest("GET", "https://localhost/api/timeline", nil)
+	res, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var body struct {
+		Timeline []types.TimelineEvent `json:"timeline"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	// The milestones come in the order they happen on every connection,
+	// the client frames follow the preface
+	want := []string{eventAccept, eventHandshake, eventPreface, eventSettingsSent}
+	seen := 0
+	var headers bool
+	for i, e := range body.Timeline {
+		if i > 0 && e.OffsetMs < body.Timeline[i-1].OffsetMs {
+			t.Fatalf("Expected monotonic offsets, got %+v", body.Timeline)
+		}
+		if seen < len(want) && e.Event == want[seen] {
+			seen++
+		}
+		if e.Event == eventFrame && e.Frame == "HEADERS" {
+			headers = seen == len(want)
+		}
+	}
+	if seen != len(want) || !headers {
+		t.Fatalf("Expected %v followed by the HEADERS frame, got %+v", want, body.Timeline)
+	}
+}
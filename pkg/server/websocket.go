@@ -1,52 +1,469 @@
 package server
 
 import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/gorilla/websocket"
+	trackmehttp "github.com/pagpeter/trackme/pkg/http"
+	"github.com/pagpeter/trackme/pkg/types"
+	"golang.org/x/net/http2/hpack"
 )
 
-// WebSocket upgrader with permissive settings for testing
-var wsUpgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	// Allow all origins for testing compatibility
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
-// HandleWebSocket handles WebSocket connections with echo functionality
-// This endpoint echoes back any message received
-func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Upgrade HTTP connection to WebSocket
-	conn, err := wsUpgrader.Upgrade(w, r, nil)
+const (
+	wsPath = "/ws"
+	// wsGUID is appended to Sec-WebSocket-Key for Sec-WebSocket-Accept
+	// (RFC 6455, section 1.3)
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// wsSessionLimit ends sessions cleanly before the connection timeout
+	wsSessionLimit = 12 * time.Second
+	// wsMaxOpcodes caps how many opcodes are recorded
+	wsMaxOpcodes = 32
+	// wsFingerprintCommand is answered with the fingerprint, including the
+	// frames received so far, instead of being echoed
+	wsFingerprintCommand = "fingerprint"
+)
+
+// Opcodes (RFC 6455, section 5.2)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// Close codes (RFC 6455, section 7.4.1)
+const (
+	wsCloseNormal      = 1000
+	wsCloseGoingAway   = 1001
+	wsCloseProtocol    = 1002
+	wsCloseTooBig      = 1009
+	wsCloseNoStatusRcv = 1005
+)
+
+var (
+	errWSProtocol = errors.New("websocket protocol error")
+	errWSTooBig   = errors.New("websocket message too big")
+)
+
+var wsOpcodeNames = map[byte]string{
+	wsOpContinuation: "continuation",
+	wsOpText:         "text",
+	wsOpBinary:       "binary",
+	wsOpClose:        "close",
+	wsOpPing:         "ping",
+	wsOpPong:         "pong",
+}
+
+type wsFrame struct {
+	fin     bool
+	rsv     byte
+	opcode  byte
+	masked  bool
+	maskKey [4]byte
+	payload []byte
+}
+
+func (f wsFrame) isControl() bool {
+	return f.opcode >= wsOpClose
+}
+
+// readWSFrame reads and unmasks one frame. Unmasked client frames are
+// accepted so they can be fingerprinted.
+func readWSFrame(r io.Reader, limit int64) (wsFrame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return wsFrame{}, err
+	}
+	f := wsFrame{
+		fin:    head[0]&0x80 != 0,
+		rsv:    head[0] & 0x70 >> 4,
+		opcode: head[0] & 0x0f,
+		masked: head[1]&0x80 != 0,
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if f.isControl() && (length > 125 || !f.fin) {
+		return f, errWSProtocol
+	}
+	if length > uint64(limit) {
+		return f, errWSTooBig
+	}
+
+	if f.masked {
+		if _, err := io.ReadFull(r, f.maskKey[:]); err != nil {
+			return f, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+	if f.masked {
+		for i := range f.payload {
+			f.payload[i] ^= f.maskKey[i%4]
+		}
+	}
+	return f, nil
+}
+
+// writeWSFrame writes an unmasked, final frame in a single write
+func writeWSFrame(w io.Writer, opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+func writeWSClose(w io.Writer, code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return writeWSFrame(w, wsOpClose, append(payload, reason...))
+}
+
+// wsTransport carries the frames of one WebSocket, either a hijacked
+// HTTP/1.1 connection or an HTTP/2 stream
+type wsTransport struct {
+	r io.Reader
+	w io.Writer
+	// interrupt unblocks a pending read once the session limit is reached
+	interrupt func()
+	// close ends the connection or stream
+	close func()
+}
+
+// flushingWriter flushes after every write, so every frame is sent at once
+type flushingWriter struct {
+	BodyWriter
+}
+
+func (w flushingWriter) Write(p []byte) (int, error) {
+	n, err := w.BodyWriter.Write(p)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		return n, err
+	}
+	return n, w.Flush()
+}
+
+// wsSession echoes messages and records how the client frames them
+type wsSession struct {
+	t        wsTransport
+	res      types.Response
+	frames   types.WebSocketFrames
+	maskKeys map[[4]byte]bool
+	ping     []byte
+	pingSent time.Time
+}
+
+// serveWebSocket runs an upgraded connection. The first message is the
+// fingerprint of the client, followed by a PING to see how it answers.
+func (srv *Server) serveWebSocket(t wsTransport, res types.Response) {
+	defer t.close()
+
+	res = completeResponse(res, srv)
+	s := &wsSession{
+		t:        t,
+		res:      res,
+		frames:   types.WebSocketFrames{Opcodes: []string{}},
+		maskKeys: map[[4]byte]bool{},
+		ping:     []byte(fmt.Sprintf("trackme-%d", time.Now().UnixNano())),
+	}
+
+	if err := writeWSFrame(t.w, wsOpText, []byte(s.fingerprint())); err != nil {
 		return
 	}
-	defer conn.Close()
+	s.pingSent = time.Now()
+	if err := writeWSFrame(t.w, wsOpPing, s.ping); err != nil {
+		return
+	}
+
+	var expired atomic.Bool
+	timer := time.AfterFunc(wsSessionLimit, func() {
+		expired.Store(true)
+		t.interrupt()
+	})
+	defer timer.Stop()
+
+	err := s.run(srv.MaxBodySize())
+	switch {
+	case err == nil:
+	case expired.Load():
+		writeWSClose(t.w, wsCloseGoingAway, "session limit reached")
+	case err == errWSProtocol:
+		writeWSClose(t.w, wsCloseProtocol, "protocol error")
+	case err == errWSTooBig:
+		writeWSClose(t.w, wsCloseTooBig, "message too big")
+	case err != io.EOF && !isConnectionClosed(err):
+		log.Println("WebSocket error:", err)
+	}
+}
+
+// fingerprint returns the fingerprint JSON with the frames seen so far
+func (s *wsSession) fingerprint() string {
+	frames := s.frames
+	frames.Opcodes = append([]string{}, s.frames.Opcodes...)
+	details := *s.res.WebSocket
+	details.Frames = &frames
+	res := s.res
+	res.WebSocket = &details
+	return res.ToJson()
+}
 
-	log.Printf("WebSocket connection established from %s", r.RemoteAddr)
+// run reads frames until the client closes the connection
+func (s *wsSession) run(limit int64) error {
+	var message []byte
+	var messageOp byte
+	inMessage := false
 
-	// Echo loop: read messages and send them back
 	for {
-		messageType, message, err := conn.ReadMessage()
+		f, err := readWSFrame(s.t.r, limit)
 		if err != nil {
-			// Check if it's a normal close
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				log.Printf("WebSocket closed normally from %s", r.RemoteAddr)
-			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				log.Printf("WebSocket error from %s: %v", r.RemoteAddr, err)
+			return err
+		}
+		s.record(f)
+
+		switch f.opcode {
+		case wsOpPing:
+			s.frames.ClientPings++
+			if err := writeWSFrame(s.t.w, wsOpPong, f.payload); err != nil {
+				return err
+			}
+			continue
+		case wsOpPong:
+			if !s.frames.PongReceived && string(f.payload) == string(s.ping) {
+				s.frames.PongReceived = true
+				s.frames.PongPayloadMatch = true
+				s.frames.PongLatencyMs = float64(time.Since(s.pingSent).Microseconds()) / 1000
+			} else {
+				s.frames.UnsolicitedPongs++
+			}
+			continue
+		case wsOpClose:
+			code := wsCloseNormal
+			if len(f.payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(f.payload))
+			}
+			if code == wsCloseNoStatusRcv {
+				code = wsCloseNormal
+			}
+			writeWSClose(s.t.w, code, "")
+			return nil
+		case wsOpText, wsOpBinary:
+			if inMessage {
+				return errWSProtocol
 			}
-			break
+			inMessage, messageOp, message = true, f.opcode, f.payload
+			if !f.fin {
+				s.frames.Fragmented++
+			}
+		case wsOpContinuation:
+			if !inMessage {
+				return errWSProtocol
+			}
+			if int64(len(message)+len(f.payload)) > limit {
+				return errWSTooBig
+			}
+			message = append(message, f.payload...)
+		default:
+			return errWSProtocol
+		}
+
+		if !f.fin {
+			continue
+		}
+		inMessage = false
+		reply := message
+		if messageOp == wsOpText && string(message) == wsFingerprintCommand {
+			reply = []byte(s.fingerprint())
+		}
+		if err := writeWSFrame(s.t.w, messageOp, reply); err != nil {
+			return err
 		}
+	}
+}
+
+// record adds a frame to the fingerprint
+func (s *wsSession) record(f wsFrame) {
+	s.frames.Received++
+	if len(s.frames.Opcodes) < wsMaxOpcodes {
+		name, ok := wsOpcodeNames[f.opcode]
+		if !ok {
+			name = fmt.Sprintf("0x%x", f.opcode)
+		}
+		s.frames.Opcodes = append(s.frames.Opcodes, name)
+	}
+	if f.rsv != 0 {
+		s.frames.RSVFrames++
+	}
+	if !f.masked {
+		s.frames.Unmasked++
+		return
+	}
+	if f.maskKey == [4]byte{} {
+		s.frames.ZeroMaskKeys++
+	}
+	if s.maskKeys[f.maskKey] {
+		s.frames.RepeatedMaskKeys++
+	}
+	s.maskKeys[f.maskKey] = true
+}
+
+// checkWebSocketHandshake returns the error response for a handshake the
+// server cannot accept
+func checkWebSocketHandshake(d types.WebSocketDetails) (RouteResponse, bool) {
+	if d.Version != "13" {
+		r := respond([]byte(`{"error": "Unsupported WebSocket version"}`), "application/json")
+		r.StatusCode = http.StatusUpgradeRequired
+		return r.withHeader("Sec-WebSocket-Version", "13"), false
+	}
+	if d.Transport == "http/1.1" && !d.KeyValid {
+		r := respond([]byte(`{"error": "Invalid Sec-WebSocket-Key"}`), "application/json")
+		r.StatusCode = http.StatusBadRequest
+		return r, false
+	}
+	return RouteResponse{}, true
+}
+
+func isWebSocketPath(path string) bool {
+	path = strings.SplitN(path, "?", 2)[0]
+	return path == wsPath || path == wsPath+"/"
+}
+
+// isWebSocketUpgrade reports whether an HTTP/1 request asks to upgrade
+// the connection to a WebSocket on /ws
+func isWebSocketUpgrade(res types.Response) bool {
+	if res.Method != "GET" || res.Http1 == nil || !isWebSocketPath(res.Path) {
+		return false
+	}
+	headers := extractHeaders(res)
+	return headerHasToken(headerValue(headers, "Upgrade"), "websocket") &&
+		headerHasToken(headerValue(headers, "Connection"), "upgrade")
+}
+
+// upgradeHTTP1WebSocket answers the upgrade and serves the WebSocket until
+// it is closed, the connection is not reused afterwards
+func (srv *Server) upgradeHTTP1WebSocket(conn net.Conn, br *bufio.Reader, res types.Response) {
+	meta := newResponseMeta(res.Method)
+	details := trackmehttp.AnalyzeWebSocketHandshake("http/1.1", res.Http1.Headers)
+	if rr, ok := checkWebSocketHandshake(details); !ok {
+		logWriteError("HTTP/1", writeRouteResponse(newHTTP1Writer(conn, false, false), rr, meta))
+		return
+	}
+
+	sum := sha1.Sum([]byte(headerValue(extractHeaders(res), "Sec-WebSocket-Key") + wsGUID))
+	header := http.Header{}
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(sum[:]))
+	header.Set("Server", "TrackMe")
+	header.Set("X-Request-Id", meta.requestID)
+
+	bw := bufio.NewWriter(conn)
+	bw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	header.Write(bw)
+	bw.WriteString("\r\n")
+	if err := bw.Flush(); err != nil {
+		logWriteError("HTTP/1", err)
+		return
+	}
 
-		// Echo the message back
-		if err := conn.WriteMessage(messageType, message); err != nil {
-			log.Printf("WebSocket write error: %v", err)
-			break
+	res.WebSocket = &details
+	conn.SetReadDeadline(time.Time{})
+	srv.serveWebSocket(wsTransport{
+		r:         br,
+		w:         conn,
+		interrupt: func() { conn.SetReadDeadline(time.Now()) },
+		close:     func() {},
+	}, res)
+}
+
+// isExtendedConnect reports whether HTTP/2 request headers open a WebSocket
+// with an extended CONNECT (RFC 8441)
+func isExtendedConnect(headers []hpack.HeaderField) bool {
+	var method, protocol string
+	for _, h := range headers {
+		switch h.Name {
+		case ":method":
+			method = h.Value
+		case ":protocol":
+			protocol = h.Value
 		}
 	}
+	return method == "CONNECT" && strings.EqualFold(protocol, "websocket")
+}
+
+// upgradeWebSocket answers an extended CONNECT and serves the WebSocket on
+// the stream. Extended CONNECTs to other paths are routed as usual.
+func (c *HTTP2Connection) upgradeWebSocket(streamID uint32, stream *HTTP2Stream, resp types.Response, headers []string) {
+	if !isWebSocketPath(resp.Path) {
+		c.sendResponse(streamID, resp, resp.Path, resp.Method)
+		return
+	}
+
+	meta := newResponseMeta(resp.Method)
+	w := &h2Writer{c: c, streamID: streamID}
+	details := trackmehttp.AnalyzeWebSocketHandshake("h2", headers)
+	if rr, ok := checkWebSocketHandshake(details); !ok {
+		logWriteError("HTTP/2", writeRouteResponse(w, rr, meta))
+		c.CloseStream(streamID)
+		return
+	}
+
+	header := http.Header{}
+	header.Set("Server", "TrackMe")
+	header.Set("X-Request-Id", meta.requestID)
+	if err := w.writeHeader(http.StatusOK, header, false); err != nil {
+		logWriteError("HTTP/2", err)
+		c.CloseStream(streamID)
+		return
+	}
+
+	resp.WebSocket = &details
+	c.srv.serveWebSocket(wsTransport{
+		r: stream,
+		w: flushingWriter{w},
+		interrupt: func() {
+			stream.mu.Lock()
+			stream.finishBody(errBodyTimeout)
+			stream.mu.Unlock()
+		},
+		close: func() {
+			logWriteError("HTTP/2", w.finish(nil))
+			c.CloseStream(streamID)
+		},
+	}, resp)
 }
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ExportFormats are the formats Export writes, the first one is the default
+var ExportFormats = []string{"ndjson", "csv"}
+
+// exportBatch is the number of logs read at once, and written between
+// flushes
+const exportBatch = 1000
+
+// ExportQuery selects the logs to export. UserAgent matches the logs whose
+// user agent contains it, ignoring case.
+type ExportQuery struct {
+	Query
+	UserAgent string
+}
+
+func (q ExportQuery) matches(r RequestLog) bool {
+	return q.Query.matches(r) && containsFold(r.UserAgent, q.UserAgent)
+}
+
+func containsFold(s, substr string) bool {
+	return substr == "" || strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// csvHeader are the columns of a CSV export, in the order of RequestLog
+var csvHeader = []string{"time", "user_agent", "ja3", "ja4", "ja4h", "h2", "peetprint", "ip", "browser", "browser_major", "os", "device"}
+
+// Export writes the logs matching the query to w, one at a time, and
+// returns how many it wrote. If w has a Flush method it is flushed every
+// exportBatch logs, so the client gets the export as it is read.
+func Export(s Reader, w io.Writer, format string, q ExportQuery) (int64, error) {
+	var n int64
+	flush := func() error { return nil }
+	if f, ok := w.(interface{ Flush() error }); ok {
+		flush = f.Flush
+	}
+
+	var write func(r RequestLog) error
+	switch format {
+	case "", "ndjson":
+		enc := json.NewEncoder(w)
+		write = func(r RequestLog) error { return enc.Encode(r) }
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvHeader); err != nil {
+			return 0, err
+		}
+		write = func(r RequestLog) error {
+			return cw.Write([]string{strconv.FormatInt(r.Time, 10), r.UserAgent, r.JA3, r.JA4, r.JA4H, r.H2, r.PeetPrint, r.IP,
+				r.Browser, r.BrowserMajor, r.OS, r.Device})
+		}
+		flush = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			if f, ok := w.(interface{ Flush() error }); ok {
+				return f.Flush()
+			}
+			return nil
+		}
+	default:
+		return 0, fmt.Errorf("unknown export format %q, use %s", format, strings.Join(ExportFormats, " or "))
+	}
+
+	err := s.Each(q, func(r RequestLog) error {
+		if err := write(r); err != nil {
+			return err
+		}
+		n++
+		if n%exportBatch == 0 {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, flush()
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+)
+
+// flushRecorder counts the flushes of an export
+type flushRecorder struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (f *flushRecorder) Flush() error {
+	f.flushes++
+	return nil
+}
+
+func TestExportNDJSON(t *testing.T) {
+	s := NewMemory()
+	logs := testLogs(exportBatch + 1)
+	s.Save(logs...)
+
+	var w flushRecorder
+	n, err := Export(s, &w, "ndjson", ExportQuery{})
+	if err != nil || n != int64(len(logs)) {
+		t.Fatalf("Expected %d logs, got %d (%v)", len(logs), n, err)
+	}
+	// Once after the first batch and once at the end
+	if w.flushes != 2 {
+		t.Fatalf("Expected 2 flushes, got %d", w.flushes)
+	}
+
+	scanner := bufio.NewScanner(&w.Buffer)
+	i := 0
+	for ; scanner.Scan(); i++ {
+		var r RequestLog
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Line %d: %v", i+1, err)
+		}
+		if r != logs[i] {
+			t.Fatalf("Line %d: expected %+v, got %+v", i+1, logs[i], r)
+		}
+	}
+	if i != len(logs) {
+		t.Fatalf("Expected %d lines, got %d", len(logs), i)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	s := NewMemory()
+	s.Save(
+		RequestLog{JA3: "771,4865", UserAgent: `Mozilla/5.0 "quoted", with comma`, IP: "1.1.1.1", Time: 1, Browser: "Chrome", BrowserMajor: "124", OS: "Windows", Device: "Desktop"},
+		RequestLog{JA3: "771,4866", UserAgent: "curl/8.5.0", Time: 2},
+	)
+
+	var buf bytes.Buffer
+	n, err := Export(s, &buf, "csv", ExportQuery{UserAgent: "mozilla"})
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 log, got %d (%v)", n, err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Expected a header and a record, got %v (%v)", records, err)
+	}
+	if len(records[0]) != len(csvHeader) || records[0][0] != "time" || records[0][7] != "ip" {
+		t.Fatalf("Unexpected header %v", records[0])
+	}
+	want := []string{"1", `Mozilla/5.0 "quoted", with comma`, "771,4865", "", "", "", "", "1.1.1.1", "Chrome", "124", "Windows", "Desktop"}
+	for i := range want {
+		if records[1][i] != want[i] {
+			t.Fatalf("Unexpected record %q", records[1])
+		}
+	}
+
+	// An empty export still has the header
+	buf.Reset()
+	if n, err := Export(s, &buf, "csv", ExportQuery{Query: Query{Since: 10}}); err != nil || n != 0 || buf.String() != "time,user_agent,ja3,ja4,ja4h,h2,peetprint,ip,browser,browser_major,os,device\n" {
+		t.Fatalf("Unexpected empty export %q (%d, %v)", buf.String(), n, err)
+	}
+	if _, err := Export(s, &buf, "xml", ExportQuery{}); err == nil {
+		t.Fatal("Expected an unknown format to be rejected")
+	}
+}
@@ -0,0 +1,341 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSONL appends every log as a line of JSON. The file is read into memory
+// on open and searched there, exports read it from disk. Snapshots go to a
+// second file next to it, which drops the expired ones when it is opened.
+// The rollups are written to a third file when logs or rollups are deleted
+// and on close, so they outlive the logs. Deleting logs rewrites the files.
+type JSONL struct {
+	*Memory
+
+	mu           sync.Mutex
+	path         string
+	snapshotPath string
+	rollupPath   string
+	file         *os.File
+	snapshots    *os.File
+	// lines is the number of lines in the log file
+	lines int64
+}
+
+// rollupState is the content of the rollup file. Logs is the number of
+// lines of the log file the rollups count, the lines after it are added to
+// them on open.
+type rollupState struct {
+	Logs    int64    `json:"logs"`
+	Rollups []Rollup `json:"rollups"`
+}
+
+func NewJSONL(path string) (*JSONL, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	base := strings.TrimSuffix(path, ".jsonl")
+	s := &JSONL{
+		Memory:       NewMemory(),
+		path:         path,
+		snapshotPath: base + ".snapshots.jsonl",
+		rollupPath:   base + ".rollups.json",
+	}
+
+	state, err := readRollups(s.rollupPath)
+	if err != nil {
+		return nil, err
+	}
+	s.Memory.setRollups(state.Rollups)
+	s.file, err = openJSONL(path, func(line []byte) error {
+		s.lines++
+		var r RequestLog
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		return s.Memory.saveLogs([]RequestLog{r}, s.lines > state.Logs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := compactSnapshots(s.snapshotPath); err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	s.snapshots, err = openJSONL(s.snapshotPath, func(line []byte) error {
+		var snap Snapshot
+		if err := json.Unmarshal(line, &snap); err != nil {
+			return err
+		}
+		return s.Memory.SaveSnapshots(snap)
+	})
+	if err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openJSONL opens a file for appending and passes every line to load
+func openJSONL(path string, load func(line []byte) error) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	scanner := newLineScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if err := load(scanner.Bytes()); err != nil {
+			// A line cut short by a crash should not lose the others
+			log.Printf("Skipping line %d of %s: %v", line, path, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// newLineScanner reads the lines of a JSONL file, a line may be 16MB
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return scanner
+}
+
+// readRollups reads the rollup file, which does not exist before the first
+// delete or close
+func readRollups(path string) (rollupState, error) {
+	var state rollupState
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(data, &state)
+}
+
+// writeRollups replaces the rollup file with the rollups in memory, s.mu
+// must be held
+func (s *JSONL) writeRollups() error {
+	data, err := json.Marshal(rollupState{Logs: s.lines, Rollups: s.Memory.allRollups()})
+	if err != nil {
+		return err
+	}
+	tmp := s.rollupPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.rollupPath)
+}
+
+// compactSnapshots rewrites the snapshot file without the expired snapshots
+func compactSnapshots(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	var kept []byte
+	expired := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		var snap Snapshot
+		if line == "" || json.Unmarshal([]byte(line), &snap) != nil {
+			continue
+		}
+		if snap.Expired(now) {
+			expired++
+			continue
+		}
+		kept = append(append(kept, line...), '\n')
+	}
+	if expired == 0 {
+		return nil
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, kept, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *JSONL) Save(logs ...RequestLog) error {
+	buf, err := jsonLines(logs)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(buf); err != nil {
+		return err
+	}
+	s.lines += int64(len(logs))
+	return s.Memory.Save(logs...)
+}
+
+// Each reads the logs from the file instead of copying them from memory, so
+// an export does not hold more than a line. Only the lines written when it
+// starts are read.
+func (s *JSONL) Each(q ExportQuery, fn func(RequestLog) error) error {
+	if err := checkFields(q.Query, nil); err != nil {
+		return err
+	}
+
+	// Saves write whole lines under s.mu, so the size ends at a line
+	s.mu.Lock()
+	file, err := os.Open(s.path)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	info, err := file.Stat()
+	s.mu.Unlock()
+	defer file.Close()
+	if err != nil {
+		return err
+	}
+	return eachLog(io.LimitReader(file, info.Size()), q, fn)
+}
+
+// eachLog calls fn for the logs of a JSONL file matching the query. Lines
+// that are not a log, like one cut short by a crash or still being written,
+// are skipped.
+func eachLog(r io.Reader, q ExportQuery, fn func(RequestLog) error) error {
+	scanner := newLineScanner(r)
+	for scanner.Scan() {
+		var l RequestLog
+		if json.Unmarshal(scanner.Bytes(), &l) != nil || !q.matches(l) {
+			continue
+		}
+		if err := fn(l); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *JSONL) SaveSnapshots(snapshots ...Snapshot) error {
+	buf, err := jsonLines(snapshots)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.snapshots.Write(buf); err != nil {
+		return err
+	}
+	return s.Memory.SaveSnapshots(snapshots...)
+}
+
+func (s *JSONL) DeleteBefore(t int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, _ := s.Memory.DeleteBefore(t)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.rewrite()
+}
+
+func (s *JSONL) DeleteRollupsBefore(t int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, _ := s.Memory.DeleteRollupsBefore(t)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.writeRollups()
+}
+
+func (s *JSONL) DeleteIP(ip string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, _ := s.Memory.DeleteIP(ip)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.rewrite()
+}
+
+// rewrite replaces the files with the logs, snapshots and rollups kept in
+// memory, s.mu must be held
+func (s *JSONL) rewrite() error {
+	s.Memory.mu.RLock()
+	lines := int64(len(s.Memory.logs))
+	logs, err := jsonLines(s.Memory.logs)
+	snapshots := make([]Snapshot, 0, len(s.Memory.snapshots))
+	for _, snap := range s.Memory.snapshots {
+		snapshots = append(snapshots, snap)
+	}
+	s.Memory.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	snapshotLines, err := jsonLines(snapshots)
+	if err != nil {
+		return err
+	}
+
+	if s.file, err = replaceFile(s.file, s.path, logs); err != nil {
+		return err
+	}
+	s.lines = lines
+	if s.snapshots, err = replaceFile(s.snapshots, s.snapshotPath, snapshotLines); err != nil {
+		return err
+	}
+	return s.writeRollups()
+}
+
+// replaceFile atomically replaces the content of an open file and returns
+// the reopened file
+func replaceFile(file *os.File, path string, data []byte) (*os.File, error) {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return file, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return file, err
+	}
+	file.Close()
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+func jsonLines[T any](values []T) ([]byte, error) {
+	var buf []byte
+	for _, v := range values {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	return buf, nil
+}
+
+func (s *JSONL) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.writeRollups()
+	s.snapshots.Close()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
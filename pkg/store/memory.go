@@ -0,0 +1,312 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// Memory keeps the logs in memory, they are lost on restart. Every field is
+// indexed, so searches only visit the matching logs.
+type Memory struct {
+	mu   sync.RWMutex
+	logs []RequestLog
+	// index maps field and value to the positions of the logs
+	index map[string]map[string][]int
+	// rollups maps type and value to the rollup
+	rollups   map[string]map[string]*Rollup
+	snapshots map[string]Snapshot
+}
+
+func NewMemory() *Memory {
+	m := &Memory{
+		index:     map[string]map[string][]int{},
+		rollups:   map[string]map[string]*Rollup{},
+		snapshots: map[string]Snapshot{},
+	}
+	for _, f := range Fields {
+		m.index[f] = map[string][]int{}
+	}
+	for _, t := range RollupTypes {
+		m.rollups[t] = map[string]*Rollup{}
+	}
+	return m
+}
+
+func (m *Memory) Save(logs ...RequestLog) error {
+	return m.saveLogs(logs, true)
+}
+
+// saveLogs adds logs, the rollups are only updated if rollups is set
+func (m *Memory) saveLogs(logs []RequestLog, rollups bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range logs {
+		for _, f := range Fields {
+			v, _ := r.field(f)
+			m.index[f][v] = append(m.index[f][v], len(m.logs))
+		}
+		m.logs = append(m.logs, r)
+		if !rollups {
+			continue
+		}
+		for _, t := range RollupTypes {
+			if v, ok := rollupValue(r, t); ok {
+				if m.rollups[t][v] == nil {
+					m.rollups[t][v] = newRollup(t, v)
+				}
+				m.rollups[t][v].add(r)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Count() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.logs)), nil
+}
+
+func (m *Memory) Find(field, value string) ([]RequestLog, error) {
+	if _, ok := (RequestLog{}).field(field); !ok {
+		return nil, unknownField(field)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.match(Query{Field: field, Value: value}), nil
+}
+
+func (m *Memory) Aggregate(q Query, groups []string, p Page) (Aggregation, error) {
+	if err := checkFields(q, groups); err != nil {
+		return Aggregation{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return aggregate(m.match(q), groups, p), nil
+}
+
+// match returns the logs selected by the query, m.mu must be held
+func (m *Memory) match(q Query) []RequestLog {
+	res := []RequestLog{}
+	if q.Field == "" {
+		for _, r := range m.logs {
+			if q.matches(r) {
+				res = append(res, r)
+			}
+		}
+		return res
+	}
+	for _, i := range m.index[q.Field][q.Value] {
+		if q.matches(m.logs[i]) {
+			res = append(res, m.logs[i])
+		}
+	}
+	return res
+}
+
+// Each copies exportBatch logs at a time, so saving is not blocked while
+// fn runs
+func (m *Memory) Each(q ExportQuery, fn func(RequestLog) error) error {
+	if err := checkFields(q.Query, nil); err != nil {
+		return err
+	}
+
+	for pos := 0; pos >= 0; {
+		var batch []RequestLog
+		m.mu.RLock()
+		batch, pos = m.scan(q, pos)
+		m.mu.RUnlock()
+		for _, r := range batch {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scan returns up to exportBatch logs matching the query from position pos
+// of the logs, or of the index if the query has a field, and the position
+// to go on from, -1 at the end. m.mu must be held.
+func (m *Memory) scan(q ExportQuery, pos int) ([]RequestLog, int) {
+	var positions []int
+	n := len(m.logs)
+	if q.Field != "" {
+		positions = m.index[q.Field][q.Value]
+		n = len(positions)
+	}
+
+	res := []RequestLog{}
+	for ; pos < n; pos++ {
+		if len(res) == exportBatch {
+			return res, pos
+		}
+		i := pos
+		if positions != nil {
+			i = positions[pos]
+		}
+		if q.matches(m.logs[i]) {
+			res = append(res, m.logs[i])
+		}
+	}
+	return res, -1
+}
+
+func (m *Memory) Rollup(typ, value string) (Rollup, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.rollups[typ][value]
+	if !ok {
+		return Rollup{}, false, nil
+	}
+	return r.copy(), true, nil
+}
+
+// setRollups adds rollups that were saved before, replacing those of the
+// same type and value
+func (m *Memory) setRollups(rollups []Rollup) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range rollups {
+		if values, ok := m.rollups[r.Type]; ok {
+			r := r.copy()
+			values[r.Value] = &r
+		}
+	}
+}
+
+// allRollups returns a copy of every rollup
+func (m *Memory) allRollups() []Rollup {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	res := []Rollup{}
+	for _, values := range m.rollups {
+		for _, r := range values {
+			res = append(res, r.copy())
+		}
+	}
+	return res
+}
+
+func (m *Memory) NewRollups(since int64, typ string, limit int) ([]Rollup, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	res := []Rollup{}
+	for t, values := range m.rollups {
+		if typ != "" && t != typ {
+			continue
+		}
+		for _, r := range values {
+			if r.FirstSeen >= since {
+				res = append(res, *r)
+			}
+		}
+	}
+	sortNew(res)
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	// Only the returned rollups are copied
+	for i := range res {
+		res[i] = res[i].copy()
+	}
+	return res, nil
+}
+
+func (m *Memory) SaveSnapshots(snapshots ...Snapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range snapshots {
+		m.snapshots[s.ID] = s
+	}
+	return nil
+}
+
+func (m *Memory) Snapshot(id string) (Snapshot, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.snapshots[id]
+	if !ok || s.Expired(time.Now().Unix()) {
+		return Snapshot{}, false, nil
+	}
+	return s, true, nil
+}
+
+func (m *Memory) DeleteExpiredSnapshots(now int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for id, s := range m.snapshots {
+		if s.Expired(now) {
+			delete(m.snapshots, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) DeleteBefore(t int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.removeLogs(func(r RequestLog) bool { return r.Time < t }), nil
+}
+
+func (m *Memory) DeleteRollupsBefore(t int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, values := range m.rollups {
+		for v, r := range values {
+			if r.LastSeen < t {
+				delete(values, v)
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+func (m *Memory) DeleteIP(ip string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.removeLogs(func(r RequestLog) bool { return r.IP == ip })
+	for id, s := range m.snapshots {
+		if s.IP == ip {
+			delete(m.snapshots, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// removeLogs removes the logs drop returns true for and rebuilds the index,
+// m.mu must be held
+func (m *Memory) removeLogs(drop func(RequestLog) bool) int64 {
+	kept := m.logs[:0]
+	for _, r := range m.logs {
+		if !drop(r) {
+			kept = append(kept, r)
+		}
+	}
+	n := int64(len(m.logs) - len(kept))
+	if n == 0 {
+		return 0
+	}
+	m.logs = kept
+	for _, f := range Fields {
+		m.index[f] = map[string][]int{}
+	}
+	for i, r := range m.logs {
+		for _, f := range Fields {
+			v, _ := r.field(f)
+			m.index[f][v] = append(m.index[f][v], i)
+		}
+	}
+	return n
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
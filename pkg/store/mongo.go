@@ -0,0 +1,372 @@
+package store
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Mongo keeps the logs in a MongoDB collection
+type Mongo struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+	// rollups and snapshots are named after the collection, with a
+	// _rollups and _snapshots suffix
+	rollups   *mongo.Collection
+	snapshots *mongo.Collection
+	ctx       context.Context
+}
+
+// NewMongo connects to the server, checks it with a ping and creates the
+// indexes the searches use
+func NewMongo(url, database, collection string) (*Mongo, error) {
+	m, err := connectMongo(url, database, collection)
+	if err != nil {
+		return nil, err
+	}
+	ctx, client := m.ctx, m.client
+
+	indexes := []mongo.IndexModel{{Keys: bson.D{{Key: "time", Value: 1}}}}
+	for _, f := range Fields {
+		indexes = append(indexes, mongo.IndexModel{Keys: bson.D{{Key: f, Value: 1}, {Key: "time", Value: 1}}})
+	}
+	if _, err := m.collection.Indexes().CreateMany(ctx, indexes); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	_, err = m.rollups.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "value", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "first_seen", Value: -1}}},
+		{Keys: bson.D{{Key: "last_seen", Value: 1}}},
+	})
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	if _, err := m.snapshots.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "expires", Value: 1}}},
+		{Keys: bson.D{{Key: "ip", Value: 1}}},
+	}); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	return m, nil
+}
+
+// connectMongo connects to the server and checks it with a ping
+func connectMongo(url, database, collection string) (*Mongo, error) {
+	ctx := context.TODO()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	return &Mongo{
+		client:     client,
+		collection: client.Database(database).Collection(collection),
+		rollups:    client.Database(database).Collection(collection + "_rollups"),
+		snapshots:  client.Database(database).Collection(collection + "_snapshots"),
+		ctx:        ctx,
+	}, nil
+}
+
+func (m *Mongo) Save(logs ...RequestLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(logs))
+	for i, r := range logs {
+		docs[i] = r
+	}
+	if _, err := m.collection.InsertMany(m.ctx, docs); err != nil {
+		return err
+	}
+
+	// The logs are written by a single writer, so read, update and replace
+	// does not lose updates
+	keys, byKey := rollupBatch(logs)
+	for _, k := range keys {
+		r, _, err := m.rollup(k.typ, k.value)
+		if err != nil {
+			return err
+		}
+		for _, l := range byKey[k] {
+			r.add(l)
+		}
+		_, err = m.rollups.ReplaceOne(m.ctx, bson.M{"type": k.typ, "value": k.value}, r, options.Replace().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollup loads a rollup, a new one is returned if it does not exist yet
+func (m *Mongo) rollup(typ, value string) (*Rollup, bool, error) {
+	r := &Rollup{}
+	err := m.rollups.FindOne(m.ctx, bson.M{"type": typ, "value": value}).Decode(r)
+	if err == mongo.ErrNoDocuments {
+		return newRollup(typ, value), false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return r, true, nil
+}
+
+func (m *Mongo) Rollup(typ, value string) (Rollup, bool, error) {
+	r, ok, err := m.rollup(typ, value)
+	if err != nil || !ok {
+		return Rollup{}, false, err
+	}
+	return *r, true, nil
+}
+
+func (m *Mongo) NewRollups(since int64, typ string, limit int) ([]Rollup, error) {
+	filter := bson.M{"first_seen": bson.M{"$gte": since}}
+	if typ != "" {
+		filter["type"] = typ
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "first_seen", Value: -1}, {Key: "type", Value: 1}, {Key: "value", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	cur, err := m.rollups.Find(m.ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	res := []Rollup{}
+	err = cur.All(m.ctx, &res)
+	return res, err
+}
+
+func (m *Mongo) Count() (int64, error) {
+	return m.collection.CountDocuments(m.ctx, bson.M{})
+}
+
+func (m *Mongo) Find(field, value string) ([]RequestLog, error) {
+	if _, ok := (RequestLog{}).field(field); !ok {
+		return nil, unknownField(field)
+	}
+
+	cur, err := m.collection.Find(m.ctx, bson.D{{Key: field, Value: value}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(m.ctx)
+
+	res := []RequestLog{}
+	for cur.Next(m.ctx) {
+		var r RequestLog
+		if err := cur.Decode(&r); err != nil {
+			return res, err
+		}
+		res = append(res, r)
+	}
+	return res, cur.Err()
+}
+
+// Each reads the logs with a cursor, which fetches them in batches
+func (m *Mongo) Each(q ExportQuery, fn func(RequestLog) error) error {
+	if err := checkFields(q.Query, nil); err != nil {
+		return err
+	}
+
+	match := mongoMatch(q.Query)
+	if q.UserAgent != "" {
+		ua := bson.M{"user_agent": bson.M{"$regex": regexp.QuoteMeta(q.UserAgent), "$options": "i"}}
+		match = bson.M{"$and": bson.A{match, ua}}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetBatchSize(exportBatch)
+	cur, err := m.collection.Find(m.ctx, match, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(m.ctx)
+
+	for cur.Next(m.ctx) {
+		var r RequestLog
+		if err := cur.Decode(&r); err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// mongoMatch returns the filter selecting the logs of a query
+func mongoMatch(q Query) bson.M {
+	match := bson.M{}
+	if q.Field != "" {
+		match[q.Field] = q.Value
+	}
+	for f, v := range q.Where {
+		match[f] = v
+	}
+	timeRange := bson.M{}
+	if q.Since != 0 {
+		timeRange["$gte"] = q.Since
+	}
+	if q.Until != 0 {
+		timeRange["$lte"] = q.Until
+	}
+	if len(timeRange) > 0 {
+		match["time"] = timeRange
+	}
+	return match
+}
+
+func (m *Mongo) Aggregate(q Query, groups []string, p Page) (Aggregation, error) {
+	if err := checkFields(q, groups); err != nil {
+		return Aggregation{}, err
+	}
+
+	match := mongoMatch(q)
+	// One $facet computes the totals and every group in a single pass
+	facets := bson.M{
+		"stats": bson.A{bson.M{"$group": bson.M{
+			"_id":   nil,
+			"total": bson.M{"$sum": 1},
+			"first": bson.M{"$min": "$time"},
+			"last":  bson.M{"$max": "$time"},
+		}}},
+	}
+	for _, g := range groups {
+		// $facet can not be nested, so the distinct count is its own facet
+		values := bson.A{
+			bson.M{"$group": bson.M{"_id": "$" + g, "n": bson.M{"$sum": 1}}},
+			bson.M{"$sort": bson.D{{Key: "n", Value: -1}, {Key: "_id", Value: 1}}},
+			bson.M{"$skip": p.Offset},
+		}
+		if p.Limit > 0 {
+			values = append(values, bson.M{"$limit": p.Limit})
+		}
+		facets[g] = values
+		facets[g+"_distinct"] = bson.A{
+			bson.M{"$group": bson.M{"_id": "$" + g}},
+			bson.M{"$count": "n"},
+		}
+	}
+
+	cur, err := m.collection.Aggregate(m.ctx, bson.A{
+		bson.M{"$match": match},
+		bson.M{"$facet": facets},
+	})
+	if err != nil {
+		return Aggregation{}, err
+	}
+	defer cur.Close(m.ctx)
+
+	var out []bson.M
+	if err := cur.All(m.ctx, &out); err != nil || len(out) == 0 {
+		return Aggregation{}, err
+	}
+
+	a := Aggregation{Groups: map[string]Group{}}
+	if stats, _ := out[0]["stats"].(bson.A); len(stats) > 0 {
+		s, _ := stats[0].(bson.M)
+		a.Total, a.FirstSeen, a.LastSeen = toInt64(s["total"]), toInt64(s["first"]), toInt64(s["last"])
+	}
+	for _, g := range groups {
+		group := Group{Values: []ValueCount{}}
+		if distinct, _ := out[0][g+"_distinct"].(bson.A); len(distinct) > 0 {
+			d, _ := distinct[0].(bson.M)
+			group.Distinct = toInt64(d["n"])
+		}
+		values, _ := out[0][g].(bson.A)
+		for _, v := range values {
+			doc, _ := v.(bson.M)
+			value, _ := doc["_id"].(string)
+			group.Values = append(group.Values, ValueCount{Value: value, Count: toInt64(doc["n"])})
+		}
+		a.Groups[g] = group
+	}
+	return a, nil
+}
+
+// toInt64 converts the number types BSON decodes to
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+func (m *Mongo) SaveSnapshots(snapshots ...Snapshot) error {
+	for _, snap := range snapshots {
+		_, err := m.snapshots.ReplaceOne(m.ctx, bson.M{"_id": snap.ID}, snap, options.Replace().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Mongo) Snapshot(id string) (Snapshot, bool, error) {
+	var snap Snapshot
+	err := m.snapshots.FindOne(m.ctx, bson.M{"_id": id}).Decode(&snap)
+	if err == mongo.ErrNoDocuments {
+		return Snapshot{}, false, nil
+	}
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	if snap.Expired(time.Now().Unix()) {
+		return Snapshot{}, false, nil
+	}
+	return snap, true, nil
+}
+
+func (m *Mongo) DeleteExpiredSnapshots(now int64) (int64, error) {
+	res, err := m.snapshots.DeleteMany(m.ctx, bson.M{"expires": bson.M{"$ne": 0, "$lte": now}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (m *Mongo) DeleteBefore(t int64) (int64, error) {
+	res, err := m.collection.DeleteMany(m.ctx, bson.M{"time": bson.M{"$lt": t}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (m *Mongo) DeleteRollupsBefore(t int64) (int64, error) {
+	res, err := m.rollups.DeleteMany(m.ctx, bson.M{"last_seen": bson.M{"$lt": t}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (m *Mongo) DeleteIP(ip string) (int64, error) {
+	var n int64
+	for _, c := range []*mongo.Collection{m.collection, m.snapshots} {
+		res, err := c.DeleteMany(m.ctx, bson.M{"ip": ip})
+		if err != nil {
+			return n, err
+		}
+		n += res.DeletedCount
+	}
+	return n, nil
+}
+
+func (m *Mongo) Close() error {
+	return m.client.Disconnect(m.ctx)
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"sort"
+)
+
+// Query selects the logs where Field equals Value, within an optional time
+// range. Since and Until are unix seconds, both inclusive, 0 means open.
+// Where maps more fields to the values they must equal.
+type Query struct {
+	Field string
+	Value string
+	Where map[string]string
+	Since int64
+	Until int64
+}
+
+func (q Query) matchesTime(t int64) bool {
+	return (q.Since == 0 || t >= q.Since) && (q.Until == 0 || t <= q.Until)
+}
+
+// matches reports whether a log is selected by the query
+func (q Query) matches(r RequestLog) bool {
+	if q.Field != "" {
+		if v, _ := r.field(q.Field); v != q.Value {
+			return false
+		}
+	}
+	for f, want := range q.Where {
+		if v, _ := r.field(f); v != want {
+			return false
+		}
+	}
+	return q.matchesTime(r.Time)
+}
+
+// Page selects a window of every group, counted from the most seen value
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+// ValueCount is a value and the number of logs it was seen in
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// Group is one page of the values of a field, most seen first
+type Group struct {
+	Values []ValueCount `json:"values"`
+	// Distinct is the number of different values
+	Distinct int64 `json:"distinct"`
+}
+
+// Aggregation summarizes the logs matching a query
+type Aggregation struct {
+	Total     int64            `json:"total"`
+	FirstSeen int64            `json:"first_seen"`
+	LastSeen  int64            `json:"last_seen"`
+	Groups    map[string]Group `json:"groups"`
+}
+
+// HasMore reports whether any group has values after the page
+func (a Aggregation) HasMore(p Page) bool {
+	for _, g := range a.Groups {
+		if int64(p.Offset+len(g.Values)) < g.Distinct {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFields returns an error for names that are not in Fields
+func checkFields(q Query, groups []string) error {
+	if q.Field != "" {
+		if _, ok := (RequestLog{}).field(q.Field); !ok {
+			return unknownField(q.Field)
+		}
+	}
+	for f := range q.Where {
+		if _, ok := (RequestLog{}).field(f); !ok {
+			return unknownField(f)
+		}
+	}
+	for _, g := range groups {
+		if _, ok := (RequestLog{}).field(g); !ok {
+			return unknownField(g)
+		}
+	}
+	return nil
+}
+
+// aggregate counts the groups of logs in Go, for the stores without a query
+// engine. The values are ordered like the database stores order them.
+func aggregate(logs []RequestLog, groups []string, p Page) Aggregation {
+	a := Aggregation{Groups: map[string]Group{}}
+	counts := make([]map[string]int64, len(groups))
+	for i := range groups {
+		counts[i] = map[string]int64{}
+	}
+	for _, r := range logs {
+		a.Total++
+		if a.FirstSeen == 0 || r.Time < a.FirstSeen {
+			a.FirstSeen = r.Time
+		}
+		if r.Time > a.LastSeen {
+			a.LastSeen = r.Time
+		}
+		for i, g := range groups {
+			v, _ := r.field(g)
+			counts[i][v]++
+		}
+	}
+
+	for i, g := range groups {
+		values := make([]ValueCount, 0, len(counts[i]))
+		for v, n := range counts[i] {
+			values = append(values, ValueCount{Value: v, Count: n})
+		}
+		sortValueCounts(values)
+		a.Groups[g] = Group{Values: window(values, p), Distinct: int64(len(values))}
+	}
+	return a
+}
+
+// sortValueCounts orders by count, most seen first, then by value
+func sortValueCounts(values []ValueCount) {
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+}
+
+func window(values []ValueCount, p Page) []ValueCount {
+	if p.Offset >= len(values) {
+		return []ValueCount{}
+	}
+	values = values[p.Offset:]
+	if p.Limit > 0 && len(values) > p.Limit {
+		values = values[:p.Limit]
+	}
+	return values
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// Reader reads the logs of a store without changing it. Every Store is one.
+type Reader interface {
+	// Each calls fn for every log matching the query, like Store.Each
+	Each(q ExportQuery, fn func(RequestLog) error) error
+	Close() error
+}
+
+// OpenReader opens the store selected in the config for reading only, so
+// the logs can be exported next to a running server: nothing is migrated,
+// written or deleted, and a JSONL file is streamed without loading it. A
+// nil Reader is returned if nothing is stored.
+func OpenReader(c *types.Config) (Reader, error) {
+	switch c.Store {
+	case "":
+		if c.MongoURL == "" {
+			return nil, nil
+		}
+		return connectMongo(c.MongoURL, c.DB, c.Collection)
+	case "none":
+		return nil, nil
+	case "mongo":
+		return connectMongo(c.MongoURL, c.DB, c.Collection)
+	case "sqlite":
+		return openSQLiteReader(pathOr(c.StorePath, DefaultSQLitePath))
+	case "jsonl":
+		return jsonlReader{path: pathOr(c.StorePath, DefaultJSONLPath)}, nil
+	case "memory":
+		return nil, fmt.Errorf("the memory store can only be read by the server")
+	}
+	return nil, fmt.Errorf("unknown store %q, use mongo, sqlite, jsonl, memory or none", c.Store)
+}
+
+// jsonlReader streams the logs of a JSONL file, which a running server may
+// append to at the same time
+type jsonlReader struct {
+	path string
+}
+
+func (r jsonlReader) Each(q ExportQuery, fn func(RequestLog) error) error {
+	if err := checkFields(q.Query, nil); err != nil {
+		return err
+	}
+	file, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return eachLog(file, q, fn)
+}
+
+func (r jsonlReader) Close() error {
+	return nil
+}
+
+// openSQLiteReader opens a database read-only, it has to exist
+func openSQLiteReader(path string) (*SQLite, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLite{db: db}, nil
+}
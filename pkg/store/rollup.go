@@ -0,0 +1,181 @@
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// RollupTypes are the fields a rollup is kept for
+var RollupTypes = []string{"ja3", "ja4", "ja4h", "h2", "peetprint", "user_agent"}
+
+const (
+	// rollupDays is how many days of daily counts a rollup keeps
+	rollupDays = 90
+	// maxRelated caps the co-occurring values kept per type
+	maxRelated = 20
+)
+
+// Rollup summarizes every request with one fingerprint value. It is updated
+// as the requests are stored, so it covers them all without a scan.
+type Rollup struct {
+	Type      string `bson:"type" json:"type"`
+	Value     string `bson:"value" json:"value"`
+	Count     int64  `bson:"count" json:"count"`
+	FirstSeen int64  `bson:"first_seen" json:"first_seen"`
+	LastSeen  int64  `bson:"last_seen" json:"last_seen"`
+	// Daily maps UTC days (2006-01-02) to counts
+	Daily map[string]int64 `bson:"daily" json:"daily,omitempty"`
+	// Related maps the other types to their most seen values. The counts
+	// are estimates once more than maxRelated values were seen.
+	Related map[string]map[string]int64 `bson:"related" json:"related,omitempty"`
+}
+
+// IsRollupType reports whether rollups are kept for the type
+func IsRollupType(typ string) bool {
+	for _, t := range RollupTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func newRollup(typ, value string) *Rollup {
+	return &Rollup{
+		Type:    typ,
+		Value:   value,
+		Daily:   map[string]int64{},
+		Related: map[string]map[string]int64{},
+	}
+}
+
+// rollupValue returns the value of a rollup type in the log, values that
+// carry no fingerprint return false
+func rollupValue(r RequestLog, typ string) (string, bool) {
+	v, _ := r.field(typ)
+	return v, v != "" && v != "-"
+}
+
+// add counts a log with the value of the rollup
+func (r *Rollup) add(l RequestLog) {
+	if r.Daily == nil {
+		r.Daily = map[string]int64{}
+	}
+	if r.Related == nil {
+		r.Related = map[string]map[string]int64{}
+	}
+
+	r.Count++
+	if r.FirstSeen == 0 || l.Time < r.FirstSeen {
+		r.FirstSeen = l.Time
+	}
+	if l.Time > r.LastSeen {
+		r.LastSeen = l.Time
+	}
+
+	day := time.Unix(l.Time, 0).UTC()
+	r.Daily[day.Format("2006-01-02")]++
+	cutoff := time.Unix(r.LastSeen, 0).UTC().AddDate(0, 0, -rollupDays).Format("2006-01-02")
+	for d := range r.Daily {
+		if d < cutoff {
+			delete(r.Daily, d)
+		}
+	}
+
+	for _, typ := range RollupTypes {
+		if typ == r.Type {
+			continue
+		}
+		if v, ok := rollupValue(l, typ); ok {
+			if r.Related[typ] == nil {
+				r.Related[typ] = map[string]int64{}
+			}
+			bump(r.Related[typ], v)
+		}
+	}
+}
+
+// bump counts a value in a map of at most maxRelated values. When it is
+// full, the least seen value is replaced and the new one inherits its count
+// (the space-saving algorithm), so frequent values are never lost.
+func bump(m map[string]int64, v string) {
+	if _, ok := m[v]; ok || len(m) < maxRelated {
+		m[v]++
+		return
+	}
+	minValue, minCount := "", int64(-1)
+	for k, n := range m {
+		if minCount < 0 || n < minCount || (n == minCount && k > minValue) {
+			minValue, minCount = k, n
+		}
+	}
+	delete(m, minValue)
+	m[v] = minCount + 1
+}
+
+// Top returns the co-occurring values of a type, most seen first
+func (r Rollup) Top(typ string) []ValueCount {
+	values := []ValueCount{}
+	for v, n := range r.Related[typ] {
+		values = append(values, ValueCount{Value: v, Count: n})
+	}
+	sortValueCounts(values)
+	return values
+}
+
+// copy returns a deep copy, so callers can not race with later updates
+func (r *Rollup) copy() Rollup {
+	c := *r
+	c.Daily = make(map[string]int64, len(r.Daily))
+	for k, v := range r.Daily {
+		c.Daily[k] = v
+	}
+	c.Related = make(map[string]map[string]int64, len(r.Related))
+	for typ, m := range r.Related {
+		c.Related[typ] = make(map[string]int64, len(m))
+		for k, v := range m {
+			c.Related[typ][k] = v
+		}
+	}
+	return c
+}
+
+// rollupKey identifies a rollup in a batch
+type rollupKey struct {
+	typ, value string
+}
+
+// rollupBatch groups the logs of a batch by the rollups they update, in the
+// order the rollups are first seen
+func rollupBatch(logs []RequestLog) ([]rollupKey, map[rollupKey][]RequestLog) {
+	var keys []rollupKey
+	byKey := map[rollupKey][]RequestLog{}
+	for _, l := range logs {
+		for _, typ := range RollupTypes {
+			v, ok := rollupValue(l, typ)
+			if !ok {
+				continue
+			}
+			k := rollupKey{typ, v}
+			if _, seen := byKey[k]; !seen {
+				keys = append(keys, k)
+			}
+			byKey[k] = append(byKey[k], l)
+		}
+	}
+	return keys, byKey
+}
+
+// sortNew orders rollups newest first, then by type and value
+func sortNew(rollups []Rollup) {
+	sort.Slice(rollups, func(i, j int) bool {
+		a, b := rollups[i], rollups[j]
+		if a.FirstSeen != b.FirstSeen {
+			return a.FirstSeen > b.FirstSeen
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Value < b.Value
+	})
+}
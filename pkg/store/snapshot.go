@@ -0,0 +1,19 @@
+package store
+
+import (
+	"encoding/json"
+)
+
+// Snapshot is the complete response of one request, kept until it expires
+type Snapshot struct {
+	ID      string          `bson:"_id" json:"id"`
+	Time    int64           `bson:"time" json:"time"`
+	Expires int64           `bson:"expires" json:"expires"`
+	IP      string          `bson:"ip" json:"ip,omitempty"`
+	Data    json.RawMessage `bson:"data" json:"data"`
+}
+
+// Expired reports whether the snapshot expired at now (unix seconds)
+func (s Snapshot) Expired(now int64) bool {
+	return s.Expires != 0 && s.Expires <= now
+}
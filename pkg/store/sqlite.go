@@ -0,0 +1,481 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/glebarez/go-sqlite"
+)
+
+// SQLite keeps the logs in a SQLite database, using a pure Go driver so no
+// cgo is needed
+type SQLite struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS requests (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time INTEGER NOT NULL,
+	user_agent TEXT NOT NULL,
+	ja3 TEXT NOT NULL,
+	ja4 TEXT NOT NULL,
+	ja4h TEXT NOT NULL,
+	h2 TEXT NOT NULL,
+	peetprint TEXT NOT NULL,
+	ip TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS rollups (
+	type TEXT NOT NULL,
+	value TEXT NOT NULL,
+	count INTEGER NOT NULL,
+	first_seen INTEGER NOT NULL,
+	last_seen INTEGER NOT NULL,
+	daily TEXT NOT NULL,
+	related TEXT NOT NULL,
+	PRIMARY KEY (type, value)
+);
+CREATE INDEX IF NOT EXISTS rollups_first_seen ON rollups (first_seen);
+CREATE TABLE IF NOT EXISTS snapshots (
+	id TEXT PRIMARY KEY,
+	time INTEGER NOT NULL,
+	expires INTEGER NOT NULL,
+	data BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS snapshots_expires ON snapshots (expires);
+CREATE INDEX IF NOT EXISTS rollups_last_seen ON rollups (last_seen)`
+
+func NewSQLite(path string) (*SQLite, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// WAL lets the searches read while requests are written
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// Snapshots are deleted by IP and logs have the parsed user agent,
+	// databases from before have no columns for them
+	columns := [][3]string{
+		{"snapshots", "ip", `TEXT NOT NULL DEFAULT ''`},
+		{"requests", "browser", `TEXT NOT NULL DEFAULT ''`},
+		{"requests", "browser_major", `TEXT NOT NULL DEFAULT ''`},
+		{"requests", "os", `TEXT NOT NULL DEFAULT ''`},
+		{"requests", "device", `TEXT NOT NULL DEFAULT ''`},
+	}
+	for _, c := range columns {
+		if err := addColumn(db, c[0], c[1], c[2]); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	// The searches filter on one field and a time range
+	indexes := []string{
+		`CREATE INDEX IF NOT EXISTS requests_time ON requests (time)`,
+		`CREATE INDEX IF NOT EXISTS snapshots_ip ON snapshots (ip)`,
+	}
+	for _, f := range Fields {
+		indexes = append(indexes, fmt.Sprintf(`CREATE INDEX IF NOT EXISTS requests_%s ON requests (%s, time)`, f, f))
+	}
+	for _, index := range indexes {
+		if _, err := db.Exec(index); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &SQLite{db: db}, nil
+}
+
+// addColumn adds a column to a table unless it already has it
+func addColumn(db *sql.DB, table, column, def string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + def)
+	return err
+}
+
+// logColumns are the columns of a log, in the order of logFields
+const logColumns = `time, user_agent, ja3, ja4, ja4h, h2, peetprint, ip, browser, browser_major, os, device`
+
+// logFields returns the fields of a log to scan logColumns into
+func logFields(r *RequestLog) []interface{} {
+	return []interface{}{&r.Time, &r.UserAgent, &r.JA3, &r.JA4, &r.JA4H, &r.H2, &r.PeetPrint, &r.IP, &r.Browser, &r.BrowserMajor, &r.OS, &r.Device}
+}
+
+func (s *SQLite) Save(logs ...RequestLog) error {
+	// One transaction per batch, SQLite syncs once per commit
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO requests (time, user_agent, ja3, ja4, ja4h, h2, peetprint, ip, browser, browser_major, os, device) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range logs {
+		if _, err := stmt.Exec(r.Time, r.UserAgent, r.JA3, r.JA4, r.JA4H, r.H2, r.PeetPrint, r.IP, r.Browser, r.BrowserMajor, r.OS, r.Device); err != nil {
+			return err
+		}
+	}
+
+	keys, byKey := rollupBatch(logs)
+	for _, k := range keys {
+		r, _, err := s.rollup(tx, k.typ, k.value)
+		if err != nil {
+			return err
+		}
+		for _, l := range byKey[k] {
+			r.add(l)
+		}
+		daily, _ := json.Marshal(r.Daily)
+		related, _ := json.Marshal(r.Related)
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO rollups (type, value, count, first_seen, last_seen, daily, related) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			r.Type, r.Value, r.Count, r.FirstSeen, r.LastSeen, string(daily), string(related)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// rowScanner is a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// queryer is a *sql.DB or *sql.Tx
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+const rollupColumns = `type, value, count, first_seen, last_seen, daily, related`
+
+func scanRollup(row rowScanner) (*Rollup, error) {
+	r := &Rollup{}
+	var daily, related string
+	if err := row.Scan(&r.Type, &r.Value, &r.Count, &r.FirstSeen, &r.LastSeen, &daily, &related); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(daily), &r.Daily); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(related), &r.Related); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// rollup loads a rollup, a new one is returned if it does not exist yet
+func (s *SQLite) rollup(q queryer, typ, value string) (*Rollup, bool, error) {
+	r, err := scanRollup(q.QueryRow(`SELECT `+rollupColumns+` FROM rollups WHERE type = ? AND value = ?`, typ, value))
+	if err == sql.ErrNoRows {
+		return newRollup(typ, value), false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return r, true, nil
+}
+
+func (s *SQLite) Rollup(typ, value string) (Rollup, bool, error) {
+	r, ok, err := s.rollup(s.db, typ, value)
+	if err != nil || !ok {
+		return Rollup{}, false, err
+	}
+	return *r, true, nil
+}
+
+func (s *SQLite) NewRollups(since int64, typ string, limit int) ([]Rollup, error) {
+	query := `SELECT ` + rollupColumns + ` FROM rollups WHERE first_seen >= ?`
+	args := []interface{}{since}
+	if typ != "" {
+		query += ` AND type = ?`
+		args = append(args, typ)
+	}
+	query += ` ORDER BY first_seen DESC, type, value`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []Rollup{}
+	for rows.Next() {
+		r, err := scanRollup(rows)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, *r)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLite) Count() (int64, error) {
+	var n int64
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM requests`).Scan(&n)
+	return n, err
+}
+
+func (s *SQLite) Find(field, value string) ([]RequestLog, error) {
+	// field is checked against Fields, so it can be used as a column name
+	if _, ok := (RequestLog{}).field(field); !ok {
+		return nil, unknownField(field)
+	}
+
+	rows, err := s.db.Query(`SELECT `+logColumns+` FROM requests WHERE `+field+` = ? ORDER BY id`, value)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []RequestLog{}
+	for rows.Next() {
+		var r RequestLog
+		if err := rows.Scan(logFields(&r)...); err != nil {
+			return res, err
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+// Each reads exportBatch rows at a time by id, so no read transaction is
+// held open while fn runs
+func (s *SQLite) Each(q ExportQuery, fn func(RequestLog) error) error {
+	if err := checkFields(q.Query, nil); err != nil {
+		return err
+	}
+
+	where, args := sqliteWhere(q.Query)
+	if q.UserAgent != "" {
+		where = appendCond(where, "instr(lower(user_agent), lower(?)) > 0")
+		args = append(args, q.UserAgent)
+	}
+	where = appendCond(where, "id > ?")
+
+	var last int64
+	for {
+		rows, err := s.db.Query(`SELECT id, `+logColumns+` FROM requests`+where+` ORDER BY id LIMIT ?`,
+			append(args, last, exportBatch)...)
+		if err != nil {
+			return err
+		}
+		batch := make([]RequestLog, 0, exportBatch)
+		for rows.Next() {
+			var r RequestLog
+			if err := rows.Scan(append([]interface{}{&last}, logFields(&r)...)...); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, r := range batch {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		if len(batch) < exportBatch {
+			return nil
+		}
+	}
+}
+
+// sqliteWhere returns the WHERE clause selecting the logs of a query and
+// its arguments, the fields are checked against Fields
+func sqliteWhere(q Query) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if q.Field != "" {
+		conds = append(conds, q.Field+" = ?")
+		args = append(args, q.Value)
+	}
+	for _, f := range sortedWhere(q.Where) {
+		conds = append(conds, f+" = ?")
+		args = append(args, q.Where[f])
+	}
+	if q.Since != 0 {
+		conds = append(conds, "time >= ?")
+		args = append(args, q.Since)
+	}
+	if q.Until != 0 {
+		conds = append(conds, "time <= ?")
+		args = append(args, q.Until)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// sortedWhere returns the fields of Query.Where in order, so the same
+// query gives the same SQL
+func sortedWhere(where map[string]string) []string {
+	fields := make([]string, 0, len(where))
+	for f := range where {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func appendCond(where, cond string) string {
+	if where == "" {
+		return " WHERE " + cond
+	}
+	return where + " AND " + cond
+}
+
+func (s *SQLite) Aggregate(q Query, groups []string, p Page) (Aggregation, error) {
+	if err := checkFields(q, groups); err != nil {
+		return Aggregation{}, err
+	}
+
+	where, args := sqliteWhere(q)
+	a := Aggregation{Groups: map[string]Group{}}
+	err := s.db.QueryRow(`SELECT COUNT(*), COALESCE(MIN(time), 0), COALESCE(MAX(time), 0) FROM requests`+where, args...).
+		Scan(&a.Total, &a.FirstSeen, &a.LastSeen)
+	if err != nil {
+		return a, err
+	}
+
+	limit := p.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	for _, g := range groups {
+		group := Group{Values: []ValueCount{}}
+		if err := s.db.QueryRow(`SELECT COUNT(DISTINCT `+g+`) FROM requests`+where, args...).Scan(&group.Distinct); err != nil {
+			return a, err
+		}
+		rows, err := s.db.Query(`SELECT `+g+`, COUNT(*) AS n FROM requests`+where+` GROUP BY `+g+` ORDER BY n DESC, `+g+` LIMIT ? OFFSET ?`,
+			append(args, limit, p.Offset)...)
+		if err != nil {
+			return a, err
+		}
+		for rows.Next() {
+			var v ValueCount
+			if err := rows.Scan(&v.Value, &v.Count); err != nil {
+				rows.Close()
+				return a, err
+			}
+			group.Values = append(group.Values, v)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return a, err
+		}
+		a.Groups[g] = group
+	}
+	return a, nil
+}
+
+func (s *SQLite) SaveSnapshots(snapshots ...Snapshot) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, snap := range snapshots {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO snapshots (id, time, expires, ip, data) VALUES (?, ?, ?, ?, ?)`,
+			snap.ID, snap.Time, snap.Expires, snap.IP, []byte(snap.Data)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) Snapshot(id string) (Snapshot, bool, error) {
+	snap := Snapshot{ID: id}
+	var data []byte
+	err := s.db.QueryRow(`SELECT time, expires, ip, data FROM snapshots WHERE id = ?`, id).Scan(&snap.Time, &snap.Expires, &snap.IP, &data)
+	if err == sql.ErrNoRows {
+		return Snapshot{}, false, nil
+	}
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	snap.Data = data
+	if snap.Expired(time.Now().Unix()) {
+		return Snapshot{}, false, nil
+	}
+	return snap, true, nil
+}
+
+func (s *SQLite) DeleteExpiredSnapshots(now int64) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM snapshots WHERE expires != 0 AND expires <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLite) DeleteBefore(t int64) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM requests WHERE time < ?`, t)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLite) DeleteRollupsBefore(t int64) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM rollups WHERE last_seen < ?`, t)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *SQLite) DeleteIP(ip string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var n int64
+	for _, table := range []string{"requests", "snapshots"} {
+		res, err := tx.Exec(`DELETE FROM `+table+` WHERE ip = ?`, ip)
+		if err != nil {
+			return 0, err
+		}
+		deleted, _ := res.RowsAffected()
+		n += deleted
+	}
+	return n, tx.Commit()
+}
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
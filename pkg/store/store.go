@@ -0,0 +1,135 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// Default paths of the file based stores, relative to the working directory
+const (
+	DefaultJSONLPath  = "data/requests.jsonl"
+	DefaultSQLitePath = "data/requests.db"
+)
+
+// RequestLog is the record kept for every fingerprinted request
+type RequestLog struct {
+	UserAgent string `bson:"user_agent" json:"user_agent"`
+	JA3       string `bson:"ja3" json:"ja3"`
+	JA4       string `bson:"ja4" json:"ja4"`
+	JA4H      string `bson:"ja4h" json:"ja4h"`
+	H2        string `bson:"h2" json:"h2"`
+	PeetPrint string `bson:"peetprint" json:"peetprint"`
+	IP        string `bson:"ip" json:"ip,omitempty"`
+	Time      int64  `bson:"time" json:"time"`
+	// The user agent parsed when the log is written, empty for logs stored
+	// before it was
+	Browser      string `bson:"browser" json:"browser,omitempty"`
+	BrowserMajor string `bson:"browser_major" json:"browser_major,omitempty"`
+	OS           string `bson:"os" json:"os,omitempty"`
+	Device       string `bson:"device" json:"device,omitempty"`
+}
+
+// Fields are the names the logs can be searched by
+var Fields = []string{"user_agent", "ja3", "ja4", "ja4h", "h2", "peetprint", "ip", "browser", "browser_major", "os", "device"}
+
+// Store keeps the request logs the search endpoints are answered from
+type Store interface {
+	// Save adds logs, a batch is written at once where the backend allows it
+	Save(logs ...RequestLog) error
+	// Count returns the number of logs
+	Count() (int64, error)
+	// Find returns the logs where field, one of Fields, equals value
+	Find(field, value string) ([]RequestLog, error)
+	// Each calls fn for every log matching the query, oldest first, without
+	// loading them all at once. It stops at the first error of fn.
+	Each(q ExportQuery, fn func(RequestLog) error) error
+	// Aggregate counts the values of the groups, each one of Fields, in the
+	// logs matching the query
+	Aggregate(q Query, groups []string, p Page) (Aggregation, error)
+	// Rollup returns the rollup of a value of one of RollupTypes, false if
+	// the value was never seen
+	Rollup(typ, value string) (Rollup, bool, error)
+	// NewRollups returns up to limit rollups first seen at or after since,
+	// newest first. An empty typ selects every type.
+	NewRollups(since int64, typ string, limit int) ([]Rollup, error)
+	// SaveSnapshots adds snapshots, replacing those with the same ID
+	SaveSnapshots(snapshots ...Snapshot) error
+	// Snapshot returns a snapshot, false if it does not exist or expired
+	Snapshot(id string) (Snapshot, bool, error)
+	// DeleteExpiredSnapshots removes the snapshots expired at now and
+	// returns how many there were
+	DeleteExpiredSnapshots(now int64) (int64, error)
+	// DeleteBefore removes the logs older than t, the rollups are kept
+	DeleteBefore(t int64) (int64, error)
+	// DeleteRollupsBefore removes the rollups last seen before t
+	DeleteRollupsBefore(t int64) (int64, error)
+	// DeleteIP removes the logs and snapshots stored with an IP and returns
+	// how many there were
+	DeleteIP(ip string) (int64, error)
+	Close() error
+}
+
+// Open opens the store selected in the config. Without a store setting,
+// Mongo is used if a URL is configured, otherwise nothing is stored and
+// a nil Store is returned.
+func Open(c *types.Config) (Store, error) {
+	switch c.Store {
+	case "":
+		if c.MongoURL == "" {
+			return nil, nil
+		}
+		return NewMongo(c.MongoURL, c.DB, c.Collection)
+	case "none":
+		return nil, nil
+	case "mongo":
+		return NewMongo(c.MongoURL, c.DB, c.Collection)
+	case "sqlite":
+		return NewSQLite(pathOr(c.StorePath, DefaultSQLitePath))
+	case "jsonl":
+		return NewJSONL(pathOr(c.StorePath, DefaultJSONLPath))
+	case "memory":
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("unknown store %q, use mongo, sqlite, jsonl, memory or none", c.Store)
+}
+
+func pathOr(path, def string) string {
+	if path == "" {
+		return def
+	}
+	return path
+}
+
+// field returns the value of a searchable field
+func (r RequestLog) field(name string) (string, bool) {
+	switch name {
+	case "user_agent":
+		return r.UserAgent, true
+	case "ja3":
+		return r.JA3, true
+	case "ja4":
+		return r.JA4, true
+	case "ja4h":
+		return r.JA4H, true
+	case "h2":
+		return r.H2, true
+	case "peetprint":
+		return r.PeetPrint, true
+	case "ip":
+		return r.IP, true
+	case "browser":
+		return r.Browser, true
+	case "browser_major":
+		return r.BrowserMajor, true
+	case "os":
+		return r.OS, true
+	case "device":
+		return r.Device, true
+	}
+	return "", false
+}
+
+func unknownField(name string) error {
+	return fmt.Errorf("unknown field %q", name)
+}
@@ -0,0 +1,392 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// testBackends opens a new store of every backend that needs no server
+func testBackends(t *testing.T) map[string]func() (Store, error) {
+	dir := t.TempDir()
+	return map[string]func() (Store, error){
+		"memory": func() (Store, error) { return NewMemory(), nil },
+		"jsonl":  func() (Store, error) { return NewJSONL(filepath.Join(dir, "requests.jsonl")) },
+		"sqlite": func() (Store, error) { return NewSQLite(filepath.Join(dir, "requests.db")) },
+	}
+}
+
+// testLogs returns n logs, one per second, from two IPs and user agents
+func testLogs(n int) []RequestLog {
+	logs := make([]RequestLog, n)
+	for i := range logs {
+		logs[i] = RequestLog{JA3: "ja3-a", UserAgent: "curl/8.5.0", IP: "1.1.1.1", Time: int64(i + 1)}
+		if i%2 == 1 {
+			logs[i].JA3, logs[i].UserAgent, logs[i].IP = "ja3-b", "Mozilla/5.0 Chrome/124.0", "2.2.2.2"
+		}
+	}
+	return logs
+}
+
+func collect(s Reader, q ExportQuery) ([]RequestLog, error) {
+	res := []RequestLog{}
+	err := s.Each(q, func(r RequestLog) error {
+		res = append(res, r)
+		return nil
+	})
+	return res, err
+}
+
+func TestEach(t *testing.T) {
+	// More than one batch, so the paging of the backends is used
+	logs := testLogs(2*exportBatch + 10)
+	for name, open := range testBackends(t) {
+		s, err := open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := s.Save(logs...); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		all, err := collect(s, ExportQuery{})
+		if err != nil || len(all) != len(logs) {
+			t.Fatalf("%s: expected %d logs, got %d (%v)", name, len(logs), len(all), err)
+		}
+		for i := range all {
+			if all[i] != logs[i] {
+				t.Fatalf("%s: expected the logs oldest first, got %+v at %d", name, all[i], i)
+			}
+		}
+
+		queries := map[string]struct {
+			q    ExportQuery
+			want int
+		}{
+			"field":      {ExportQuery{Query: Query{Field: "ja3", Value: "ja3-b"}}, exportBatch + 5},
+			"where":      {ExportQuery{Query: Query{Where: map[string]string{"ip": "1.1.1.1"}}}, exportBatch + 5},
+			"time range": {ExportQuery{Query: Query{Since: 11, Until: 20}}, 10},
+			"user agent": {ExportQuery{UserAgent: "CHROME"}, exportBatch + 5},
+			"combined":   {ExportQuery{Query: Query{Field: "ja3", Value: "ja3-a", Until: 100}, UserAgent: "curl"}, 50},
+			"no match":   {ExportQuery{Query: Query{Field: "ja3", Value: "ja3-a"}, UserAgent: "chrome"}, 0},
+		}
+		for qname, tt := range queries {
+			res, err := collect(s, tt.q)
+			if err != nil || len(res) != tt.want {
+				t.Fatalf("%s: %s: expected %d logs, got %d (%v)", name, qname, tt.want, len(res), err)
+			}
+		}
+
+		// Each stops at the first error of fn
+		stop := errors.New("stop")
+		calls := 0
+		err = s.Each(ExportQuery{}, func(RequestLog) error {
+			calls++
+			return stop
+		})
+		if err != stop || calls != 1 {
+			t.Fatalf("%s: expected Each to stop after the first error, got %d calls (%v)", name, calls, err)
+		}
+		if err := s.Each(ExportQuery{Query: Query{Field: "password"}}, func(RequestLog) error { return nil }); err == nil {
+			t.Fatalf("%s: expected unknown fields to be rejected", name)
+		}
+		s.Close()
+	}
+}
+
+func TestDelete(t *testing.T) {
+	logs := testLogs(10)
+	for name, open := range testBackends(t) {
+		s, err := open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := s.Save(logs...); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		data := json.RawMessage(`{}`)
+		if err := s.SaveSnapshots(Snapshot{ID: "a", IP: "2.2.2.2", Data: data}, Snapshot{ID: "b", IP: "1.1.1.1", Data: data}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if n, err := s.DeleteBefore(5); err != nil || n != 4 {
+			t.Fatalf("%s: expected 4 logs deleted, got %d (%v)", name, n, err)
+		}
+		// 3 of the 6 logs left and a snapshot
+		if n, err := s.DeleteIP("2.2.2.2"); err != nil || n != 4 {
+			t.Fatalf("%s: expected 4 logs and snapshots deleted, got %d (%v)", name, n, err)
+		}
+		if n, err := s.DeleteIP("3.3.3.3"); err != nil || n != 0 {
+			t.Fatalf("%s: expected nothing deleted for an unknown IP, got %d (%v)", name, n, err)
+		}
+		if _, ok, _ := s.Snapshot("a"); ok {
+			t.Fatalf("%s: expected the snapshot of the IP to be deleted", name)
+		}
+		s.Close()
+
+		if name == "memory" {
+			continue
+		}
+		// The deletes are kept after reopening the file based stores
+		s, err = open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		left, _ := collect(s, ExportQuery{})
+		if len(left) != 3 || left[0].Time != 5 || left[0].IP != "1.1.1.1" || left[2].Time != 9 {
+			t.Fatalf("%s: unexpected logs after reopening %+v", name, left)
+		}
+		if _, ok, _ := s.Snapshot("b"); !ok {
+			t.Fatalf("%s: expected the other snapshot to be kept", name)
+		}
+		if _, ok, _ := s.Snapshot("a"); ok {
+			t.Fatalf("%s: expected the deleted snapshot to stay deleted", name)
+		}
+		s.Close()
+	}
+}
+
+// searchLogs are three logs sharing their JA3 and HTTP/2 fingerprints
+var searchLogs = []RequestLog{
+	{JA3: "a", H2: "h2-a", UserAgent: "curl", Time: 1},
+	{JA3: "a", H2: "h2-b", UserAgent: "curl", Time: 2},
+	{JA3: "b", H2: "h2-a", UserAgent: "chrome", Time: 3},
+}
+
+func TestAggregate(t *testing.T) {
+	for name, open := range testBackends(t) {
+		s, err := open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := s.Save(searchLogs...); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		agg, err := s.Aggregate(Query{Field: "ja3", Value: "a"}, []string{"user_agent", "h2"}, Page{Limit: 10})
+		if err != nil || agg.Total != 2 || agg.FirstSeen != 1 || agg.LastSeen != 2 {
+			t.Fatalf("%s: unexpected totals %+v (%v)", name, agg, err)
+		}
+		if ua := agg.Groups["user_agent"]; len(ua.Values) != 1 || ua.Values[0] != (ValueCount{Value: "curl", Count: 2}) || agg.Groups["h2"].Distinct != 2 {
+			t.Fatalf("%s: unexpected groups %+v", name, agg.Groups)
+		}
+
+		// Pages walk the values most seen first, ties ordered by value
+		for i, want := range []string{"a", "b"} {
+			p := Page{Limit: 1, Offset: i}
+			agg, err := s.Aggregate(Query{Field: "h2", Value: "h2-a"}, []string{"ja3"}, p)
+			if v := agg.Groups["ja3"].Values; err != nil || len(v) != 1 || v[0].Value != want || agg.HasMore(p) != (i == 0) {
+				t.Fatalf("%s: unexpected page %d %+v (%v)", name, i, agg, err)
+			}
+		}
+		agg, err = s.Aggregate(Query{Field: "h2", Value: "h2-a", Since: 2}, []string{"ja3"}, Page{Limit: 10})
+		if err != nil || agg.Total != 1 || agg.FirstSeen != 3 || agg.Groups["ja3"].Values[0].Value != "b" {
+			t.Fatalf("%s: unexpected time range result %+v (%v)", name, agg, err)
+		}
+
+		if _, err := s.Aggregate(Query{Field: "ja3; DROP TABLE requests", Value: "a"}, nil, Page{Limit: 10}); err == nil {
+			t.Fatalf("%s: expected unknown fields to be rejected", name)
+		}
+		if _, err := s.Find("ja3; DROP TABLE requests", "a"); err == nil {
+			t.Fatalf("%s: expected unknown fields to be rejected", name)
+		}
+		s.Close()
+	}
+}
+
+func TestRollups(t *testing.T) {
+	for name, open := range testBackends(t) {
+		s, err := open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := s.Save(searchLogs...); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		check := func() {
+			t.Helper()
+			r, ok, err := s.Rollup("h2", "h2-a")
+			if err != nil || !ok || r.Count != 2 || r.FirstSeen != 1 || r.LastSeen != 3 || r.Daily["1970-01-01"] != 2 {
+				t.Fatalf("%s: unexpected rollup %+v (%v)", name, r, err)
+			}
+			if ja3 := r.Top("ja3"); len(ja3) != 2 || ja3[0] != (ValueCount{Value: "a", Count: 1}) {
+				t.Fatalf("%s: unexpected related values %+v", name, r.Related)
+			}
+			if _, ok, _ := s.Rollup("ja3", "c"); ok {
+				t.Fatalf("%s: expected no rollup for an unknown value", name)
+			}
+			fresh, err := s.NewRollups(2, "ja3", 0)
+			if err != nil || len(fresh) != 1 || fresh[0].Value != "b" || fresh[0].FirstSeen != 3 {
+				t.Fatalf("%s: unexpected new rollups %+v (%v)", name, fresh, err)
+			}
+		}
+		check()
+		s.Close()
+
+		if name == "memory" {
+			continue
+		}
+		// The file based stores keep the logs and rollups across restarts
+		s, err = open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if n, err := s.Count(); err != nil || n != 3 {
+			t.Fatalf("%s: expected 3 logs after reopening, got %d (%v)", name, n, err)
+		}
+		check()
+		s.Close()
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	now := time.Now().Unix()
+	data := json.RawMessage(`{"request_id":"live"}`)
+	for name, open := range testBackends(t) {
+		s, err := open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		err = s.SaveSnapshots(
+			Snapshot{ID: "live", Time: now, Expires: now + 3600, Data: data},
+			Snapshot{ID: "old", Time: now - 7200, Expires: now - 3600, Data: data},
+		)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		check := func() {
+			t.Helper()
+			if snap, ok, err := s.Snapshot("live"); err != nil || !ok || string(snap.Data) != string(data) || snap.Expires != now+3600 {
+				t.Fatalf("%s: unexpected snapshot %+v (%v)", name, snap, err)
+			}
+			if _, ok, _ := s.Snapshot("old"); ok {
+				t.Fatalf("%s: expected the expired snapshot to be left out", name)
+			}
+		}
+		check()
+		if n, err := s.DeleteExpiredSnapshots(now); err != nil || n != 1 {
+			t.Fatalf("%s: expected 1 expired snapshot, got %d (%v)", name, n, err)
+		}
+		s.Close()
+
+		if name == "memory" {
+			continue
+		}
+		s, err = open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		check()
+		s.Close()
+	}
+}
+
+func TestJSONLRollups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	s, err := NewJSONL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Save(testLogs(10)...)
+	count := func(s Store, want int64) {
+		t.Helper()
+		r, ok, err := s.Rollup("ja3", "ja3-a")
+		if err != nil || !ok || r.Count != want {
+			t.Fatalf("Expected a rollup of %d logs, got %+v (%v)", want, r, err)
+		}
+	}
+
+	// The rollups outlive the logs deleted by the retention
+	if n, _ := s.DeleteBefore(100); n != 10 {
+		t.Fatalf("Expected every log to be deleted, got %d", n)
+	}
+	s.Save(RequestLog{JA3: "ja3-a", Time: 200})
+	count(s, 6)
+	s.Close()
+
+	s, err = NewJSONL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count(s, 6)
+	// Logs saved after the rollup file was written are counted once
+	s.Save(RequestLog{JA3: "ja3-a", Time: 300})
+	s.file.Close()
+	s, err = NewJSONL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count(s, 7)
+	// ja3-b and both user agents were last seen with the deleted logs
+	if n, _ := s.DeleteRollupsBefore(250); n != 3 {
+		t.Fatalf("Expected 3 rollups to be deleted, got %d", n)
+	}
+	s.Close()
+	s, _ = NewJSONL(path)
+	if _, ok, _ := s.Rollup("ja3", "ja3-b"); ok {
+		t.Fatal("Expected the deleted rollup to stay deleted")
+	}
+	s.Close()
+}
+
+func TestJSONLEachSkipsBrokenLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	s, err := NewJSONL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Save(RequestLog{JA3: "a", Time: 1})
+	// A line cut short by a crash
+	s.file.Write([]byte("{\"ja3\": \"b\", \"ti\n"))
+	s.Save(RequestLog{JA3: "c", Time: 3})
+
+	logs, err := collect(s, ExportQuery{})
+	if err != nil || len(logs) != 2 || logs[0].JA3 != "a" || logs[1].JA3 != "c" {
+		t.Fatalf("Expected the broken line to be skipped, got %+v (%v)", logs, err)
+	}
+}
+
+func TestOpenReader(t *testing.T) {
+	dir := t.TempDir()
+	logs := testLogs(exportBatch + 1)
+	for _, c := range []types.Config{
+		{Store: "jsonl", StorePath: filepath.Join(dir, "requests.jsonl")},
+		{Store: "sqlite", StorePath: filepath.Join(dir, "requests.db")},
+	} {
+		s, err := Open(&c)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Store, err)
+		}
+		defer s.Close()
+		s.Save(logs...)
+
+		// The files are read while the store is open, like the export
+		// command does next to a running server
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		r, err := OpenReader(&c)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Store, err)
+		}
+		res, err := collect(r, ExportQuery{Query: Query{Field: "ja3", Value: "ja3-b"}})
+		if err != nil || len(res) != exportBatch/2 || res[0] != logs[1] {
+			t.Fatalf("%s: unexpected logs %d (%v)", c.Store, len(res), err)
+		}
+		r.Close()
+		if after, _ := filepath.Glob(filepath.Join(dir, "*")); len(after) != len(files) {
+			t.Fatalf("%s: expected the reader to leave the files alone, got %v", c.Store, after)
+		}
+	}
+
+	if r, err := OpenReader(&types.Config{Store: "sqlite", StorePath: filepath.Join(dir, "missing.db")}); err == nil {
+		r.Close()
+		t.Fatal("Expected a missing database to be an error, not created")
+	}
+	if r, err := OpenReader(&types.Config{}); r != nil || err != nil {
+		t.Fatalf("Expected no reader without a store, got %v (%v)", r, err)
+	}
+}
@@ -20,6 +20,8 @@ var (
 	handle       *pcap.Handle
 )
 
+const maxPendingHandshakes = 65536
+
 func parseIP(packet gopacket.Packet) *types.IPDetails {
 	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer == nil {
 		if ipLayer := packet.Layer(layers.LayerTypeIPv6); ipLayer == nil {
@@ -55,11 +57,23 @@ func SniffTCP(device string, tlsPort int, srv *server.Server) {
 	}
 	defer handle.Close()
 
+	// When our SYN-ACK left, by client address. The ACK that completes the
+	// handshake gives the RTT of the TCP connection.
+	synAckSent := make(map[string]time.Time)
+
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
 	for packet := range packetSource.Packets() {
 		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
 			ip := parseIP(packet)
 			tcp := tcpLayer.(*layers.TCP)
+			if ip != nil && tcp.SYN && tcp.ACK && int(tcp.SrcPort) == tlsPort {
+				// Handshakes that never complete must not grow the map forever
+				if len(synAckSent) > maxPendingHandshakes {
+					synAckSent = make(map[string]time.Time)
+				}
+				synAckSent[fmt.Sprintf("%s:%v", ip.DstIp, tcp.DstPort)] = packet.Metadata().Timestamp
+				continue
+			}
 			if !tcp.ACK || int(tcp.DstPort) != tlsPort || ip.IPVersion == 0 {
 				continue
 			}
@@ -79,6 +93,12 @@ func SniffTCP(device string, tlsPort int, srv *server.Server) {
 				},
 			}
 			src := fmt.Sprintf("%s:%v", pack.IP.SrcIP, pack.SrcPort)
+			if sent, ok := synAckSent[src]; ok {
+				pack.HandshakeRTTMs = float64(packet.Metadata().Timestamp.Sub(sent).Microseconds()) / 1000
+				delete(synAckSent, src)
+			} else if prev, ok := srv.GetTCPFingerprints().Load(src); ok {
+				pack.HandshakeRTTMs = prev.(types.TCPIPDetails).HandshakeRTTMs
+			}
 			srv.GetTCPFingerprints().Store(src, pack)
 		}
 	}
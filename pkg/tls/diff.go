@@ -0,0 +1,195 @@
+package tls
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+// TLSDiff is the difference between two ClientHellos, from a to b. GREASE
+// values are left out and the extension order is not compared, as clients
+// randomize both.
+type TLSDiff struct {
+	Ciphers    types.ListDiff `json:"ciphers"`
+	Extensions types.ListDiff `json:"extensions"`
+	// Parameters maps the extensions sent by both to their differing
+	// parameters, e.g. the key_share groups or the ALPN protocols
+	Parameters map[string]map[string]types.ListDiff `json:"parameters,omitempty"`
+}
+
+// Changed reports whether the ClientHellos differ
+func (d TLSDiff) Changed() bool {
+	return d.Ciphers.Changed() || d.Extensions.Changed() || len(d.Parameters) > 0
+}
+
+// noisyParameters change with every connection, so they are not compared
+var noisyParameters = map[string]bool{
+	"padding_data_length":         true,
+	"master_secret_data":          true,
+	"extended_master_secret_data": true,
+}
+
+// randomExtensions carry data that changes with every connection
+var randomExtensions = []string{"pre_shared_key", "session_ticket", "extensionEncryptedClientHello"}
+
+// DiffTLS compares the ClientHellos of two requests
+func DiffTLS(a, b *types.TLSDetails) TLSDiff {
+	d := TLSDiff{
+		Ciphers:    types.DiffList(withoutGrease(a.Ciphers), withoutGrease(b.Ciphers)),
+		Parameters: map[string]map[string]types.ListDiff{},
+	}
+
+	namesA, paramsA := extensionParameters(a.Extensions)
+	namesB, paramsB := extensionParameters(b.Extensions)
+	d.Extensions = types.DiffList(namesA, namesB)
+	d.Extensions.Reordered = false
+
+	for name, pa := range paramsA {
+		pb, ok := paramsB[name]
+		if !ok {
+			continue
+		}
+		keys := map[string]bool{}
+		for k := range pa {
+			keys[k] = true
+		}
+		for k := range pb {
+			keys[k] = true
+		}
+		for k := range keys {
+			if diff := types.DiffList(pa[k], pb[k]); diff.Changed() {
+				if d.Parameters[name] == nil {
+					d.Parameters[name] = map[string]types.ListDiff{}
+				}
+				d.Parameters[name][k] = diff
+			}
+		}
+	}
+	return d
+}
+
+// DiffElements compares the lists of two fingerprints, as returned by
+// JA3Elements or PeetPrintElements. Only the changed lists are returned.
+func DiffElements(a, b map[string][]string) map[string]types.ListDiff {
+	res := map[string]types.ListDiff{}
+	for name, la := range a {
+		diff := types.DiffList(la, b[name])
+		if name == "extensions" {
+			diff.Reordered = false
+		}
+		if diff.Changed() {
+			res[name] = diff
+		}
+	}
+	return res
+}
+
+// DiffJA4 compares two JA4s section by section. Only the changed sections
+// are returned.
+func DiffJA4(a, b string) (map[string]types.ValueDiff, bool) {
+	aa, ab, ac, okA := JA4Sections(a)
+	ba, bb, bc, okB := JA4Sections(b)
+	if !okA || !okB {
+		return nil, false
+	}
+	res := map[string]types.ValueDiff{}
+	for name, v := range map[string][2]string{"ja4_a": {aa, ba}, "ja4_b": {ab, bb}, "ja4_c": {ac, bc}} {
+		if v[0] != v[1] {
+			res[name] = types.ValueDiff{A: v[0], B: v[1]}
+		}
+	}
+	return res, true
+}
+
+// extensionParameters returns the names of the extensions, without
+// GREASE, and their parameters as lists
+func extensionParameters(extensions []interface{}) ([]string, map[string]map[string][]string) {
+	var names []string
+	params := map[string]map[string][]string{}
+	for _, ext := range extensions {
+		// The extensions are structs when parsed and maps when decoded
+		// from a snapshot, JSON works for both
+		var m map[string]interface{}
+		j, _ := json.Marshal(ext)
+		if json.Unmarshal(j, &m) != nil {
+			continue
+		}
+		name, _ := m["name"].(string)
+		if name == "" || strings.HasPrefix(name, "TLS_GREASE") {
+			continue
+		}
+		names = append(names, name)
+
+		p := map[string][]string{}
+		for k, v := range m {
+			if k == "name" || noisyParameters[k] || (k == "data" && isRandomExtension(name)) {
+				continue
+			}
+			p[k] = parameterValues(v)
+		}
+		params[name] = p
+	}
+	return names, params
+}
+
+func isRandomExtension(name string) bool {
+	for _, prefix := range randomExtensions {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parameterValues flattens a parameter to a list. Lists of objects, like
+// the key_share entries, are reduced to their keys, the key data is random.
+func parameterValues(v interface{}) []string {
+	switch v := v.(type) {
+	case []interface{}:
+		res := []string{}
+		for _, item := range v {
+			if obj, ok := item.(map[string]interface{}); ok {
+				res = append(res, sortedKeys(obj)...)
+				continue
+			}
+			if s := fmt.Sprint(item); !strings.HasPrefix(s, "TLS_GREASE") {
+				res = append(res, s)
+			}
+		}
+		return res
+	case map[string]interface{}:
+		res := []string{}
+		for _, k := range sortedKeys(v) {
+			res = append(res, fmt.Sprintf("%s=%v", k, v[k]))
+		}
+		return res
+	case nil:
+		return []string{}
+	}
+	return []string{fmt.Sprint(v)}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if !strings.HasPrefix(k, "TLS_GREASE") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// withoutGrease drops the GREASE values of a list of names
+func withoutGrease(values []string) []string {
+	res := []string{}
+	for _, v := range values {
+		if !strings.HasPrefix(v, "TLS_GREASE") {
+			res = append(res, v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,69 @@
+package tls
+
+import (
+	"testing"
+
+	"github.com/pagpeter/trackme/pkg/types"
+)
+
+func TestDiffTLS(t *testing.T) {
+	hello := func(grease, cipher, group string, alpn ...interface{}) *types.TLSDetails {
+		return &types.TLSDetails{
+			Ciphers: []string{"TLS_GREASE (0x" + grease + ")", "TLS_AES_128_GCM_SHA256", cipher},
+			Extensions: []interface{}{
+				map[string]interface{}{"name": "TLS_GREASE (0x" + grease + ")"},
+				map[string]interface{}{"name": "server_name (0)", "server_name": "example.com"},
+				map[string]interface{}{"name": "key_share (51)", "shared_keys": []interface{}{map[string]interface{}{group: grease}}},
+				map[string]interface{}{"name": "application_layer_protocol_negotiation (16)", "protocols": alpn},
+				map[string]interface{}{"name": "padding (21)", "padding_data_length": len(alpn)},
+				map[string]interface{}{"name": "pre_shared_key (41)", "data": grease},
+			},
+		}
+	}
+	a := hello("0a0a", "TLS_AES_256_GCM_SHA384", "X25519MLKEM768", "h2", "http/1.1")
+	b := hello("fafa", "TLS_CHACHA20_POLY1305_SHA256", "X25519", "http/1.1")
+
+	d := DiffTLS(a, b)
+	if !d.Changed() || len(d.Ciphers.Added) != 1 || d.Ciphers.Added[0] != "TLS_CHACHA20_POLY1305_SHA256" || len(d.Ciphers.Removed) != 1 {
+		t.Fatalf("Unexpected cipher diff %+v", d.Ciphers)
+	}
+	if d.Extensions.Changed() {
+		t.Fatalf("Expected GREASE to be ignored: %+v", d.Extensions)
+	}
+	if ks := d.Parameters["key_share (51)"]["shared_keys"]; len(ks.Added) != 1 || ks.Added[0] != "X25519" {
+		t.Fatalf("Unexpected key_share diff %+v", d.Parameters)
+	}
+	if alpn := d.Parameters["application_layer_protocol_negotiation (16)"]["protocols"]; len(alpn.Removed) != 1 || alpn.Removed[0] != "h2" {
+		t.Fatalf("Unexpected ALPN diff %+v", d.Parameters)
+	}
+	// Padding lengths and PSK data change with every connection
+	if len(d.Parameters) != 2 {
+		t.Fatalf("Expected only key_share and ALPN to differ: %+v", d.Parameters)
+	}
+
+	// The extension order is randomized by clients, so it is not compared
+	b = hello("1a1a", "TLS_AES_256_GCM_SHA384", "X25519MLKEM768", "h2", "http/1.1")
+	b.Extensions[1], b.Extensions[3] = b.Extensions[3], b.Extensions[1]
+	if d := DiffTLS(a, b); d.Changed() {
+		t.Fatalf("Expected the ClientHellos to match: %+v", d)
+	}
+}
+
+func TestDiffJA4(t *testing.T) {
+	d, ok := DiffJA4("t13d1516h2_8daaf6152771_02713d6af862", "t13d1517h2_8daaf6152771_b1ff8ab2d16f")
+	if !ok || len(d) != 2 || d["ja4_a"] != (types.ValueDiff{A: "t13d1516h2", B: "t13d1517h2"}) || d["ja4_c"].B != "b1ff8ab2d16f" {
+		t.Fatalf("Unexpected JA4 diff %+v", d)
+	}
+	if _, ok := DiffJA4("t13d1516h2_8daaf6152771_02713d6af862", "771,4865,0,29,0"); ok {
+		t.Fatal("Expected a JA3 to be rejected")
+	}
+}
+
+func TestDiffElements(t *testing.T) {
+	a := map[string][]string{"ciphers": {"4865", "4866"}, "extensions": {"0", "10", "16"}}
+	b := map[string][]string{"ciphers": {"4866", "4865"}, "extensions": {"16", "0", "10"}}
+	d := DiffElements(a, b)
+	if len(d) != 1 || !d["ciphers"].Reordered {
+		t.Fatalf("Expected only the cipher order to differ: %+v", d)
+	}
+}
@@ -0,0 +1,59 @@
+package tls
+
+import "strings"
+
+// JA3Elements splits a JA3 string into its lists: ciphers, extensions,
+// groups and point_formats. It reports false if it is not a JA3 string.
+func JA3Elements(ja3 string) (map[string][]string, bool) {
+	parts := strings.Split(ja3, ",")
+	if len(parts) != 5 {
+		return nil, false
+	}
+	return map[string][]string{
+		"tls_version":   splitElements(parts[0]),
+		"ciphers":       splitElements(parts[1]),
+		"extensions":    splitElements(parts[2]),
+		"groups":        splitElements(parts[3]),
+		"point_formats": splitElements(parts[4]),
+	}, true
+}
+
+// PeetPrintElements splits a PeetPrint into its lists. GREASE values are
+// left out, so they compare like the JA3 lists.
+func PeetPrintElements(peetprint string) (map[string][]string, bool) {
+	parts := strings.Split(peetprint, "|")
+	if len(parts) != 8 {
+		return nil, false
+	}
+	return map[string][]string{
+		"tls_versions":          splitElements(parts[0]),
+		"protocols":             splitElements(parts[1]),
+		"groups":                splitElements(parts[2]),
+		"signature_algorithms":  splitElements(parts[3]),
+		"psk_key_exchange_mode": splitElements(parts[4]),
+		"cert_compression":      splitElements(parts[5]),
+		"ciphers":               splitElements(parts[6]),
+		"extensions":            splitElements(parts[7]),
+	}, true
+}
+
+// JA4Sections splits a JA4 into its a (protocol, version, SNI, counts and
+// ALPN), b (cipher hash) and c (extension and signature hash) sections
+func JA4Sections(ja4 string) (a, b, c string, ok bool) {
+	parts := strings.Split(ja4, "_")
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// splitElements splits a dash separated list, without GREASE values
+func splitElements(s string) []string {
+	res := []string{}
+	for _, v := range strings.Split(s, "-") {
+		if v != "" && v != "GREASE" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,56 @@
+package types
+
+// ListDiff is the difference between two lists, from a to b
+type ListDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Reordered is set when the values in both lists are in another order
+	Reordered bool `json:"reordered,omitempty"`
+}
+
+// Changed reports whether the lists differ
+func (d ListDiff) Changed() bool {
+	return len(d.Added) > 0 || len(d.Removed) > 0 || d.Reordered
+}
+
+// ValueDiff is a value that differs, empty if it is only on one side
+type ValueDiff struct {
+	A string `json:"a"`
+	B string `json:"b"`
+}
+
+// DiffList compares two lists. Values are compared as a set, the order is
+// compared for the values in both lists.
+func DiffList(a, b []string) ListDiff {
+	inA, inB := map[string]bool{}, map[string]bool{}
+	for _, v := range a {
+		inA[v] = true
+	}
+	for _, v := range b {
+		inB[v] = true
+	}
+
+	d := ListDiff{}
+	var sharedA, sharedB []string
+	for _, v := range a {
+		if inB[v] {
+			sharedA = append(sharedA, v)
+		} else {
+			d.Removed = append(d.Removed, v)
+		}
+	}
+	for _, v := range b {
+		if inA[v] {
+			sharedB = append(sharedB, v)
+		} else {
+			d.Added = append(d.Added, v)
+		}
+	}
+	for i := range sharedA {
+		if i >= len(sharedB) || sharedA[i] != sharedB[i] {
+			d.Reordered = true
+			break
+		}
+	}
+	return d
+}
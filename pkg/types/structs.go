@@ -33,22 +33,147 @@ type TLSDetails struct {
 
 type Http1Details struct {
 	Headers []string `json:"headers"`
+	// Raw is the request line and header block exactly as received
+	Raw    string       `json:"raw"`
+	RawB64 string       `json:"raw_b64"`
+	Format *Http1Format `json:"format,omitempty"`
+
+	// JA4H is only set here for cleartext connections, TLS connections
+	// report it in the tls section
+	JA4H   string `json:"ja4h,omitempty"`
+	JA4H_r string `json:"ja4h_r,omitempty"`
+}
+
+// Http1Format describes how an HTTP/1 request head was written, the details
+// that get lost when only header names and values are looked at
+type Http1Format struct {
+	LineEndings      string   `json:"line_endings"`
+	RequestTarget    string   `json:"request_target"`
+	HeaderCasing     []string `json:"header_casing"`
+	ColonSpacing     []string `json:"colon_spacing"`
+	DuplicateHeaders []string `json:"duplicate_headers"`
+	FoldedHeaders    []string `json:"folded_headers"`
+	Anomalies        []string `json:"anomalies"`
+	Fingerprint      string   `json:"fingerprint"`
+	FingerprintHash  string   `json:"fingerprint_hash"`
 }
 
 type Http2Details struct {
-	AkamaiFingerprint     string        `json:"akamai_fingerprint"`
-	AkamaiFingerprintHash string        `json:"akamai_fingerprint_hash"`
-	SendFrames            []ParsedFrame `json:"sent_frames"`
+	AkamaiFingerprint     string           `json:"akamai_fingerprint"`
+	AkamaiFingerprintHash string           `json:"akamai_fingerprint_hash"`
+	SendFrames            []ParsedFrame    `json:"sent_frames"`
+	Active                *ActiveH2Details `json:"active,omitempty"`
+	Push                  *H2PushDetails   `json:"push,omitempty"`
+
+	// JA4H is only set here for cleartext (h2c) connections, TLS
+	// connections report it in the tls section
+	JA4H   string `json:"ja4h,omitempty"`
+	JA4H_r string `json:"ja4h_r,omitempty"`
+}
+
+// ActiveH2Details describes how a client reacted to the SETTINGS, PING and
+// GOAWAY frames the server sent from a probing profile
+type ActiveH2Details struct {
+	Profile                string    `json:"profile"`
+	AdvertisedSettings     []string  `json:"advertised_settings"`
+	SettingsAcked          bool      `json:"settings_acked"`
+	SettingsAckLatencyMs   float64   `json:"settings_ack_latency_ms"`
+	PingsSent              int       `json:"pings_sent"`
+	PingAckLatenciesMs     []float64 `json:"ping_ack_latencies_ms"`
+	WindowUpdates          []string  `json:"window_updates"`
+	HeaderTableSizeUpdates []uint32  `json:"header_table_size_updates"`
+	MaxFrameSizeSeen       uint32    `json:"max_frame_size_seen"`
+	MaxConcurrentStreams   int       `json:"max_concurrent_streams_seen"`
+	StreamsAfterGoAway     int       `json:"streams_after_goaway"`
+	Violations             []string  `json:"violations"`
+	Fingerprint            string    `json:"active_fingerprint"`
+	FingerprintHash        string    `json:"active_fingerprint_hash"`
+}
+
+// H2PushDetails describes how a client handled the PUSH_PROMISE frames of the
+// push probe
+type H2PushDetails struct {
+	EnablePush      bool            `json:"enable_push"`
+	Promises        []H2PushPromise `json:"promises"`
+	Fingerprint     string          `json:"push_fingerprint"`
+	FingerprintHash string          `json:"push_fingerprint_hash"`
+}
+
+type H2PushPromise struct {
+	PromisedStream  uint32  `json:"promised_stream"`
+	Path            string  `json:"path"`
+	Delivered       bool    `json:"delivered"`
+	Cancelled       bool    `json:"cancelled"`
+	RSTCode         string  `json:"rst_code,omitempty"`
+	CancelLatencyMs float64 `json:"cancel_latency_ms"`
+	// Refetched is set when the client requested the pushed path itself
+	// instead of using the pushed response
+	Refetched bool `json:"refetched"`
 }
 
 type Http3Details struct {
-	Information                        string `json:"important_info"`
-	Used0RTT                           bool   `json:"used_0rtt"`
-	SupportsDatagrams                  bool   `json:"supports_datagrams"`
-	SupportsStreamResetPartialDelivery bool   `json:"supports_stream_reset_partial_delivery"`
-	Version                            uint32 `json:"version"`
-	GSO                                bool   `json:"gso"`
-	Settings                           any    `json:"settings"`
+	Information                        string   `json:"important_info"`
+	Used0RTT                           bool     `json:"used_0rtt"`
+	SupportsDatagrams                  bool     `json:"supports_datagrams"`
+	SupportsStreamResetPartialDelivery bool     `json:"supports_stream_reset_partial_delivery"`
+	Version                            uint32   `json:"version"`
+	GSO                                bool     `json:"gso"`
+	Settings                           any      `json:"settings"`
+	Headers                            []string `json:"headers,omitempty"`
+	// SNI is the server name from the QUIC handshake
+	SNI string `json:"sni,omitempty"`
+}
+
+// WebSocketDetails describes the handshake of a WebSocket connection and how
+// the client behaved once it was open
+type WebSocketDetails struct {
+	// Transport is "http/1.1" for an Upgrade or "h2" for an extended CONNECT
+	Transport   string   `json:"transport"`
+	HeaderOrder []string `json:"header_order"`
+	Version     string   `json:"version"`
+	// KeyValid is set if Sec-WebSocket-Key is 16 bytes of base64 (HTTP/1.1)
+	KeyValid          bool                    `json:"key_valid"`
+	Origin            string                  `json:"origin,omitempty"`
+	Protocols         []string                `json:"protocols,omitempty"`
+	Extensions        string                  `json:"extensions,omitempty"`
+	ExtensionOffers   []WebSocketExtension    `json:"extension_offers,omitempty"`
+	PermessageDeflate *PermessageDeflateOffer `json:"permessage_deflate,omitempty"`
+	Fingerprint       string                  `json:"fingerprint"`
+	FingerprintHash   string                  `json:"fingerprint_hash"`
+	// Frames is filled while the connection is open
+	Frames *WebSocketFrames `json:"frames,omitempty"`
+}
+
+type WebSocketExtension struct {
+	Name   string   `json:"name"`
+	Params []string `json:"params,omitempty"`
+}
+
+// PermessageDeflateOffer is the first permessage-deflate offer (RFC 7692).
+// Window bits are 0 if not offered and 15 if offered without a value.
+type PermessageDeflateOffer struct {
+	ServerNoContextTakeover bool `json:"server_no_context_takeover"`
+	ClientNoContextTakeover bool `json:"client_no_context_takeover"`
+	ServerMaxWindowBits     int  `json:"server_max_window_bits,omitempty"`
+	ClientMaxWindowBits     int  `json:"client_max_window_bits,omitempty"`
+}
+
+// WebSocketFrames describes the frames a client sent and how it answered
+// the server's PING
+type WebSocketFrames struct {
+	Received int `json:"received"`
+	// Opcodes of the first frames in the order they arrived
+	Opcodes          []string `json:"opcodes"`
+	Unmasked         int      `json:"unmasked"`
+	ZeroMaskKeys     int      `json:"zero_mask_keys"`
+	RepeatedMaskKeys int      `json:"repeated_mask_keys"`
+	RSVFrames        int      `json:"rsv_frames"`
+	Fragmented       int      `json:"fragmented_messages"`
+	ClientPings      int      `json:"client_pings"`
+	UnsolicitedPongs int      `json:"unsolicited_pongs"`
+	PongReceived     bool     `json:"pong_received"`
+	PongPayloadMatch bool     `json:"pong_payload_match"`
+	PongLatencyMs    float64  `json:"pong_latency_ms"`
 }
 
 type Http3Settings struct {
@@ -98,6 +223,27 @@ type TCPIPDetails struct {
 	TS        []int      `json:"ts,omitempty"`
 	IP        IPDetails  `json:"ip,omitempty"`
 	TCP       TCPDetails `json:"tcp,omitempty"`
+	// HandshakeRTTMs is the time between our SYN-ACK and the ACK of the client
+	HandshakeRTTMs float64 `json:"handshake_rtt_ms,omitempty"`
+}
+
+// RTTDetails compares the round trip measured inside the encrypted
+// connection (HTTP/2 PING or QUIC) with the round trip of the TCP connection.
+// A TLS terminating proxy answers on the TCP level, but has to forward the
+// application level PINGs, so the gap between the two grows.
+type RTTDetails struct {
+	Method string `json:"method"`
+	// AppRTTSamplesMs are the measured PINGs, QUIC only reports its
+	// estimates: the latest, minimum and smoothed RTT
+	AppRTTSamplesMs  []float64 `json:"app_rtt_samples_ms,omitempty"`
+	AppLatestRTTMs   float64   `json:"app_latest_rtt_ms"`
+	AppMinRTTMs      float64   `json:"app_min_rtt_ms"`
+	AppSmoothedRTTMs float64   `json:"app_smoothed_rtt_ms,omitempty"`
+	TCPRTTMs         float64   `json:"tcp_rtt_ms"`
+	TCPMinRTTMs      float64   `json:"tcp_min_rtt_ms"`
+	TCPRTTSource     string    `json:"tcp_rtt_source"`
+	GapMs            float64   `json:"gap_ms"`
+	ProxyLikely      bool      `json:"proxy_likely"`
 }
 
 type Response struct {
@@ -112,6 +258,32 @@ type Response struct {
 	Http2       *Http2Details `json:"http2,omitempty"`
 	Http3       *Http3Details `json:"http3,omitempty"`
 	TCPIP       TCPIPDetails  `json:"tcpip,omitempty"`
+	// Body is the request body, set for HTTP/1, HTTP/2 and HTTP/3 requests
+	Body []byte `json:"-"`
+	// PathParams are the parameters of the matched route pattern
+	PathParams map[string]string `json:"-"`
+	// Timeline is only set for /api/timeline
+	Timeline []TimelineEvent `json:"timeline,omitempty"`
+	// RTT is only set for /api/rtt
+	RTT *RTTDetails `json:"rtt,omitempty"`
+	// WebSocket is only set for WebSocket connections to /ws
+	WebSocket *WebSocketDetails `json:"websocket,omitempty"`
+	// RequestID is the X-Request-Id of the response, snapshots are stored
+	// under it
+	RequestID string `json:"-"`
+}
+
+// TimelineEvent is a frame or connection milestone, with its offset from the
+// moment the connection was accepted
+type TimelineEvent struct {
+	OffsetMs float64  `json:"offset_ms"`
+	Event    string   `json:"event"`
+	Frame    string   `json:"frame_type,omitempty"`
+	Stream   uint32   `json:"stream_id,omitempty"`
+	Length   uint32   `json:"length,omitempty"`
+	Flags    []string `json:"flags,omitempty"`
+	// Dropped is the number of events left out of a truncated timeline
+	Dropped int `json:"dropped,omitempty"`
 }
 
 func (res Response) ToJson() string {
@@ -161,13 +333,14 @@ type ParsedFrame struct {
 	Type      string    `json:"frame_type,omitempty"`
 	Stream    uint32    `json:"stream_id,omitempty"`
 	Length    uint32    `json:"length,omitempty"`
-	Payload   []byte    `json:"payload,omitempty"`
 	Headers   []string  `json:"headers,omitempty"`
 	Settings  []string  `json:"settings,omitempty"`
 	Increment uint32    `json:"increment,omitempty"`
 	Flags     []string  `json:"flags,omitempty"`
 	Priority  *Priority `json:"priority,omitempty"`
 	GoAway    *GoAway   `json:"goaway,omitempty"`
+	// OffsetMs is the time since the connection was accepted
+	OffsetMs float64 `json:"offset_ms,omitempty"`
 }
 
 type Config struct {
@@ -181,16 +354,33 @@ type Config struct {
 	Collection   string `json:"mongo_collection"`
 	DB           string `json:"mongo_database"`
 	LogIPs       bool   `json:"mongo_log_ips"`
+	IPMode       string `json:"log_ip_mode"`
+	IPHashKey    string `json:"ip_hash_key"`
+	IPv4Prefix   int    `json:"ip_v4_prefix"`
+	IPv6Prefix   int    `json:"ip_v6_prefix"`
+	LogDays      int64  `json:"log_retention_days"`
+	RollupDays   int64  `json:"rollup_retention_days"`
+	AdminToken   string `json:"admin_token"`
+	Store        string `json:"store"`
+	StorePath    string `json:"store_path"`
+	LogPolicy    string `json:"log_queue_policy"`
+	LogQueueSize int    `json:"log_queue_size"`
+	LogBatchSize int    `json:"log_batch_size"`
+	Snapshots    bool   `json:"snapshots"`
+	SnapshotSize int    `json:"snapshot_max_size"`
+	SnapshotTTL  int64  `json:"snapshot_ttl_hours"`
+	PublicURL    string `json:"public_url"`
 	HTTPRedirect string `json:"http_redirect"`
 	Device       string `json:"device"`
 	CorsKey      string `json:"cors_key"`
+	H2Profile    string `json:"h2_profile"`
+	MaxBodySize  int64  `json:"max_body_size"`
 }
 
 func (c *Config) LoadFromFile() error {
 	data, err := os.ReadFile("config.json")
-	fmt.Println(string(data))
 	if err != nil {
-		fmt.Println("No config file found: generating one", err)
+		fmt.Fprintln(os.Stderr, "No config file found: generating one", err)
 		c.MakeDefault()
 		return c.WriteToFile("config.json")
 	}
@@ -210,9 +400,27 @@ func (c *Config) LoadFromFile() error {
 	c.Collection = tmp.Collection
 	c.DB = tmp.DB
 	c.LogIPs = tmp.LogIPs
+	c.IPMode = tmp.IPMode
+	c.IPHashKey = tmp.IPHashKey
+	c.IPv4Prefix = tmp.IPv4Prefix
+	c.IPv6Prefix = tmp.IPv6Prefix
+	c.LogDays = tmp.LogDays
+	c.RollupDays = tmp.RollupDays
+	c.AdminToken = tmp.AdminToken
+	c.Store = tmp.Store
+	c.StorePath = tmp.StorePath
+	c.LogPolicy = tmp.LogPolicy
+	c.LogQueueSize = tmp.LogQueueSize
+	c.LogBatchSize = tmp.LogBatchSize
+	c.Snapshots = tmp.Snapshots
+	c.SnapshotSize = tmp.SnapshotSize
+	c.SnapshotTTL = tmp.SnapshotTTL
+	c.PublicURL = tmp.PublicURL
 	c.HTTPRedirect = tmp.HTTPRedirect
 	c.Device = tmp.Device
 	c.CorsKey = tmp.CorsKey
+	c.H2Profile = tmp.H2Profile
+	c.MaxBodySize = tmp.MaxBodySize
 	return nil
 }
 
@@ -236,6 +444,15 @@ func (c *Config) MakeDefault() {
 	c.Collection = "requests"
 	c.DB = "TrackMe"
 	c.LogIPs = false
+	c.IPMode = "none"
+	c.IPv4Prefix = 24
+	c.IPv6Prefix = 48
+	c.Store = "none"
+	c.LogPolicy = "drop"
+	c.LogQueueSize = 10000
+	c.LogBatchSize = 100
 	c.HTTPRedirect = "https://tls.peet.ws"
 	c.CorsKey = "X-CORS"
+	c.H2Profile = "google"
+	c.MaxBodySize = 16 * 1024 * 1024
 }
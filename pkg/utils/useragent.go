@@ -0,0 +1,150 @@
+package utils
+
+import "strings"
+
+// UserAgent is what a user agent string says about the client
+type UserAgent struct {
+	// Family is the browser or client, e.g. Chrome, Firefox, Safari or curl
+	Family string
+	// Major is the major version of the family, e.g. 124
+	Major string
+	// OS is Windows, macOS, iOS, Android, ChromeOS or Linux
+	OS string
+	// Device is Desktop, Mobile, Tablet or Bot
+	Device string
+}
+
+// uaFamily is a client told apart by a product token, Token/version
+type uaFamily struct {
+	name   string
+	tokens []string
+}
+
+// uaFamilies are checked in order. Most browsers also send the tokens of
+// those they are based on (Edge sends Chrome/ and Safari/), so they come
+// before them.
+var uaFamilies = []uaFamily{
+	{"Edge", []string{"Edg/", "EdgA/", "EdgiOS/", "Edge/"}},
+	{"Opera", []string{"OPR/", "OPiOS/", "Opera/"}},
+	{"Samsung Internet", []string{"SamsungBrowser/"}},
+	{"Yandex", []string{"YaBrowser/"}},
+	{"Vivaldi", []string{"Vivaldi/"}},
+	{"Firefox", []string{"Firefox/", "FxiOS/"}},
+	{"Chromium", []string{"Chromium/"}},
+	{"Chrome", []string{"CriOS/", "Chrome/"}},
+	{"curl", []string{"curl/"}},
+	{"Wget", []string{"Wget/"}},
+	{"Go", []string{"Go-http-client/"}},
+	{"Python Requests", []string{"python-requests/"}},
+	{"aiohttp", []string{"aiohttp/"}},
+	{"OkHttp", []string{"okhttp/"}},
+	{"Node.js", []string{"node-fetch/", "undici", "axios/"}},
+}
+
+// Crawlers are told apart by whole words, like "bot" or "Slurp", and by the
+// names of their product tokens, like Googlebot/2.1 or HeadlessChrome/124.
+// Matching inside words would also catch device names like CUBOT.
+var (
+	uaBotWords    = []string{"bot", "crawler", "spider", "slurp"}
+	uaBotSuffixes = []string{"bot", "spider", "crawler"}
+	uaBotPrefixes = []string{"headless"}
+)
+
+// ParseUserAgent returns the browser family and major version, the OS and
+// the device type of a user agent string. Parts it can not tell are empty,
+// an unknown family is Other.
+func ParseUserAgent(ua string) UserAgent {
+	if ua == "" {
+		return UserAgent{}
+	}
+	res := UserAgent{Family: "Other"}
+	for _, f := range uaFamilies {
+		if major, ok := uaVersion(ua, f.tokens...); ok {
+			res.Family, res.Major = f.name, major
+			break
+		}
+	}
+	// Safari has its version in Version/, its Safari/ token is the WebKit
+	// build
+	if res.Family == "Other" && strings.Contains(ua, "Safari/") && strings.Contains(ua, "AppleWebKit/") {
+		res.Family, res.Major = "Safari", ""
+		if major, ok := uaVersion(ua, "Version/"); ok {
+			res.Major = major
+		}
+	}
+
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"), strings.Contains(ua, "iPod"):
+		res.OS = "iOS"
+	case strings.Contains(ua, "Android"):
+		res.OS = "Android"
+	case strings.Contains(ua, "Windows"):
+		res.OS = "Windows"
+	case strings.Contains(ua, "CrOS"):
+		res.OS = "ChromeOS"
+	case strings.Contains(ua, "Macintosh"), strings.Contains(ua, "Mac OS X"):
+		res.OS = "macOS"
+	case strings.Contains(ua, "Linux"), strings.Contains(ua, "X11"):
+		res.OS = "Linux"
+	}
+
+	switch {
+	case isBot(ua):
+		res.Device = "Bot"
+	case strings.Contains(ua, "iPad"), strings.Contains(ua, "Tablet"),
+		res.OS == "Android" && !strings.Contains(ua, "Mobile"):
+		res.Device = "Tablet"
+	case strings.Contains(ua, "Mobile"), strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPod"):
+		res.Device = "Mobile"
+	case res.OS != "":
+		res.Device = "Desktop"
+	}
+	return res
+}
+
+// uaVersion returns the major version after the first of the tokens found,
+// which may be empty
+func uaVersion(ua string, tokens ...string) (string, bool) {
+	for _, t := range tokens {
+		i := strings.Index(ua, t)
+		if i < 0 {
+			continue
+		}
+		v := ua[i+len(t):]
+		end := 0
+		for end < len(v) && v[end] >= '0' && v[end] <= '9' {
+			end++
+		}
+		return v[:end], true
+	}
+	return "", false
+}
+
+// isBot reports whether a user agent has a crawler word or product token
+func isBot(ua string) bool {
+	words := strings.FieldsFunc(strings.ToLower(ua), func(r rune) bool {
+		return r == ' ' || r == ';' || r == '(' || r == ')' || r == ','
+	})
+	for _, w := range words {
+		name, _, product := strings.Cut(w, "/")
+		for _, b := range uaBotWords {
+			if name == b {
+				return true
+			}
+		}
+		if !product {
+			continue
+		}
+		for _, s := range uaBotSuffixes {
+			if strings.HasSuffix(name, s) {
+				return true
+			}
+		}
+		for _, p := range uaBotPrefixes {
+			if strings.HasPrefix(name, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
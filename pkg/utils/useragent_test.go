@@ -0,0 +1,51 @@
+package utils
+
+import "testing"
+
+func TestParseUserAgent(t *testing.T) {
+	cases := []struct {
+		ua   string
+		want UserAgent
+	}{
+		{
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			UserAgent{Family: "Chrome", Major: "124", OS: "macOS", Device: "Desktop"},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.2478.51",
+			UserAgent{Family: "Edge", Major: "124", OS: "Windows", Device: "Desktop"},
+		},
+		{
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+			UserAgent{Family: "Safari", Major: "17", OS: "iOS", Device: "Mobile"},
+		},
+		{
+			"Mozilla/5.0 (Android 14; Tablet; rv:125.0) Gecko/125.0 Firefox/125.0",
+			UserAgent{Family: "Firefox", Major: "125", OS: "Android", Device: "Tablet"},
+		},
+		// A phone whose name contains "bot"
+		{
+			"Mozilla/5.0 (Linux; Android 10; CUBOT X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			UserAgent{Family: "Chrome", Major: "120", OS: "Android", Device: "Mobile"},
+		},
+		{
+			"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/124.0.0.0 Safari/537.36",
+			UserAgent{Family: "Chrome", Major: "124", OS: "Linux", Device: "Bot"},
+		},
+		{
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			UserAgent{Family: "Other", Device: "Bot"},
+		},
+		{
+			"Mozilla/5.0 (compatible; Yahoo! Slurp; http://help.yahoo.com/help/us/ysearch/slurp)",
+			UserAgent{Family: "Other", Device: "Bot"},
+		},
+		{"curl/8.4.0", UserAgent{Family: "curl", Major: "8"}},
+		{"", UserAgent{}},
+	}
+	for _, c := range cases {
+		if got := ParseUserAgent(c.ua); got != c.want {
+			t.Errorf("ParseUserAgent(%q) = %+v, want %+v", c.ua, got, c.want)
+		}
+	}
+}